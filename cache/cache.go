@@ -0,0 +1,144 @@
+// Package cache keeps encoded values for a while so reads can skip the
+// database. LRU keeps them in memory; an adapter for a shared store such as
+// Redis only has to implement Cache.
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Cache holds values by key until they expire or are cleared
+type Cache interface {
+	// Get returns the value of the key, and whether there is one
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	// Set stores the value of the key until it expires
+	Set(ctx context.Context, key string, value []byte) error
+	// Clear drops every value. A shared store may switch to a new key
+	// prefix instead of deleting the keys.
+	Clear(ctx context.Context) error
+}
+
+// LRU is an in-memory cache holding a bounded number of values, which
+// expire after their TTL. When it is full, the least recently used value is
+// dropped.
+type LRU struct {
+	size int
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu      sync.Mutex
+	order   *list.List // of *entry, the most recently used first
+	entries map[string]*list.Element
+}
+
+type entry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+var _ Cache = (*LRU)(nil)
+
+// NewLRU returns an empty cache of size values lasting ttl
+func NewLRU(size int, ttl time.Duration) *LRU {
+	return &LRU{size: size, ttl: ttl, now: time.Now, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// Get returns the value of the key unless it expired
+func (c *LRU) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	e := el.Value.(*entry)
+	if !c.now().Before(e.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil, false, nil
+	}
+	c.order.MoveToFront(el)
+	return e.value, true, nil
+}
+
+// Set stores the value of the key, dropping the least recently used value
+// if the cache is full
+func (c *LRU) Set(ctx context.Context, key string, value []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := c.now().Add(c.ttl)
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*entry)
+		e.value, e.expires = value, expires
+		c.order.MoveToFront(el)
+		return nil
+	}
+	c.entries[key] = c.order.PushFront(&entry{key: key, value: value, expires: expires})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*entry).key)
+	}
+	return nil
+}
+
+// Clear drops every value
+func (c *LRU) Clear(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+	return nil
+}
+
+// Counters count the hits and misses of a cache. Its user counts them,
+// since only it can tell whether a cached value could be used. The methods
+// of nil Counters count nothing.
+type Counters struct {
+	hits   prometheus.Counter
+	misses prometheus.Counter
+}
+
+// NewCounters registers the hit and miss counters of the cache of the name
+func NewCounters(reg prometheus.Registerer, name string) (*Counters, error) {
+	counters := &Counters{
+		hits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "cache_hits_total",
+			Help:        "Number of reads served by the cache.",
+			ConstLabels: prometheus.Labels{"cache": name},
+		}),
+		misses: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "cache_misses_total",
+			Help:        "Number of reads the cache could not serve.",
+			ConstLabels: prometheus.Labels{"cache": name},
+		}),
+	}
+	if err := reg.Register(counters.hits); err != nil {
+		return nil, err
+	}
+	if err := reg.Register(counters.misses); err != nil {
+		return nil, err
+	}
+	return counters, nil
+}
+
+// Hit counts a read served by the cache
+func (c *Counters) Hit() {
+	if c != nil {
+		c.hits.Inc()
+	}
+}
+
+// Miss counts a read the cache could not serve, because it had no value,
+// failed, or had a value that could not be used
+func (c *Counters) Miss() {
+	if c != nil {
+		c.misses.Inc()
+	}
+}
@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRU(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	c := NewLRU(2, time.Minute)
+	c.now = func() time.Time { return now }
+	get := func(key string) string {
+		value, ok, err := c.Get(ctx, key)
+		assert.Nil(t, err)
+		if !ok {
+			return "<none>"
+		}
+		return string(value)
+	}
+
+	assert.Nil(t, c.Set(ctx, "a", []byte("1")))
+	assert.Nil(t, c.Set(ctx, "b", []byte("2")))
+	assert.Equal(t, "1", get("a"))
+	// b is the least recently used
+	assert.Nil(t, c.Set(ctx, "c", []byte("3")))
+	assert.Equal(t, "<none>", get("b"))
+	assert.Equal(t, "1", get("a"))
+	assert.Equal(t, "3", get("c"))
+
+	now = now.Add(30 * time.Second)
+	assert.Nil(t, c.Set(ctx, "a", []byte("4")))
+	now = now.Add(30 * time.Second)
+	assert.Equal(t, "<none>", get("c"), "expired")
+	assert.Equal(t, "4", get("a"), "setting a value again renews it")
+
+	assert.Nil(t, c.Clear(ctx))
+	assert.Equal(t, "<none>", get("a"))
+}
+
+func TestCounters(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	c, err := NewCounters(reg, "products")
+	assert.Nil(t, err)
+	_, err = NewCounters(reg, "products")
+	assert.NotNil(t, err, "the counters of a cache are registered once")
+
+	c.Hit()
+	c.Hit()
+	c.Miss()
+	assert.Nil(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP cache_hits_total Number of reads served by the cache.
+# TYPE cache_hits_total counter
+cache_hits_total{cache="products"} 2
+# HELP cache_misses_total Number of reads the cache could not serve.
+# TYPE cache_misses_total counter
+cache_misses_total{cache="products"} 1
+`)))
+
+	var none *Counters
+	none.Hit()
+	none.Miss()
+}
@@ -1,13 +1,50 @@
 package config
 
+import "time"
+
 // Properties Configures properties based on environment variables
 type Properties struct {
-	Port              string `env:"MY_APP_PORT" env-default:"8080"`
-	Host              string `env:"HOST" env-default:"localhost"`
-	DBHost            string `env:"DB_HOST" env-default:"localhost"`
-	DBPort            string `env:"DB_PORT" env-default:"27017"`
-	DBName            string `env:"DB_NAME" env-default:"electronics"`
-	ProductCollection string `env:"PRODUCTS_COL_NAME" env-default:"products"`
-	UsersCollection   string `env:"USERS_COL_NAME" env-default:"users"`
-	JwtTokenSecret    string `env:"JWT_TOKEN_SECRET" env-default:"esdfrdfg"`
+	Port                 string        `env:"MY_APP_PORT" env-default:"8080"`
+	Host                 string        `env:"HOST" env-default:"localhost"`
+	ShutdownTimeout      time.Duration `env:"SHUTDOWN_TIMEOUT" env-default:"10s"`
+	DBHost               string        `env:"DB_HOST" env-default:"localhost"`
+	DBPort               string        `env:"DB_PORT" env-default:"27017"`
+	DBName               string        `env:"DB_NAME" env-default:"electronics"`
+	StorageDriver        string        `env:"STORAGE_DRIVER" env-default:"mongo"`
+	SQLitePath           string        `env:"SQLITE_PATH" env-default:"go-rest-api.db"`
+	SlowQueryThreshold   time.Duration `env:"SLOW_QUERY_THRESHOLD" env-default:"200ms"`
+	OTLPEndpoint         string        `env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	ProductCacheSize     int           `env:"PRODUCT_CACHE_SIZE" env-default:"1000"`
+	ProductCacheTTL      time.Duration `env:"PRODUCT_CACHE_TTL" env-default:"1m"`
+	ProductCollection    string        `env:"PRODUCTS_COL_NAME" env-default:"products"`
+	UsersCollection      string        `env:"USERS_COL_NAME" env-default:"users"`
+	SessionsCollection   string        `env:"SESSIONS_COL_NAME" env-default:"sessions"`
+	UserTokensCollection string        `env:"USER_TOKENS_COL_NAME" env-default:"user_tokens"`
+	AttemptsCollection   string        `env:"AUTH_ATTEMPTS_COL_NAME" env-default:"auth_attempts"`
+	APIKeysCollection    string        `env:"API_KEYS_COL_NAME" env-default:"api_keys"`
+	JwtAlgorithm         string        `env:"JWT_ALGORITHM" env-default:"EdDSA"`
+	JwtKeysDir           string        `env:"JWT_KEYS_DIR"`
+	JwtKeyRotation       time.Duration `env:"JWT_KEY_ROTATION" env-default:"0"`
+	AccessTokenTTL       time.Duration `env:"ACCESS_TOKEN_TTL" env-default:"15m"`
+	RefreshTokenTTL      time.Duration `env:"REFRESH_TOKEN_TTL" env-default:"720h"`
+	ResetTokenTTL        time.Duration `env:"RESET_TOKEN_TTL" env-default:"1h"`
+	APIKeyTTL            time.Duration `env:"API_KEY_TTL" env-default:"2160h"`
+	VerifyTokenTTL       time.Duration `env:"VERIFY_TOKEN_TTL" env-default:"24h"`
+	AllowUnverifiedLogin bool          `env:"ALLOW_UNVERIFIED_LOGIN" env-default:"false"`
+	TwoFactorRoles       []string      `env:"TWO_FACTOR_ROLES" env-separator:","`
+	TwoFactorIssuer      string        `env:"TWO_FACTOR_ISSUER" env-default:"go-rest-api"`
+	ChallengeTTL         time.Duration `env:"TWO_FACTOR_CHALLENGE_TTL" env-default:"5m"`
+	LockoutThreshold     int           `env:"LOCKOUT_THRESHOLD" env-default:"5"`
+	LockoutIPThreshold   int           `env:"LOCKOUT_IP_THRESHOLD" env-default:"20"`
+	LockoutBaseDelay     time.Duration `env:"LOCKOUT_BASE_DELAY" env-default:"1m"`
+	LockoutMaxDelay      time.Duration `env:"LOCKOUT_MAX_DELAY" env-default:"1h"`
+	LockoutReset         time.Duration `env:"LOCKOUT_RESET" env-default:"24h"`
+	TrustedProxies       []string      `env:"TRUSTED_PROXIES" env-separator:","`
+	PublicURL            string        `env:"PUBLIC_URL" env-default:"http://localhost:8080"`
+	MailDriver           string        `env:"MAIL_DRIVER" env-default:"file"`
+	MailFrom             string        `env:"MAIL_FROM" env-default:"no-reply@localhost"`
+	MailDir              string        `env:"MAIL_DIR" env-default:"outbox"`
+	SMTPAddr             string        `env:"SMTP_ADDR" env-default:"localhost:25"`
+	SMTPUsername         string        `env:"SMTP_USERNAME"`
+	SMTPPassword         string        `env:"SMTP_PASSWORD"`
 }
@@ -0,0 +1,241 @@
+package dbiface
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type (
+	// Instruments holds the metrics and the tracer shared by the
+	// instrumented collections
+	Instruments struct {
+		duration *prometheus.HistogramVec
+		errors   *prometheus.CounterVec
+		tracer   trace.Tracer
+		// SlowQuery is the duration above which an operation is logged,
+		// zero to log none
+		SlowQuery time.Duration
+	}
+
+	// InstrumentedCollection times the operations of a collection, counts
+	// their errors, traces them and logs the slow ones
+	InstrumentedCollection struct {
+		Col         CollectionAPI
+		Name        string
+		Instruments *Instruments
+	}
+
+	correlationIDKey struct{}
+)
+
+var _ CollectionAPI = (*InstrumentedCollection)(nil)
+
+// NewInstruments registers the metrics of the collection operations
+func NewInstruments(reg prometheus.Registerer, slowQuery time.Duration) (*Instruments, error) {
+	i := &Instruments{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "db_operation_duration_seconds",
+			Help:    "Duration of the database operations.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"collection", "operation"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "db_operation_errors_total",
+			Help: "Number of failed database operations.",
+		}, []string{"collection", "operation"}),
+		tracer:    otel.Tracer("github.com/nitin06890/go-rest-api/dbiface"),
+		SlowQuery: slowQuery,
+	}
+	if err := reg.Register(i.duration); err != nil {
+		return nil, err
+	}
+	if err := reg.Register(i.errors); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// WithCorrelationID returns a context carrying the correlation ID of a
+// request, which slow operations are logged with
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// CorrelationID returns the correlation ID carried by the context, if any
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
+
+// maxLoggedQuery is the length above which the queries of slow operations
+// are truncated in the log
+const maxLoggedQuery = 512
+
+// redactedQuery returns the filter or pipeline of an operation with every
+// value replaced by ?, so that its shape is logged without the user data it
+// holds, such as usernames or token hashes. Documents and arrays are kept.
+func redactedQuery(query interface{}) string {
+	if query == nil {
+		return ""
+	}
+	// pipelines are arrays, which cannot be marshaled on their own
+	raw, err := bson.Marshal(bson.D{{Key: "q", Value: query}})
+	if err != nil {
+		return ""
+	}
+	var b strings.Builder
+	writeRedacted(&b, bson.Raw(raw).Lookup("q"))
+	if b.Len() > maxLoggedQuery {
+		return b.String()[:maxLoggedQuery] + "..."
+	}
+	return b.String()
+}
+
+func writeRedacted(b *strings.Builder, v bson.RawValue) {
+	switch v.Type {
+	case bsontype.EmbeddedDocument:
+		elems, _ := v.Document().Elements()
+		b.WriteByte('{')
+		for i, e := range elems {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(strconv.Quote(e.Key()))
+			b.WriteString(": ")
+			writeRedacted(b, e.Value())
+		}
+		b.WriteByte('}')
+	case bsontype.Array:
+		values, _ := v.Array().Values()
+		b.WriteByte('[')
+		for i, e := range values {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			writeRedacted(b, e)
+		}
+		b.WriteByte(']')
+	default:
+		b.WriteByte('?')
+	}
+}
+
+// start opens the span of an operation and returns the function ending it
+// with the error of the operation. Documents that are not found are not
+// errors. The query is the filter or pipeline of the operation, nil for
+// inserts, and is only logged when the operation is slow.
+func (c *InstrumentedCollection) start(ctx context.Context, op string, query interface{}) (context.Context, func(error)) {
+	began := time.Now()
+	ctx, span := c.Instruments.tracer.Start(ctx, c.Name+"."+op, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.collection", c.Name), attribute.String("db.operation", op)))
+	return ctx, func(err error) {
+		elapsed := time.Since(began)
+		c.Instruments.duration.WithLabelValues(c.Name, op).Observe(elapsed.Seconds())
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			c.Instruments.errors.WithLabelValues(c.Name, op).Inc()
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+		if slow := c.Instruments.SlowQuery; slow > 0 && elapsed > slow {
+			if q := redactedQuery(query); q != "" {
+				log.Warnf("Slow %s on %s took %s (correlation ID %q): %s", op, c.Name, elapsed, CorrelationID(ctx), q)
+				return
+			}
+			log.Warnf("Slow %s on %s took %s (correlation ID %q)", op, c.Name, elapsed, CorrelationID(ctx))
+		}
+	}
+}
+
+// InsertOne inserts a document
+func (c *InstrumentedCollection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	ctx, end := c.start(ctx, "InsertOne", nil)
+	res, err := c.Col.InsertOne(ctx, document, opts...)
+	end(err)
+	return res, err
+}
+
+// InsertMany inserts documents
+func (c *InstrumentedCollection) InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	ctx, end := c.start(ctx, "InsertMany", nil)
+	res, err := c.Col.InsertMany(ctx, documents, opts...)
+	end(err)
+	return res, err
+}
+
+// Find returns a cursor over the matching documents
+func (c *InstrumentedCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	ctx, end := c.start(ctx, "Find", filter)
+	cur, err := c.Col.Find(ctx, filter, opts...)
+	end(err)
+	return cur, err
+}
+
+// CountDocuments counts the matching documents
+func (c *InstrumentedCollection) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+	ctx, end := c.start(ctx, "CountDocuments", filter)
+	n, err := c.Col.CountDocuments(ctx, filter, opts...)
+	end(err)
+	return n, err
+}
+
+// FindOne returns the first matching document
+func (c *InstrumentedCollection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	ctx, end := c.start(ctx, "FindOne", filter)
+	res := c.Col.FindOne(ctx, filter, opts...)
+	end(res.Err())
+	return res
+}
+
+// UpdateOne updates the first matching document
+func (c *InstrumentedCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	ctx, end := c.start(ctx, "UpdateOne", filter)
+	res, err := c.Col.UpdateOne(ctx, filter, update, opts...)
+	end(err)
+	return res, err
+}
+
+// UpdateMany updates the matching documents
+func (c *InstrumentedCollection) UpdateMany(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	ctx, end := c.start(ctx, "UpdateMany", filter)
+	res, err := c.Col.UpdateMany(ctx, filter, update, opts...)
+	end(err)
+	return res, err
+}
+
+// FindOneAndUpdate updates the first matching document and returns it
+func (c *InstrumentedCollection) FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+	ctx, end := c.start(ctx, "FindOneAndUpdate", filter)
+	res := c.Col.FindOneAndUpdate(ctx, filter, update, opts...)
+	end(res.Err())
+	return res
+}
+
+// DeleteOne deletes the first matching document
+func (c *InstrumentedCollection) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	ctx, end := c.start(ctx, "DeleteOne", filter)
+	res, err := c.Col.DeleteOne(ctx, filter, opts...)
+	end(err)
+	return res, err
+}
+
+// Aggregate runs a pipeline on the collection
+func (c *InstrumentedCollection) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error) {
+	ctx, end := c.start(ctx, "Aggregate", pipeline)
+	cur, err := c.Col.Aggregate(ctx, pipeline, opts...)
+	end(err)
+	return cur, err
+}
@@ -0,0 +1,100 @@
+package dbiface_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"github.com/nitin06890/go-rest-api/dbiface"
+	"github.com/nitin06890/go-rest-api/memdb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestInstrumentedCollection(t *testing.T) {
+	ctx := context.Background()
+	spans := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stdout) })
+
+	reg := prometheus.NewRegistry()
+	inst, err := dbiface.NewInstruments(reg, time.Hour)
+	require.Nil(t, err)
+	_, err = dbiface.NewInstruments(reg, time.Hour)
+	assert.NotNil(t, err, "the metrics are registered once")
+
+	users := memdb.NewCollection("users")
+	require.Nil(t, users.CreateUniqueIndex("username"))
+	col := &dbiface.InstrumentedCollection{Col: users, Name: "users", Instruments: inst}
+
+	_, err = col.InsertOne(ctx, bson.M{"username": "ann"})
+	assert.Nil(t, err)
+	_, err = col.InsertOne(ctx, bson.M{"username": "ann"})
+	assert.True(t, mongo.IsDuplicateKeyError(err))
+	err = col.FindOne(ctx, bson.M{"username": "bob"}).Err()
+	assert.Equal(t, mongo.ErrNoDocuments, err)
+	_, err = col.UpdateOne(ctx, bson.M{"username": "ann"}, bson.M{"$set": bson.M{"name": "Ann"}})
+	assert.Nil(t, err)
+
+	n, err := testutil.GatherAndCount(reg, "db_operation_duration_seconds")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n, "a histogram by operation")
+	// documents that are not found are no errors
+	assert.Nil(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP db_operation_errors_total Number of failed database operations.
+# TYPE db_operation_errors_total counter
+db_operation_errors_total{collection="users",operation="InsertOne"} 1
+`), "db_operation_errors_total"))
+
+	ended := spans.Ended()
+	require.Len(t, ended, 4)
+	assert.Equal(t, "users.InsertOne", ended[1].Name())
+	assert.Equal(t, codes.Error, ended[1].Status().Code)
+	assert.Equal(t, codes.Unset, ended[2].Status().Code)
+	assert.Empty(t, logged.String(), "no operation is slow")
+
+	inst.SlowQuery = time.Nanosecond
+	_, err = col.DeleteOne(dbiface.WithCorrelationID(ctx, "abc123"), bson.M{"username": "ann"})
+	assert.Nil(t, err)
+	assert.Contains(t, logged.String(), `Slow DeleteOne on users`)
+	assert.Contains(t, logged.String(), `abc123`)
+	// the shape of the filter is logged, not its values
+	assert.Contains(t, logged.String(), `{\"username\": ?}`)
+	assert.NotContains(t, logged.String(), `ann`)
+
+	logged.Reset()
+	_, err = col.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"roles": bson.M{"$in": bson.A{"admin", "editor"}}}}},
+		{{Key: "$limit", Value: 5}},
+	})
+	assert.Nil(t, err)
+	assert.Contains(t, logged.String(), `[{\"$match\": {\"roles\": {\"$in\": [?, ?]}}}, {\"$limit\": ?}]`)
+	assert.NotContains(t, logged.String(), `editor`)
+
+	// long filters are truncated
+	logged.Reset()
+	long := bson.D{}
+	for i := 0; i < 100; i++ {
+		long = append(long, bson.E{Key: fmt.Sprintf("field%d", i), Value: i})
+	}
+	_, err = col.CountDocuments(ctx, long)
+	assert.Nil(t, err)
+	assert.Contains(t, logged.String(), `field1`)
+	assert.NotContains(t, logged.String(), `field99`)
+	assert.Contains(t, logged.String(), `...`)
+}
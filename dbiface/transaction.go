@@ -0,0 +1,33 @@
+package dbiface
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type (
+	// TransactionAPI runs a function in a database transaction
+	TransactionAPI interface {
+		WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error
+	}
+
+	// MongoTransactions runs transactions in sessions of a mongo client
+	MongoTransactions struct {
+		Client *mongo.Client
+	}
+)
+
+// WithTransaction runs fn in a transaction, which is committed if fn
+// succeeds and aborted otherwise. fn may be retried on transient errors.
+func (t *MongoTransactions) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	sess, err := t.Client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer sess.EndSession(ctx)
+	_, err = sess.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	return err
+}
@@ -0,0 +1,78 @@
+// Package events publishes security relevant events, such as account
+// lockouts, to logs or memory for tests.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Types of events
+const (
+	// TypeLockout is emitted when an account or an address is locked out
+	// after too many failed logins
+	TypeLockout = "auth.lockout"
+)
+
+// Event is something that happened to an account or an address
+type Event struct {
+	Type    string                 `json:"type"`
+	Subject string                 `json:"subject"`
+	IP      string                 `json:"ip,omitempty"`
+	Time    time.Time              `json:"time"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+// Emitter publishes events
+type Emitter interface {
+	Emit(ctx context.Context, event Event) error
+}
+
+// Log writes every event as a line of JSON
+type Log struct {
+	// Out defaults to the standard error
+	Out io.Writer
+
+	mu sync.Mutex
+}
+
+// Emit writes the event
+func (l *Log) Emit(ctx context.Context, event Event) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	out := l.Out
+	if out == nil {
+		out = os.Stderr
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = out.Write(append(b, '\n'))
+	return err
+}
+
+// Memory keeps the events in memory
+type Memory struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+// Emit appends the event
+func (m *Memory) Emit(ctx context.Context, event Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, event)
+	return nil
+}
+
+// Events returns the events emitted so far
+func (m *Memory) Events() []Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Event(nil), m.events...)
+}
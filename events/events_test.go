@@ -0,0 +1,34 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLog(t *testing.T) {
+	var out bytes.Buffer
+	var got Event
+	l := &Log{Out: &out}
+	event := Event{Type: TypeLockout, Subject: "shelby@example.com", IP: "192.0.2.1", Time: time.Unix(0, 0).UTC()}
+	assert.Nil(t, l.Emit(context.Background(), event))
+	assert.Nil(t, l.Emit(context.Background(), event))
+
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	assert.Len(t, lines, 2)
+	assert.Nil(t, json.Unmarshal(lines[0], &got))
+	assert.Equal(t, event, got)
+}
+
+func TestMemory(t *testing.T) {
+	m := &Memory{}
+	assert.Nil(t, m.Emit(context.Background(), Event{Type: TypeLockout, Subject: "a"}))
+	assert.Nil(t, m.Emit(context.Background(), Event{Type: TypeLockout, Subject: "b"}))
+	events := m.Events()
+	assert.Len(t, events, 2)
+	assert.Equal(t, "b", events[1].Subject)
+}
@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/nitin06890/go-rest-api/problem"
+	"github.com/nitin06890/go-rest-api/store"
+)
+
+const (
+	// apiKeyContextKey is where Authenticate stores the API key of the request
+	apiKeyContextKey = "api_key"
+	// authSchemeAPIKey is the scheme of the Authorization header carrying API keys
+	authSchemeAPIKey = "ApiKey"
+	// apiKeyPrefix starts the public part of every API key
+	apiKeyPrefix = "ak_"
+	// lastUsedResolution is how stale the last use of a key may be, so that
+	// busy keys aren't written on every request
+	lastUsedResolution = time.Minute
+)
+
+// apiKey is an API key as returned by the API. It never carries the hash
+// of its secret.
+type apiKey struct {
+	ID         string       `json:"_id"`
+	Name       string       `json:"name"`
+	Prefix     string       `json:"prefix"`
+	Owner      string       `json:"-"`
+	Scopes     []Permission `json:"scopes"`
+	Revoked    bool         `json:"revoked"`
+	CreatedAt  time.Time    `json:"created_at"`
+	ExpiresAt  time.Time    `json:"expires_at"`
+	LastUsedAt *time.Time   `json:"last_used_at,omitempty"`
+}
+
+func newAPIKeyResource(k store.APIKey) apiKey {
+	scopes := make([]Permission, 0, len(k.Scopes))
+	for _, s := range k.Scopes {
+		scopes = append(scopes, Permission(s))
+	}
+	return apiKey{
+		ID:         string(k.ID),
+		Name:       k.Name,
+		Prefix:     k.Prefix,
+		Owner:      k.Owner,
+		Scopes:     scopes,
+		Revoked:    k.Revoked,
+		CreatedAt:  k.CreatedAt,
+		ExpiresAt:  k.ExpiresAt,
+		LastUsedAt: k.LastUsedAt,
+	}
+}
+
+type apiKeyRequest struct {
+	Name      string       `json:"name" validate:"required,max=100"`
+	Scopes    []Permission `json:"scopes" validate:"required,min=1"`
+	ExpiresAt *time.Time   `json:"expires_at"`
+}
+
+// createdAPIKey is an API key as returned once on creation, with its secret
+type createdAPIKey struct {
+	apiKey
+	Key string `json:"key"`
+}
+
+// newAPIKey returns a new key, its prefix and the hash of its secret. The
+// key is the prefix and the secret separated by a dot.
+func newAPIKey() (string, string, string, error) {
+	id := make([]byte, 6)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", "", "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", "", err
+	}
+	prefix := apiKeyPrefix + hex.EncodeToString(id)
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+	return prefix + "." + encoded, prefix, hashToken(encoded), nil
+}
+
+func insertAPIKey(ctx context.Context, owner store.User, req apiKeyRequest, h *UsersHandler) (createdAPIKey, *problem.Problem) {
+	var created createdAPIKey
+	granted := make(map[Permission]bool)
+	for _, p := range userPermissions(owner) {
+		granted[p] = true
+	}
+	scopes := []string{}
+	seen := make(map[Permission]bool)
+	for _, s := range req.Scopes {
+		if !granted[s] {
+			log.Errorf("User %s cannot grant the %s scope", owner.Email, s)
+			return created, problem.Newf(http.StatusForbidden, "You cannot grant the %s scope", s).With("field", "scopes")
+		}
+		if !seen[s] {
+			seen[s] = true
+			scopes = append(scopes, string(s))
+		}
+	}
+	now := time.Now().UTC()
+	expiresAt := now.Add(prop.APIKeyTTL)
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(now) {
+			log.Errorf("API key expiring in the past: %s", req.ExpiresAt)
+			return created, problem.New(http.StatusBadRequest, "The expiry must be in the future").With("field", "expires_at")
+		}
+		expiresAt = req.ExpiresAt.UTC()
+	}
+	key, prefix, hash, err := newAPIKey()
+	if err != nil {
+		log.Errorf("Unable to generate the API key: %v", err)
+		return created, problem.New(http.StatusInternalServerError, "Unable to generate the API key")
+	}
+	stored, err := h.APIKeys.Create(ctx, store.APIKey{
+		Name:      req.Name,
+		Prefix:    prefix,
+		Hash:      hash,
+		Owner:     owner.Email,
+		Scopes:    scopes,
+		CreatedAt: now,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		log.Errorf("Unable to insert the API key: %v", err)
+		return created, problem.New(http.StatusInternalServerError, "Unable to store the API key")
+	}
+	created.apiKey = newAPIKeyResource(stored)
+	created.Key = key
+	return created, nil
+}
+
+// CreateAPIKey creates an API key of the current user. Its scopes are
+// permissions of the user, and the key is only ever returned here.
+func (h *UsersHandler) CreateAPIKey(c echo.Context) error {
+	var req apiKeyRequest
+	ctx := c.Request().Context()
+	if err := c.Bind(&req); err != nil {
+		log.Errorf("Unable to bind the API key: %v", err)
+		return problem.New(http.StatusBadRequest, "Unable to bind the API key")
+	}
+	if err := v.Struct(req); err != nil {
+		log.Errorf("Unable to validate the API key: %v", err)
+		return validationError("Unable to validate the API key", err)
+	}
+	owner, httpErr := findCurrentUser(ctx, c, h.Users)
+	if httpErr != nil {
+		return httpErr
+	}
+	created, httpErr := insertAPIKey(ctx, owner, req, h)
+	if httpErr != nil {
+		return httpErr
+	}
+	return c.JSON(http.StatusCreated, created)
+}
+
+// GetAPIKeys returns the API keys of the current user, without their secrets
+func (h *UsersHandler) GetAPIKeys(c echo.Context) error {
+	stored, err := h.APIKeys.ListByOwner(c.Request().Context(), currentUsername(c))
+	if err != nil {
+		log.Errorf("Unable to find the API keys: %v", err)
+		return problem.New(http.StatusInternalServerError, "Unable to find the API keys")
+	}
+	keys := make([]apiKey, 0, len(stored))
+	for _, k := range stored {
+		keys = append(keys, newAPIKeyResource(k))
+	}
+	return c.JSON(http.StatusOK, keys)
+}
+
+// RevokeAPIKey revokes an API key of the current user
+func (h *UsersHandler) RevokeAPIKey(c echo.Context) error {
+	id := c.Param("id")
+	revoked, err := h.APIKeys.Revoke(c.Request().Context(), id, currentUsername(c))
+	if err != nil {
+		log.Errorf("Unable to revoke the API key: %v", err)
+		return problem.New(http.StatusInternalServerError, "Unable to revoke the API key")
+	}
+	if !revoked {
+		log.Errorf("API key %s doesn't exist", id)
+		return problem.New(http.StatusNotFound, "API key doesn't exist")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// revokeUserAPIKeys revokes every API key of the user
+func revokeUserAPIKeys(ctx context.Context, username string, keys APIKeyRepository) *problem.Problem {
+	if err := keys.RevokeOwner(ctx, username); err != nil {
+		log.Errorf("Unable to revoke the API keys of %s: %v", username, err)
+		return problem.New(http.StatusInternalServerError, "Unable to revoke the API keys")
+	}
+	return nil
+}
+
+// checkAPIKey returns the API key of the Authorization header value, with
+// its scopes narrowed to the permissions its owner still has
+func checkAPIKey(ctx context.Context, credentials string, h *UsersHandler) (apiKey, *problem.Problem) {
+	var key apiKey
+	invalid := problem.New(http.StatusUnauthorized, "Invalid API key")
+	prefix, secret, ok := strings.Cut(credentials, ".")
+	if !ok || !strings.HasPrefix(prefix, apiKeyPrefix) || secret == "" {
+		log.Errorf("Malformed API key")
+		return key, invalid
+	}
+	stored, err := h.APIKeys.FindByPrefix(ctx, prefix)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			log.Errorf("API key %s doesn't exist", prefix)
+			return key, invalid
+		}
+		log.Errorf("Unable to decode the API key: %v", err)
+		return key, problem.New(http.StatusInternalServerError, "Unable to check the API key")
+	}
+	if subtle.ConstantTimeCompare([]byte(stored.Hash), []byte(hashToken(secret))) != 1 {
+		log.Errorf("Wrong secret for API key %s", prefix)
+		return key, invalid
+	}
+	key = newAPIKeyResource(stored)
+	now := time.Now().UTC()
+	if key.Revoked || now.After(key.ExpiresAt) {
+		log.Errorf("API key %s is revoked or expired", prefix)
+		return key, problem.New(http.StatusUnauthorized, "API key is no longer valid")
+	}
+	owner, err := h.Users.FindByUsername(ctx, key.Owner)
+	if err != nil {
+		log.Errorf("Unable to find the owner of API key %s: %v", prefix, err)
+		return key, invalid
+	}
+	if owner.Disabled() {
+		log.Errorf("Owner of API key %s is disabled", prefix)
+		return key, problem.New(http.StatusForbidden, "User is disabled")
+	}
+	// keys don't outlive the permissions of their owner
+	granted := make(map[Permission]bool)
+	for _, p := range userPermissions(owner) {
+		granted[p] = true
+	}
+	scopes := []Permission{}
+	for _, s := range key.Scopes {
+		if granted[s] {
+			scopes = append(scopes, s)
+		}
+	}
+	key.Scopes = scopes
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > lastUsedResolution {
+		if err := h.APIKeys.Touch(ctx, key.ID, now); err != nil {
+			// the request may still go through
+			log.Errorf("Unable to record the use of API key %s: %v", prefix, err)
+		}
+	}
+	return key, nil
+}
+
+// Authenticate accepts either an API key in an "Authorization: ApiKey"
+// header or an access token checked by jwtMiddleware and RequireSession.
+func (h *UsersHandler) Authenticate(jwtMiddleware echo.MiddlewareFunc) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		withToken := jwtMiddleware(h.RequireSession(next))
+		return func(c echo.Context) error {
+			scheme, credentials, _ := strings.Cut(c.Request().Header.Get(echo.HeaderAuthorization), " ")
+			if !strings.EqualFold(scheme, authSchemeAPIKey) {
+				return withToken(c)
+			}
+			key, err := checkAPIKey(c.Request().Context(), strings.TrimSpace(credentials), h)
+			if err != nil {
+				return err
+			}
+			c.Set(apiKeyContextKey, &key)
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nitin06890/go-rest-api/store"
+	mongostore "github.com/nitin06890/go-rest-api/store/mongo"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestAPIKeys(t *testing.T) {
+	ctx := context.Background()
+	e := echo.New()
+	users, sessions, apiKeys := db.Collection("keys_users"), db.Collection("keys_sessions"), db.Collection("keys_api_keys")
+	uh := UsersHandler{Users: &mongostore.Users{Col: users}, Sessions: &mongostore.Sessions{Col: sessions}, APIKeys: &mongostore.APIKeys{Col: apiKeys}, Keys: keys}
+	t.Cleanup(func() {
+		users.Drop(ctx)
+		sessions.Drop(ctx)
+		apiKeys.Drop(ctx)
+	})
+
+	editor, httpErr := insertUser(ctx, store.User{Email: "kim@example.com", Password: "qwertyuiop", Roles: []string{RoleEditor}}, uh.Users)
+	assert.Nil(t, httpErr)
+	sid, _, httpErr := startSession(ctx, editor.Email, uh.Sessions)
+	assert.Nil(t, httpErr)
+	accessToken, err := generateToken(editor, keys, sid)
+	assert.Nil(t, err)
+
+	// me runs a handler of the API keys of the current user
+	me := func(method, body string, handler echo.HandlerFunc, id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/me/api-keys", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(headerAuthToken, accessToken)
+		res := httptest.NewRecorder()
+		c := e.NewContext(req, res)
+		c.SetParamNames("id")
+		c.SetParamValues(id)
+		serve(jwtMiddleware()(uh.RequireSession(handler)), c)
+		return res
+	}
+	// call runs a handler behind the middleware of the product routes
+	call := func(header, value string, perm Permission) int {
+		req := httptest.NewRequest(http.MethodPost, "/products", nil)
+		req.Header.Set(header, value)
+		res := httptest.NewRecorder()
+		ok := func(c echo.Context) error { return c.String(http.StatusOK, currentUsername(c)) }
+		serve(uh.Authenticate(jwtMiddleware())(RequirePermission(perm)(ok)), e.NewContext(req, res))
+		return res.Code
+	}
+
+	var created createdAPIKey
+	t.Run("create a key", func(t *testing.T) {
+		res := me(http.MethodPost, `{"name":"nightly import","scopes":["catalog:write"]}`, uh.CreateAPIKey, "")
+		assert.Equal(t, http.StatusCreated, res.Code)
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &created))
+		assert.True(t, strings.HasPrefix(created.Key, created.Prefix+"."))
+		assert.Equal(t, []Permission{PermCatalogWrite}, created.Scopes)
+		assert.WithinDuration(t, time.Now().Add(prop.APIKeyTTL), created.ExpiresAt, time.Minute)
+		assert.NotContains(t, res.Body.String(), "hash")
+
+		var stored store.APIKey
+		assert.Nil(t, apiKeys.FindOne(ctx, bson.M{"_id": store.ID(created.ID)}).Decode(&stored))
+		assert.NotContains(t, created.Key, stored.Hash)
+	})
+
+	t.Run("keys cannot grant more than their owner has", func(t *testing.T) {
+		res := me(http.MethodPost, `{"name":"cleanup","scopes":["catalog:delete"]}`, uh.CreateAPIKey, "")
+		assert.Equal(t, http.StatusForbidden, res.Code)
+		res = me(http.MethodPost, `{"name":"past","scopes":["catalog:write"],"expires_at":"2001-01-01T00:00:00Z"}`, uh.CreateAPIKey, "")
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+		res = me(http.MethodPost, `{"name":"none","scopes":[]}`, uh.CreateAPIKey, "")
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+	})
+
+	t.Run("list the keys", func(t *testing.T) {
+		var list []apiKey
+		res := me(http.MethodGet, "", uh.GetAPIKeys, "")
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.NotContains(t, res.Body.String(), created.Key)
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &list))
+		assert.Len(t, list, 1)
+		assert.Equal(t, created.Prefix, list[0].Prefix)
+	})
+
+	t.Run("authenticate with a key", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, call(echo.HeaderAuthorization, "ApiKey "+created.Key, PermCatalogWrite))
+		assert.Equal(t, http.StatusForbidden, call(echo.HeaderAuthorization, "ApiKey "+created.Key, PermCatalogDelete))
+		assert.Equal(t, http.StatusUnauthorized, call(echo.HeaderAuthorization, "ApiKey "+created.Prefix+".forged", PermCatalogWrite))
+		assert.Equal(t, http.StatusUnauthorized, call(echo.HeaderAuthorization, "ApiKey garbage", PermCatalogWrite))
+
+		var stored store.APIKey
+		assert.Nil(t, apiKeys.FindOne(ctx, bson.M{"_id": store.ID(created.ID)}).Decode(&stored))
+		assert.NotNil(t, stored.LastUsedAt)
+
+		// access tokens keep working on the same routes
+		assert.Equal(t, http.StatusOK, call(headerAuthToken, accessToken, PermCatalogWrite))
+		assert.Equal(t, http.StatusUnauthorized, call("X-Other", "", PermCatalogWrite))
+	})
+
+	t.Run("keys lose the permissions their owner loses", func(t *testing.T) {
+		_, err := users.UpdateOne(ctx, bson.M{"_id": editor.ID}, bson.M{"$set": bson.M{"roles": []string{RoleCustomer}}})
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusForbidden, call(echo.HeaderAuthorization, "ApiKey "+created.Key, PermCatalogWrite))
+		_, err = users.UpdateOne(ctx, bson.M{"_id": editor.ID}, bson.M{"$set": bson.M{"roles": []string{RoleEditor}}})
+		assert.Nil(t, err)
+	})
+
+	t.Run("revoke a key", func(t *testing.T) {
+		missing := primitive.NewObjectID().Hex()
+		assert.Equal(t, http.StatusNotFound, me(http.MethodDelete, "", uh.RevokeAPIKey, missing).Code)
+		assert.Equal(t, http.StatusNoContent, me(http.MethodDelete, "", uh.RevokeAPIKey, created.ID).Code)
+		assert.Equal(t, http.StatusUnauthorized, call(echo.HeaderAuthorization, "ApiKey "+created.Key, PermCatalogWrite))
+	})
+
+	t.Run("expired keys are refused", func(t *testing.T) {
+		res := me(http.MethodPost, `{"name":"short","scopes":["catalog:write"]}`, uh.CreateAPIKey, "")
+		assert.Equal(t, http.StatusCreated, res.Code)
+		var short createdAPIKey
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &short))
+		_, err := apiKeys.UpdateOne(ctx, bson.M{"_id": store.ID(short.ID)}, bson.M{"$set": bson.M{"expires_at": time.Now().Add(-time.Second)}})
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusUnauthorized, call(echo.HeaderAuthorization, "ApiKey "+short.Key, PermCatalogWrite))
+	})
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/labstack/gommon/log"
+	"github.com/nitin06890/go-rest-api/problem"
+	"github.com/nitin06890/go-rest-api/store"
+)
+
+// bulkItem reports the outcome for one product of a batch
+type bulkItem struct {
+	Index      int          `json:"index"`
+	Status     int          `json:"status"`
+	InsertedID *store.ID    `json:"inserted_id,omitempty"`
+	Error      string       `json:"error,omitempty"`
+	Errors     []fieldError `json:"errors,omitempty"`
+}
+
+// bulkReport is the multi-status response of a batch write
+type bulkReport struct {
+	Inserted int        `json:"inserted"`
+	Failed   int        `json:"failed"`
+	Items    []bulkItem `json:"items"`
+}
+
+func parseBulkMode(q url.Values) (store.BulkMode, error) {
+	mode := store.BulkMode{Ordered: true}
+	var err error
+	if s := q.Get("atomic"); s != "" {
+		if mode.Atomic, err = strconv.ParseBool(s); err != nil {
+			return mode, errors.New("atomic must be a boolean")
+		}
+	}
+	if s := q.Get("ordered"); s != "" {
+		if mode.Ordered, err = strconv.ParseBool(s); err != nil {
+			return mode, errors.New("ordered must be a boolean")
+		}
+	}
+	if mode.Atomic && !mode.Ordered {
+		return mode, errors.New("atomic and ordered=false cannot be combined")
+	}
+	return mode, nil
+}
+
+func newBulkReport(n int) bulkReport {
+	report := bulkReport{Items: make([]bulkItem, n)}
+	for i := range report.Items {
+		report.Items[i] = bulkItem{Index: i, Status: http.StatusFailedDependency, Error: "Not inserted"}
+	}
+	return report
+}
+
+func (r *bulkReport) succeed(i int, id store.ID) {
+	r.Items[i] = bulkItem{Index: i, Status: http.StatusCreated, InsertedID: &id}
+}
+
+func (r *bulkReport) fail(i, status int, msg string) {
+	r.Items[i] = bulkItem{Index: i, Status: status, Error: msg}
+}
+
+func (r *bulkReport) invalid(i int, errs []fieldError) {
+	r.Items[i] = bulkItem{Index: i, Status: http.StatusBadRequest, Error: "Unable to validate the product", Errors: errs}
+}
+
+func (r *bulkReport) count() {
+	r.Inserted, r.Failed = 0, 0
+	for _, item := range r.Items {
+		if item.Status == http.StatusCreated {
+			r.Inserted++
+		} else {
+			r.Failed++
+		}
+	}
+}
+
+// fieldErrors returns the validation errors of all the products
+func (r *bulkReport) fieldErrors() []fieldError {
+	errs := []fieldError{}
+	for _, item := range r.Items {
+		errs = append(errs, item.Errors...)
+	}
+	return errs
+}
+
+// insertedIDs returns the ids of the products, in order, once all are inserted
+func (r *bulkReport) insertedIDs() []interface{} {
+	ids := make([]interface{}, 0, len(r.Items))
+	for _, item := range r.Items {
+		ids = append(ids, *item.InsertedID)
+	}
+	return ids
+}
+
+// writeErrorStatus is the status of a product that could not be written
+func writeErrorStatus(err error) int {
+	if err == store.ErrDuplicate {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// insertProducts writes the valid products of a batch according to mode.
+// report holds an item per product and already records the invalid ones;
+// the returned status is the status of the whole response.
+func insertProducts(ctx context.Context, products []store.Product, mode store.BulkMode, report *bulkReport, repo ProductRepository) (int, *problem.Problem) {
+	defer report.count()
+	var valid []store.Product
+	var indexes []int
+	for i, product := range products {
+		if report.Items[i].Status != http.StatusFailedDependency {
+			continue
+		}
+		valid = append(valid, product)
+		indexes = append(indexes, i)
+	}
+	if len(valid) < len(products) && mode.Ordered {
+		return http.StatusBadRequest, nil
+	}
+	if len(valid) == 0 {
+		return http.StatusMultiStatus, nil
+	}
+
+	errs, err := repo.Create(ctx, valid, mode)
+	if err == store.ErrNoTransactions {
+		log.Errorf("Atomic insert requested without transaction support")
+		return 0, problem.New(http.StatusNotImplemented, "Transactions are not available")
+	}
+	if err != nil {
+		log.Errorf("Unable to insert to database: %v", err)
+		return 0, problem.New(http.StatusInternalServerError, "Unable to insert to database")
+	}
+	status := http.StatusCreated
+	failed := false
+	for j, i := range indexes {
+		switch errs[j] {
+		case nil:
+			report.succeed(i, valid[j].ID)
+		case store.ErrNotInserted:
+			failed = true
+		default:
+			log.Errorf("Unable to insert product %d: %v", i, errs[j])
+			report.fail(i, writeErrorStatus(errs[j]), "Unable to insert to database")
+			status = writeErrorStatus(errs[j])
+			failed = true
+		}
+	}
+	if !mode.Atomic && (failed || !mode.Ordered) {
+		status = http.StatusMultiStatus
+	}
+	return status, nil
+}
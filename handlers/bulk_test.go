@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nitin06890/go-rest-api/dbiface"
+	"github.com/nitin06890/go-rest-api/problem"
+	mongostore "github.com/nitin06890/go-rest-api/store/mongo"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// passthroughTransactions runs the function without a transaction
+type passthroughTransactions struct {
+	calls int
+}
+
+func (p *passthroughTransactions) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	p.calls++
+	return fn(ctx)
+}
+
+// standaloneTransactions fails like a mongo server that is not part of a replica set
+type standaloneTransactions struct{}
+
+func (standaloneTransactions) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return mongo.CommandError{Code: 20, Message: "Transaction numbers are only allowed on a replica set member or mongos"}
+}
+
+// failingInsertCollection fails to insert the document at index failAt
+type failingInsertCollection struct {
+	dbiface.CollectionAPI
+	failAt int
+}
+
+func (f *failingInsertCollection) InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	return nil, mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{
+		{WriteError: mongo.WriteError{Index: f.failAt, Code: 11000, Message: "duplicate key"}},
+	}}
+}
+
+func TestCreateProductsBulk(t *testing.T) {
+	body := `
+	[
+		{"product_name":"watch","price":300,"currency":"USD","vendor":"bulky"},
+		{"product_name":"invalid product name","price":100,"currency":"USD","vendor":"bulky"},
+		{"product_name":"buds","price":150,"currency":"USD","vendor":"bulky"}
+	]
+	`
+	t.Cleanup(func() {
+		col.DeleteMany(context.Background(), bson.M{"vendor": "bulky"})
+	})
+	e := echo.New()
+	create := func(ph *ProductHandler, query, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/products"+query, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		res := httptest.NewRecorder()
+		serve(ph.CreateProducts, e.NewContext(req, res))
+		return res
+	}
+	statuses := func(report bulkReport) []int {
+		var statuses []int
+		for _, item := range report.Items {
+			statuses = append(statuses, item.Status)
+		}
+		return statuses
+	}
+	count := func() int64 {
+		n, err := col.CountDocuments(context.Background(), bson.M{"vendor": "bulky"})
+		assert.Nil(t, err)
+		return n
+	}
+
+	t.Run("ordered batch with an invalid product", func(t *testing.T) {
+		var report problemBody
+		res := create(&ProductHandler{Products: &mongostore.Products{Col: col}}, "", body)
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+		assert.Equal(t, problem.MIMEProblemJSON, res.Header().Get(echo.HeaderContentType))
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &report))
+		assert.Equal(t, problem.TypeValidation, report.Type)
+		assert.Equal(t, []int{http.StatusFailedDependency, http.StatusBadRequest, http.StatusFailedDependency}, statuses(bulkReport{Items: report.Items}))
+		index := 1
+		assert.Equal(t, []fieldError{{Field: "product_name", Rule: "max", Param: "10", Index: &index}}, report.Errors)
+		assert.Equal(t, int64(0), count())
+	})
+
+	t.Run("unordered batch with an invalid product", func(t *testing.T) {
+		var report bulkReport
+		res := create(&ProductHandler{Products: &mongostore.Products{Col: col}}, "?ordered=false", body)
+		assert.Equal(t, http.StatusMultiStatus, res.Code)
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &report))
+		assert.Equal(t, 2, report.Inserted)
+		assert.Equal(t, 1, report.Failed)
+		assert.Equal(t, []int{http.StatusCreated, http.StatusBadRequest, http.StatusCreated}, statuses(report))
+		assert.NotNil(t, report.Items[0].InsertedID)
+		assert.Nil(t, report.Items[1].InsertedID)
+		assert.Equal(t, int64(2), count())
+	})
+
+	t.Run("atomic batch", func(t *testing.T) {
+		var IDs []string
+		txn := &passthroughTransactions{}
+		res := create(&ProductHandler{Products: &mongostore.Products{Col: col, Txn: txn}}, "?atomic=true", `[{"product_name":"tag","price":30,"currency":"USD","vendor":"bulky"}]`)
+		assert.Equal(t, http.StatusCreated, res.Code)
+		assert.Equal(t, 1, txn.calls)
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &IDs))
+		assert.Len(t, IDs, 1)
+		assert.Equal(t, int64(3), count())
+	})
+
+	t.Run("atomic batch without transactions", func(t *testing.T) {
+		res := create(&ProductHandler{Products: &mongostore.Products{Col: col}}, "?atomic=true", `[{"product_name":"tag","price":30,"currency":"USD","vendor":"bulky"}]`)
+		assert.Equal(t, http.StatusNotImplemented, res.Code)
+		res = create(&ProductHandler{Products: &mongostore.Products{Col: col, Txn: standaloneTransactions{}}}, "?atomic=true", `[{"product_name":"tag","price":30,"currency":"USD","vendor":"bulky"}]`)
+		assert.Equal(t, http.StatusNotImplemented, res.Code, "a standalone server")
+	})
+
+	t.Run("invalid modes", func(t *testing.T) {
+		res := create(&ProductHandler{Products: &mongostore.Products{Col: col}}, "?atomic=true&ordered=false", body)
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+		res = create(&ProductHandler{Products: &mongostore.Products{Col: col}}, "?atomic=maybe", body)
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+	})
+
+	valid := `
+	[
+		{"product_name":"a","price":1,"currency":"USD","vendor":"bulky"},
+		{"product_name":"b","price":2,"currency":"USD","vendor":"bulky"},
+		{"product_name":"c","price":3,"currency":"USD","vendor":"bulky"}
+	]
+	`
+	t.Run("ordered batch failing in the database", func(t *testing.T) {
+		var report bulkReport
+		res := create(&ProductHandler{Products: &mongostore.Products{Col: &failingInsertCollection{failAt: 1}}}, "", valid)
+		assert.Equal(t, http.StatusMultiStatus, res.Code)
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &report))
+		assert.Equal(t, []int{http.StatusCreated, http.StatusConflict, http.StatusFailedDependency}, statuses(report))
+	})
+
+	t.Run("atomic batch failing in the database", func(t *testing.T) {
+		var report problemBody
+		res := create(&ProductHandler{Products: &mongostore.Products{Col: &failingInsertCollection{failAt: 1}, Txn: &passthroughTransactions{}}}, "?atomic=true", valid)
+		assert.Equal(t, http.StatusConflict, res.Code)
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &report))
+		assert.Equal(t, []int{http.StatusFailedDependency, http.StatusConflict, http.StatusFailedDependency}, statuses(bulkReport{Items: report.Items}))
+	})
+}
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/labstack/gommon/log"
+	"github.com/nitin06890/go-rest-api/cache"
+	"github.com/nitin06890/go-rest-api/store"
+)
+
+// CachedProducts serves the product lookups, lists and counts from a cache
+// in front of a repository, and clears the cache whenever the products are
+// written through it. A read racing a write may still cache what it read
+// before the write, until the entry expires. Searches and facets are not
+// cached.
+type CachedProducts struct {
+	Products ProductRepository
+	Cache    cache.Cache
+	// Counters, if any, count the reads served by the cache and the others
+	Counters *cache.Counters
+}
+
+var _ ProductRepository = (*CachedProducts)(nil)
+
+// listKey is the cache key of a page of products
+type listKey struct {
+	Filter    store.ProductFilter `json:"filter"`
+	Sort      []string            `json:"sort"`
+	After     []interface{}       `json:"after,omitempty"`
+	Backwards bool                `json:"backwards,omitempty"`
+	Limit     int64               `json:"limit"`
+}
+
+// cached decodes the value of the key into v if the cache has it, and
+// otherwise reads it with read and caches it. The cache failing, or holding
+// a value that cannot be decoded, only means the value is read again.
+func (r *CachedProducts) cached(ctx context.Context, key string, v interface{}, read func() error) error {
+	data, ok, err := r.Cache.Get(ctx, key)
+	if err != nil {
+		log.Errorf("Unable to read %s from the cache: %v", key, err)
+	}
+	if ok {
+		if err := json.Unmarshal(data, v); err == nil {
+			r.Counters.Hit()
+			return nil
+		}
+		log.Errorf("Unable to decode %s from the cache: %v", key, err)
+	}
+	r.Counters.Miss()
+	if err := read(); err != nil {
+		return err
+	}
+	if data, err = json.Marshal(v); err == nil {
+		err = r.Cache.Set(ctx, key, data)
+	}
+	if err != nil {
+		log.Errorf("Unable to cache %s: %v", key, err)
+	}
+	return nil
+}
+
+// invalidate clears the cache after a write
+func (r *CachedProducts) invalidate(ctx context.Context) {
+	if err := r.Cache.Clear(ctx); err != nil {
+		log.Errorf("Unable to clear the products cache: %v", err)
+	}
+}
+
+// FindByID returns the product of the id
+func (r *CachedProducts) FindByID(ctx context.Context, id string) (store.Product, error) {
+	var product store.Product
+	err := r.cached(ctx, "products:id:"+id, &product, func() (err error) {
+		product, err = r.Products.FindByID(ctx, id)
+		return err
+	})
+	return product, err
+}
+
+// List returns a page of the products matching the filter
+func (r *CachedProducts) List(ctx context.Context, filter store.ProductFilter, page store.ProductPageRequest) ([]store.Product, error) {
+	k := listKey{Filter: filter, After: page.After, Backwards: page.Backwards, Limit: page.Limit}
+	for _, s := range page.Sort {
+		if s.Desc {
+			k.Sort = append(k.Sort, "-"+s.Field.Name)
+		} else {
+			k.Sort = append(k.Sort, s.Field.Name)
+		}
+	}
+	key, err := json.Marshal(k)
+	if err != nil {
+		return r.Products.List(ctx, filter, page)
+	}
+	var products []store.Product
+	err = r.cached(ctx, "products:list:"+string(key), &products, func() (err error) {
+		products, err = r.Products.List(ctx, filter, page)
+		return err
+	})
+	return products, err
+}
+
+// Count counts the products matching the filter
+func (r *CachedProducts) Count(ctx context.Context, filter store.ProductFilter) (int64, error) {
+	key, err := json.Marshal(filter)
+	if err != nil {
+		return r.Products.Count(ctx, filter)
+	}
+	var n int64
+	err = r.cached(ctx, "products:count:"+string(key), &n, func() (err error) {
+		n, err = r.Products.Count(ctx, filter)
+		return err
+	})
+	return n, err
+}
+
+// Create inserts the products and clears the cache
+func (r *CachedProducts) Create(ctx context.Context, products []store.Product, mode store.BulkMode) ([]error, error) {
+	defer r.invalidate(ctx)
+	return r.Products.Create(ctx, products, mode)
+}
+
+// Update stores the product and clears the cache
+func (r *CachedProducts) Update(ctx context.Context, product store.Product, version int64) error {
+	defer r.invalidate(ctx)
+	return r.Products.Update(ctx, product, version)
+}
+
+// Patch sets and unsets the fields of the product and clears the cache
+func (r *CachedProducts) Patch(ctx context.Context, id string, version int64, set map[string]interface{}, unset []string) error {
+	defer r.invalidate(ctx)
+	return r.Products.Patch(ctx, id, version, set, unset)
+}
+
+// Delete deletes the product and clears the cache
+func (r *CachedProducts) Delete(ctx context.Context, id string, version *int64) (bool, error) {
+	defer r.invalidate(ctx)
+	return r.Products.Delete(ctx, id, version)
+}
+
+// Search runs a full-text search, which is not cached
+func (r *CachedProducts) Search(ctx context.Context, text string, offset, limit int64) ([]store.ScoredProduct, int64, error) {
+	return r.Products.Search(ctx, text, offset, limit)
+}
+
+// Facets counts the products by facet, which is not cached
+func (r *CachedProducts) Facets(ctx context.Context, filter store.ProductFilter) (store.FacetCounts, error) {
+	return r.Products.Facets(ctx, filter)
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nitin06890/go-rest-api/cache"
+	"github.com/nitin06890/go-rest-api/memdb"
+	"github.com/nitin06890/go-rest-api/store"
+	mongostore "github.com/nitin06890/go-rest-api/store/mongo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestCachedProducts(t *testing.T) {
+	ctx := context.Background()
+	products := memdb.NewDatabase().Collection("products")
+	repo := &CachedProducts{Products: &mongostore.Products{Col: products}, Cache: cache.NewLRU(100, time.Minute)}
+	seeded := seedProducts(t, repo)
+	id := seeded[0].ID
+
+	byID := []store.SortKey{{Field: store.ProductFields["_id"]}}
+	list := func() []string {
+		found, err := repo.List(ctx, store.ProductFilter{"vendor": {"eq": "google"}}, store.ProductPageRequest{Sort: byID, Limit: 10})
+		assert.Nil(t, err)
+		return productNames(found)
+	}
+	count := func() int64 {
+		n, err := repo.Count(ctx, store.ProductFilter{"vendor": {"eq": "google"}})
+		assert.Nil(t, err)
+		return n
+	}
+	find := func() store.Product {
+		found, err := repo.FindByID(ctx, string(id))
+		assert.Nil(t, err)
+		return found
+	}
+	assert.Equal(t, []string{"alpha", "delta"}, list())
+	assert.Equal(t, int64(2), count())
+	assert.Equal(t, seeded[0], find())
+
+	// changes behind the back of the repository are not seen
+	_, err := products.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"vendor": "acme"}})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"alpha", "delta"}, list())
+	assert.Equal(t, int64(2), count())
+	assert.Equal(t, "google", find().Vendor)
+	// other pages are other entries
+	n, err := repo.Count(ctx, store.ProductFilter{"vendor": {"eq": "acme"}})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+
+	// writes through the repository clear the cache
+	assert.Nil(t, repo.Patch(ctx, string(seeded[3].ID), 1, map[string]interface{}{"version": int64(2)}, nil))
+	assert.Equal(t, []string{"delta"}, list())
+	assert.Equal(t, int64(1), count())
+	assert.Equal(t, "acme", find().Vendor)
+
+	deleted, err := repo.Delete(ctx, string(seeded[3].ID), nil)
+	assert.Nil(t, err)
+	assert.True(t, deleted)
+	assert.Empty(t, list())
+	_, err = repo.FindByID(ctx, string(seeded[3].ID))
+	assert.Equal(t, store.ErrNotFound, err, "missing products are not cached")
+}
+
+func TestCachedProductsCounters(t *testing.T) {
+	ctx := context.Background()
+	reg := prometheus.NewRegistry()
+	counters, err := cache.NewCounters(reg, "products")
+	require.Nil(t, err)
+	lru := cache.NewLRU(100, time.Minute)
+	repo := &CachedProducts{Products: &mongostore.Products{Col: memdb.NewDatabase().Collection("products")}, Cache: lru, Counters: counters}
+	seeded := seedProducts(t, repo)
+	id := string(seeded[0].ID)
+
+	for i := 0; i < 2; i++ {
+		found, err := repo.FindByID(ctx, id)
+		assert.Nil(t, err)
+		assert.Equal(t, seeded[0], found)
+	}
+	// a value that cannot be decoded is read from the database again
+	require.Nil(t, lru.Set(ctx, "products:id:"+id, []byte("{")))
+	found, err := repo.FindByID(ctx, id)
+	assert.Nil(t, err)
+	assert.Equal(t, seeded[0], found)
+
+	assert.Nil(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP cache_hits_total Number of reads served by the cache.
+# TYPE cache_hits_total counter
+cache_hits_total{cache="products"} 1
+# HELP cache_misses_total Number of reads the cache could not serve.
+# TYPE cache_misses_total counter
+cache_misses_total{cache="products"} 2
+`)))
+}
+
+func TestProductCacheControl(t *testing.T) {
+	handler := ProductHandler{Products: &mongostore.Products{Col: memdb.NewDatabase().Collection("products")}}
+	seeded := seedProducts(t, handler.Products)
+
+	get := func(path string, read echo.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		res := httptest.NewRecorder()
+		c := echo.New().NewContext(req, res)
+		c.SetParamNames("id")
+		c.SetParamValues(string(seeded[0].ID))
+		assert.Nil(t, read(c))
+		assert.Equal(t, http.StatusOK, res.Code)
+		return res
+	}
+	path := fmt.Sprintf("/products/%s", string(seeded[0].ID))
+	assert.Empty(t, get(path, handler.GetProduct).Header().Get("Cache-Control"), "no cache, no Cache-Control")
+
+	handler.CacheTTL = 90 * time.Second
+	assert.Equal(t, "private, max-age=90, must-revalidate", get(path, handler.GetProduct).Header().Get("Cache-Control"))
+	assert.Equal(t, "private, max-age=90, must-revalidate", get("/products", handler.GetProducts).Header().Get("Cache-Control"))
+}
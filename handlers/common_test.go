@@ -2,26 +2,35 @@ package handlers
 
 import (
 	"context"
-	"fmt"
 	"os"
 	"testing"
 
 	"github.com/ilyakaznacheev/cleanenv"
+	echojwt "github.com/labstack/echo-jwt/v4"
+	"github.com/labstack/echo/v4"
 	"github.com/labstack/gommon/log"
 	"github.com/nitin06890/go-rest-api/config"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"github.com/nitin06890/go-rest-api/events"
+	"github.com/nitin06890/go-rest-api/keyring"
+	"github.com/nitin06890/go-rest-api/mailer"
+	"github.com/nitin06890/go-rest-api/memdb"
+	"github.com/nitin06890/go-rest-api/problem"
+	mongostore "github.com/nitin06890/go-rest-api/store/mongo"
 )
 
 var (
-	// c        *mongo.Client
-	db       *mongo.Database
-	col      *mongo.Collection
-	usersCol *mongo.Collection
+	db       *memdb.Database
+	col      *memdb.Collection
+	usersCol *memdb.Collection
+	sessCol  *memdb.Collection
+	tokCol   *memdb.Collection
+	attCol   *memdb.Collection
+	outbox   = &mailer.Memory{}
+	emitted  = &events.Memory{}
 	cfg      config.Properties
 	h        ProductHandler
 	uh       UsersHandler
+	keys     *keyring.Ring
 )
 
 func init() {
@@ -29,23 +38,25 @@ func init() {
 		log.Fatalf("Configuration cannot be read : %v", err)
 	}
 
-	connectURI := fmt.Sprintf("mongodb://%s:%s", cfg.DBHost, cfg.DBPort)
-	c, err := mongo.Connect(context.Background(), options.Client().ApplyURI(connectURI))
+	var err error
+	keys, err = keyring.New(keyring.EdDSA, "", keyring.Lifetimes{})
 	if err != nil {
-		log.Fatalf("Unable to connect to database : %v", err)
+		log.Fatalf("Unable to generate a signing key : %v", err)
 	}
-	db = c.Database(cfg.DBName)
+	uh.Keys = keys
+	uh.Mailer = outbox
+	uh.Events = emitted
+
+	// the suites run against memory so they need no database
+	db = memdb.NewDatabase()
 	col = db.Collection(cfg.ProductCollection)
 	usersCol = db.Collection(cfg.UsersCollection)
-	isUserIndexUnique := true
-	indexModel := mongo.IndexModel{
-		Keys: bson.M{"username": 1},
-		Options: &options.IndexOptions{
-			Unique: &isUserIndexUnique,
-		},
-	}
-	_, err = usersCol.Indexes().CreateOne(context.Background(), indexModel)
-	if err != nil {
+	sessCol = db.Collection(cfg.SessionsCollection)
+	tokCol = db.Collection(cfg.UserTokensCollection)
+	uh.Tokens = &mongostore.UserTokens{Col: tokCol}
+	attCol = db.Collection(cfg.AttemptsCollection)
+	uh.Attempts = &mongostore.LoginAttempts{Col: attCol}
+	if err := usersCol.CreateUniqueIndex("username"); err != nil {
 		log.Fatalf("Unable to create an index : %+v", err)
 	}
 }
@@ -54,7 +65,36 @@ func TestMain(m *testing.M) {
 	ctx := context.Background()
 	testCode := m.Run()
 	usersCol.Drop(ctx)
+	sessCol.Drop(ctx)
+	tokCol.Drop(ctx)
+	attCol.Drop(ctx)
 	col.Drop(ctx)
 	db.Drop(ctx)
 	os.Exit(testCode)
 }
+
+// problemBody is the decoded form of a problem+json response
+type problemBody struct {
+	Type   string       `json:"type"`
+	Title  string       `json:"title"`
+	Status int          `json:"status"`
+	Detail string       `json:"detail"`
+	Field  string       `json:"field"`
+	Errors []fieldError `json:"errors"`
+	Items  []bulkItem   `json:"items"`
+}
+
+// jwtMiddleware validates access tokens the way the server does
+func jwtMiddleware() echo.MiddlewareFunc {
+	return echojwt.WithConfig(echojwt.Config{
+		KeyFunc:     keys.Keyfunc,
+		TokenLookup: "header:x-auth-token",
+	})
+}
+
+// serve calls handler and writes a returned error the way the server does
+func serve(handler echo.HandlerFunc, c echo.Context) {
+	if err := handler(c); err != nil {
+		problem.HTTPErrorHandler(err, c)
+	}
+}
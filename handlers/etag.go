@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/nitin06890/go-rest-api/problem"
+	"github.com/nitin06890/go-rest-api/store"
+)
+
+const (
+	headerCacheControl = "Cache-Control"
+	headerETag         = "ETag"
+	headerIfMatch      = "If-Match"
+	headerIfNoneMatch  = "If-None-Match"
+)
+
+// productETag is the strong entity tag of a product, derived from its version
+func productETag(p store.Product) string {
+	return fmt.Sprintf(`"%d"`, p.Version)
+}
+
+// contentETag is a weak entity tag derived from a response body
+func contentETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `W/"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether an If-Match or If-None-Match header value
+// matches etag. If-Match uses the strong comparison, so weak tags in the
+// header never match; If-None-Match uses the weak comparison.
+func etagMatches(header, etag string, weak bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	if weak {
+		etag = strings.TrimPrefix(etag, "W/")
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag && !strings.HasPrefix(candidate, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch returns 412 Precondition Failed if the If-Match header is
+// given and does not match the current version of the product
+func checkIfMatch(ifMatch string, p store.Product) *problem.Problem {
+	if ifMatch == "" || etagMatches(ifMatch, productETag(p), false) {
+		return nil
+	}
+	return problem.New(http.StatusPreconditionFailed, "Product has been modified")
+}
+
+// lostUpdate is returned when a product changed between reading and writing it
+func lostUpdate(ifMatch string) *problem.Problem {
+	if ifMatch != "" {
+		return problem.New(http.StatusPreconditionFailed, "Product has been modified")
+	}
+	return problem.New(http.StatusConflict, "Product was modified concurrently")
+}
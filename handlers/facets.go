@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/nitin06890/go-rest-api/problem"
+	"github.com/nitin06890/go-rest-api/store"
+)
+
+type priceBucket struct {
+	Min   int   `json:"min"`
+	Max   int   `json:"max"`
+	Count int64 `json:"count"`
+}
+
+type productFacets struct {
+	Total       int64              `json:"total"`
+	Vendor      []store.ValueCount `json:"vendor"`
+	Currency    []store.ValueCount `json:"currency"`
+	IsEssential []store.ValueCount `json:"is_essential"`
+	Price       []priceBucket      `json:"price"`
+	// PriceOther counts the products priced outside of the price buckets,
+	// such as those stored before prices were validated
+	PriceOther int64 `json:"price_other"`
+}
+
+func findFacets(ctx context.Context, q url.Values, products ProductRepository) (productFacets, *problem.Problem) {
+	facets := productFacets{}
+	filter, err := buildProductFilter(q)
+	if err != nil {
+		log.Errorf("Invalid filter: %v", err)
+		return facets, filterProblem(err)
+	}
+	counts, err := products.Facets(ctx, filter)
+	if err != nil {
+		log.Errorf("Unable to aggregate the products: %v", err)
+		return facets, problem.New(http.StatusInternalServerError, "Unable to aggregate the products")
+	}
+
+	facets.Total = counts.Total
+	values := func(name string) []store.ValueCount {
+		if counts.Values[name] == nil {
+			return []store.ValueCount{}
+		}
+		return counts.Values[name]
+	}
+	facets.Vendor = values("vendor")
+	facets.Currency = values("currency")
+	facets.IsEssential = values("is_essential")
+
+	// report every bucket, including the empty ones, so the shape is stable
+	for i := 0; i < len(store.PriceBoundaries)-1; i++ {
+		facets.Price = append(facets.Price, priceBucket{
+			Min:   store.PriceBoundaries[i],
+			Max:   store.PriceBoundaries[i+1] - 1,
+			Count: counts.Prices[store.PriceBoundaries[i]],
+		})
+	}
+	facets.PriceOther = counts.OtherPrices
+	return facets, nil
+}
+
+// GetProductFacets returns product counts by vendor, currency, is_essential
+// and price range for the products matching the query filters
+func (h *ProductHandler) GetProductFacets(c echo.Context) error {
+	facets, err := findFacets(c.Request().Context(), c.QueryParams(), h.Products)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, facets)
+}
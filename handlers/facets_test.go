@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nitin06890/go-rest-api/dbiface"
+	"github.com/nitin06890/go-rest-api/store"
+	mongostore "github.com/nitin06890/go-rest-api/store/mongo"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// facetCollection serves a canned $facet result and records the pipeline
+type facetCollection struct {
+	dbiface.CollectionAPI
+	result   bson.M
+	pipeline interface{}
+}
+
+func (c *facetCollection) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error) {
+	c.pipeline = pipeline
+	return mongo.NewCursorFromDocuments([]interface{}{c.result}, nil, nil)
+}
+
+func TestGetProductFacets(t *testing.T) {
+	fc := &facetCollection{result: bson.M{
+		"total":        bson.A{bson.M{"count": 3}},
+		"vendor":       bson.A{bson.M{"_id": "google", "count": 2}, bson.M{"_id": "apple", "count": 1}},
+		"currency":     bson.A{bson.M{"_id": "USD", "count": 3}},
+		"is_essential": bson.A{bson.M{"_id": false, "count": 3}},
+		"price":        bson.A{bson.M{"_id": 100, "count": 2}, bson.M{"_id": 750, "count": 1}, bson.M{"_id": "other", "count": 4}},
+	}}
+	ph := ProductHandler{Products: &mongostore.Products{Col: fc}}
+	e := echo.New()
+
+	t.Run("facets for a filter", func(t *testing.T) {
+		var facets productFacets
+		req := httptest.NewRequest(http.MethodGet, "/products/facets?currency=USD", nil)
+		res := httptest.NewRecorder()
+		err := ph.GetProductFacets(e.NewContext(req, res))
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, bson.M{"$match": bson.M{"currency": bson.M{"$eq": "USD"}}}, fc.pipeline.(bson.A)[0])
+
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &facets))
+		assert.Equal(t, int64(3), facets.Total)
+		assert.Equal(t, []store.ValueCount{{Value: "google", Count: 2}, {Value: "apple", Count: 1}}, facets.Vendor)
+		assert.Equal(t, []store.ValueCount{{Value: false, Count: 3}}, facets.IsEssential)
+		assert.Equal(t, []priceBucket{
+			{Min: 0, Max: 99, Count: 0},
+			{Min: 100, Max: 249, Count: 2},
+			{Min: 250, Max: 499, Count: 0},
+			{Min: 500, Max: 749, Count: 0},
+			{Min: 750, Max: 1000, Count: 1},
+		}, facets.Price)
+		assert.Equal(t, int64(4), facets.PriceOther)
+	})
+
+	t.Run("facets with an unknown filter", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/products/facets?colour=red", nil)
+		res := httptest.NewRecorder()
+		serve(ph.GetProductFacets, e.NewContext(req, res))
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+	})
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/nitin06890/go-rest-api/problem"
+	"github.com/nitin06890/go-rest-api/store"
+)
+
+// filterError reports a query parameter that cannot be used as a filter
+type filterError struct {
+	Field  string
+	Reason string
+}
+
+func (e *filterError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Reason)
+}
+
+// filterProblem returns the problem of an error building a filter: the
+// query parameter at fault for a *filterError, an internal error otherwise
+func filterProblem(err error) *problem.Problem {
+	var fe *filterError
+	if errors.As(err, &fe) {
+		return problem.InvalidQuery(fe.Field, fe.Reason)
+	}
+	return problem.New(http.StatusInternalServerError, "Unable to build the filter")
+}
+
+// parseFilterKey splits a query key such as "price[gte]" into field and operator
+func parseFilterKey(key string) (string, string, error) {
+	open := strings.IndexByte(key, '[')
+	if open < 0 {
+		return key, "eq", nil
+	}
+	if open == 0 || !strings.HasSuffix(key, "]") || strings.Count(key, "[") != 1 || strings.Count(key, "]") != 1 {
+		return "", "", &filterError{Field: key, Reason: "malformed filter"}
+	}
+	return key[:open], key[open+1 : len(key)-1], nil
+}
+
+// parseFilterValue converts a query value to the type of the given field
+func parseFilterValue(field store.Field, s string) (interface{}, error) {
+	t := field.Type
+	if t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	switch {
+	case t == reflect.TypeOf(store.ID("")):
+		return store.ParseID(s)
+	case t.Kind() == reflect.String:
+		return s, nil
+	case t.Kind() == reflect.Int:
+		return strconv.Atoi(s)
+	case t.Kind() == reflect.Bool:
+		return strconv.ParseBool(s)
+	}
+	return nil, fmt.Errorf("cannot filter by %s", field.Name)
+}
+
+// buildProductFilter compiles the query parameters to a filter, e.g.
+// price[gte]=100&price[lt]=500&vendor[in]=google,apple&is_essential=true.
+// Field names are whitelisted from the bson tags of store.Product and
+// operators from store.FilterOperators; every value is converted to the
+// type of its field, so user input only ever reaches the database as a
+// plain value. Any other query parameter is rejected with a *filterError
+// naming it.
+func buildProductFilter(q url.Values) (store.ProductFilter, error) {
+	filter := store.ProductFilter{}
+	for key, values := range q {
+		if paginationParams[key] {
+			continue
+		}
+		name, op, err := parseFilterKey(key)
+		if err != nil {
+			return nil, err
+		}
+		field, ok := store.ProductFields[name]
+		if !ok {
+			return nil, &filterError{Field: name, Reason: "unknown filter field"}
+		}
+		if _, ok := store.FilterOperators[op]; !ok {
+			return nil, &filterError{Field: key, Reason: fmt.Sprintf("unknown filter operator %q", op)}
+		}
+		if field.Type.Kind() == reflect.Bool && op != "eq" && op != "ne" {
+			return nil, &filterError{Field: key, Reason: fmt.Sprintf("operator %q is not supported for this field", op)}
+		}
+		if len(values) != 1 {
+			return nil, &filterError{Field: key, Reason: "filter given more than once"}
+		}
+
+		var value interface{}
+		if op == "in" || op == "nin" {
+			list := []interface{}{}
+			for _, s := range strings.Split(values[0], ",") {
+				v, err := parseFilterValue(field, s)
+				if err != nil {
+					return nil, &filterError{Field: key, Reason: fmt.Sprintf("invalid value %q", s)}
+				}
+				list = append(list, v)
+			}
+			value = list
+		} else {
+			value, err = parseFilterValue(field, values[0])
+			if err != nil {
+				return nil, &filterError{Field: key, Reason: fmt.Sprintf("invalid value %q", values[0])}
+			}
+		}
+
+		ops, ok := filter[name]
+		if !ok {
+			ops = make(map[string]interface{})
+			filter[name] = ops
+		}
+		if _, ok := ops[op]; ok {
+			return nil, &filterError{Field: key, Reason: "filter given more than once"}
+		}
+		ops[op] = value
+	}
+	return filter, nil
+}
@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nitin06890/go-rest-api/dbiface"
+	"github.com/nitin06890/go-rest-api/store"
+	mongostore "github.com/nitin06890/go-rest-api/store/mongo"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// recordingCollection records the filters that reach the database
+type recordingCollection struct {
+	dbiface.CollectionAPI
+	filters []interface{}
+}
+
+func (r *recordingCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	r.filters = append(r.filters, filter)
+	return mongo.NewCursorFromDocuments(nil, nil, nil)
+}
+
+func (r *recordingCollection) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+	r.filters = append(r.filters, filter)
+	return 0, nil
+}
+
+// assertOnlyKnownOperators fails if the filter holds any mongo operator the
+// filter builder does not generate itself
+func assertOnlyKnownOperators(t *testing.T, filter interface{}) {
+	allowed := map[string]bool{"$and": true, "$or": true}
+	for op := range store.FilterOperators {
+		allowed["$"+op] = true
+	}
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case bson.M:
+			for k, child := range v {
+				if strings.HasPrefix(k, "$") {
+					assert.True(t, allowed[k], "unexpected operator %s", k)
+				} else {
+					_, ok := store.ProductFields[k]
+					assert.True(t, ok, "unexpected field %s", k)
+				}
+				walk(child)
+			}
+		case bson.A:
+			for _, child := range v {
+				walk(child)
+			}
+		}
+	}
+	walk(filter)
+}
+
+func TestBuildProductFilter(t *testing.T) {
+	id := store.NewID()
+	tests := []struct {
+		name  string
+		query string
+		want  store.ProductFilter
+	}{
+		{"plain equality is typed", "price=250&is_essential=true", store.ProductFilter{
+			"price":        map[string]interface{}{"eq": 250},
+			"is_essential": map[string]interface{}{"eq": true},
+		}},
+		{"range", "price[gte]=100&price[lt]=500", store.ProductFilter{
+			"price": map[string]interface{}{"gte": 100, "lt": 500},
+		}},
+		{"in list", "vendor[in]=google,apple", store.ProductFilter{
+			"vendor": map[string]interface{}{"in": []interface{}{"google", "apple"}},
+		}},
+		{"negation", "currency[ne]=INR&vendor[nin]=acme", store.ProductFilter{
+			"currency": map[string]interface{}{"ne": "INR"},
+			"vendor":   map[string]interface{}{"nin": []interface{}{"acme"}},
+		}},
+		{"object id", "_id=" + string(id), store.ProductFilter{
+			"_id": map[string]interface{}{"eq": id},
+		}},
+		{"array element", "accessories=charger", store.ProductFilter{
+			"accessories": map[string]interface{}{"eq": "charger"},
+		}},
+		{"pagination params are ignored", "limit=5&sort=price&cursor=abc", store.ProductFilter{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := url.ParseQuery(tt.query)
+			assert.Nil(t, err)
+			filter, err := buildProductFilter(q)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, filter)
+		})
+	}
+}
+
+func TestBuildProductFilterRejects(t *testing.T) {
+	for _, query := range []string{
+		"password=secret",
+		"price[regex]=1",
+		"price=cheap",
+		"price[in]=1,two",
+		"is_essential[gt]=true",
+		"_id=not-an-id",
+		"price[gte=1",
+	} {
+		t.Run(query, func(t *testing.T) {
+			q, err := url.ParseQuery(query)
+			assert.Nil(t, err)
+			_, err = buildProductFilter(q)
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestFindProductsInjection(t *testing.T) {
+	rejected := []struct {
+		query string
+		field string
+	}{
+		{"$where=sleep(1000)", "$where"},
+		{"%24where=this.price%3E0", "$where"},
+		{"$or[0][vendor]=google", "$or[0][vendor]"},
+		{"vendor[$ne]=google", "vendor[$ne]"},
+		{"vendor[$regex]=.*", "vendor[$regex]"},
+		{"vendor[regex]=.*", "vendor[regex]"},
+		{"vendor[where]=1", "vendor[where]"},
+		{"price[gt][$where]=1", "price[gt][$where]"},
+		{"price[$gt]=0", "price[$gt]"},
+		{"vendor.$where=1", "vendor.$where"},
+		{"password=secret", "password"},
+		{"vendor=google&vendor=apple", "vendor"},
+	}
+	for _, tt := range rejected {
+		t.Run(tt.query, func(t *testing.T) {
+			var msg problemBody
+			rc := &recordingCollection{}
+			req := httptest.NewRequest(http.MethodGet, "/products?"+tt.query, nil)
+			res := httptest.NewRecorder()
+			e := echo.New()
+			ph := ProductHandler{Products: &mongostore.Products{Col: rc}}
+			serve(ph.GetProducts, e.NewContext(req, res))
+			assert.Equal(t, http.StatusBadRequest, res.Code)
+			assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &msg))
+			assert.Equal(t, tt.field, msg.Field)
+			assert.Empty(t, rc.filters)
+		})
+	}
+
+	// operator-looking values are accepted but only ever reach mongo as strings
+	accepted := []url.Values{
+		{"vendor": {`{"$where":"sleep(1000)"}`}},
+		{"vendor": {"$regex"}},
+		{"vendor[in]": {`$where,{"$gt":""}`}},
+		{"product_name[ne]": {`{"$ne":null}`}},
+	}
+	for _, q := range accepted {
+		t.Run(q.Encode(), func(t *testing.T) {
+			rc := &recordingCollection{}
+			req := httptest.NewRequest(http.MethodGet, "/products?"+q.Encode(), nil)
+			res := httptest.NewRecorder()
+			e := echo.New()
+			ph := ProductHandler{Products: &mongostore.Products{Col: rc}}
+			err := ph.GetProducts(e.NewContext(req, res))
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusOK, res.Code)
+			assert.NotEmpty(t, rc.filters)
+			for _, filter := range rc.filters {
+				assertOnlyKnownOperators(t, filter)
+			}
+		})
+	}
+
+	t.Run("tampered cursor values stay typed", func(t *testing.T) {
+		keys, err := parseSort("price")
+		assert.Nil(t, err)
+		token := encodeCursorValues(t, cursorNext, "price,_id", `{"$where":"1"}`, `"000000000000000000000000"`)
+		_, _, err = decodeCursor(token, keys)
+		assert.NotNil(t, err)
+	})
+}
+
+func TestFilterProblem(t *testing.T) {
+	p := filterProblem(fmt.Errorf("building: %w", &filterError{Field: "colour", Reason: "unknown filter field"}))
+	assert.Equal(t, http.StatusBadRequest, p.Status)
+	assert.Equal(t, "colour", p.Extensions["field"])
+	p = filterProblem(errors.New("boom"))
+	assert.Equal(t, http.StatusInternalServerError, p.Status, "other errors are not blamed on the query")
+}
+
+func encodeCursorValues(t *testing.T, dir, sort string, values ...string) string {
+	pc := pageCursor{Dir: dir, Sort: sort}
+	for _, v := range values {
+		pc.Values = append(pc.Values, json.RawMessage(v))
+	}
+	b, err := json.Marshal(pc)
+	assert.Nil(t, err)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
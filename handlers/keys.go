@@ -0,0 +1,21 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nitin06890/go-rest-api/keyring"
+)
+
+// KeysHandler publishes the keys access tokens are signed with
+type KeysHandler struct {
+	Keys *keyring.Ring
+}
+
+// GetJWKS returns the public signing keys as a JWK set
+func (h *KeysHandler) GetJWKS(c echo.Context) error {
+	c.Response().Header().Set(echo.HeaderCacheControl, fmt.Sprintf("public, max-age=%d", int64(keyring.JWKSCacheTTL/time.Second)))
+	return c.JSON(http.StatusOK, h.Keys.JWKS())
+}
@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/nitin06890/go-rest-api/events"
+	"github.com/nitin06890/go-rest-api/problem"
+	"github.com/nitin06890/go-rest-api/store"
+)
+
+// throttle is a key failed logins are counted against, and the number of
+// failures that locks it out
+type throttle struct {
+	key       string
+	threshold int
+}
+
+// IPExtractor returns how the address of a client is read, which keys the
+// throttles of the logins. Forwarding headers are only trusted from the
+// proxies of the CIDR ranges, and ignored when there are none, so clients
+// cannot pick the address they are throttled by.
+func IPExtractor(trustedProxies []string) (echo.IPExtractor, error) {
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false),
+	}
+	for _, cidr := range trustedProxies {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy range %q: %w", cidr, err)
+		}
+		options = append(options, echo.TrustIPRange(ipNet))
+	}
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
+
+// loginThrottles returns the throttles of the account and of the address,
+// the account first
+func loginThrottles(username, ip string) []throttle {
+	return []throttle{
+		{key: "user:" + username, threshold: prop.LockoutThreshold},
+		{key: "ip:" + ip, threshold: prop.LockoutIPThreshold},
+	}
+}
+
+// lockedOut returns how long the longest lockout of the throttles lasts,
+// zero when none is locked out
+func lockedOut(ctx context.Context, throttles []throttle, attempts LoginAttemptRepository) (time.Duration, *problem.Problem) {
+	keys := make([]string, 0, len(throttles))
+	for _, t := range throttles {
+		keys = append(keys, t.key)
+	}
+	now := time.Now().UTC()
+	locked, err := attempts.Locked(ctx, keys, now)
+	if err != nil {
+		log.Errorf("Unable to find the login attempts: %v", err)
+		return 0, problem.New(http.StatusInternalServerError, "Unable to check the login attempts")
+	}
+	var wait time.Duration
+	for _, a := range locked {
+		if d := a.LockedUntil.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+// backoff returns how long the nth lockout of a key lasts. It doubles with
+// every lockout up to the maximum delay.
+func backoff(n int) time.Duration {
+	d := prop.LockoutBaseDelay
+	for i := 1; i < n && d < prop.LockoutMaxDelay; i++ {
+		d *= 2
+	}
+	if d > prop.LockoutMaxDelay {
+		d = prop.LockoutMaxDelay
+	}
+	return d
+}
+
+// recordFailure counts a failed login against the throttle and locks it out
+// when it reaches its threshold. It returns the attempts and whether this
+// failure locked the throttle out.
+func recordFailure(ctx context.Context, t throttle, attempts LoginAttemptRepository) (store.LoginAttempts, bool, *problem.Problem) {
+	now := time.Now().UTC()
+	a, err := attempts.AddFailure(ctx, t.key, now.Add(prop.LockoutReset))
+	if err != nil {
+		log.Errorf("Unable to record the failed login of %s: %v", t.key, err)
+		return a, false, problem.New(http.StatusInternalServerError, "Unable to record the login attempt")
+	}
+	if t.threshold <= 0 || a.Failures < t.threshold {
+		return a, false, nil
+	}
+
+	// only the request that resets the failures locks out, whatever the replica
+	a.Failures, a.Lockouts = 0, a.Lockouts+1
+	a.LockedUntil = now.Add(backoff(a.Lockouts))
+	a.ExpiresAt = a.LockedUntil.Add(prop.LockoutReset)
+	locked, err := attempts.LockOut(ctx, t.key, t.threshold, a.LockedUntil, a.ExpiresAt)
+	if err != nil {
+		log.Errorf("Unable to lock %s out: %v", t.key, err)
+		return a, false, problem.New(http.StatusInternalServerError, "Unable to record the login attempt")
+	}
+	return a, locked, nil
+}
+
+// clearLoginFailures forgets the failed logins of the throttle
+func clearLoginFailures(ctx context.Context, t throttle, attempts LoginAttemptRepository) *problem.Problem {
+	if err := attempts.Clear(ctx, t.key); err != nil {
+		log.Errorf("Unable to clear the failed logins of %s: %v", t.key, err)
+		return problem.New(http.StatusInternalServerError, "Unable to record the login attempt")
+	}
+	return nil
+}
+
+// recordLoginFailure counts a failed login against every throttle and emits
+// an event for each lockout. It returns how long the login is locked out
+// for, zero when it isn't.
+func (h *UsersHandler) recordLoginFailure(ctx context.Context, throttles []throttle, ip string) (time.Duration, *problem.Problem) {
+	var wait time.Duration
+	for _, t := range throttles {
+		a, locked, httpErr := recordFailure(ctx, t, h.Attempts)
+		if httpErr != nil {
+			return 0, httpErr
+		}
+		if !locked {
+			continue
+		}
+		d := time.Until(a.LockedUntil)
+		if d > wait {
+			wait = d
+		}
+		scope, subject, _ := strings.Cut(t.key, ":")
+		log.Warnf("Locked %s out until %s after too many failed logins", t.key, a.LockedUntil.Format(time.RFC3339))
+		err := h.Events.Emit(ctx, events.Event{
+			Type:    events.TypeLockout,
+			Subject: subject,
+			IP:      ip,
+			Time:    time.Now().UTC(),
+			Data: map[string]interface{}{
+				"scope":        scope,
+				"lockouts":     a.Lockouts,
+				"locked_until": a.LockedUntil,
+			},
+		})
+		if err != nil {
+			// the lockout holds even if nobody hears about it
+			log.Errorf("Unable to emit the lockout of %s: %v", t.key, err)
+		}
+	}
+	return wait, nil
+}
+
+// tooManyAttempts returns the problem of a login that is locked out and
+// tells the client when to retry
+func tooManyAttempts(c echo.Context, wait time.Duration) *problem.Problem {
+	seconds := int(math.Ceil(wait.Seconds()))
+	c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(seconds))
+	return problem.New(http.StatusTooManyRequests, "Too many failed login attempts, try again later").
+		With("retry_after", seconds)
+}
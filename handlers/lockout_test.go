@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nitin06890/go-rest-api/events"
+	"github.com/nitin06890/go-rest-api/store"
+	mongostore "github.com/nitin06890/go-rest-api/store/mongo"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestBackoff(t *testing.T) {
+	saved := prop
+	t.Cleanup(func() { prop = saved })
+	prop.LockoutBaseDelay, prop.LockoutMaxDelay = time.Minute, 5*time.Minute
+	assert.Equal(t, time.Minute, backoff(1))
+	assert.Equal(t, 2*time.Minute, backoff(2))
+	assert.Equal(t, 4*time.Minute, backoff(3))
+	assert.Equal(t, 5*time.Minute, backoff(4))
+	assert.Equal(t, 5*time.Minute, backoff(100))
+}
+
+func TestIPExtractor(t *testing.T) {
+	throttledIP := func(extract echo.IPExtractor, remote string, header http.Header) string {
+		e := echo.New()
+		e.IPExtractor = extract
+		req := httptest.NewRequest(http.MethodPost, "/auth", nil)
+		req.RemoteAddr = remote + ":4321"
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		c := e.NewContext(req, httptest.NewRecorder())
+		return loginThrottles("heidi@example.com", c.RealIP())[1].key
+	}
+	spoofed := http.Header{
+		echo.HeaderXForwardedFor: {"203.0.113.9"},
+		echo.HeaderXRealIP:       {"203.0.113.9"},
+	}
+
+	direct, err := IPExtractor(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "ip:192.0.2.1", throttledIP(direct, "192.0.2.1", nil))
+	assert.Equal(t, "ip:192.0.2.1", throttledIP(direct, "192.0.2.1", spoofed), "forwarding headers are ignored")
+
+	proxied, err := IPExtractor([]string{"10.0.0.0/8"})
+	assert.Nil(t, err)
+	assert.Equal(t, "ip:203.0.113.9", throttledIP(proxied, "10.1.2.3", spoofed))
+	assert.Equal(t, "ip:198.51.100.4", throttledIP(proxied, "10.1.2.3", http.Header{
+		echo.HeaderXForwardedFor: {"203.0.113.9, 198.51.100.4"},
+	}), "the addresses before the first untrusted one are ignored")
+	assert.Equal(t, "ip:192.0.2.1", throttledIP(proxied, "192.0.2.1", spoofed), "untrusted proxies are ignored")
+
+	_, err = IPExtractor([]string{"10.0.0.1"})
+	assert.NotNil(t, err)
+}
+
+func TestLockout(t *testing.T) {
+	ctx := context.Background()
+	e := echo.New()
+	saved := prop
+	prop.LockoutThreshold, prop.LockoutIPThreshold = 3, 5
+	prop.LockoutBaseDelay, prop.LockoutMaxDelay = time.Minute, time.Hour
+	users, sessions, attempts := db.Collection("lockout_users"), db.Collection("lockout_sessions"), db.Collection("lockout_attempts")
+	emitted := &events.Memory{}
+	uh := UsersHandler{Users: &mongostore.Users{Col: users}, Sessions: &mongostore.Sessions{Col: sessions}, Attempts: &mongostore.LoginAttempts{Col: attempts}, Keys: keys, Events: emitted}
+	t.Cleanup(func() {
+		prop = saved
+		users.Drop(ctx)
+		sessions.Drop(ctx)
+		attempts.Drop(ctx)
+	})
+
+	for _, email := range []string{"heidi@example.com", "ivan@example.com"} {
+		_, httpErr := insertUser(ctx, store.User{Email: email, Password: "qwertyuiop", Roles: []string{RoleCustomer}}, uh.Users)
+		assert.Nil(t, httpErr)
+	}
+	login := func(ip, email, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader(`{"username":"`+email+`","password":"`+password+`"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.RemoteAddr = ip + ":4321"
+		res := httptest.NewRecorder()
+		serve(uh.AuthnUser, e.NewContext(req, res))
+		return res
+	}
+	retryAfter := func(res *httptest.ResponseRecorder) int {
+		seconds, err := strconv.Atoi(res.Header().Get(echo.HeaderRetryAfter))
+		assert.Nil(t, err)
+		return seconds
+	}
+	unlock := func(key string) {
+		_, err := attempts.UpdateOne(ctx, bson.M{"_id": key}, bson.M{"$set": bson.M{"locked_until": time.Now().Add(-time.Second)}})
+		assert.Nil(t, err)
+	}
+
+	t.Run("a successful login clears the failures", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, login("192.0.2.1", "heidi@example.com", "wrongpassword").Code)
+		assert.Equal(t, http.StatusUnauthorized, login("192.0.2.1", "heidi@example.com", "wrongpassword").Code)
+		assert.Equal(t, http.StatusOK, login("192.0.2.1", "heidi@example.com", "qwertyuiop").Code)
+		assert.Equal(t, http.StatusUnauthorized, login("192.0.2.1", "heidi@example.com", "wrongpassword").Code)
+		assert.Equal(t, http.StatusUnauthorized, login("192.0.2.1", "heidi@example.com", "wrongpassword").Code)
+		assert.Empty(t, emitted.Events())
+	})
+
+	t.Run("too many failures lock the account out", func(t *testing.T) {
+		var msg problemBody
+		res := login("192.0.2.2", "heidi@example.com", "wrongpassword")
+		assert.Equal(t, http.StatusTooManyRequests, res.Code)
+		assert.InDelta(t, 60, retryAfter(res), 1)
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &msg))
+		assert.Equal(t, http.StatusTooManyRequests, msg.Status)
+
+		// even the right password is refused, from any address
+		res = login("192.0.2.3", "heidi@example.com", "qwertyuiop")
+		assert.Equal(t, http.StatusTooManyRequests, res.Code)
+		assert.NotEmpty(t, res.Header().Get(echo.HeaderRetryAfter))
+		assert.Equal(t, http.StatusOK, login("192.0.2.3", "ivan@example.com", "qwertyuiop").Code)
+
+		lockouts := emitted.Events()
+		assert.Len(t, lockouts, 1)
+		assert.Equal(t, events.TypeLockout, lockouts[0].Type)
+		assert.Equal(t, "heidi@example.com", lockouts[0].Subject)
+		assert.Equal(t, "192.0.2.2", lockouts[0].IP)
+		assert.Equal(t, "user", lockouts[0].Data["scope"])
+	})
+
+	t.Run("lockouts back off exponentially", func(t *testing.T) {
+		unlock("user:heidi@example.com")
+		for i := 0; i < 2; i++ {
+			assert.Equal(t, http.StatusUnauthorized, login("192.0.2.4", "heidi@example.com", "wrongpassword").Code)
+		}
+		res := login("192.0.2.4", "heidi@example.com", "wrongpassword")
+		assert.Equal(t, http.StatusTooManyRequests, res.Code)
+		assert.InDelta(t, 120, retryAfter(res), 1)
+		assert.Len(t, emitted.Events(), 2)
+	})
+
+	t.Run("too many failures lock the address out", func(t *testing.T) {
+		for i := 0; i < 4; i++ {
+			res := login("198.51.100.1", "nobody"+strconv.Itoa(i)+"@example.com", "wrongpassword")
+			assert.Equal(t, http.StatusBadRequest, res.Code)
+		}
+		res := login("198.51.100.1", "nobody4@example.com", "wrongpassword")
+		assert.Equal(t, http.StatusTooManyRequests, res.Code)
+		assert.Equal(t, http.StatusTooManyRequests, login("198.51.100.1", "ivan@example.com", "qwertyuiop").Code)
+		assert.Equal(t, http.StatusOK, login("198.51.100.2", "ivan@example.com", "qwertyuiop").Code)
+
+		lockouts := emitted.Events()
+		assert.Equal(t, "ip", lockouts[len(lockouts)-1].Data["scope"])
+		assert.Equal(t, "198.51.100.1", lockouts[len(lockouts)-1].Subject)
+	})
+}
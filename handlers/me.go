@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/nitin06890/go-rest-api/problem"
+	"github.com/nitin06890/go-rest-api/store"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// profileUpdate is the body of PATCH /me, absent members are left unchanged
+type profileUpdate struct {
+	Name *string `json:"name" validate:"omitempty,max=100"`
+}
+
+type passwordChange struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	NewPassword     string `json:"new_password" validate:"required,min=8,max=300"`
+}
+
+// findCurrentUser returns the user the access token was issued to
+func findCurrentUser(ctx context.Context, c echo.Context, users UserRepository) (store.User, *problem.Problem) {
+	username := currentUsername(c)
+	if username == "" {
+		log.Errorf("Access token without a user")
+		return store.User{}, problem.New(http.StatusUnauthorized, "Invalid access token")
+	}
+	user, err := users.FindByUsername(ctx, username)
+	if err != nil {
+		if err == store.ErrNotFound {
+			log.Errorf("User by %s doesn't exist", username)
+			return user, problem.New(http.StatusUnauthorized, "User doesn't exist")
+		}
+		log.Errorf("Unable to decode retrieved user: %v", err)
+		return user, problem.New(http.StatusUnprocessableEntity, "Unable to decode retrieved user")
+	}
+	return user, nil
+}
+
+// GetMe returns the profile of the current user
+func (h *UsersHandler) GetMe(c echo.Context) error {
+	user, err := findCurrentUser(c.Request().Context(), c, h.Users)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, newUserResource(user))
+}
+
+func modifyProfile(ctx context.Context, c echo.Context, reqBody io.Reader, users UserRepository) (store.User, *problem.Problem) {
+	var update profileUpdate
+	user, httpErr := findCurrentUser(ctx, c, users)
+	if httpErr != nil {
+		return user, httpErr
+	}
+	dec := json.NewDecoder(reqBody)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&update); err != nil {
+		log.Errorf("Unable to decode the profile update: %v", err)
+		return user, problem.New(http.StatusUnprocessableEntity, "Unable to decode the request body")
+	}
+	if err := v.Struct(update); err != nil {
+		log.Errorf("Unable to validate the profile update: %v", err)
+		return user, validationError("Unable to validate the profile", err)
+	}
+	if update.Name == nil {
+		return user, nil
+	}
+	user.Name = *update.Name
+	if err := users.Update(ctx, string(user.ID), store.UserUpdate{Name: &user.Name}); err != nil {
+		log.Errorf("Unable to update the profile: %v", err)
+		return user, problem.New(http.StatusInternalServerError, "Unable to update the profile")
+	}
+	return user, nil
+}
+
+// UpdateMe updates the profile of the current user. Roles and status are
+// managed by administrators and cannot be changed here.
+func (h *UsersHandler) UpdateMe(c echo.Context) error {
+	user, err := modifyProfile(c.Request().Context(), c, c.Request().Body, h.Users)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, newUserResource(user))
+}
+
+// setPassword stores the new password of the user and revokes their sessions
+func setPassword(ctx context.Context, user store.User, password string, h *UsersHandler) *problem.Problem {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Errorf("Unable to hash password: %+v", err)
+		return problem.New(http.StatusInternalServerError, "Unable to hash password")
+	}
+	hash := string(hashedPassword)
+	if err := h.Users.Update(ctx, string(user.ID), store.UserUpdate{Password: &hash}); err != nil {
+		log.Errorf("Unable to update the password: %v", err)
+		return problem.New(http.StatusInternalServerError, "Unable to update the password")
+	}
+	return revokeUserSessions(ctx, user.Email, h.Sessions)
+}
+
+// ChangePassword changes the password of the current user after checking
+// the current one. Every session of the user is revoked and a new one is
+// started for the caller.
+func (h *UsersHandler) ChangePassword(c echo.Context) error {
+	var req passwordChange
+	ctx := c.Request().Context()
+	if err := c.Bind(&req); err != nil {
+		log.Errorf("Unable to bind the password change: %v", err)
+		return problem.New(http.StatusBadRequest, "Unable to bind the password change")
+	}
+	if err := v.Struct(req); err != nil {
+		log.Errorf("Unable to validate the password change: %v", err)
+		return validationError("Unable to validate the password change", err)
+	}
+	user, httpErr := findCurrentUser(ctx, c, h.Users)
+	if httpErr != nil {
+		return httpErr
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.CurrentPassword)); err != nil {
+		log.Errorf("Invalid current password: %v", err)
+		return problem.New(http.StatusForbidden, "Current password is incorrect")
+	}
+	if httpErr := setPassword(ctx, user, req.NewPassword, h); httpErr != nil {
+		return httpErr
+	}
+	tokens, httpErr := h.issueTokens(ctx, c, store.User{ID: user.ID, Email: user.Email, Roles: user.AllRoles(), Status: user.Status, TOTP: user.TOTP})
+	if httpErr != nil {
+		return httpErr
+	}
+	return c.JSON(http.StatusOK, tokens)
+}
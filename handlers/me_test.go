@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nitin06890/go-rest-api/events"
+	"github.com/nitin06890/go-rest-api/store"
+	mongostore "github.com/nitin06890/go-rest-api/store/mongo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMe(t *testing.T) {
+	ctx := context.Background()
+	e := echo.New()
+	users, sessions, attempts := db.Collection("me_users"), db.Collection("me_sessions"), db.Collection("me_attempts")
+	uh := UsersHandler{Users: &mongostore.Users{Col: users}, Sessions: &mongostore.Sessions{Col: sessions}, Attempts: &mongostore.LoginAttempts{Col: attempts}, Keys: keys, Events: &events.Memory{}}
+	t.Cleanup(func() {
+		users.Drop(ctx)
+		sessions.Drop(ctx)
+		attempts.Drop(ctx)
+	})
+
+	_, httpErr := insertUser(ctx, store.User{Email: "carol@example.com", Password: "qwertyuiop", Roles: []string{RoleCustomer}}, uh.Users)
+	assert.Nil(t, httpErr)
+	login := func(password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader(`{"username":"carol@example.com","password":"`+password+`"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		res := httptest.NewRecorder()
+		serve(uh.AuthnUser, e.NewContext(req, res))
+		return res
+	}
+	accessToken := login("qwertyuiop").Header().Get(headerAuthToken)
+	do := func(method, body, token string, handler echo.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/me", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(headerAuthToken, token)
+		res := httptest.NewRecorder()
+		serve(jwtMiddleware()(uh.RequireSession(handler)), e.NewContext(req, res))
+		return res
+	}
+
+	t.Run("get the profile", func(t *testing.T) {
+		var me userResource
+		res := do(http.MethodGet, "", accessToken, uh.GetMe)
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.NotContains(t, res.Body.String(), "password")
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &me))
+		assert.Equal(t, "carol@example.com", me.Username)
+		assert.Equal(t, []string{RoleCustomer}, me.Roles)
+	})
+
+	t.Run("update the profile", func(t *testing.T) {
+		var me userResource
+		res := do(http.MethodPatch, `{"name":"Carol"}`, accessToken, uh.UpdateMe)
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &me))
+		assert.Equal(t, "Carol", me.Name)
+
+		res = do(http.MethodPatch, `{"roles":["admin"]}`, accessToken, uh.UpdateMe)
+		assert.Equal(t, http.StatusUnprocessableEntity, res.Code)
+		res = do(http.MethodPatch, `{"name":"`+strings.Repeat("a", 101)+`"}`, accessToken, uh.UpdateMe)
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+	})
+
+	t.Run("change the password", func(t *testing.T) {
+		var msg problemBody
+		var tokens tokenPair
+		res := do(http.MethodPost, `{"current_password":"wrongpassword","new_password":"asdfghjkl"}`, accessToken, uh.ChangePassword)
+		assert.Equal(t, http.StatusForbidden, res.Code)
+
+		res = do(http.MethodPost, `{"current_password":"qwertyuiop","new_password":"short"}`, accessToken, uh.ChangePassword)
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &msg))
+		assert.Equal(t, []fieldError{{Field: "new_password", Rule: "min", Param: "8"}}, msg.Errors)
+
+		res = do(http.MethodPost, `{"current_password":"qwertyuiop","new_password":"asdfghjkl"}`, accessToken, uh.ChangePassword)
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &tokens))
+
+		// existing tokens are revoked, the ones returned keep working
+		assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "", accessToken, uh.GetMe).Code)
+		assert.Equal(t, http.StatusOK, do(http.MethodGet, "", tokens.AccessToken, uh.GetMe).Code)
+		assert.Equal(t, http.StatusUnauthorized, login("qwertyuiop").Code)
+		assert.Equal(t, http.StatusOK, login("asdfghjkl").Code)
+	})
+}
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/nitin06890/go-rest-api/store"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+
+	cursorNext = "n"
+	cursorPrev = "p"
+)
+
+// paginationParams are the query parameters that control paging rather than filtering
+var paginationParams = map[string]bool{"limit": true, "sort": true, "cursor": true, "after": true}
+
+// parseSort parses a sort specification such as "price,-product_name".
+// The _id field is always appended as a tie breaker so the order is total.
+func parseSort(spec string) ([]store.SortKey, error) {
+	var keys []store.SortKey
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		desc := strings.HasPrefix(part, "-")
+		name := strings.TrimPrefix(strings.TrimPrefix(part, "-"), "+")
+		field, ok := store.ProductFields[name]
+		if !ok || !field.Sortable {
+			return nil, errors.New("cannot sort by " + name)
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		keys = append(keys, store.SortKey{Field: field, Desc: desc})
+	}
+	if !seen["_id"] {
+		keys = append(keys, store.SortKey{Field: store.ProductFields["_id"]})
+	}
+	return keys, nil
+}
+
+func sortSpec(keys []store.SortKey) string {
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		if k.Desc {
+			parts[i] = "-" + k.Field.Name
+		} else {
+			parts[i] = k.Field.Name
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// pageCursor is the decoded form of the opaque cursor handed out to clients
+type pageCursor struct {
+	Dir    string            `json:"d"`
+	Sort   string            `json:"s"`
+	Values []json.RawMessage `json:"v"`
+}
+
+func encodeCursor(dir string, keys []store.SortKey, p store.Product) string {
+	pc := pageCursor{Dir: dir, Sort: sortSpec(keys)}
+	rv := reflect.ValueOf(p)
+	for _, k := range keys {
+		raw, _ := json.Marshal(rv.Field(k.Field.Index).Interface())
+		pc.Values = append(pc.Values, raw)
+	}
+	b, _ := json.Marshal(pc)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor decodes a cursor and converts its values to the types of the
+// sort fields, so a tampered cursor can only ever carry plain values.
+func decodeCursor(token string, keys []store.SortKey) (string, []interface{}, error) {
+	errInvalid := errors.New("invalid cursor")
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", nil, errInvalid
+	}
+	var pc pageCursor
+	if err := json.Unmarshal(b, &pc); err != nil {
+		return "", nil, errInvalid
+	}
+	if pc.Dir != cursorNext && pc.Dir != cursorPrev {
+		return "", nil, errInvalid
+	}
+	if pc.Sort != sortSpec(keys) || len(pc.Values) != len(keys) {
+		return "", nil, errors.New("cursor does not match the requested sort")
+	}
+	values := make([]interface{}, len(keys))
+	for i, k := range keys {
+		v := reflect.New(k.Field.Type)
+		if err := json.Unmarshal(pc.Values[i], v.Interface()); err != nil {
+			return "", nil, errInvalid
+		}
+		values[i] = v.Elem().Interface()
+	}
+	return pc.Dir, values, nil
+}
+
+// offsetCursor is the cursor of result sets that cannot be paged by key,
+// such as search results ordered by relevance
+type offsetCursor struct {
+	Offset int64 `json:"o"`
+}
+
+func encodeOffsetCursor(offset int64) string {
+	b, _ := json.Marshal(offsetCursor{Offset: offset})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeOffsetCursor(token string) (int64, error) {
+	var oc offsetCursor
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || json.Unmarshal(b, &oc) != nil || oc.Offset < 0 {
+		return 0, errors.New("invalid cursor")
+	}
+	return oc.Offset, nil
+}
+
+func parseLimit(q url.Values) (int64, error) {
+	s := q.Get("limit")
+	if s == "" {
+		return defaultPageLimit, nil
+	}
+	limit, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || limit < 1 {
+		return 0, errors.New("limit must be a positive integer")
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	return limit, nil
+}
+
+// pageLink returns the request URI with the cursor replaced by the given one
+func pageLink(u *url.URL, cursor string) string {
+	q := u.Query()
+	q.Del("after")
+	q.Set("cursor", cursor)
+	return u.Path + "?" + q.Encode()
+}
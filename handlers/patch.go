@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/nitin06890/go-rest-api/jsonpatch"
+	"github.com/nitin06890/go-rest-api/problem"
+	"github.com/nitin06890/go-rest-api/store"
+)
+
+// applyPatch applies a merge patch or a JSON patch, depending on the content type
+func applyPatch(contentType string, doc, patch []byte) ([]byte, *problem.Problem) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	var patched []byte
+	var err error
+	switch mediaType {
+	case jsonpatch.MIMEMergePatch:
+		patched, err = jsonpatch.MergePatch(doc, patch)
+	case jsonpatch.MIMEJSONPatch:
+		patched, err = jsonpatch.Apply(doc, patch)
+	default:
+		log.Errorf("Unsupported patch media type: %s", contentType)
+		return nil, problem.New(http.StatusUnsupportedMediaType, "Patch must be "+jsonpatch.MIMEMergePatch+" or "+jsonpatch.MIMEJSONPatch)
+	}
+	if errors.Is(err, jsonpatch.ErrTestFailed) {
+		log.Errorf("Unable to apply the patch: %v", err)
+		return nil, problem.New(http.StatusConflict, err.Error())
+	}
+	if err != nil {
+		log.Errorf("Unable to apply the patch: %v", err)
+		return nil, problem.New(http.StatusBadRequest, err.Error())
+	}
+	return patched, nil
+}
+
+// productChanges returns the fields, by stored name, to set and to unset to
+// turn the stored product into the patched one. storedFields and
+// patchedFields hold the top level keys of both documents, so fields
+// removed by the patch are unset.
+func productChanges(stored, patched store.Product, storedFields, patchedFields map[string]json.RawMessage) (map[string]interface{}, []string) {
+	set := make(map[string]interface{})
+	var unset []string
+	sv, pv := reflect.ValueOf(stored), reflect.ValueOf(patched)
+	for name, f := range store.ProductFields {
+		if name == "_id" {
+			continue
+		}
+		if _, ok := patchedFields[f.JSONName]; !ok {
+			if _, ok := storedFields[f.JSONName]; ok {
+				unset = append(unset, name)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(sv.Field(f.Index).Interface(), pv.Field(f.Index).Interface()) {
+			set[name] = pv.Field(f.Index).Interface()
+		}
+	}
+	return set, unset
+}
+
+func patchProduct(ctx context.Context, id, contentType, ifMatch string, reqBody io.Reader, products ProductRepository) (store.Product, *problem.Problem) {
+	stored, httpErr := findProduct(ctx, id, products)
+	if httpErr != nil {
+		return stored, httpErr
+	}
+	if httpErr := checkIfMatch(ifMatch, stored); httpErr != nil {
+		log.Errorf("If-Match %s does not match product %s", ifMatch, id)
+		return stored, httpErr
+	}
+	patch, err := io.ReadAll(reqBody)
+	if err != nil {
+		log.Errorf("Unable to read the request body: %v", err)
+		return stored, problem.New(http.StatusBadRequest, "Unable to read the request body")
+	}
+	doc, err := json.Marshal(stored)
+	if err != nil {
+		log.Errorf("Unable to encode the product: %v", err)
+		return stored, problem.New(http.StatusInternalServerError, "Unable to encode the product")
+	}
+	patchedDoc, httpErr := applyPatch(contentType, doc, patch)
+	if httpErr != nil {
+		return stored, httpErr
+	}
+
+	var storedFields, patchedFields map[string]json.RawMessage
+	var patched store.Product
+	dec := json.NewDecoder(bytes.NewReader(patchedDoc))
+	dec.DisallowUnknownFields()
+	_ = json.Unmarshal(doc, &storedFields)
+	if err := json.Unmarshal(patchedDoc, &patchedFields); err != nil || dec.Decode(&patched) != nil {
+		log.Errorf("Unable to decode the patched product: %s", patchedDoc)
+		return stored, problem.New(http.StatusUnprocessableEntity, "Patched document is not a valid product")
+	}
+	if patched.ID != stored.ID {
+		log.Errorf("Patch modifies the product id")
+		return stored, problem.New(http.StatusBadRequest, "_id cannot be modified").With("field", "_id")
+	}
+	if patched.Version != stored.Version {
+		log.Errorf("Patch modifies the product version")
+		return stored, problem.New(http.StatusBadRequest, "version cannot be modified").With("field", "version")
+	}
+	if err := v.Struct(patched); err != nil {
+		log.Errorf("unable to validate the struct : %v", err)
+		return stored, validationError("Unable to validate the product", err)
+	}
+
+	if set, unset := productChanges(stored, patched, storedFields, patchedFields); len(set) == 0 && len(unset) == 0 {
+		return patched, nil
+	}
+	patched.Version = stored.Version + 1
+	set, unset := productChanges(stored, patched, storedFields, patchedFields)
+	err = products.Patch(ctx, string(stored.ID), stored.Version, set, unset)
+	if err == store.ErrConflict {
+		log.Errorf("Product %s was modified concurrently", id)
+		return stored, lostUpdate(ifMatch)
+	}
+	if err != nil {
+		log.Errorf("Unable to update the product : %v", err)
+		return stored, problem.New(http.StatusInternalServerError, "Unable to update the product")
+	}
+	return patched, nil
+}
+
+// PatchProduct partially updates a product with a JSON Merge Patch or a JSON Patch
+func (h *ProductHandler) PatchProduct(c echo.Context) error {
+	req := c.Request()
+	product, err := patchProduct(c.Request().Context(), c.Param("id"), req.Header.Get(echo.HeaderContentType), req.Header.Get(headerIfMatch), req.Body, h.Products)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set(headerETag, productETag(product))
+	return c.JSON(http.StatusOK, product)
+}
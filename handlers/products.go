@@ -3,198 +3,300 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
-
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/gommon/log"
-	"github.com/nitin06890/go-rest-api/dbiface"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
+	"github.com/nitin06890/go-rest-api/problem"
+	"github.com/nitin06890/go-rest-api/store"
 )
 
-// Product describes an electronic product
-type Product struct {
-	ID          primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
-	Name        string             `json:"product_name" bson:"product_name" validate:"required,max=10"`
-	Price       int                `json:"price" bson:"price" validate:"required,max=1000"`
-	Currency    string             `json:"currency" bson:"currency" validate:"required,len=3"`
-	Discount    int                `json:"discount" bson:"discount"`
-	Vendor      string             `json:"vendor" bson:"vendor" validate:"required"`
-	Accessories []string           `json:"accessories,omitempty" bson:"accessories,omitempty"`
-	IsEssential bool               `json:"is_essential" bson:"is_essential"`
-}
-
 // ProductHandler handles product related requests
 type ProductHandler struct {
-	Col dbiface.CollectionAPI
+	Products ProductRepository
+	// CacheTTL is how long product reads are cached. When they are, clients
+	// may keep their copies as long. Zero sends no Cache-Control.
+	CacheTTL time.Duration
+}
+
+// setCacheControl lets clients keep a product read for the TTL of the cache.
+// Every replica may already serve reads that old, since it only clears its
+// own cache on writes, so a client copy is never staler than a fresh read
+// could be. Once the copy is older it must be revalidated with its ETag.
+// Reads are private so shared caches, which no write clears, don't keep them.
+func (h *ProductHandler) setCacheControl(c echo.Context) {
+	if h.CacheTTL > 0 {
+		c.Response().Header().Set(headerCacheControl,
+			fmt.Sprintf("private, max-age=%d, must-revalidate", int64(h.CacheTTL/time.Second)))
+	}
+}
+
+type productsPage struct {
+	Data  []store.Product `json:"data"`
+	Total int64           `json:"total"`
+	Next  string          `json:"next,omitempty"`
+	Prev  string          `json:"prev,omitempty"`
+
+	nextCursor string
+	prevCursor string
 }
 
-func findProducts(ctx context.Context, q url.Values, col dbiface.CollectionAPI) ([]Product, *echo.HTTPError) {
-	var products []Product
-	filter := make(map[string]interface{})
-	for k, v := range q {
-		filter[k] = v[0]
+func findProducts(ctx context.Context, q url.Values, products ProductRepository) (productsPage, *problem.Problem) {
+	page := productsPage{Data: []store.Product{}}
+	filter, err := buildProductFilter(q)
+	if err != nil {
+		log.Errorf("Invalid filter: %v", err)
+		return page, filterProblem(err)
+	}
+	limit, err := parseLimit(q)
+	if err != nil {
+		log.Errorf("Invalid limit: %v", err)
+		return page, problem.InvalidQuery("limit", err.Error())
+	}
+	keys, err := parseSort(q.Get("sort"))
+	if err != nil {
+		log.Errorf("Invalid sort: %v", err)
+		return page, problem.InvalidQuery("sort", err.Error())
+	}
+
+	page.Total, err = products.Count(ctx, filter)
+	if err != nil {
+		log.Errorf("Unable to count the products: %v", err)
+		return page, problem.New(http.StatusInternalServerError, "Unable to count the products")
 	}
-	if filter["_id"] != nil {
-		id, err := primitive.ObjectIDFromHex(filter["_id"].(string))
+
+	// fetch one extra product to find out whether there is another page
+	req := store.ProductPageRequest{Sort: keys, Limit: limit + 1}
+	token := q.Get("cursor")
+	if token == "" {
+		token = q.Get("after")
+	}
+	dir := cursorNext
+	if token != "" {
+		dir, req.After, err = decodeCursor(token, keys)
 		if err != nil {
-			log.Errorf("Unable to convert id to object id: %v", err)
-			return products, echo.NewHTTPError(http.StatusInternalServerError, errorMessage{Message: "Unable to convert id to object id"})
+			log.Errorf("Unable to decode the cursor: %v", err)
+			return page, problem.InvalidQuery("cursor", err.Error())
 		}
-		filter["_id"] = id
+		req.Backwards = dir == cursorPrev
 	}
-	cursor, err := col.Find(ctx, bson.M(filter))
+
+	page.Data, err = products.List(ctx, filter, req)
 	if err != nil {
 		log.Errorf("Unable to find the products: %v", err)
-		return products, echo.NewHTTPError(http.StatusNotFound, errorMessage{Message: "Unable to find the products"})
+		return page, problem.New(http.StatusNotFound, "Unable to find the products")
 	}
-	err = cursor.All(ctx, &products)
-	if err != nil {
-		log.Errorf("Unable to decode the cursor to products: %v", err)
-		return products, echo.NewHTTPError(http.StatusUnprocessableEntity, errorMessage{Message: "Unable to decode the cursor to products"})
+
+	hasMore := int64(len(page.Data)) > limit
+	if hasMore {
+		page.Data = page.Data[:limit]
+	}
+	if dir == cursorPrev {
+		for i, j := 0, len(page.Data)-1; i < j; i, j = i+1, j-1 {
+			page.Data[i], page.Data[j] = page.Data[j], page.Data[i]
+		}
+	}
+	if len(page.Data) == 0 {
+		return page, nil
 	}
-	return products, nil
+	if hasMore || dir == cursorPrev {
+		page.nextCursor = encodeCursor(cursorNext, keys, page.Data[len(page.Data)-1])
+	}
+	if (hasMore && dir == cursorPrev) || (token != "" && dir == cursorNext) {
+		page.prevCursor = encodeCursor(cursorPrev, keys, page.Data[0])
+	}
+	return page, nil
 }
 
-// GetProducts returns all the products
+// GetProducts returns a page of products
 func (h *ProductHandler) GetProducts(c echo.Context) error {
-	products, err := findProducts(context.Background(), c.QueryParams(), h.Col)
+	page, err := findProducts(c.Request().Context(), c.QueryParams(), h.Products)
 	if err != nil {
-		return c.JSON(err.Code, err.Message)
+		return err
+	}
+	if page.nextCursor != "" {
+		page.Next = pageLink(c.Request().URL, page.nextCursor)
 	}
-	return c.JSON(http.StatusOK, products)
+	if page.prevCursor != "" {
+		page.Prev = pageLink(c.Request().URL, page.prevCursor)
+	}
+	body, er := json.Marshal(page)
+	if er != nil {
+		log.Errorf("Unable to encode the products: %v", er)
+		return problem.New(http.StatusInternalServerError, "Unable to encode the products")
+	}
+	etag := contentETag(body)
+	c.Response().Header().Set(headerETag, etag)
+	h.setCacheControl(c)
+	if etagMatches(c.Request().Header.Get(headerIfNoneMatch), etag, true) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.JSONBlob(http.StatusOK, body)
 }
 
-func findProduct(ctx context.Context, id string, col dbiface.CollectionAPI) (Product, *echo.HTTPError) {
-	var product Product
-	docID, err := primitive.ObjectIDFromHex(id)
-	if err != nil {
+func findProduct(ctx context.Context, id string, products ProductRepository) (store.Product, *problem.Problem) {
+	product, err := products.FindByID(ctx, id)
+	if err == store.ErrInvalidID {
 		log.Errorf("cannot convert to ObjectID :%v", err)
-		return product, echo.NewHTTPError(http.StatusInternalServerError, errorMessage{Message: "Unable to convert id to object id"})
+		return product, problem.New(http.StatusInternalServerError, "Unable to convert id to object id")
 	}
-	filter := bson.M{"_id": docID}
-	res := col.FindOne(ctx, filter)
-	if err := res.Decode(&product); err != nil {
+	if err != nil {
 		log.Errorf("unable to decode to product :%v", err)
-		return product, echo.NewHTTPError(http.StatusUnprocessableEntity, errorMessage{Message: "Unable to find the product"})
+		return product, problem.New(http.StatusUnprocessableEntity, "Unable to find the product")
 	}
 	return product, nil
 }
 
 // GetProduct returns a product
 func (h *ProductHandler) GetProduct(c echo.Context) error {
-	product, err := findProduct(context.Background(), c.Param("id"), h.Col)
+	product, err := findProduct(c.Request().Context(), c.Param("id"), h.Products)
 	if err != nil {
-		return c.JSON(err.Code, err.Message)
+		return err
+	}
+	etag := productETag(product)
+	c.Response().Header().Set(headerETag, etag)
+	h.setCacheControl(c)
+	if etagMatches(c.Request().Header.Get(headerIfNoneMatch), etag, true) {
+		return c.NoContent(http.StatusNotModified)
 	}
 	return c.JSON(http.StatusOK, product)
 }
 
-func deleteProduct(ctx context.Context, id string, col dbiface.CollectionAPI) (int64, *echo.HTTPError) {
-	docID, err := primitive.ObjectIDFromHex(id)
-	if err != nil {
+func deleteProduct(ctx context.Context, id, ifMatch string, products ProductRepository) (int64, *problem.Problem) {
+	var version *int64
+	if ifMatch != "" {
+		product, httpErr := findProduct(ctx, id, products)
+		if httpErr != nil {
+			return 0, httpErr
+		}
+		if httpErr := checkIfMatch(ifMatch, product); httpErr != nil {
+			log.Errorf("If-Match %s does not match product %s", ifMatch, id)
+			return 0, httpErr
+		}
+		version = &product.Version
+	}
+	deleted, err := products.Delete(ctx, id, version)
+	if err == store.ErrInvalidID {
 		log.Errorf("cannot convert to ObjectID :%v", err)
-		return 0, echo.NewHTTPError(http.StatusInternalServerError, errorMessage{Message: "Unable to convert id to object id"})
+		return 0, problem.New(http.StatusInternalServerError, "Unable to convert id to object id")
 	}
-	filter := bson.M{"_id": docID}
-	res, err := col.DeleteOne(ctx, filter)
 	if err != nil {
 		log.Errorf("unable to delete the product :%v", err)
-		return 0, echo.NewHTTPError(http.StatusInternalServerError, errorMessage{Message: "Unable to delete the product"})
+		return 0, problem.New(http.StatusInternalServerError, "Unable to delete the product")
 	}
-	return res.DeletedCount, nil
+	if !deleted {
+		if ifMatch != "" {
+			log.Errorf("Product %s was modified before it could be deleted", id)
+			return 0, lostUpdate(ifMatch)
+		}
+		return 0, nil
+	}
+	return 1, nil
 }
 
 // DeleteProduct deletes a product
 func (h *ProductHandler) DeleteProduct(c echo.Context) error {
-	delCount, err := deleteProduct(context.Background(), c.Param("id"), h.Col)
+	delCount, err := deleteProduct(c.Request().Context(), c.Param("id"), c.Request().Header.Get(headerIfMatch), h.Products)
 	if err != nil {
-		return c.JSON(err.Code, err.Message)
+		return err
 	}
 	return c.JSON(http.StatusOK, delCount)
 }
 
-func insertProducts(ctx context.Context, products []Product, col dbiface.CollectionAPI) ([]interface{}, *echo.HTTPError) {
-	var insertedIds []interface{}
-
-	for _, product := range products {
-		product.ID = primitive.NewObjectID()
-		insertID, err := col.InsertOne(ctx, product)
-		if err != nil {
-			log.Errorf("Unable to insert to database: %v", err)
-			return nil, echo.NewHTTPError(http.StatusInternalServerError, errorMessage{Message: "Unable to insert to database"})
-		}
-		insertedIds = append(insertedIds, insertID.InsertedID)
-	}
-	return insertedIds, nil
-}
-
+// CreateProducts creates a batch of products. By default the batch is
+// validated as a whole and inserted in order; atomic=true inserts it in a
+// transaction and ordered=false inserts every valid product and reports
+// the outcome of each one with 207 Multi-Status.
 func (h *ProductHandler) CreateProducts(c echo.Context) error {
-	var products []Product
+	var products []store.Product
 
+	mode, er := parseBulkMode(c.QueryParams())
+	if er != nil {
+		log.Errorf("Invalid bulk mode: %v", er)
+		return problem.New(http.StatusBadRequest, er.Error())
+	}
 	c.Echo().Validator = &ProductValidator{validator: v}
 	if err := c.Bind(&products); err != nil {
 		log.Errorf("Unable to bind the request: %v", err)
-		return c.JSON(http.StatusUnprocessableEntity, errorMessage{Message: "Unable to bind the request"})
+		return problem.New(http.StatusUnprocessableEntity, "Unable to bind the request")
+	}
+	if len(products) == 0 {
+		log.Errorf("No products to create")
+		return problem.New(http.StatusBadRequest, "No products to create")
 	}
-	for _, product := range products {
+	report := newBulkReport(len(products))
+	for i, product := range products {
 		if err := c.Validate(product); err != nil {
 			log.Errorf("Unable to validate the product %+v: %v", product, err)
-			return c.JSON(http.StatusBadRequest, errorMessage{Message: "Unable to validate the product"})
+			index := i
+			report.invalid(i, fieldErrors(err, &index))
 		}
 	}
-	IDs, err := insertProducts(context.Background(), products, h.Col)
+	status, err := insertProducts(c.Request().Context(), products, mode, &report, h.Products)
 	if err != nil {
-		return c.JSON(err.Code, err.Message)
+		return err
 	}
-
-	return c.JSON(http.StatusCreated, IDs)
+	switch status {
+	case http.StatusCreated:
+		return c.JSON(http.StatusCreated, report.insertedIDs())
+	case http.StatusMultiStatus:
+		return c.JSON(http.StatusMultiStatus, report)
+	case http.StatusBadRequest:
+		return problem.Validation("Unable to validate the products", report.fieldErrors()).With("items", report.Items)
+	}
+	return problem.New(status, "Unable to insert the products").With("items", report.Items)
 }
 
-func modifyProduct(ctx context.Context, id string, reqBody io.ReadCloser, collection dbiface.CollectionAPI) (Product, *echo.HTTPError) {
-	var product Product
-	// convert the id to ObjectID, if err return 400
-	docID, err := primitive.ObjectIDFromHex(id)
-	if err != nil {
-		log.Errorf("cannot convert to ObjectID :%v", err)
-		return product, echo.NewHTTPError(http.StatusInternalServerError, errorMessage{Message: "Unable to convert id to object id"})
+func modifyProduct(ctx context.Context, id, ifMatch string, reqBody io.ReadCloser, products ProductRepository) (store.Product, *problem.Problem) {
+	product, httpErr := findProduct(ctx, id, products)
+	if httpErr != nil {
+		return product, httpErr
 	}
-	filter := bson.M{"_id": docID}
-	res := collection.FindOne(ctx, filter)
-	if err := res.Decode(&product); err != nil {
-		log.Errorf("unable to decode to product :%v", err)
-		return product, echo.NewHTTPError(http.StatusUnprocessableEntity, errorMessage{Message: "Unable to find the product"})
+
+	// check the version the client last saw, if it doesn't match return 412
+	if httpErr := checkIfMatch(ifMatch, product); httpErr != nil {
+		log.Errorf("If-Match %s does not match product %s", ifMatch, id)
+		return product, httpErr
 	}
+	docID, version := product.ID, product.Version
 
 	//decode the request body to product, if err return 500
 	if err := json.NewDecoder(reqBody).Decode(&product); err != nil {
 		log.Errorf("unable to decode using reqbody : %v", err)
-		return product, echo.NewHTTPError(http.StatusUnprocessableEntity, errorMessage{Message: "Unable to decode the request body"})
+		return product, problem.New(http.StatusUnprocessableEntity, "Unable to decode the request body")
 	}
+	product.ID = docID
+	product.Version = version + 1
 
 	// validate the product, if err return 400
 	if err := v.Struct(product); err != nil {
 		log.Errorf("unable to validate the struct : %v", err)
-		return product, echo.NewHTTPError((http.StatusBadRequest), errorMessage{Message: "Unable to validate the product"})
+		return product, validationError("Unable to validate the product", err)
 	}
 
-	// update the product, if err return 500
-	_, err = collection.UpdateOne(ctx, filter, bson.M{"$set": product})
+	// update the product unless it changed since it was read, if err return 500
+	err := products.Update(ctx, product, version)
+	if err == store.ErrConflict {
+		log.Errorf("Product %s was modified concurrently", id)
+		return product, lostUpdate(ifMatch)
+	}
 	if err != nil {
 		log.Errorf("Unable to update the product : %v", err)
-		return product, echo.NewHTTPError(http.StatusInternalServerError, errorMessage{Message: "Unable to update the product"})
+		return product, problem.New(http.StatusInternalServerError, "Unable to update the product")
 	}
 	return product, nil
 }
 
 // UpdateProduct updates a product
 func (h *ProductHandler) UpdateProduct(c echo.Context) error {
-	product, err := modifyProduct(context.Background(), c.Param("id"), c.Request().Body, h.Col)
+	product, err := modifyProduct(c.Request().Context(), c.Param("id"), c.Request().Header.Get(headerIfMatch), c.Request().Body, h.Products)
 	if err != nil {
-		return c.JSON(err.Code, err.Message)
+		return err
 	}
+	c.Response().Header().Set(headerETag, productETag(product))
 	return c.JSON(http.StatusOK, product)
 }
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -8,9 +9,13 @@ import (
 	"strings"
 	"testing"
 
-	"github.com/stretchr/testify/assert"
-
 	"github.com/labstack/echo/v4"
+	"github.com/nitin06890/go-rest-api/dbiface"
+	"github.com/nitin06890/go-rest-api/memdb"
+	"github.com/nitin06890/go-rest-api/problem"
+	"github.com/nitin06890/go-rest-api/store"
+	mongostore "github.com/nitin06890/go-rest-api/store/mongo"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestProduct(t *testing.T) {
@@ -32,7 +37,7 @@ func TestProduct(t *testing.T) {
 		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 		e := echo.New()
 		c := e.NewContext(req, res)
-		h.Col = col
+		h.Products = &mongostore.Products{Col: col}
 		err := h.CreateProducts(c)
 		assert.Nil(t, err)
 		assert.Equal(t, http.StatusCreated, res.Code)
@@ -47,52 +52,80 @@ func TestProduct(t *testing.T) {
 	})
 
 	t.Run("get products", func(t *testing.T) {
-		var products []Product
+		var page productsPage
 		req := httptest.NewRequest(http.MethodGet, "/products", nil)
 		res := httptest.NewRecorder()
 		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 		e := echo.New()
 		c := e.NewContext(req, res)
-		h.Col = col
+		h.Products = &mongostore.Products{Col: col}
 		err := h.GetProducts(c)
 		assert.Nil(t, err)
 		assert.Equal(t, http.StatusOK, res.Code)
 
-		err = json.Unmarshal(res.Body.Bytes(), &products)
+		err = json.Unmarshal(res.Body.Bytes(), &page)
 		assert.Nil(t, err)
-		for _, product := range products {
+		assert.Equal(t, int64(1), page.Total)
+		for _, product := range page.Data {
 			assert.Equal(t, "googletalk", product.Name)
 		}
 	})
 
 	t.Run("get products with query params", func(t *testing.T) {
-		var products []Product
+		var page productsPage
 		req := httptest.NewRequest(http.MethodGet, "/products?currency=INR&vendor=google", nil)
 		res := httptest.NewRecorder()
 		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 		e := echo.New()
 		c := e.NewContext(req, res)
-		h.Col = col
+		h.Products = &mongostore.Products{Col: col}
 		err := h.GetProducts(c)
 		assert.Nil(t, err)
 		assert.Equal(t, http.StatusOK, res.Code)
 
-		err = json.Unmarshal(res.Body.Bytes(), &products)
+		err = json.Unmarshal(res.Body.Bytes(), &page)
 		assert.Nil(t, err)
-		for _, product := range products {
+		for _, product := range page.Data {
 			assert.Equal(t, "googletalk", product.Name)
 		}
 	})
 
+	t.Run("get products with typed filters", func(t *testing.T) {
+		var page productsPage
+		req := httptest.NewRequest(http.MethodGet, "/products?price[gte]=100&price[lt]=500&vendor[in]=google,apple", nil)
+		res := httptest.NewRecorder()
+		e := echo.New()
+		c := e.NewContext(req, res)
+		h.Products = &mongostore.Products{Col: col}
+		err := h.GetProducts(c)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, res.Code)
+
+		err = json.Unmarshal(res.Body.Bytes(), &page)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(1), page.Total)
+	})
+
+	t.Run("get products with an unknown filter", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/products?colour=red", nil)
+		res := httptest.NewRecorder()
+		e := echo.New()
+		c := e.NewContext(req, res)
+		h.Products = &mongostore.Products{Col: col}
+		serve(h.GetProducts, c)
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+		assert.Equal(t, problem.MIMEProblemJSON, res.Header().Get(echo.HeaderContentType))
+	})
+
 	t.Run("get a product", func(t *testing.T) {
-		var product Product
+		var product store.Product
 		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/products/%s", docID), nil)
 		res := httptest.NewRecorder()
 		e := echo.New()
 		c := e.NewContext(req, res)
-		c.SetParamNames("id")                      
-		c.SetParamValues(docID) 
-		h.Col = col
+		c.SetParamNames("id")
+		c.SetParamValues(docID)
+		h.Products = &mongostore.Products{Col: col}
 		err := h.GetProduct(c)
 		assert.Nil(t, err)
 		assert.Equal(t, http.StatusOK, res.Code)
@@ -102,7 +135,7 @@ func TestProduct(t *testing.T) {
 	})
 
 	t.Run("put product", func(t *testing.T) {
-		var product Product
+		var product store.Product
 		body := `
 		{
 			"product_name":"googletalk",
@@ -119,7 +152,7 @@ func TestProduct(t *testing.T) {
 		c := e.NewContext(req, res)
 		c.SetParamNames("id")
 		c.SetParamValues(docID)
-		h.Col = col
+		h.Products = &mongostore.Products{Col: col}
 		err := h.UpdateProduct(c)
 		assert.Nil(t, err)
 		assert.Equal(t, http.StatusOK, res.Code)
@@ -136,7 +169,7 @@ func TestProduct(t *testing.T) {
 		c := e.NewContext(req, res)
 		c.SetParamNames("id")
 		c.SetParamValues(docID)
-		h.Col = col
+		h.Products = &mongostore.Products{Col: col}
 		err := h.DeleteProduct(c)
 		assert.Nil(t, err)
 		assert.Equal(t, http.StatusOK, res.Code)
@@ -145,3 +178,286 @@ func TestProduct(t *testing.T) {
 		assert.Equal(t, int64(1), delCount)
 	})
 }
+
+func TestProductPagination(t *testing.T) {
+	body := `
+	[
+		{"product_name":"pixel","price":300,"currency":"USD","vendor":"pager"},
+		{"product_name":"nexus","price":100,"currency":"USD","vendor":"pager"},
+		{"product_name":"nest","price":200,"currency":"USD","vendor":"pager"}
+	]
+	`
+	req := httptest.NewRequest(http.MethodPost, "/products", strings.NewReader(body))
+	res := httptest.NewRecorder()
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	e := echo.New()
+	h.Products = &mongostore.Products{Col: col}
+	err := h.CreateProducts(e.NewContext(req, res))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, res.Code)
+
+	getPage := func(t *testing.T, target string) productsPage {
+		var page productsPage
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		res := httptest.NewRecorder()
+		err := h.GetProducts(e.NewContext(req, res))
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &page))
+		return page
+	}
+	names := func(page productsPage) []string {
+		var names []string
+		for _, p := range page.Data {
+			names = append(names, p.Name)
+		}
+		return names
+	}
+
+	var next string
+	t.Run("first page", func(t *testing.T) {
+		page := getPage(t, "/products?vendor=pager&limit=2&sort=-price")
+		assert.Equal(t, int64(3), page.Total)
+		assert.Equal(t, []string{"pixel", "nest"}, names(page))
+		assert.Empty(t, page.Prev)
+		assert.NotEmpty(t, page.Next)
+		next = page.Next
+	})
+
+	var prev string
+	t.Run("next page", func(t *testing.T) {
+		page := getPage(t, next)
+		assert.Equal(t, []string{"nexus"}, names(page))
+		assert.Empty(t, page.Next)
+		assert.NotEmpty(t, page.Prev)
+		prev = page.Prev
+	})
+
+	t.Run("previous page", func(t *testing.T) {
+		page := getPage(t, prev)
+		assert.Equal(t, []string{"pixel", "nest"}, names(page))
+		assert.Empty(t, page.Prev)
+		assert.NotEmpty(t, page.Next)
+	})
+
+	t.Run("cursor must match the sort", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, strings.Replace(next, "sort=-price", "sort=price", 1), nil)
+		res := httptest.NewRecorder()
+		serve(h.GetProducts, e.NewContext(req, res))
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+	})
+
+	t.Run("unknown sort field", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/products?sort=password", nil)
+		res := httptest.NewRecorder()
+		serve(h.GetProducts, e.NewContext(req, res))
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+	})
+}
+
+func TestPatchProduct(t *testing.T) {
+	var IDs []string
+	body := `
+	[{
+		"product_name":"chromebook",
+		"price":500,
+		"currency":"USD",
+		"vendor":"google",
+		"accessories":["charger"]
+	}]
+	`
+	req := httptest.NewRequest(http.MethodPost, "/products", strings.NewReader(body))
+	res := httptest.NewRecorder()
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	e := echo.New()
+	h.Products = &mongostore.Products{Col: col}
+	err := h.CreateProducts(e.NewContext(req, res))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, res.Code)
+	assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &IDs))
+	docID := IDs[0]
+
+	patch := func(contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/products/%s", docID), strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, contentType)
+		res := httptest.NewRecorder()
+		c := e.NewContext(req, res)
+		c.SetParamNames("id")
+		c.SetParamValues(docID)
+		serve(h.PatchProduct, c)
+		return res
+	}
+	stored := func() store.Product {
+		product, err := findProduct(context.Background(), docID, &mongostore.Products{Col: col})
+		assert.Nil(t, err)
+		return product
+	}
+
+	t.Run("merge patch", func(t *testing.T) {
+		res := patch("application/merge-patch+json", `{"price":450,"accessories":null}`)
+		assert.Equal(t, http.StatusOK, res.Code)
+		product := stored()
+		assert.Equal(t, 450, product.Price)
+		assert.Nil(t, product.Accessories)
+		assert.Equal(t, "USD", product.Currency)
+	})
+
+	t.Run("json patch", func(t *testing.T) {
+		res := patch("application/json-patch+json", `[
+			{"op":"test","path":"/price","value":450},
+			{"op":"replace","path":"/currency","value":"EUR"},
+			{"op":"add","path":"/accessories","value":["case"]}
+		]`)
+		assert.Equal(t, http.StatusOK, res.Code)
+		product := stored()
+		assert.Equal(t, "EUR", product.Currency)
+		assert.Equal(t, []string{"case"}, product.Accessories)
+	})
+
+	t.Run("failed test operation", func(t *testing.T) {
+		res := patch("application/json-patch+json", `[
+			{"op":"test","path":"/price","value":1},
+			{"op":"replace","path":"/currency","value":"INR"}
+		]`)
+		assert.Equal(t, http.StatusConflict, res.Code)
+		assert.Equal(t, "EUR", stored().Currency)
+	})
+
+	t.Run("patched product is validated", func(t *testing.T) {
+		var msg problemBody
+		res := patch("application/merge-patch+json", `{"currency":"EURO","price":2000}`)
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &msg))
+		assert.ElementsMatch(t, []fieldError{
+			{Field: "price", Rule: "max", Param: "1000"},
+			{Field: "currency", Rule: "len", Param: "3"},
+		}, msg.Errors)
+		res = patch("application/json-patch+json", `[{"op":"remove","path":"/vendor"}]`)
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+		assert.Equal(t, "google", stored().Vendor)
+	})
+
+	t.Run("unknown fields and ids are rejected", func(t *testing.T) {
+		res := patch("application/merge-patch+json", `{"colour":"red"}`)
+		assert.Equal(t, http.StatusUnprocessableEntity, res.Code)
+		res = patch("application/merge-patch+json", `{"_id":"000000000000000000000000"}`)
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+	})
+
+	t.Run("unsupported media type", func(t *testing.T) {
+		res := patch(echo.MIMEApplicationJSON, `{"price":1}`)
+		assert.Equal(t, http.StatusUnsupportedMediaType, res.Code)
+	})
+}
+
+func TestProductConditionalRequests(t *testing.T) {
+	var IDs []string
+	body := `[{"product_name":"pixelbook","price":900,"currency":"USD","vendor":"google"}]`
+	req := httptest.NewRequest(http.MethodPost, "/products", strings.NewReader(body))
+	res := httptest.NewRecorder()
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	e := echo.New()
+	h.Products = &mongostore.Products{Col: col}
+	err := h.CreateProducts(e.NewContext(req, res))
+	assert.Nil(t, err)
+	assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &IDs))
+	docID := IDs[0]
+
+	do := func(method, body string, header http.Header, handler echo.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, fmt.Sprintf("/products/%s", docID), strings.NewReader(body))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		res := httptest.NewRecorder()
+		c := e.NewContext(req, res)
+		c.SetParamNames("id")
+		c.SetParamValues(docID)
+		serve(handler, c)
+		return res
+	}
+	putBody := `{"product_name":"pixelbook","price":800,"currency":"USD","vendor":"google"}`
+
+	t.Run("get returns an etag", func(t *testing.T) {
+		res := do(http.MethodGet, "", nil, h.GetProduct)
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, `"1"`, res.Header().Get("ETag"))
+
+		res = do(http.MethodGet, "", http.Header{"If-None-Match": {`W/"1"`}}, h.GetProduct)
+		assert.Equal(t, http.StatusNotModified, res.Code)
+	})
+
+	t.Run("put with a matching etag", func(t *testing.T) {
+		res := do(http.MethodPut, putBody, http.Header{"If-Match": {`"1"`}}, h.UpdateProduct)
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, `"2"`, res.Header().Get("ETag"))
+	})
+
+	t.Run("put with a stale etag", func(t *testing.T) {
+		res := do(http.MethodPut, putBody, http.Header{"If-Match": {`"1"`}}, h.UpdateProduct)
+		assert.Equal(t, http.StatusPreconditionFailed, res.Code)
+	})
+
+	t.Run("patch with a stale and a matching etag", func(t *testing.T) {
+		header := http.Header{"Content-Type": {"application/merge-patch+json"}, "If-Match": {`"1"`}}
+		res := do(http.MethodPatch, `{"price":700}`, header, h.PatchProduct)
+		assert.Equal(t, http.StatusPreconditionFailed, res.Code)
+
+		header.Set("If-Match", `"1", "2"`)
+		res = do(http.MethodPatch, `{"price":700}`, header, h.PatchProduct)
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, `"3"`, res.Header().Get("ETag"))
+	})
+
+	t.Run("delete with a stale etag", func(t *testing.T) {
+		res := do(http.MethodDelete, "", http.Header{"If-Match": {`"2"`}}, h.DeleteProduct)
+		assert.Equal(t, http.StatusPreconditionFailed, res.Code)
+		res = do(http.MethodGet, "", nil, h.GetProduct)
+		assert.Equal(t, http.StatusOK, res.Code)
+	})
+
+	t.Run("list etag", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/products?vendor=google", nil)
+		res := httptest.NewRecorder()
+		assert.Nil(t, h.GetProducts(e.NewContext(req, res)))
+		etag := res.Header().Get("ETag")
+		assert.NotEmpty(t, etag)
+
+		req = httptest.NewRequest(http.MethodGet, "/products?vendor=google", nil)
+		req.Header.Set("If-None-Match", etag)
+		res = httptest.NewRecorder()
+		assert.Nil(t, h.GetProducts(e.NewContext(req, res)))
+		assert.Equal(t, http.StatusNotModified, res.Code)
+	})
+
+	t.Run("delete with a matching etag", func(t *testing.T) {
+		res := do(http.MethodDelete, "", http.Header{"If-Match": {`"3"`}}, h.DeleteProduct)
+		assert.Equal(t, http.StatusOK, res.Code)
+	})
+}
+
+// correlatedProducts records the correlation IDs the products are read with
+type correlatedProducts struct {
+	ProductRepository
+	ids []string
+}
+
+func (r *correlatedProducts) FindByID(ctx context.Context, id string) (store.Product, error) {
+	r.ids = append(r.ids, dbiface.CorrelationID(ctx))
+	return r.ProductRepository.FindByID(ctx, id)
+}
+
+func TestProductRequestContext(t *testing.T) {
+	repo := &correlatedProducts{ProductRepository: &mongostore.Products{Col: memdb.NewDatabase().Collection("products")}}
+	seeded := seedProducts(t, repo)
+	handler := ProductHandler{Products: repo}
+
+	req := httptest.NewRequest(http.MethodGet, "/products/"+string(seeded[0].ID), nil)
+	req = req.WithContext(dbiface.WithCorrelationID(req.Context(), "abc123"))
+	res := httptest.NewRecorder()
+	c := echo.New().NewContext(req, res)
+	c.SetParamNames("id")
+	c.SetParamValues(string(seeded[0].ID))
+	assert.Nil(t, handler.GetProduct(c))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, []string{"abc123"}, repo.ids, "the repository gets the context of the request")
+}
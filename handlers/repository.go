@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"github.com/nitin06890/go-rest-api/store"
+)
+
+// ProductRepository stores the products
+type ProductRepository interface {
+	// FindByID returns the product of the id
+	FindByID(ctx context.Context, id string) (store.Product, error)
+	// List returns a page of the products matching the filter
+	List(ctx context.Context, filter store.ProductFilter, page store.ProductPageRequest) ([]store.Product, error)
+	// Count counts the products matching the filter
+	Count(ctx context.Context, filter store.ProductFilter) (int64, error)
+	// Create inserts the products with new ids and version 1, which are set
+	// on them. The errors are by product, nil for the inserted ones; the
+	// returned error is set when the batch could not be written at all.
+	Create(ctx context.Context, products []store.Product, mode store.BulkMode) ([]error, error)
+	// Update stores the product over the one of its id while that one still
+	// has the version, and returns store.ErrConflict otherwise
+	Update(ctx context.Context, product store.Product, version int64) error
+	// Patch sets and unsets the fields, by stored name, of the product of the
+	// id while it still has the version, and returns store.ErrConflict otherwise
+	Patch(ctx context.Context, id string, version int64, set map[string]interface{}, unset []string) error
+	// Delete deletes the product of the id, if it still has the version when
+	// one is given, and reports whether it did
+	Delete(ctx context.Context, id string, version *int64) (bool, error)
+	// Search returns the products matching a full-text search, the most
+	// relevant first, and how many there are in total
+	Search(ctx context.Context, text string, offset, limit int64) ([]store.ScoredProduct, int64, error)
+	// Facets counts the products matching the filter by facet
+	Facets(ctx context.Context, filter store.ProductFilter) (store.FacetCounts, error)
+}
+
+// UserRepository stores the users
+type UserRepository interface {
+	// FindByID returns the user of the id
+	FindByID(ctx context.Context, id string) (store.User, error)
+	// FindByUsername returns the user of the username
+	FindByUsername(ctx context.Context, username string) (store.User, error)
+	// List returns a page of the users matching the filter
+	List(ctx context.Context, filter store.UserFilter, page store.UserPageRequest) ([]store.User, error)
+	// Count counts the users matching the filter
+	Count(ctx context.Context, filter store.UserFilter) (int64, error)
+	// Create inserts the user with a new id, and returns store.ErrDuplicate
+	// if the username is taken
+	Create(ctx context.Context, user store.User) (store.User, error)
+	// Update applies the changes to the user of the id
+	Update(ctx context.Context, id string, update store.UserUpdate) error
+	// Delete deletes the user of the id
+	Delete(ctx context.Context, id string) error
+	// Activate activates the user of the username if they are unverified.
+	// Disabled users stay disabled.
+	Activate(ctx context.Context, username string) error
+	// ConfirmTOTP stores the confirmed second factor of the user while they
+	// are still enrolling the one of the same secret, and reports whether it did
+	ConfirmTOTP(ctx context.Context, id string, factor store.TOTPFactor) (bool, error)
+	// UseTOTPStep records the step of a TOTP code of the user unless a code
+	// of that step or a later one was used, and reports whether it did
+	UseTOTPStep(ctx context.Context, id string, step int64) (bool, error)
+	// UseRecoveryCode removes the recovery code of the hash from the user,
+	// and reports whether they had it
+	UseRecoveryCode(ctx context.Context, id string, hash string) (bool, error)
+}
+
+// SessionRepository stores the sessions
+type SessionRepository interface {
+	// Create inserts the session with a new id, and returns it with the id
+	Create(ctx context.Context, session store.Session) (store.Session, error)
+	// FindByID returns the session of the id
+	FindByID(ctx context.Context, id string) (store.Session, error)
+	// Rotate replaces the token hash of the session of the id with newHash,
+	// keeping hash among the spent ones, while the session still has hash
+	// and is not revoked. It returns the rotated session, or
+	// store.ErrConflict when the session no longer has hash.
+	Rotate(ctx context.Context, id, hash, newHash string) (store.Session, error)
+	// Revoke revokes the session of the id
+	Revoke(ctx context.Context, id string) error
+	// RevokeUser revokes every session of the user
+	RevokeUser(ctx context.Context, username string) error
+}
+
+// UserTokenRepository stores the tokens mailed to the users
+type UserTokenRepository interface {
+	// Issue inserts the token with a new id, and marks the unused tokens of
+	// the same user and purpose as used
+	Issue(ctx context.Context, token store.UserToken) error
+	// Consume marks the unused token of the hash and purpose that has not
+	// expired by now as used and returns it, or returns store.ErrNotFound
+	Consume(ctx context.Context, hash, purpose string, now time.Time) (store.UserToken, error)
+}
+
+// LoginAttemptRepository stores the failed logins by throttle key
+type LoginAttemptRepository interface {
+	// Locked returns the attempts of the keys that are locked out after now
+	Locked(ctx context.Context, keys []string, now time.Time) ([]store.LoginAttempts, error)
+	// AddFailure counts a failed login against the key, which expires at
+	// expiresAt, and returns its attempts including it
+	AddFailure(ctx context.Context, key string, expiresAt time.Time) (store.LoginAttempts, error)
+	// LockOut resets the failures of the key and counts a lockout until
+	// lockedUntil while the key has at least threshold failures, and
+	// reports whether it did
+	LockOut(ctx context.Context, key string, threshold int, lockedUntil, expiresAt time.Time) (bool, error)
+	// Clear forgets the failed logins of the key
+	Clear(ctx context.Context, key string) error
+}
+
+// APIKeyRepository stores the API keys
+type APIKeyRepository interface {
+	// Create inserts the key with a new id, and returns it with the id
+	Create(ctx context.Context, key store.APIKey) (store.APIKey, error)
+	// FindByPrefix returns the key of the prefix
+	FindByPrefix(ctx context.Context, prefix string) (store.APIKey, error)
+	// ListByOwner returns the keys of the user, in the order of ids
+	ListByOwner(ctx context.Context, owner string) ([]store.APIKey, error)
+	// Revoke revokes the key of the id if the user owns it, and reports
+	// whether they do
+	Revoke(ctx context.Context, id, owner string) (bool, error)
+	// RevokeOwner revokes every key of the user
+	RevokeOwner(ctx context.Context, owner string) error
+	// Touch records that the key of the id was used at the time
+	Touch(ctx context.Context, id string, at time.Time) error
+}
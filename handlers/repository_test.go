@@ -0,0 +1,669 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nitin06890/go-rest-api/dbiface"
+	"github.com/nitin06890/go-rest-api/memdb"
+	"github.com/nitin06890/go-rest-api/sqlstore"
+	"github.com/nitin06890/go-rest-api/store"
+	mongostore "github.com/nitin06890/go-rest-api/store/mongo"
+	"github.com/nitin06890/go-rest-api/store/sqlite"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// repositoryBackend opens empty repositories of a storage backend, so the
+// same cases check that every backend behaves the same
+type repositoryBackend struct {
+	name     string
+	products func(t *testing.T) ProductRepository
+	users    func(t *testing.T) UserRepository
+	sessions func(t *testing.T) SessionRepository
+	tokens   func(t *testing.T) UserTokenRepository
+	attempts func(t *testing.T) LoginAttemptRepository
+	apiKeys  func(t *testing.T) APIKeyRepository
+	// search tells whether the backend runs full-text searches, which memdb doesn't
+	search bool
+}
+
+func openSQLite(t *testing.T) *sql.DB {
+	sqlDB, err := sqlstore.Open(context.Background(), ":memory:")
+	require.Nil(t, err)
+	t.Cleanup(func() { sqlDB.Close() })
+	return sqlDB
+}
+
+// openMongo connects to the server of MONGO_URI, such as
+// mongodb://localhost:27017/?directConnection=true for the one of
+// docker-compose, and returns a database of its own that is dropped after
+// the test. The test is skipped without MONGO_URI.
+func openMongo(t *testing.T) (*mongo.Client, *mongo.Database) {
+	uri := os.Getenv("MONGO_URI")
+	if uri == "" {
+		t.Skip("MONGO_URI is not set")
+	}
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	require.Nil(t, err)
+	database := client.Database("go_rest_api_test_" + primitive.NewObjectID().Hex())
+	t.Cleanup(func() {
+		database.Drop(ctx)
+		client.Disconnect(ctx)
+	})
+	return client, database
+}
+
+var repositoryBackends = []repositoryBackend{
+	{
+		name: "mongo",
+		products: func(t *testing.T) ProductRepository {
+			return &mongostore.Products{Col: memdb.NewDatabase().Collection("products")}
+		},
+		users: func(t *testing.T) UserRepository {
+			users := memdb.NewDatabase().Collection("users")
+			require.Nil(t, users.CreateUniqueIndex("username"))
+			return &mongostore.Users{Col: users}
+		},
+		sessions: func(t *testing.T) SessionRepository {
+			return &mongostore.Sessions{Col: memdb.NewDatabase().Collection("sessions")}
+		},
+		tokens: func(t *testing.T) UserTokenRepository {
+			return &mongostore.UserTokens{Col: memdb.NewDatabase().Collection("user_tokens")}
+		},
+		attempts: func(t *testing.T) LoginAttemptRepository {
+			return &mongostore.LoginAttempts{Col: memdb.NewDatabase().Collection("login_attempts")}
+		},
+		apiKeys: func(t *testing.T) APIKeyRepository {
+			apiKeys := memdb.NewDatabase().Collection("api_keys")
+			require.Nil(t, apiKeys.CreateUniqueIndex("prefix"))
+			return &mongostore.APIKeys{Col: apiKeys}
+		},
+	},
+	{
+		name: "mongo server",
+		products: func(t *testing.T) ProductRepository {
+			client, database := openMongo(t)
+			products := database.Collection("products")
+			require.Nil(t, mongostore.CreateProductIndexes(context.Background(), products))
+			return &mongostore.Products{Col: products, Txn: &dbiface.MongoTransactions{Client: client}}
+		},
+		users: func(t *testing.T) UserRepository {
+			_, database := openMongo(t)
+			users := database.Collection("users")
+			require.Nil(t, mongostore.CreateUserIndexes(context.Background(), users))
+			return &mongostore.Users{Col: users}
+		},
+		sessions: func(t *testing.T) SessionRepository {
+			_, database := openMongo(t)
+			sessions := database.Collection("sessions")
+			require.Nil(t, mongostore.CreateSessionIndexes(context.Background(), sessions))
+			return &mongostore.Sessions{Col: sessions}
+		},
+		tokens: func(t *testing.T) UserTokenRepository {
+			_, database := openMongo(t)
+			tokens := database.Collection("user_tokens")
+			require.Nil(t, mongostore.CreateUserTokenIndexes(context.Background(), tokens))
+			return &mongostore.UserTokens{Col: tokens}
+		},
+		attempts: func(t *testing.T) LoginAttemptRepository {
+			_, database := openMongo(t)
+			attempts := database.Collection("login_attempts")
+			require.Nil(t, mongostore.CreateLoginAttemptIndexes(context.Background(), attempts))
+			return &mongostore.LoginAttempts{Col: attempts}
+		},
+		apiKeys: func(t *testing.T) APIKeyRepository {
+			_, database := openMongo(t)
+			apiKeys := database.Collection("api_keys")
+			require.Nil(t, mongostore.CreateAPIKeyIndexes(context.Background(), apiKeys))
+			return &mongostore.APIKeys{Col: apiKeys}
+		},
+		search: true,
+	},
+	{
+		name: "sqlite",
+		products: func(t *testing.T) ProductRepository {
+			return &sqlite.Products{DB: openSQLite(t)}
+		},
+		users: func(t *testing.T) UserRepository {
+			return &sqlite.Users{DB: openSQLite(t)}
+		},
+		sessions: func(t *testing.T) SessionRepository {
+			return &sqlite.Sessions{DB: openSQLite(t)}
+		},
+		tokens: func(t *testing.T) UserTokenRepository {
+			return &sqlite.UserTokens{DB: openSQLite(t)}
+		},
+		attempts: func(t *testing.T) LoginAttemptRepository {
+			return &sqlite.LoginAttempts{DB: openSQLite(t)}
+		},
+		apiKeys: func(t *testing.T) APIKeyRepository {
+			return &sqlite.APIKeys{DB: openSQLite(t)}
+		},
+		search: true,
+	},
+}
+
+// seedProducts creates alpha, beta, gamma and delta, in the order of their ids
+func seedProducts(t *testing.T, repo ProductRepository) []store.Product {
+	products := []store.Product{
+		{Name: "alpha", Price: 100, Currency: "USD", Discount: 10, Vendor: "google", Accessories: []string{"charger", "case"}, IsEssential: true},
+		{Name: "beta", Price: 250, Currency: "EUR", Vendor: "apple", Accessories: []string{"charger"}},
+		{Name: "gamma", Price: 500, Currency: "USD", Discount: 5, Vendor: "acme", IsEssential: true},
+		{Name: "delta", Price: 250, Currency: "INR", Vendor: "google"},
+	}
+	errs, err := repo.Create(context.Background(), products, store.BulkMode{Ordered: true})
+	require.Nil(t, err)
+	for i, p := range products {
+		require.Nil(t, errs[i])
+		require.False(t, p.ID == "")
+		require.Equal(t, int64(1), p.Version)
+	}
+	return products
+}
+
+func productNames(products []store.Product) []string {
+	names := []string{}
+	for _, p := range products {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+func TestProductRepositories(t *testing.T) {
+	ctx := context.Background()
+	for _, backend := range repositoryBackends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			t.Run("find", func(t *testing.T) {
+				repo := backend.products(t)
+				seeded := seedProducts(t, repo)
+				found, err := repo.FindByID(ctx, string(seeded[0].ID))
+				assert.Nil(t, err)
+				assert.Equal(t, seeded[0], found)
+				_, err = repo.FindByID(ctx, "nope")
+				assert.Equal(t, store.ErrInvalidID, err)
+				_, err = repo.FindByID(ctx, primitive.NewObjectID().Hex())
+				assert.Equal(t, store.ErrNotFound, err)
+			})
+
+			t.Run("filters", func(t *testing.T) {
+				repo := backend.products(t)
+				seeded := seedProducts(t, repo)
+				byID := []store.SortKey{{Field: store.ProductFields["_id"]}}
+				list := func(filter store.ProductFilter) []string {
+					found, err := repo.List(ctx, filter, store.ProductPageRequest{Sort: byID, Limit: 10})
+					assert.Nil(t, err)
+					return productNames(found)
+				}
+				tests := []struct {
+					name   string
+					filter store.ProductFilter
+					want   []string
+				}{
+					{"everything", store.ProductFilter{}, []string{"alpha", "beta", "gamma", "delta"}},
+					{"eq", store.ProductFilter{"price": {"eq": 250}}, []string{"beta", "delta"}},
+					{"range", store.ProductFilter{"price": {"gte": 250, "lt": 500}}, []string{"beta", "delta"}},
+					{"gt lte", store.ProductFilter{"price": {"gt": 100, "lte": 250}}, []string{"beta", "delta"}},
+					{"in", store.ProductFilter{"vendor": {"in": []interface{}{"google", "apple"}}}, []string{"alpha", "beta", "delta"}},
+					{"nin", store.ProductFilter{"vendor": {"nin": []interface{}{"google"}}}, []string{"beta", "gamma"}},
+					{"ne", store.ProductFilter{"currency": {"ne": "USD"}}, []string{"beta", "delta"}},
+					{"bool", store.ProductFilter{"is_essential": {"eq": true}}, []string{"alpha", "gamma"}},
+					{"object id", store.ProductFilter{"_id": {"eq": seeded[2].ID}}, []string{"gamma"}},
+					{"array element", store.ProductFilter{"accessories": {"eq": "charger"}}, []string{"alpha", "beta"}},
+					{"array ne", store.ProductFilter{"accessories": {"ne": "charger"}}, []string{"gamma", "delta"}},
+					{"array in", store.ProductFilter{"accessories": {"in": []interface{}{"case"}}}, []string{"alpha"}},
+					{"array nin", store.ProductFilter{"accessories": {"nin": []interface{}{"case"}}}, []string{"beta", "gamma", "delta"}},
+					{"several fields", store.ProductFilter{"vendor": {"eq": "google"}, "is_essential": {"ne": true}}, []string{"delta"}},
+				}
+				for _, tt := range tests {
+					assert.Equal(t, tt.want, list(tt.filter), tt.name)
+				}
+
+				n, err := repo.Count(ctx, store.ProductFilter{"currency": {"eq": "USD"}})
+				assert.Nil(t, err)
+				assert.Equal(t, int64(2), n)
+
+				// a removed field only matches the negations
+				set := map[string]interface{}{"version": int64(2)}
+				assert.Nil(t, repo.Patch(ctx, string(seeded[2].ID), 1, set, []string{"discount"}))
+				assert.Equal(t, []string{"beta", "delta"}, list(store.ProductFilter{"discount": {"eq": 0}}))
+				assert.Equal(t, []string{"beta", "delta"}, list(store.ProductFilter{"discount": {"lt": 10}}))
+				assert.Equal(t, []string{"beta", "gamma", "delta"}, list(store.ProductFilter{"discount": {"ne": 10}}))
+				assert.Equal(t, []string{"gamma"}, list(store.ProductFilter{"discount": {"nin": []interface{}{0, 10}}}))
+			})
+
+			t.Run("keyset pages", func(t *testing.T) {
+				repo := backend.products(t)
+				seeded := seedProducts(t, repo)
+				keys := []store.SortKey{{Field: store.ProductFields["price"], Desc: true}, {Field: store.ProductFields["_id"]}}
+
+				page, err := repo.List(ctx, store.ProductFilter{}, store.ProductPageRequest{Sort: keys, Limit: 2})
+				assert.Nil(t, err)
+				assert.Equal(t, []string{"gamma", "beta"}, productNames(page))
+				page, err = repo.List(ctx, store.ProductFilter{}, store.ProductPageRequest{Sort: keys, After: []interface{}{250, seeded[1].ID}, Limit: 2})
+				assert.Nil(t, err)
+				assert.Equal(t, []string{"delta", "alpha"}, productNames(page))
+				// pages before a cursor come in reverse order
+				page, err = repo.List(ctx, store.ProductFilter{}, store.ProductPageRequest{Sort: keys, After: []interface{}{250, seeded[3].ID}, Backwards: true, Limit: 2})
+				assert.Nil(t, err)
+				assert.Equal(t, []string{"beta", "gamma"}, productNames(page))
+				page, err = repo.List(ctx, store.ProductFilter{"vendor": {"eq": "google"}}, store.ProductPageRequest{Sort: keys, After: []interface{}{500, seeded[2].ID}, Limit: 5})
+				assert.Nil(t, err)
+				assert.Equal(t, []string{"delta", "alpha"}, productNames(page))
+			})
+
+			t.Run("optimistic writes", func(t *testing.T) {
+				repo := backend.products(t)
+				seeded := seedProducts(t, repo)
+				alpha := seeded[0]
+				alpha.Price, alpha.Version = 150, 2
+				assert.Nil(t, repo.Update(ctx, alpha, 1))
+				assert.Equal(t, store.ErrConflict, repo.Update(ctx, alpha, 1))
+				found, err := repo.FindByID(ctx, string(alpha.ID))
+				assert.Nil(t, err)
+				assert.Equal(t, alpha, found)
+
+				set := map[string]interface{}{"vendor": "acme", "is_essential": true, "version": int64(2)}
+				assert.Nil(t, repo.Patch(ctx, string(seeded[1].ID), 1, set, []string{"accessories"}))
+				assert.Equal(t, store.ErrConflict, repo.Patch(ctx, string(seeded[1].ID), 1, set, nil))
+				found, err = repo.FindByID(ctx, string(seeded[1].ID))
+				assert.Nil(t, err)
+				assert.Equal(t, "acme", found.Vendor)
+				assert.True(t, found.IsEssential)
+				assert.Empty(t, found.Accessories)
+				assert.Equal(t, int64(2), found.Version)
+
+				stale := int64(1)
+				deleted, err := repo.Delete(ctx, string(alpha.ID), &stale)
+				assert.Nil(t, err)
+				assert.False(t, deleted)
+				deleted, err = repo.Delete(ctx, string(alpha.ID), &alpha.Version)
+				assert.Nil(t, err)
+				assert.True(t, deleted)
+				deleted, err = repo.Delete(ctx, string(seeded[2].ID), nil)
+				assert.Nil(t, err)
+				assert.True(t, deleted)
+				_, err = repo.FindByID(ctx, string(alpha.ID))
+				assert.Equal(t, store.ErrNotFound, err)
+				_, err = repo.Delete(ctx, "nope", nil)
+				assert.Equal(t, store.ErrInvalidID, err)
+			})
+
+			t.Run("atomic create", func(t *testing.T) {
+				repo := backend.products(t)
+				products := []store.Product{{Name: "alpha", Price: 1, Currency: "USD", Vendor: "acme"}}
+				errs, err := repo.Create(ctx, products, store.BulkMode{Atomic: true, Ordered: true})
+				if err == store.ErrNoTransactions {
+					t.Skip("the backend has no transactions")
+				}
+				assert.Nil(t, err)
+				assert.Equal(t, []error{nil}, errs)
+				n, err := repo.Count(ctx, store.ProductFilter{})
+				assert.Nil(t, err)
+				assert.Equal(t, int64(1), n)
+			})
+
+			t.Run("facets", func(t *testing.T) {
+				repo := backend.products(t)
+				seedProducts(t, repo)
+				counts, err := repo.Facets(ctx, store.ProductFilter{})
+				assert.Nil(t, err)
+				assert.Equal(t, int64(4), counts.Total)
+				assert.Equal(t, []store.ValueCount{{Value: "google", Count: 2}, {Value: "acme", Count: 1}, {Value: "apple", Count: 1}}, counts.Values["vendor"])
+				assert.Equal(t, []store.ValueCount{{Value: false, Count: 2}, {Value: true, Count: 2}}, counts.Values["is_essential"])
+				assert.Equal(t, map[int]int64{100: 1, 250: 2, 500: 1}, counts.Prices)
+				assert.Equal(t, int64(0), counts.OtherPrices)
+
+				// products priced outside of the buckets are counted apart
+				_, err = repo.Create(ctx, []store.Product{{Name: "omega", Price: 5000, Currency: "USD", Vendor: "acme"}}, store.BulkMode{Ordered: true})
+				assert.Nil(t, err)
+				counts, err = repo.Facets(ctx, store.ProductFilter{"vendor": {"eq": "acme"}})
+				assert.Nil(t, err)
+				assert.Equal(t, map[int]int64{500: 1}, counts.Prices)
+				assert.Equal(t, int64(1), counts.OtherPrices)
+
+				counts, err = repo.Facets(ctx, store.ProductFilter{"currency": {"eq": "CHF"}})
+				assert.Nil(t, err)
+				assert.Equal(t, int64(0), counts.Total)
+				assert.Equal(t, []store.ValueCount{}, counts.Values["currency"])
+				assert.Empty(t, counts.Prices)
+			})
+
+			t.Run("search", func(t *testing.T) {
+				if !backend.search {
+					t.Skip("the backend cannot search")
+				}
+				repo := backend.products(t)
+				seedProducts(t, repo)
+				search := func(text string, offset int64) ([]string, int64) {
+					results, total, err := repo.Search(ctx, text, offset, 10)
+					assert.Nil(t, err)
+					var names []string
+					for _, r := range results {
+						names = append(names, r.Name)
+					}
+					return names, total
+				}
+				names, total := search("google charger", 0)
+				assert.Equal(t, int64(3), total)
+				assert.Equal(t, "alpha", names[0], "matching both terms ranks first")
+				assert.ElementsMatch(t, []string{"alpha", "beta", "delta"}, names)
+				names, total = search("google charger", 1)
+				assert.Equal(t, int64(3), total)
+				assert.Len(t, names, 2)
+				names, _ = search("google -alpha", 0)
+				assert.Equal(t, []string{"delta"}, names)
+				names, _ = search(`"chargers" apple`, 0)
+				assert.ElementsMatch(t, []string{"alpha", "beta"}, names, "phrases are required and stemmed")
+				names, total = search(`-alpha "`, 0)
+				assert.Empty(t, names)
+				assert.Equal(t, int64(0), total)
+			})
+		})
+	}
+}
+
+func TestUserRepositories(t *testing.T) {
+	ctx := context.Background()
+	for _, backend := range repositoryBackends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			repo := backend.users(t)
+			var created []store.User
+			for _, u := range []store.User{
+				{Email: "a@example.com", Password: "x", Roles: []string{RoleCustomer}, Status: store.StatusUnverified},
+				{Email: "b@example.com", Password: "x", Name: "B", Roles: []string{RoleAdmin}, Status: store.StatusActive},
+				{Email: "c@example.com", Password: "x", Roles: []string{RoleCustomer}, Status: store.StatusDisabled},
+			} {
+				user, err := repo.Create(ctx, u)
+				require.Nil(t, err)
+				require.False(t, user.ID == "")
+				created = append(created, user)
+			}
+			_, err := repo.Create(ctx, store.User{Email: "a@example.com", Password: "y"})
+			assert.Equal(t, store.ErrDuplicate, err)
+
+			found, err := repo.FindByUsername(ctx, "b@example.com")
+			assert.Nil(t, err)
+			assert.Equal(t, created[1], found)
+			_, err = repo.FindByUsername(ctx, "z@example.com")
+			assert.Equal(t, store.ErrNotFound, err)
+			_, err = repo.FindByID(ctx, "nope")
+			assert.Equal(t, store.ErrInvalidID, err)
+
+			list := func(filter store.UserFilter, page store.UserPageRequest) []string {
+				page.Limit = 10
+				found, err := repo.List(ctx, filter, page)
+				assert.Nil(t, err)
+				var names []string
+				for _, u := range found {
+					names = append(names, u.Email)
+				}
+				return names
+			}
+			assert.Equal(t, []string{"a@example.com", "c@example.com"}, list(store.UserFilter{Role: RoleCustomer}, store.UserPageRequest{}))
+			assert.Equal(t, []string{"b@example.com"}, list(store.UserFilter{Status: store.StatusActive}, store.UserPageRequest{}))
+			assert.Equal(t, []string{"c@example.com"}, list(store.UserFilter{Role: RoleCustomer, Status: store.StatusDisabled}, store.UserPageRequest{}))
+			assert.Equal(t, []string{"c@example.com"}, list(store.UserFilter{}, store.UserPageRequest{After: created[1].ID}))
+			n, err := repo.Count(ctx, store.UserFilter{Role: RoleCustomer})
+			assert.Nil(t, err)
+			assert.Equal(t, int64(2), n)
+
+			name, roles := "A", []string{RoleEditor}
+			assert.Nil(t, repo.Update(ctx, string(created[0].ID), store.UserUpdate{Name: &name, Roles: &roles}))
+			assert.Nil(t, repo.Activate(ctx, "a@example.com"))
+			assert.Nil(t, repo.Activate(ctx, "c@example.com"))
+			found, err = repo.FindByID(ctx, string(created[0].ID))
+			assert.Nil(t, err)
+			assert.Equal(t, "A", found.Name)
+			assert.Equal(t, roles, found.Roles)
+			assert.Equal(t, store.StatusActive, found.Status)
+			assert.Equal(t, []string{"c@example.com"}, list(store.UserFilter{Status: store.StatusDisabled}, store.UserPageRequest{}), "disabled users stay disabled")
+
+			id := string(created[0].ID)
+			assert.Nil(t, repo.Update(ctx, id, store.UserUpdate{TOTP: &store.TOTPFactor{Secret: "S"}}))
+			confirmed, err := repo.ConfirmTOTP(ctx, id, store.TOTPFactor{Secret: "T", Confirmed: true, LastStep: 5, RecoveryCodes: []string{"h1", "h2"}})
+			assert.Nil(t, err)
+			assert.False(t, confirmed, "another enrollment")
+			factor := store.TOTPFactor{Secret: "S", Confirmed: true, LastStep: 5, RecoveryCodes: []string{"h1", "h2"}}
+			confirmed, err = repo.ConfirmTOTP(ctx, id, factor)
+			assert.Nil(t, err)
+			assert.True(t, confirmed)
+			confirmed, err = repo.ConfirmTOTP(ctx, id, factor)
+			assert.Nil(t, err)
+			assert.False(t, confirmed, "already confirmed")
+
+			used, err := repo.UseTOTPStep(ctx, id, 5)
+			assert.Nil(t, err)
+			assert.False(t, used, "replayed step")
+			used, err = repo.UseTOTPStep(ctx, id, 6)
+			assert.Nil(t, err)
+			assert.True(t, used)
+			used, err = repo.UseTOTPStep(ctx, string(created[1].ID), 6)
+			assert.Nil(t, err)
+			assert.False(t, used, "no second factor")
+			used, err = repo.UseRecoveryCode(ctx, id, "h1")
+			assert.Nil(t, err)
+			assert.True(t, used)
+			used, err = repo.UseRecoveryCode(ctx, id, "h1")
+			assert.Nil(t, err)
+			assert.False(t, used, "used recovery code")
+
+			found, err = repo.FindByID(ctx, id)
+			assert.Nil(t, err)
+			assert.Equal(t, &store.TOTPFactor{Secret: "S", Confirmed: true, LastStep: 6, RecoveryCodes: []string{"h2"}}, found.TOTP)
+
+			assert.Nil(t, repo.Delete(ctx, id))
+			_, err = repo.FindByID(ctx, id)
+			assert.Equal(t, store.ErrNotFound, err)
+		})
+	}
+}
+
+func TestSessionRepositories(t *testing.T) {
+	ctx := context.Background()
+	// times are kept to the millisecond, like mongo does
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	for _, backend := range repositoryBackends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			repo := backend.sessions(t)
+			created, err := repo.Create(ctx, store.Session{Username: "a@example.com", TokenHash: "h1", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+			require.Nil(t, err)
+			require.False(t, created.ID == "")
+			other, err := repo.Create(ctx, store.Session{Username: "a@example.com", TokenHash: "o1", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+			require.Nil(t, err)
+			id := string(created.ID)
+
+			found, err := repo.FindByID(ctx, id)
+			assert.Nil(t, err)
+			assert.Equal(t, store.Session{ID: created.ID, Username: "a@example.com", TokenHash: "h1", PreviousHashes: []string{},
+				CreatedAt: now, ExpiresAt: now.Add(time.Hour)}, found)
+			_, err = repo.FindByID(ctx, "nope")
+			assert.Equal(t, store.ErrInvalidID, err)
+			_, err = repo.FindByID(ctx, string(store.NewID()))
+			assert.Equal(t, store.ErrNotFound, err)
+
+			rotated, err := repo.Rotate(ctx, id, "h1", "h2")
+			assert.Nil(t, err)
+			assert.Equal(t, "h2", rotated.TokenHash)
+			assert.Equal(t, []string{"h1"}, rotated.PreviousHashes)
+			_, err = repo.Rotate(ctx, id, "h1", "h3")
+			assert.Equal(t, store.ErrConflict, err, "spent hash")
+
+			assert.Nil(t, repo.Revoke(ctx, id))
+			_, err = repo.Rotate(ctx, id, "h2", "h3")
+			assert.Equal(t, store.ErrConflict, err, "revoked session")
+			found, err = repo.FindByID(ctx, id)
+			assert.Nil(t, err)
+			assert.True(t, found.Revoked)
+			assert.Equal(t, "h2", found.TokenHash)
+
+			found, err = repo.FindByID(ctx, string(other.ID))
+			assert.Nil(t, err)
+			assert.False(t, found.Revoked)
+			assert.Nil(t, repo.RevokeUser(ctx, "a@example.com"))
+			found, err = repo.FindByID(ctx, string(other.ID))
+			assert.Nil(t, err)
+			assert.True(t, found.Revoked)
+		})
+	}
+}
+
+func TestUserTokenRepositories(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	for _, backend := range repositoryBackends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			repo := backend.tokens(t)
+			issue := func(username, purpose, hash string, ttl time.Duration) {
+				err := repo.Issue(ctx, store.UserToken{Username: username, Purpose: purpose, TokenHash: hash, CreatedAt: now, ExpiresAt: now.Add(ttl)})
+				require.Nil(t, err)
+			}
+			issue("a@example.com", "reset", "r1", time.Hour)
+			issue("a@example.com", "verify", "v1", time.Hour)
+			issue("a@example.com", "reset", "r2", time.Hour)
+			issue("b@example.com", "reset", "b1", -time.Second)
+
+			_, err := repo.Consume(ctx, "r1", "reset", now)
+			assert.Equal(t, store.ErrNotFound, err, "replaced token")
+			_, err = repo.Consume(ctx, "r2", "verify", now)
+			assert.Equal(t, store.ErrNotFound, err, "other purpose")
+			_, err = repo.Consume(ctx, "b1", "reset", now)
+			assert.Equal(t, store.ErrNotFound, err, "expired token")
+
+			consumed, err := repo.Consume(ctx, "r2", "reset", now)
+			assert.Nil(t, err)
+			assert.False(t, consumed.ID == "")
+			assert.Equal(t, store.UserToken{ID: consumed.ID, Username: "a@example.com", Purpose: "reset", TokenHash: "r2", Used: true,
+				CreatedAt: now, ExpiresAt: now.Add(time.Hour)}, consumed)
+			_, err = repo.Consume(ctx, "r2", "reset", now)
+			assert.Equal(t, store.ErrNotFound, err, "used token")
+
+			consumed, err = repo.Consume(ctx, "v1", "verify", now)
+			assert.Nil(t, err, "tokens of other purposes are kept")
+			assert.Equal(t, "a@example.com", consumed.Username)
+		})
+	}
+}
+
+func TestLoginAttemptRepositories(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	for _, backend := range repositoryBackends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			repo := backend.attempts(t)
+			for i := 1; i <= 3; i++ {
+				a, err := repo.AddFailure(ctx, "user:a", now.Add(time.Hour))
+				require.Nil(t, err)
+				assert.Equal(t, store.LoginAttempts{Key: "user:a", Failures: i, ExpiresAt: now.Add(time.Hour)}, a)
+			}
+			_, err := repo.AddFailure(ctx, "ip:1", now.Add(time.Hour))
+			require.Nil(t, err)
+
+			locked, err := repo.LockOut(ctx, "user:a", 4, now.Add(time.Minute), now.Add(2*time.Hour))
+			assert.Nil(t, err)
+			assert.False(t, locked, "below the threshold")
+			locked, err = repo.LockOut(ctx, "user:a", 3, now.Add(time.Minute), now.Add(2*time.Hour))
+			assert.Nil(t, err)
+			assert.True(t, locked)
+			locked, err = repo.LockOut(ctx, "user:a", 3, now.Add(time.Minute), now.Add(2*time.Hour))
+			assert.Nil(t, err)
+			assert.False(t, locked, "failures already reset")
+
+			found, err := repo.Locked(ctx, []string{"user:a", "ip:1", "ip:2"}, now)
+			assert.Nil(t, err)
+			assert.Equal(t, []store.LoginAttempts{
+				{Key: "user:a", Lockouts: 1, LockedUntil: now.Add(time.Minute), ExpiresAt: now.Add(2 * time.Hour)},
+			}, found)
+			found, err = repo.Locked(ctx, []string{"user:a"}, now.Add(time.Minute))
+			assert.Nil(t, err)
+			assert.Empty(t, found, "lockout over")
+
+			a, err := repo.AddFailure(ctx, "user:a", now.Add(time.Hour))
+			assert.Nil(t, err)
+			assert.Equal(t, 1, a.Failures)
+			assert.Equal(t, 1, a.Lockouts)
+
+			assert.Nil(t, repo.Clear(ctx, "user:a"))
+			a, err = repo.AddFailure(ctx, "user:a", now.Add(time.Hour))
+			assert.Nil(t, err)
+			assert.Equal(t, store.LoginAttempts{Key: "user:a", Failures: 1, ExpiresAt: now.Add(time.Hour)}, a)
+		})
+	}
+}
+
+func TestAPIKeyRepositories(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	for _, backend := range repositoryBackends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			repo := backend.apiKeys(t)
+			var created []store.APIKey
+			for _, k := range []store.APIKey{
+				{Name: "one", Prefix: "ak_1", Hash: "h1", Owner: "a@example.com", Scopes: []string{"catalog:write"}},
+				{Name: "two", Prefix: "ak_2", Hash: "h2", Owner: "b@example.com", Scopes: []string{"catalog:read"}},
+				{Name: "three", Prefix: "ak_3", Hash: "h3", Owner: "a@example.com", Scopes: []string{"catalog:read", "catalog:write"}},
+			} {
+				k.CreatedAt, k.ExpiresAt = now, now.Add(time.Hour)
+				key, err := repo.Create(ctx, k)
+				require.Nil(t, err)
+				require.False(t, key.ID == "")
+				created = append(created, key)
+			}
+			_, err := repo.Create(ctx, store.APIKey{Name: "dup", Prefix: "ak_1", Hash: "h4", Owner: "b@example.com", CreatedAt: now, ExpiresAt: now})
+			assert.Equal(t, store.ErrDuplicate, err)
+
+			found, err := repo.FindByPrefix(ctx, "ak_2")
+			assert.Nil(t, err)
+			assert.Equal(t, created[1], found)
+			_, err = repo.FindByPrefix(ctx, "ak_9")
+			assert.Equal(t, store.ErrNotFound, err)
+
+			owned, err := repo.ListByOwner(ctx, "a@example.com")
+			assert.Nil(t, err)
+			assert.Equal(t, []store.APIKey{created[0], created[2]}, owned)
+			owned, err = repo.ListByOwner(ctx, "z@example.com")
+			assert.Nil(t, err)
+			assert.Empty(t, owned)
+
+			revoked, err := repo.Revoke(ctx, string(created[1].ID), "a@example.com")
+			assert.Nil(t, err)
+			assert.False(t, revoked, "not the owner")
+			revoked, err = repo.Revoke(ctx, "nope", "a@example.com")
+			assert.Nil(t, err)
+			assert.False(t, revoked, "invalid id")
+			revoked, err = repo.Revoke(ctx, string(created[0].ID), "a@example.com")
+			assert.Nil(t, err)
+			assert.True(t, revoked)
+
+			used := now.Add(time.Minute)
+			assert.Nil(t, repo.Touch(ctx, string(created[0].ID), used))
+			found, err = repo.FindByPrefix(ctx, "ak_1")
+			assert.Nil(t, err)
+			assert.True(t, found.Revoked)
+			assert.Equal(t, &used, found.LastUsedAt)
+
+			assert.Nil(t, repo.RevokeOwner(ctx, "a@example.com"))
+			owned, err = repo.ListByOwner(ctx, "a@example.com")
+			assert.Nil(t, err)
+			for _, k := range owned {
+				assert.True(t, k.Revoked, k.Name)
+			}
+			found, err = repo.FindByPrefix(ctx, "ak_2")
+			assert.Nil(t, err)
+			assert.False(t, found.Revoked, "keys of other users")
+		})
+	}
+}
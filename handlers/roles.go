@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/nitin06890/go-rest-api/problem"
+	"github.com/nitin06890/go-rest-api/store"
+)
+
+// Permission names an action a user may be allowed to perform
+type Permission string
+
+// Permissions checked by the API
+const (
+	PermCatalogWrite  Permission = "catalog:write"
+	PermCatalogDelete Permission = "catalog:delete"
+	PermUsersAdmin    Permission = "users:admin"
+)
+
+// Roles users can be given
+const (
+	RoleCustomer = "customer"
+	RoleEditor   = "editor"
+	RoleAdmin    = store.RoleAdmin
+)
+
+// rolePermissions grants permissions to roles
+var rolePermissions = map[string][]Permission{
+	RoleCustomer: {},
+	RoleEditor:   {PermCatalogWrite},
+	RoleAdmin:    {PermCatalogWrite, PermCatalogDelete, PermUsersAdmin},
+}
+
+// permissionsOf returns the sorted permissions granted by the roles.
+// Unknown roles grant nothing.
+func permissionsOf(roles []string) []Permission {
+	granted := make(map[Permission]bool)
+	for _, r := range roles {
+		for _, p := range rolePermissions[r] {
+			granted[p] = true
+		}
+	}
+	perms := make([]Permission, 0, len(granted))
+	for p := range granted {
+		perms = append(perms, p)
+	}
+	sort.Slice(perms, func(i, j int) bool { return perms[i] < perms[j] })
+	return perms
+}
+
+// permissionsGranted reports whether the roles grant every one of the permissions
+func permissionsGranted(roles []string, required ...Permission) bool {
+	granted := make(map[Permission]bool)
+	for _, p := range permissionsOf(roles) {
+		granted[p] = true
+	}
+	for _, p := range required {
+		if !granted[p] {
+			return false
+		}
+	}
+	return true
+}
+
+// tokenPermissions returns the scopes of the API key checked by
+// Authenticate or the permissions claimed by the access token validated by
+// echojwt
+func tokenPermissions(c echo.Context) map[Permission]bool {
+	perms := make(map[Permission]bool)
+	if key, ok := c.Get(apiKeyContextKey).(*apiKey); ok {
+		for _, p := range key.Scopes {
+			perms[p] = true
+		}
+		return perms
+	}
+	token, ok := c.Get(jwtContextKey).(*jwt.Token)
+	if !ok {
+		return perms
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return perms
+	}
+	list, _ := claims["permissions"].([]interface{})
+	for _, p := range list {
+		if s, ok := p.(string); ok {
+			perms[Permission(s)] = true
+		}
+	}
+	return perms
+}
+
+// RequirePermission allows the request only if the access token or the API
+// key grants every one of the permissions. It must run after the echojwt
+// middleware or Authenticate.
+func RequirePermission(required ...Permission) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			granted := tokenPermissions(c)
+			for _, p := range required {
+				if !granted[p] {
+					log.Errorf("Access token lacks the %s permission", p)
+					return problem.Newf(http.StatusForbidden, "Missing permission %s", p)
+				}
+			}
+			return next(c)
+		}
+	}
+}
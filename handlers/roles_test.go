@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nitin06890/go-rest-api/store"
+	mongostore "github.com/nitin06890/go-rest-api/store/mongo"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestPermissionsOf(t *testing.T) {
+	assert.Equal(t, []Permission{}, permissionsOf([]string{RoleCustomer}))
+	assert.Equal(t, []Permission{PermCatalogWrite}, permissionsOf([]string{RoleEditor, "unknown"}))
+	assert.Equal(t, []Permission{PermCatalogDelete, PermCatalogWrite, PermUsersAdmin}, permissionsOf([]string{RoleEditor, RoleAdmin}))
+}
+
+func TestRequirePermission(t *testing.T) {
+	e := echo.New()
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	call := func(user store.User, perms ...Permission) int {
+		token, err := generateToken(user, keys, string(store.NewID()))
+		assert.Nil(t, err)
+		req := httptest.NewRequest(http.MethodDelete, "/products/1", nil)
+		req.Header.Set(headerAuthToken, token)
+		res := httptest.NewRecorder()
+		serve(jwtMiddleware()(RequirePermission(perms...)(ok)), e.NewContext(req, res))
+		return res.Code
+	}
+
+	assert.Equal(t, http.StatusForbidden, call(store.User{Roles: []string{RoleCustomer}}, PermCatalogWrite))
+	assert.Equal(t, http.StatusOK, call(store.User{Roles: []string{RoleEditor}}, PermCatalogWrite))
+	assert.Equal(t, http.StatusForbidden, call(store.User{Roles: []string{RoleEditor}}, PermCatalogWrite, PermCatalogDelete))
+	assert.Equal(t, http.StatusOK, call(store.User{Roles: []string{RoleAdmin}}, PermCatalogWrite, PermCatalogDelete))
+	assert.Equal(t, http.StatusOK, call(store.User{IsAdmin: true}, PermCatalogDelete))
+}
+
+func TestSignUpRoles(t *testing.T) {
+	var stored store.User
+	body := `{"username":"eve.dummy@gmail.com","password":"qwertyuiop","roles":["admin"],"isadmin":true}`
+	req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	res := httptest.NewRecorder()
+	uh := UsersHandler{Users: &mongostore.Users{Col: usersCol}, Sessions: &mongostore.Sessions{Col: sessCol}, Tokens: &mongostore.UserTokens{Col: tokCol}, Keys: keys, Mailer: outbox}
+	serve(uh.CreateUser, echo.New().NewContext(req, res))
+	assert.Equal(t, http.StatusCreated, res.Code)
+
+	err := usersCol.FindOne(context.Background(), bson.M{"username": "eve.dummy@gmail.com"}).Decode(&stored)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{RoleCustomer}, stored.AllRoles())
+}
@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"context"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/nitin06890/go-rest-api/problem"
+	"github.com/nitin06890/go-rest-api/store"
+)
+
+const (
+	highlightStart = "<em>"
+	highlightEnd   = "</em>"
+)
+
+// searchHit is a product matching a full-text search
+type searchHit struct {
+	Product    store.Product       `json:"product"`
+	Score      float64             `json:"score"`
+	Highlights map[string][]string `json:"highlights,omitempty"`
+}
+
+type searchPage struct {
+	Data  []searchHit `json:"data"`
+	Total int64       `json:"total"`
+	Next  string      `json:"next,omitempty"`
+	Prev  string      `json:"prev,omitempty"`
+
+	nextCursor string
+	prevCursor string
+}
+
+func searchProducts(ctx context.Context, q url.Values, products ProductRepository) (searchPage, *problem.Problem) {
+	page := searchPage{Data: []searchHit{}}
+	text := strings.TrimSpace(q.Get("q"))
+	if text == "" {
+		log.Errorf("Empty search query")
+		return page, problem.InvalidQuery("q", "search query is required")
+	}
+	limit, err := parseLimit(q)
+	if err != nil {
+		log.Errorf("Invalid limit: %v", err)
+		return page, problem.InvalidQuery("limit", err.Error())
+	}
+	var offset int64
+	if token := q.Get("cursor"); token != "" {
+		if offset, err = decodeOffsetCursor(token); err != nil {
+			log.Errorf("Unable to decode the cursor: %v", err)
+			return page, problem.InvalidQuery("cursor", err.Error())
+		}
+	}
+
+	results, total, err := products.Search(ctx, text, offset, limit)
+	if err != nil {
+		log.Errorf("Unable to search the products: %v", err)
+		return page, problem.New(http.StatusInternalServerError, "Unable to search the products")
+	}
+	page.Total = total
+
+	terms := searchTerms(text)
+	for _, r := range results {
+		page.Data = append(page.Data, searchHit{
+			Product:    r.Product,
+			Score:      r.Score,
+			Highlights: highlightProduct(r.Product, terms),
+		})
+	}
+	if offset+int64(len(results)) < page.Total {
+		page.nextCursor = encodeOffsetCursor(offset + limit)
+	}
+	if offset > 0 {
+		prev := offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+		page.prevCursor = encodeOffsetCursor(prev)
+	}
+	return page, nil
+}
+
+// SearchProducts returns the products matching a full-text search ordered by relevance
+func (h *ProductHandler) SearchProducts(c echo.Context) error {
+	page, err := searchProducts(c.Request().Context(), c.QueryParams(), h.Products)
+	if err != nil {
+		return err
+	}
+	if page.nextCursor != "" {
+		page.Next = pageLink(c.Request().URL, page.nextCursor)
+	}
+	if page.prevCursor != "" {
+		page.Prev = pageLink(c.Request().URL, page.prevCursor)
+	}
+	return c.JSON(http.StatusOK, page)
+}
+
+// searchTerms returns the lower cased words of a search query, leaving out
+// negated words since they never appear in a match
+func searchTerms(text string) []string {
+	var terms []string
+	for _, word := range strings.Fields(strings.ToLower(text)) {
+		if strings.HasPrefix(word, "-") {
+			continue
+		}
+		word = strings.TrimFunc(word, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+		if word != "" {
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+// highlightProduct returns a snippet for every indexed field matching one of the terms
+func highlightProduct(p store.Product, terms []string) map[string][]string {
+	highlights := make(map[string][]string)
+	add := func(field, value string) {
+		if snippet, ok := highlight(value, terms); ok {
+			highlights[field] = append(highlights[field], snippet)
+		}
+	}
+	add("product_name", p.Name)
+	add("vendor", p.Vendor)
+	for _, a := range p.Accessories {
+		add("accessories", a)
+	}
+	if len(highlights) == 0 {
+		return nil
+	}
+	return highlights
+}
+
+// highlight wraps the words of value matching one of the terms in <em> tags.
+// Words match on a shared prefix, which approximates the stemming done by
+// the text index. The rest of the value is HTML escaped.
+func highlight(value string, terms []string) (string, bool) {
+	var b strings.Builder
+	matched := false
+	word := func(w string) {
+		lw := strings.ToLower(w)
+		for _, t := range terms {
+			if strings.HasPrefix(lw, t) || (len(lw) >= 4 && strings.HasPrefix(t, lw)) {
+				matched = true
+				b.WriteString(highlightStart + html.EscapeString(w) + highlightEnd)
+				return
+			}
+		}
+		b.WriteString(html.EscapeString(w))
+	}
+	start := -1
+	for i, r := range value {
+		isWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		switch {
+		case isWord && start < 0:
+			start = i
+		case !isWord && start >= 0:
+			word(value[start:i])
+			start = -1
+		}
+		if !isWord {
+			b.WriteString(html.EscapeString(string(r)))
+		}
+	}
+	if start >= 0 {
+		word(value[start:])
+	}
+	return b.String(), matched
+}
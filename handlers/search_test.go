@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nitin06890/go-rest-api/dbiface"
+	mongostore "github.com/nitin06890/go-rest-api/store/mongo"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// textSearchCollection serves canned search results, since text indexes
+// are not available on every test database
+type textSearchCollection struct {
+	dbiface.CollectionAPI
+	docs   []interface{}
+	filter interface{}
+	opts   *options.FindOptions
+}
+
+func (c *textSearchCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	c.filter = filter
+	c.opts = options.MergeFindOptions(opts...)
+	return mongo.NewCursorFromDocuments(c.docs, nil, nil)
+}
+
+func (c *textSearchCollection) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+	return 3, nil
+}
+
+func TestSearchProducts(t *testing.T) {
+	sc := &textSearchCollection{docs: []interface{}{
+		bson.M{"product_name": "pixel", "vendor": "google", "accessories": bson.A{"charger"}, "score": 2.5},
+		bson.M{"product_name": "chromecast", "vendor": "google", "score": 1.1},
+	}}
+	ph := ProductHandler{Products: &mongostore.Products{Col: sc}}
+	e := echo.New()
+
+	t.Run("ranked results with highlights", func(t *testing.T) {
+		var page searchPage
+		req := httptest.NewRequest(http.MethodGet, "/products/search?q=google+chargers&limit=2", nil)
+		res := httptest.NewRecorder()
+		err := ph.SearchProducts(e.NewContext(req, res))
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, bson.M{"$text": bson.M{"$search": "google chargers"}}, sc.filter)
+		assert.Equal(t, bson.D{{Key: "score", Value: bson.M{"$meta": "textScore"}}, {Key: "_id", Value: 1}}, sc.opts.Sort)
+
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &page))
+		assert.Equal(t, int64(3), page.Total)
+		assert.Len(t, page.Data, 2)
+		assert.Equal(t, 2.5, page.Data[0].Score)
+		assert.Equal(t, []string{"<em>google</em>"}, page.Data[0].Highlights["vendor"])
+		assert.Equal(t, []string{"<em>charger</em>"}, page.Data[0].Highlights["accessories"])
+		assert.Empty(t, page.Prev)
+		assert.NotEmpty(t, page.Next)
+	})
+
+	t.Run("missing query", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/products/search", nil)
+		res := httptest.NewRecorder()
+		serve(ph.SearchProducts, e.NewContext(req, res))
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+	})
+}
+
+func TestHighlight(t *testing.T) {
+	tests := []struct {
+		value   string
+		terms   []string
+		want    string
+		matched bool
+	}{
+		{"Google Home", []string{"home"}, "Google <em>Home</em>", true},
+		{"fast chargers", []string{"charger"}, "fast <em>chargers</em>", true},
+		{"<b>pixel</b>", []string{"pixel"}, "&lt;b&gt;<em>pixel</em>&lt;/b&gt;", true},
+		{"nest", []string{"pixel"}, "nest", false},
+	}
+	for _, tt := range tests {
+		got, matched := highlight(tt.value, tt.terms)
+		assert.Equal(t, tt.want, got)
+		assert.Equal(t, tt.matched, matched)
+	}
+	assert.Equal(t, []string{"pixel", "phone"}, searchTerms(`"Pixel" -case phone`))
+}
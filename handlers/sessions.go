@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/nitin06890/go-rest-api/problem"
+	"github.com/nitin06890/go-rest-api/store"
+)
+
+const (
+	headerAuthToken    = "x-auth-token"
+	headerRefreshToken = "x-refresh-token"
+
+	// jwtContextKey is where the echojwt middleware stores the parsed token
+	jwtContextKey = "user"
+)
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+type tokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// newRefreshSecret returns the random secret of a refresh token and its hash
+func newRefreshSecret() (string, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+	return encoded, hashToken(encoded), nil
+}
+
+// refreshToken returns the refresh token of the session. The token is the
+// session ID and the secret separated by a dot.
+func refreshToken(sid, secret string) string {
+	return sid + "." + secret
+}
+
+// parseRefreshToken returns the session ID and the secret hash of a refresh token
+func parseRefreshToken(token string) (string, string, error) {
+	sid, secret, ok := strings.Cut(token, ".")
+	if !ok || sid == "" || secret == "" {
+		return "", "", errors.New("malformed refresh token")
+	}
+	return sid, hashToken(secret), nil
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// startSession returns the ID and the refresh token of a new session of the
+// user. Only the secret is hashed, so the session can be stored before the
+// repository gives it the ID the token starts with.
+func startSession(ctx context.Context, username string, sessions SessionRepository) (string, string, *problem.Problem) {
+	secret, hash, err := newRefreshSecret()
+	if err != nil {
+		log.Errorf("Unable to generate the refresh token: %v", err)
+		return "", "", problem.New(http.StatusInternalServerError, "Unable to generate the refresh token")
+	}
+	now := time.Now().UTC()
+	sess, err := sessions.Create(ctx, store.Session{
+		Username:       username,
+		TokenHash:      hash,
+		PreviousHashes: []string{},
+		CreatedAt:      now,
+		ExpiresAt:      now.Add(prop.RefreshTokenTTL),
+	})
+	if err != nil {
+		log.Errorf("Unable to insert the session: %v", err)
+		return "", "", problem.New(http.StatusInternalServerError, "Unable to start the session")
+	}
+	sid := string(sess.ID)
+	return sid, refreshToken(sid, secret), nil
+}
+
+// rotateSession exchanges a refresh token for a new one. Presenting a token
+// that was already exchanged revokes the session.
+func rotateSession(ctx context.Context, token string, sessions SessionRepository) (store.Session, string, *problem.Problem) {
+	invalid := problem.New(http.StatusUnauthorized, "Invalid refresh token")
+	sid, hash, err := parseRefreshToken(token)
+	if err != nil {
+		log.Errorf("Unable to parse the refresh token: %v", err)
+		return store.Session{}, "", invalid
+	}
+	sess, err := sessions.FindByID(ctx, sid)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) || errors.Is(err, store.ErrInvalidID) {
+			log.Errorf("Session %s doesn't exist", sid)
+			return sess, "", invalid
+		}
+		log.Errorf("Unable to decode the session: %v", err)
+		return sess, "", problem.New(http.StatusInternalServerError, "Unable to find the session")
+	}
+	if sess.Revoked || time.Now().After(sess.ExpiresAt) {
+		log.Errorf("Session %s is revoked or expired", sid)
+		return sess, "", invalid
+	}
+	for _, h := range sess.PreviousHashes {
+		if h == hash {
+			log.Errorf("Refresh token of session %s reused, revoking it", sid)
+			if p := revokeSession(ctx, sid, sessions); p != nil {
+				return sess, "", p
+			}
+			return sess, "", problem.New(http.StatusUnauthorized, "Refresh token reused, the session is revoked")
+		}
+	}
+	if hash != sess.TokenHash {
+		log.Errorf("Unknown refresh token for session %s", sid)
+		return sess, "", invalid
+	}
+
+	secret, newHash, err := newRefreshSecret()
+	if err != nil {
+		log.Errorf("Unable to generate the refresh token: %v", err)
+		return sess, "", problem.New(http.StatusInternalServerError, "Unable to generate the refresh token")
+	}
+	sess, err = sessions.Rotate(ctx, sid, hash, newHash)
+	if errors.Is(err, store.ErrConflict) {
+		log.Errorf("Refresh token of session %s used concurrently, revoking it", sid)
+		if p := revokeSession(ctx, sid, sessions); p != nil {
+			return sess, "", p
+		}
+		return sess, "", problem.New(http.StatusUnauthorized, "Refresh token reused, the session is revoked")
+	}
+	if err != nil {
+		log.Errorf("Unable to rotate the refresh token: %v", err)
+		return sess, "", problem.New(http.StatusInternalServerError, "Unable to rotate the refresh token")
+	}
+	return sess, refreshToken(sid, secret), nil
+}
+
+func revokeSession(ctx context.Context, sid string, sessions SessionRepository) *problem.Problem {
+	if err := sessions.Revoke(ctx, sid); err != nil {
+		log.Errorf("Unable to revoke the session: %v", err)
+		return problem.New(http.StatusInternalServerError, "Unable to revoke the session")
+	}
+	return nil
+}
+
+// revokeUserSessions revokes every session of the user
+func revokeUserSessions(ctx context.Context, username string, sessions SessionRepository) *problem.Problem {
+	if err := sessions.RevokeUser(ctx, username); err != nil {
+		log.Errorf("Unable to revoke the sessions of %s: %v", username, err)
+		return problem.New(http.StatusInternalServerError, "Unable to revoke the sessions")
+	}
+	return nil
+}
+
+// sessionID returns the session of the access token validated by echojwt
+func sessionID(c echo.Context) (string, bool) {
+	token, ok := c.Get(jwtContextKey).(*jwt.Token)
+	if !ok {
+		return "", false
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return "", false
+	}
+	sid, ok := claims["sid"].(string)
+	return sid, ok && sid != ""
+}
+
+// RequireSession rejects access tokens whose session was revoked or has
+// expired. It must run after the echojwt middleware.
+func (h *UsersHandler) RequireSession(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		sid, ok := sessionID(c)
+		if !ok {
+			log.Errorf("Access token without a session")
+			return problem.New(http.StatusUnauthorized, "Invalid access token")
+		}
+		sess, err := h.Sessions.FindByID(c.Request().Context(), sid)
+		if err != nil {
+			if errors.Is(err, store.ErrNotFound) || errors.Is(err, store.ErrInvalidID) {
+				log.Errorf("Session %s doesn't exist", sid)
+				return problem.New(http.StatusUnauthorized, "Invalid access token")
+			}
+			log.Errorf("Unable to decode the session: %v", err)
+			return problem.New(http.StatusInternalServerError, "Unable to find the session")
+		}
+		if sess.Revoked || time.Now().After(sess.ExpiresAt) {
+			log.Errorf("Session %s is revoked or expired", sid)
+			return problem.New(http.StatusUnauthorized, "Session is no longer valid")
+		}
+		return next(c)
+	}
+}
+
+// issueTokens starts a session for the user and sets its tokens on the response
+func (h *UsersHandler) issueTokens(ctx context.Context, c echo.Context, user store.User) (tokenPair, *problem.Problem) {
+	sid, refreshToken, err := startSession(ctx, user.Email, h.Sessions)
+	if err != nil {
+		return tokenPair{}, err
+	}
+	return h.setTokens(c, user, sid, refreshToken)
+}
+
+func (h *UsersHandler) setTokens(c echo.Context, user store.User, sid, refreshToken string) (tokenPair, *problem.Problem) {
+	token, err := generateToken(user, h.Keys, sid)
+	if err != nil {
+		log.Errorf("Unable to generate token: %v", err)
+		return tokenPair{}, problem.New(http.StatusInternalServerError, "Unable to generate token")
+	}
+	c.Response().Header().Set(headerAuthToken, token)
+	c.Response().Header().Set(headerRefreshToken, refreshToken)
+	return tokenPair{
+		AccessToken:  token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(prop.AccessTokenTTL / time.Second),
+	}, nil
+}
+
+// RefreshToken exchanges a refresh token for a new access and refresh token
+func (h *UsersHandler) RefreshToken(c echo.Context) error {
+	var req refreshRequest
+	ctx := c.Request().Context()
+	if err := c.Bind(&req); err != nil {
+		log.Errorf("Unable to bind the refresh request: %v", err)
+		return problem.New(http.StatusBadRequest, "Unable to bind the refresh request")
+	}
+	if err := v.Struct(req); err != nil {
+		log.Errorf("Unable to validate the refresh request: %v", err)
+		return validationError("Unable to validate the refresh request", err)
+	}
+	sess, refreshToken, err := rotateSession(ctx, req.RefreshToken, h.Sessions)
+	if err != nil {
+		return err
+	}
+	user, findErr := h.Users.FindByUsername(ctx, sess.Username)
+	if findErr != nil {
+		log.Errorf("Unable to find the user of session %s: %v", sess.ID, findErr)
+		return problem.New(http.StatusUnauthorized, "Invalid refresh token")
+	}
+	if user.Disabled() {
+		log.Errorf("User %s is disabled", user.Email)
+		return problem.New(http.StatusForbidden, "User is disabled")
+	}
+	if user.Unverified() && !prop.AllowUnverifiedLogin {
+		log.Errorf("User %s is not verified", user.Email)
+		return problem.New(http.StatusForbidden, "Email address is not verified")
+	}
+	tokens, err := h.setTokens(c, user, string(sess.ID), refreshToken)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, tokens)
+}
+
+// Logout revokes the session of the access token
+func (h *UsersHandler) Logout(c echo.Context) error {
+	sid, ok := sessionID(c)
+	if !ok {
+		log.Errorf("Access token without a session")
+		return problem.New(http.StatusUnauthorized, "Invalid access token")
+	}
+	if err := revokeSession(c.Request().Context(), sid, h.Sessions); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
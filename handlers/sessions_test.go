@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	mongostore "github.com/nitin06890/go-rest-api/store/mongo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessions(t *testing.T) {
+	e := echo.New()
+	uh := UsersHandler{Users: &mongostore.Users{Col: usersCol}, Sessions: &mongostore.Sessions{Col: sessCol}, Tokens: &mongostore.UserTokens{Col: tokCol}, Attempts: &mongostore.LoginAttempts{Col: attCol}, Keys: keys, Mailer: outbox, Events: emitted}
+	credentials := `{"username":"tommy.dummy@gmail.com","password":"qwertyuiop"}`
+
+	post := func(handler echo.HandlerFunc, body string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		res := httptest.NewRecorder()
+		serve(handler, e.NewContext(req, res))
+		return res
+	}
+	refresh := func(token string) *httptest.ResponseRecorder {
+		return post(uh.RefreshToken, `{"refresh_token":"`+token+`"}`, nil)
+	}
+	// protected runs a handler behind the same middleware as the API routes
+	protected := func(handler echo.HandlerFunc, accessToken string) *httptest.ResponseRecorder {
+		return post(jwtMiddleware()(uh.RequireSession(handler)), "", http.Header{"X-Auth-Token": {accessToken}})
+	}
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+
+	res := post(uh.CreateUser, credentials, nil)
+	assert.Equal(t, http.StatusCreated, res.Code)
+	res = post(uh.VerifyEmail, `{"token":"`+mailedToken(t, outbox, "tommy.dummy@gmail.com")+`"}`, nil)
+	assert.Equal(t, http.StatusNoContent, res.Code)
+
+	res = post(uh.AuthnUser, credentials, nil)
+	assert.Equal(t, http.StatusOK, res.Code)
+	accessToken := res.Header().Get(headerAuthToken)
+	refreshToken := res.Header().Get(headerRefreshToken)
+	assert.NotEmpty(t, accessToken)
+	assert.NotEmpty(t, refreshToken)
+	assert.Equal(t, http.StatusOK, protected(ok, accessToken).Code)
+
+	t.Run("login with a wrong password", func(t *testing.T) {
+		res := post(uh.AuthnUser, `{"username":"tommy.dummy@gmail.com","password":"wrongpassword"}`, nil)
+		assert.Equal(t, http.StatusUnauthorized, res.Code)
+	})
+
+	t.Run("refresh rotates the refresh token", func(t *testing.T) {
+		var tokens tokenPair
+		res := refresh(refreshToken)
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &tokens))
+		assert.NotEqual(t, refreshToken, tokens.RefreshToken)
+		assert.Equal(t, http.StatusOK, protected(ok, tokens.AccessToken).Code)
+
+		res = refresh(tokens.RefreshToken)
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &tokens))
+		refreshToken = tokens.RefreshToken
+	})
+
+	t.Run("unknown refresh token", func(t *testing.T) {
+		sid := strings.SplitN(refreshToken, ".", 2)[0]
+		assert.Equal(t, http.StatusUnauthorized, refresh(sid+".forged").Code)
+		assert.Equal(t, http.StatusUnauthorized, refresh("garbage").Code)
+		// a forged token doesn't revoke the session
+		res := refresh(refreshToken)
+		assert.Equal(t, http.StatusOK, res.Code)
+		refreshToken = res.Header().Get(headerRefreshToken)
+	})
+
+	t.Run("reuse revokes the family", func(t *testing.T) {
+		res := post(uh.AuthnUser, credentials, nil)
+		first := res.Header().Get(headerRefreshToken)
+		res = refresh(first)
+		assert.Equal(t, http.StatusOK, res.Code)
+		second := res.Header().Get(headerRefreshToken)
+		accessToken := res.Header().Get(headerAuthToken)
+
+		assert.Equal(t, http.StatusUnauthorized, refresh(first).Code)
+		assert.Equal(t, http.StatusUnauthorized, refresh(second).Code)
+		assert.Equal(t, http.StatusUnauthorized, protected(ok, accessToken).Code)
+
+		// other sessions of the user are unaffected
+		assert.Equal(t, http.StatusOK, refresh(refreshToken).Code)
+	})
+
+	t.Run("logout revokes the session", func(t *testing.T) {
+		res := post(uh.AuthnUser, credentials, nil)
+		accessToken := res.Header().Get(headerAuthToken)
+		refreshToken := res.Header().Get(headerRefreshToken)
+
+		assert.Equal(t, http.StatusNoContent, protected(uh.Logout, accessToken).Code)
+		assert.Equal(t, http.StatusUnauthorized, protected(ok, accessToken).Code)
+		assert.Equal(t, http.StatusUnauthorized, refresh(refreshToken).Code)
+	})
+}
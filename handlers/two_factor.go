@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/nitin06890/go-rest-api/problem"
+	"github.com/nitin06890/go-rest-api/store"
+	"github.com/nitin06890/go-rest-api/totp"
+)
+
+const (
+	purposeTwoFactor = "2fa"
+	// recoveryCodes is the number of recovery codes given on enrollment
+	recoveryCodes = 10
+	// totpSkew is the number of steps codes may be early or late by
+	totpSkew = 1
+)
+
+type totpEnrollment struct {
+	Secret     string `json:"secret"`
+	OtpauthURI string `json:"otpauth_uri"`
+}
+
+type totpConfirmation struct {
+	Code string `json:"code" validate:"required,len=6,numeric"`
+}
+
+// totpConfirmed carries the recovery codes, shown once, and the tokens of
+// the new session
+type totpConfirmed struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+	tokenPair
+}
+
+type twoFactorChallenge struct {
+	ChallengeToken string `json:"challenge_token"`
+	ExpiresIn      int64  `json:"expires_in"`
+}
+
+type twoFactorRequest struct {
+	ChallengeToken string `json:"challenge_token" validate:"required"`
+	Code           string `json:"code" validate:"required_without=RecoveryCode,omitempty,len=6,numeric"`
+	RecoveryCode   string `json:"recovery_code" validate:"required_without=Code"`
+}
+
+// twoFactorRequired reports whether a role of the user requires a second factor
+func twoFactorRequired(u store.User) bool {
+	for _, required := range prop.TwoFactorRoles {
+		for _, r := range u.AllRoles() {
+			if r == strings.TrimSpace(required) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newRecoveryCodes returns recovery codes and their hashes
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodes)
+	hashes := make([]string, 0, recoveryCodes)
+	for i := 0; i < recoveryCodes; i++ {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hashToken(code))
+	}
+	return codes, hashes, nil
+}
+
+// recoveryCodeHash returns the hash of a recovery code as typed by the user
+func recoveryCodeHash(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return hashToken(code)
+}
+
+// EnrollTOTP starts the enrollment of a TOTP second factor for the current
+// user. It only applies once confirmed with a code from the authenticator.
+func (h *UsersHandler) EnrollTOTP(c echo.Context) error {
+	ctx := c.Request().Context()
+	user, httpErr := findCurrentUser(ctx, c, h.Users)
+	if httpErr != nil {
+		return httpErr
+	}
+	if user.TwoFactor() {
+		log.Errorf("User %s already enrolled a second factor", user.Email)
+		return problem.New(http.StatusConflict, "Two-factor authentication is already enabled")
+	}
+	secret, err := totp.NewSecret()
+	if err != nil {
+		log.Errorf("Unable to generate the TOTP secret: %v", err)
+		return problem.New(http.StatusInternalServerError, "Unable to generate the secret")
+	}
+	factor := store.TOTPFactor{Secret: secret, RecoveryCodes: []string{}}
+	if err := h.Users.Update(ctx, string(user.ID), store.UserUpdate{TOTP: &factor}); err != nil {
+		log.Errorf("Unable to store the TOTP secret: %v", err)
+		return problem.New(http.StatusInternalServerError, "Unable to store the secret")
+	}
+	return c.JSON(http.StatusOK, totpEnrollment{
+		Secret:     secret,
+		OtpauthURI: totp.URI(prop.TwoFactorIssuer, user.Email, secret),
+	})
+}
+
+// ConfirmTOTP enables the second factor enrolled by the current user with a
+// code from their authenticator. It returns the recovery codes, revokes
+// every session of the user and starts a new one for the caller.
+func (h *UsersHandler) ConfirmTOTP(c echo.Context) error {
+	var req totpConfirmation
+	ctx := c.Request().Context()
+	if err := c.Bind(&req); err != nil {
+		log.Errorf("Unable to bind the TOTP confirmation: %v", err)
+		return problem.New(http.StatusBadRequest, "Unable to bind the request")
+	}
+	if err := v.Struct(req); err != nil {
+		log.Errorf("Unable to validate the TOTP confirmation: %v", err)
+		return validationError("Unable to validate the request", err)
+	}
+	user, httpErr := findCurrentUser(ctx, c, h.Users)
+	if httpErr != nil {
+		return httpErr
+	}
+	if user.TOTP == nil {
+		log.Errorf("User %s has no second factor to confirm", user.Email)
+		return problem.New(http.StatusConflict, "Enroll a second factor first")
+	}
+	if user.TwoFactor() {
+		log.Errorf("User %s already enrolled a second factor", user.Email)
+		return problem.New(http.StatusConflict, "Two-factor authentication is already enabled")
+	}
+	step, ok := totp.Validate(user.TOTP.Secret, req.Code, time.Now(), totpSkew)
+	if !ok {
+		log.Errorf("Invalid TOTP code for %s", user.Email)
+		return problem.New(http.StatusBadRequest, "Invalid code").With("field", "code")
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		log.Errorf("Unable to generate the recovery codes: %v", err)
+		return problem.New(http.StatusInternalServerError, "Unable to generate the recovery codes")
+	}
+	user.TOTP.Confirmed, user.TOTP.LastStep, user.TOTP.RecoveryCodes = true, step, hashes
+	// the secret is checked again so a concurrent enrollment isn't confirmed
+	confirmed, err := h.Users.ConfirmTOTP(ctx, string(user.ID), *user.TOTP)
+	if err != nil {
+		log.Errorf("Unable to confirm the second factor: %v", err)
+		return problem.New(http.StatusInternalServerError, "Unable to confirm the second factor")
+	}
+	if !confirmed {
+		log.Errorf("The second factor of %s changed while confirming it", user.Email)
+		return problem.New(http.StatusConflict, "The second factor changed, enroll again")
+	}
+	// sessions started with the password only don't carry the second factor
+	if httpErr := revokeUserSessions(ctx, user.Email, h.Sessions); httpErr != nil {
+		return httpErr
+	}
+	tokens, httpErr := h.issueTokens(ctx, c, store.User{ID: user.ID, Email: user.Email, Roles: user.AllRoles(), Status: user.Status, TOTP: user.TOTP})
+	if httpErr != nil {
+		return httpErr
+	}
+	return c.JSON(http.StatusOK, totpConfirmed{RecoveryCodes: codes, tokenPair: tokens})
+}
+
+// challengeTwoFactor answers a login with the right password of a user with
+// a second factor. The challenge token is exchanged for the session tokens
+// with a code at POST /auth/2fa.
+func (h *UsersHandler) challengeTwoFactor(ctx context.Context, c echo.Context, user store.User) error {
+	token, httpErr := issueUserToken(ctx, user.Email, purposeTwoFactor, prop.ChallengeTTL, h.Tokens)
+	if httpErr != nil {
+		return httpErr
+	}
+	return c.JSON(http.StatusAccepted, twoFactorChallenge{
+		ChallengeToken: token,
+		ExpiresIn:      int64(prop.ChallengeTTL / time.Second),
+	})
+}
+
+// useSecondFactor checks a TOTP code or a recovery code of the user and
+// makes sure it cannot be used again
+func useSecondFactor(ctx context.Context, user store.User, req twoFactorRequest, h *UsersHandler) (bool, *problem.Problem) {
+	var used bool
+	var err error
+	if req.Code != "" {
+		step, ok := totp.Validate(user.TOTP.Secret, req.Code, time.Now(), totpSkew)
+		if !ok {
+			return false, nil
+		}
+		used, err = h.Users.UseTOTPStep(ctx, string(user.ID), step)
+	} else {
+		used, err = h.Users.UseRecoveryCode(ctx, string(user.ID), recoveryCodeHash(req.RecoveryCode))
+	}
+	if err != nil {
+		log.Errorf("Unable to use the second factor of %s: %v", user.Email, err)
+		return false, problem.New(http.StatusInternalServerError, "Unable to check the code")
+	}
+	// codes used before are not used again
+	return used, nil
+}
+
+// VerifyTwoFactor completes a login with the challenge token and either a
+// TOTP code or a recovery code. A challenge token can only be tried once.
+func (h *UsersHandler) VerifyTwoFactor(c echo.Context) error {
+	var req twoFactorRequest
+	ctx := c.Request().Context()
+	if err := c.Bind(&req); err != nil {
+		log.Errorf("Unable to bind the second factor: %v", err)
+		return problem.New(http.StatusBadRequest, "Unable to bind the request")
+	}
+	if err := v.Struct(req); err != nil {
+		log.Errorf("Unable to validate the second factor: %v", err)
+		return validationError("Unable to validate the request", err)
+	}
+	challenge, httpErr := consumeUserToken(ctx, req.ChallengeToken, purposeTwoFactor, h.Tokens)
+	if httpErr != nil {
+		if httpErr.Status == http.StatusBadRequest {
+			httpErr.With("field", "challenge_token")
+		}
+		return httpErr
+	}
+	throttles := loginThrottles(challenge.Username, c.RealIP())
+	if wait, err := lockedOut(ctx, throttles, h.Attempts); err != nil {
+		return err
+	} else if wait > 0 {
+		return tooManyAttempts(c, wait)
+	}
+	user, err := h.Users.FindByUsername(ctx, challenge.Username)
+	if err != nil {
+		if err == store.ErrNotFound {
+			log.Errorf("User by %s doesn't exist", challenge.Username)
+			return problem.New(http.StatusUnauthorized, "User doesn't exist")
+		}
+		log.Errorf("Unable to decode retrieved user: %v", err)
+		return problem.New(http.StatusUnprocessableEntity, "Unable to decode retrieved user")
+	}
+	if user.Disabled() {
+		log.Errorf("User %s is disabled", user.Email)
+		return problem.New(http.StatusForbidden, "User is disabled")
+	}
+	if !user.TwoFactor() {
+		log.Errorf("User %s has no second factor", user.Email)
+		return problem.New(http.StatusConflict, "Two-factor authentication is not enabled")
+	}
+
+	ok, httpErr := useSecondFactor(ctx, user, req, h)
+	if httpErr != nil {
+		return httpErr
+	}
+	if !ok {
+		log.Errorf("Invalid second factor for %s", user.Email)
+		if wait, err := h.recordLoginFailure(ctx, throttles, c.RealIP()); err != nil {
+			return err
+		} else if wait > 0 {
+			return tooManyAttempts(c, wait)
+		}
+		return problem.New(http.StatusUnauthorized, "Invalid code, log in again")
+	}
+	if err := clearLoginFailures(ctx, throttles[0], h.Attempts); err != nil {
+		return err
+	}
+	if _, err := h.issueTokens(ctx, c, user); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, store.User{Email: user.Email})
+}
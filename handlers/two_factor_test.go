@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/nitin06890/go-rest-api/events"
+	"github.com/nitin06890/go-rest-api/store"
+	mongostore "github.com/nitin06890/go-rest-api/store/mongo"
+	"github.com/nitin06890/go-rest-api/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTwoFactor(t *testing.T) {
+	ctx := context.Background()
+	e := echo.New()
+	saved := prop
+	users, sessions, tokens := db.Collection("2fa_users"), db.Collection("2fa_sessions"), db.Collection("2fa_tokens")
+	attempts := db.Collection("2fa_attempts")
+	uh := UsersHandler{Users: &mongostore.Users{Col: users}, Sessions: &mongostore.Sessions{Col: sessions}, Tokens: &mongostore.UserTokens{Col: tokens}, Attempts: &mongostore.LoginAttempts{Col: attempts}, Keys: keys, Events: &events.Memory{}}
+	t.Cleanup(func() {
+		prop = saved
+		users.Drop(ctx)
+		sessions.Drop(ctx)
+		tokens.Drop(ctx)
+		attempts.Drop(ctx)
+	})
+
+	_, httpErr := insertUser(ctx, store.User{Email: "judy@example.com", Password: "qwertyuiop", Roles: []string{RoleAdmin}}, uh.Users)
+	assert.Nil(t, httpErr)
+	post := func(handler echo.HandlerFunc, body, accessToken string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if accessToken != "" {
+			req.Header.Set(headerAuthToken, accessToken)
+			handler = jwtMiddleware()(uh.RequireSession(handler))
+		}
+		res := httptest.NewRecorder()
+		serve(handler, e.NewContext(req, res))
+		return res
+	}
+	login := func() *httptest.ResponseRecorder {
+		return post(uh.AuthnUser, `{"username":"judy@example.com","password":"qwertyuiop"}`, "")
+	}
+	challenge := func() string {
+		var ch twoFactorChallenge
+		res := login()
+		assert.Equal(t, http.StatusAccepted, res.Code)
+		assert.Empty(t, res.Header().Get(headerAuthToken))
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &ch))
+		assert.NotEmpty(t, ch.ChallengeToken)
+		return ch.ChallengeToken
+	}
+	permissions := func(accessToken string) interface{} {
+		token, err := jwt.Parse(accessToken, keys.Keyfunc)
+		assert.Nil(t, err)
+		return token.Claims.(jwt.MapClaims)["permissions"]
+	}
+
+	var secret string
+	var recovery []string
+	accessToken := login().Header().Get(headerAuthToken)
+
+	t.Run("roles can require a second factor", func(t *testing.T) {
+		prop.TwoFactorRoles = []string{RoleAdmin}
+		res := login()
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Empty(t, permissions(res.Header().Get(headerAuthToken)))
+	})
+
+	t.Run("enroll", func(t *testing.T) {
+		var enrollment totpEnrollment
+		res := post(uh.EnrollTOTP, "", accessToken)
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &enrollment))
+		assert.True(t, strings.HasPrefix(enrollment.OtpauthURI, "otpauth://totp/"))
+		assert.Contains(t, enrollment.OtpauthURI, "secret="+enrollment.Secret)
+		secret = enrollment.Secret
+
+		// logins don't ask for the second factor until it is confirmed
+		assert.Equal(t, http.StatusOK, login().Code)
+	})
+
+	t.Run("confirm", func(t *testing.T) {
+		var confirmed totpConfirmed
+		res := post(uh.ConfirmTOTP, `{"code":"000000"}`, accessToken)
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+
+		code, err := totp.Code(secret, time.Now())
+		assert.Nil(t, err)
+		res = post(uh.ConfirmTOTP, `{"code":"`+code+`"}`, accessToken)
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &confirmed))
+		assert.Len(t, confirmed.RecoveryCodes, recoveryCodes)
+		assert.NotEmpty(t, permissions(confirmed.AccessToken))
+		recovery = confirmed.RecoveryCodes
+
+		// sessions started with the password only are revoked
+		assert.Equal(t, http.StatusUnauthorized, post(uh.EnrollTOTP, "", accessToken).Code)
+		accessToken = confirmed.AccessToken
+		assert.Equal(t, http.StatusConflict, post(uh.EnrollTOTP, "", accessToken).Code)
+	})
+
+	t.Run("log in with a code", func(t *testing.T) {
+		// the code of the confirmation was used, so take the next one
+		code, err := totp.Code(secret, time.Now().Add(totp.Period))
+		assert.Nil(t, err)
+		res := post(uh.VerifyTwoFactor, `{"challenge_token":"`+challenge()+`","code":"`+code+`"}`, "")
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.NotEmpty(t, permissions(res.Header().Get(headerAuthToken)))
+
+		// neither codes nor challenges can be used twice
+		token := challenge()
+		res = post(uh.VerifyTwoFactor, `{"challenge_token":"`+token+`","code":"`+code+`"}`, "")
+		assert.Equal(t, http.StatusUnauthorized, res.Code)
+		res = post(uh.VerifyTwoFactor, `{"challenge_token":"`+token+`","code":"`+code+`"}`, "")
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+	})
+
+	t.Run("log in with a recovery code", func(t *testing.T) {
+		body := `{"challenge_token":"` + challenge() + `","recovery_code":"` + strings.ToUpper(recovery[0]) + `"}`
+		assert.Equal(t, http.StatusOK, post(uh.VerifyTwoFactor, body, "").Code)
+		body = `{"challenge_token":"` + challenge() + `","recovery_code":"` + recovery[0] + `"}`
+		assert.Equal(t, http.StatusUnauthorized, post(uh.VerifyTwoFactor, body, "").Code)
+	})
+
+	t.Run("a code or a recovery code is required", func(t *testing.T) {
+		res := post(uh.VerifyTwoFactor, `{"challenge_token":"`+challenge()+`"}`, "")
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+	})
+
+	t.Run("wrong codes lock the account out", func(t *testing.T) {
+		prop.LockoutThreshold = 3
+		var res *httptest.ResponseRecorder
+		for i := 0; i < prop.LockoutThreshold && (res == nil || res.Code != http.StatusTooManyRequests); i++ {
+			// the password is right every time
+			res = post(uh.VerifyTwoFactor, `{"challenge_token":"`+challenge()+`","code":"000000"}`, "")
+		}
+		assert.Equal(t, http.StatusTooManyRequests, res.Code)
+		assert.Equal(t, http.StatusTooManyRequests, login().Code)
+	})
+}
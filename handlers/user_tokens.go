@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/nitin06890/go-rest-api/dbiface"
+	"github.com/nitin06890/go-rest-api/mailer"
+	"github.com/nitin06890/go-rest-api/problem"
+	"github.com/nitin06890/go-rest-api/store"
+)
+
+// Purposes of the tokens mailed to users
+const (
+	purposeReset  = "reset"
+	purposeVerify = "verify"
+)
+
+type forgotRequest struct {
+	Username string `json:"username" validate:"required,email"`
+}
+
+type verifyRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type resetRequest struct {
+	Token       string `json:"token" validate:"required"`
+	NewPassword string `json:"new_password" validate:"required,min=8,max=300"`
+}
+
+// issueUserToken stores a new token of the purpose for the user, replacing
+// the unused ones issued before, and returns it
+func issueUserToken(ctx context.Context, username, purpose string, ttl time.Duration, tokens UserTokenRepository) (string, *problem.Problem) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Errorf("Unable to generate the %s token: %v", purpose, err)
+		return "", problem.New(http.StatusInternalServerError, "Unable to generate the token")
+	}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+	now := time.Now().UTC()
+	err := tokens.Issue(ctx, store.UserToken{
+		Username:  username,
+		Purpose:   purpose,
+		TokenHash: hashToken(token),
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	})
+	if err != nil {
+		log.Errorf("Unable to store the %s token: %v", purpose, err)
+		return "", problem.New(http.StatusInternalServerError, "Unable to store the token")
+	}
+	return token, nil
+}
+
+// consumeUserToken marks a valid token of the purpose as used and returns it.
+// Unknown, used and expired tokens are all reported the same way.
+func consumeUserToken(ctx context.Context, token, purpose string, tokens UserTokenRepository) (store.UserToken, *problem.Problem) {
+	ut, err := tokens.Consume(ctx, hashToken(token), purpose, time.Now().UTC())
+	if errors.Is(err, store.ErrNotFound) {
+		log.Errorf("Invalid or expired %s token", purpose)
+		return ut, problem.New(http.StatusBadRequest, "Invalid or expired token").With("field", "token")
+	}
+	if err != nil {
+		log.Errorf("Unable to consume the %s token: %v", purpose, err)
+		return ut, problem.New(http.StatusInternalServerError, "Unable to check the token")
+	}
+	return ut, nil
+}
+
+// link returns the public URL of path carrying the token
+func link(path, token string) string {
+	return fmt.Sprintf("%s%s?token=%s", prop.PublicURL, path, url.QueryEscape(token))
+}
+
+// ForgotPassword mails a password reset link to the user in the background.
+// The response is the same whether the user exists or not.
+func (h *UsersHandler) ForgotPassword(c echo.Context) error {
+	var req forgotRequest
+	ctx := c.Request().Context()
+	if err := c.Bind(&req); err != nil {
+		log.Errorf("Unable to bind the forgot password request: %v", err)
+		return problem.New(http.StatusBadRequest, "Unable to bind the request")
+	}
+	if err := v.Struct(req); err != nil {
+		log.Errorf("Unable to validate the forgot password request: %v", err)
+		return validationError("Unable to validate the request", err)
+	}
+	accepted := func() error {
+		return c.JSON(http.StatusAccepted, map[string]string{
+			"message": "If the user exists, a password reset link was sent to them",
+		})
+	}
+
+	user, err := h.Users.FindByUsername(ctx, req.Username)
+	if err != nil {
+		if err != store.ErrNotFound {
+			log.Errorf("Unable to decode retrieved user: %v", err)
+			return problem.New(http.StatusInternalServerError, "Unable to process the request")
+		}
+		log.Infof("Password reset requested for unknown user %s", req.Username)
+		return accepted()
+	}
+	if user.Disabled() {
+		log.Infof("Password reset requested for disabled user %s", req.Username)
+		return accepted()
+	}
+	// issuing the token and mailing it take time, which would tell that the
+	// user exists if the response waited for them. They outlive the request,
+	// so only its correlation ID is kept.
+	bgCtx := dbiface.WithCorrelationID(context.Background(), dbiface.CorrelationID(ctx))
+	h.background.Add(1)
+	go func() {
+		defer h.background.Done()
+		h.sendPasswordReset(bgCtx, user.Email)
+	}()
+	return accepted()
+}
+
+// sendPasswordReset issues a password reset token to the user and mails it.
+// Failures are only logged since the request was already answered.
+func (h *UsersHandler) sendPasswordReset(ctx context.Context, email string) {
+	token, httpErr := issueUserToken(ctx, email, purposeReset, prop.ResetTokenTTL, h.Tokens)
+	if httpErr != nil {
+		log.Errorf("Unable to issue the password reset token of %s: %v", email, httpErr)
+		return
+	}
+	msg := mailer.Message{
+		To:      email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Someone asked to reset the password of your account.\n\n"+
+			"Follow this link within %s to choose a new password:\n%s\n\n"+
+			"If it wasn't you, ignore this email and your password will stay the same.\n",
+			prop.ResetTokenTTL, link("/reset-password", token)),
+	}
+	if err := h.Mailer.Send(ctx, msg); err != nil {
+		log.Errorf("Unable to send the password reset email to %s: %v", email, err)
+	}
+}
+
+// Wait waits for the emails being sent in the background
+func (h *UsersHandler) Wait() {
+	h.background.Wait()
+}
+
+// ResetPassword sets a new password with a token mailed by ForgotPassword
+// and revokes every session of the user
+func (h *UsersHandler) ResetPassword(c echo.Context) error {
+	var req resetRequest
+	ctx := c.Request().Context()
+	if err := c.Bind(&req); err != nil {
+		log.Errorf("Unable to bind the reset password request: %v", err)
+		return problem.New(http.StatusBadRequest, "Unable to bind the request")
+	}
+	if err := v.Struct(req); err != nil {
+		log.Errorf("Unable to validate the reset password request: %v", err)
+		return validationError("Unable to validate the request", err)
+	}
+	ut, httpErr := consumeUserToken(ctx, req.Token, purposeReset, h.Tokens)
+	if httpErr != nil {
+		return httpErr
+	}
+	user, err := h.Users.FindByUsername(ctx, ut.Username)
+	if err == store.ErrNotFound {
+		// the user was deleted since the token was issued
+		log.Infof("Password reset for deleted user %s", ut.Username)
+		return c.NoContent(http.StatusNoContent)
+	}
+	if err != nil {
+		log.Errorf("Unable to decode retrieved user: %v", err)
+		return problem.New(http.StatusInternalServerError, "Unable to reset the password")
+	}
+	if httpErr := setPassword(ctx, user, req.NewPassword, h); httpErr != nil {
+		return httpErr
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// sendVerification mails an email verification link to the user. Failing
+// to send it is only logged, since the user can ask for another link.
+func (h *UsersHandler) sendVerification(ctx context.Context, username string) *problem.Problem {
+	token, httpErr := issueUserToken(ctx, username, purposeVerify, prop.VerifyTokenTTL, h.Tokens)
+	if httpErr != nil {
+		return httpErr
+	}
+	msg := mailer.Message{
+		To:      username,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Welcome!\n\nFollow this link within %s to verify your email address:\n%s\n",
+			prop.VerifyTokenTTL, link("/verify-email", token)),
+	}
+	if err := h.Mailer.Send(ctx, msg); err != nil {
+		log.Errorf("Unable to send the verification email to %s: %v", username, err)
+	}
+	return nil
+}
+
+// VerifyEmail confirms the email address of a user with a token mailed at sign up
+func (h *UsersHandler) VerifyEmail(c echo.Context) error {
+	var req verifyRequest
+	ctx := c.Request().Context()
+	if err := c.Bind(&req); err != nil {
+		log.Errorf("Unable to bind the verification request: %v", err)
+		return problem.New(http.StatusBadRequest, "Unable to bind the request")
+	}
+	if err := v.Struct(req); err != nil {
+		log.Errorf("Unable to validate the verification request: %v", err)
+		return validationError("Unable to validate the request", err)
+	}
+	ut, httpErr := consumeUserToken(ctx, req.Token, purposeVerify, h.Tokens)
+	if httpErr != nil {
+		return httpErr
+	}
+	// disabled users stay disabled
+	if err := h.Users.Activate(ctx, ut.Username); err != nil {
+		log.Errorf("Unable to verify the user: %v", err)
+		return problem.New(http.StatusInternalServerError, "Unable to verify the user")
+	}
+	// tokens issued while unverified carry no permissions
+	if httpErr := revokeUserSessions(ctx, ut.Username, h.Sessions); httpErr != nil {
+		return httpErr
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ResendVerification mails a new verification link to an unverified user.
+// The response is the same whether the user exists or not.
+func (h *UsersHandler) ResendVerification(c echo.Context) error {
+	var req forgotRequest
+	ctx := c.Request().Context()
+	if err := c.Bind(&req); err != nil {
+		log.Errorf("Unable to bind the verification request: %v", err)
+		return problem.New(http.StatusBadRequest, "Unable to bind the request")
+	}
+	if err := v.Struct(req); err != nil {
+		log.Errorf("Unable to validate the verification request: %v", err)
+		return validationError("Unable to validate the request", err)
+	}
+	user, err := h.Users.FindByUsername(ctx, req.Username)
+	switch {
+	case err == nil:
+		if !user.Unverified() {
+			break
+		}
+		if httpErr := h.sendVerification(ctx, user.Email); httpErr != nil {
+			return httpErr
+		}
+	case err != store.ErrNotFound:
+		log.Errorf("Unable to decode retrieved user: %v", err)
+		return problem.New(http.StatusInternalServerError, "Unable to process the request")
+	}
+	return c.JSON(http.StatusAccepted, map[string]string{
+		"message": "If the user exists and is not verified, a verification link was sent to them",
+	})
+}
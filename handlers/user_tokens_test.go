@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/nitin06890/go-rest-api/events"
+	"github.com/nitin06890/go-rest-api/mailer"
+	"github.com/nitin06890/go-rest-api/store"
+	mongostore "github.com/nitin06890/go-rest-api/store/mongo"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// mailedToken returns the token of the link in the last message sent to the address
+func mailedToken(t *testing.T, outbox *mailer.Memory, to string) string {
+	msg, ok := outbox.Last(to)
+	assert.True(t, ok)
+	start := strings.Index(msg.Body, prop.PublicURL)
+	assert.True(t, start >= 0)
+	u, err := url.Parse(strings.Fields(msg.Body[start:])[0])
+	assert.Nil(t, err)
+	return u.Query().Get("token")
+}
+
+func TestPasswordReset(t *testing.T) {
+	ctx := context.Background()
+	e := echo.New()
+	users, sessions, tokens := db.Collection("reset_users"), db.Collection("reset_sessions"), db.Collection("reset_tokens")
+	outbox := &mailer.Memory{}
+	uh := UsersHandler{Users: &mongostore.Users{Col: users}, Sessions: &mongostore.Sessions{Col: sessions}, Tokens: &mongostore.UserTokens{Col: tokens}, Keys: keys, Mailer: outbox}
+	t.Cleanup(func() {
+		users.Drop(ctx)
+		sessions.Drop(ctx)
+		tokens.Drop(ctx)
+	})
+
+	_, httpErr := insertUser(ctx, store.User{Email: "dave@example.com", Password: "qwertyuiop", Roles: []string{RoleCustomer}}, uh.Users)
+	assert.Nil(t, httpErr)
+	sid, _, httpErr := startSession(ctx, "dave@example.com", uh.Sessions)
+	assert.Nil(t, httpErr)
+
+	post := func(handler echo.HandlerFunc, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		res := httptest.NewRecorder()
+		serve(handler, e.NewContext(req, res))
+		return res
+	}
+	reset := func(token, password string) int {
+		return post(uh.ResetPassword, `{"token":"`+token+`","new_password":"`+password+`"}`).Code
+	}
+
+	t.Run("forgot doesn't reveal unknown users", func(t *testing.T) {
+		unknown := post(uh.ForgotPassword, `{"username":"nobody@example.com"}`)
+		known := post(uh.ForgotPassword, `{"username":"dave@example.com"}`)
+		uh.Wait()
+		assert.Equal(t, http.StatusAccepted, unknown.Code)
+		assert.Equal(t, known.Code, unknown.Code)
+		assert.Equal(t, known.Body.String(), unknown.Body.String())
+		assert.Len(t, outbox.Messages(), 1)
+		_, ok := outbox.Last("nobody@example.com")
+		assert.False(t, ok)
+	})
+
+	t.Run("a new request replaces the previous token", func(t *testing.T) {
+		first := mailedToken(t, outbox, "dave@example.com")
+		post(uh.ForgotPassword, `{"username":"dave@example.com"}`)
+		uh.Wait()
+		assert.Equal(t, http.StatusBadRequest, reset(first, "asdfghjkl"))
+	})
+
+	t.Run("reset the password", func(t *testing.T) {
+		token := mailedToken(t, outbox, "dave@example.com")
+		assert.Equal(t, http.StatusBadRequest, reset("forged", "asdfghjkl"))
+		assert.Equal(t, http.StatusBadRequest, reset(token, "short"))
+		assert.Equal(t, http.StatusNoContent, reset(token, "asdfghjkl"))
+		assert.Equal(t, http.StatusBadRequest, reset(token, "zxcvbnmzx"))
+
+		_, httpErr := authenticateUser(ctx, store.User{Email: "dave@example.com", Password: "asdfghjkl"}, uh.Users)
+		assert.Nil(t, httpErr)
+		sess, err := uh.Sessions.FindByID(ctx, sid)
+		assert.Nil(t, err)
+		assert.True(t, sess.Revoked)
+	})
+
+	t.Run("expired tokens are refused", func(t *testing.T) {
+		token, httpErr := issueUserToken(ctx, "dave@example.com", purposeReset, -time.Minute, uh.Tokens)
+		assert.Nil(t, httpErr)
+		assert.Equal(t, http.StatusBadRequest, reset(token, "asdfghjkl"))
+	})
+}
+
+// failingMailer fails to send anything
+type failingMailer struct{}
+
+func (failingMailer) Send(ctx context.Context, msg mailer.Message) error {
+	return errors.New("connection refused")
+}
+
+func TestEmailVerification(t *testing.T) {
+	ctx := context.Background()
+	e := echo.New()
+	users, sessions, tokens := db.Collection("verify_users"), db.Collection("verify_sessions"), db.Collection("verify_tokens")
+	attempts := db.Collection("verify_attempts")
+	outbox := &mailer.Memory{}
+	uh := UsersHandler{Users: &mongostore.Users{Col: users}, Sessions: &mongostore.Sessions{Col: sessions}, Tokens: &mongostore.UserTokens{Col: tokens}, Attempts: &mongostore.LoginAttempts{Col: attempts}, Keys: keys, Mailer: outbox, Events: &events.Memory{}}
+	t.Cleanup(func() {
+		users.Drop(ctx)
+		sessions.Drop(ctx)
+		tokens.Drop(ctx)
+		attempts.Drop(ctx)
+		prop.AllowUnverifiedLogin = false
+	})
+
+	post := func(handler echo.HandlerFunc, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		res := httptest.NewRecorder()
+		serve(handler, e.NewContext(req, res))
+		return res
+	}
+	signUp := func(email string) *httptest.ResponseRecorder {
+		return post(uh.CreateUser, `{"username":"`+email+`","password":"qwertyuiop"}`)
+	}
+	login := func(email string) *httptest.ResponseRecorder {
+		return post(uh.AuthnUser, `{"username":"`+email+`","password":"qwertyuiop"}`)
+	}
+	verify := func(token string) int {
+		return post(uh.VerifyEmail, `{"token":"`+token+`"}`).Code
+	}
+
+	t.Run("unverified users cannot log in", func(t *testing.T) {
+		var user store.User
+		res := signUp("frank@example.com")
+		assert.Equal(t, http.StatusCreated, res.Code)
+		assert.Empty(t, res.Header().Get(headerAuthToken))
+		assert.Nil(t, users.FindOne(ctx, bson.M{"username": "frank@example.com"}).Decode(&user))
+		assert.Equal(t, store.StatusUnverified, user.Status)
+
+		var msg problemBody
+		res = login("frank@example.com")
+		assert.Equal(t, http.StatusForbidden, res.Code)
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &msg))
+		assert.Equal(t, "Email address is not verified", msg.Detail)
+	})
+
+	t.Run("resend doesn't reveal unknown users", func(t *testing.T) {
+		first := mailedToken(t, outbox, "frank@example.com")
+		unknown := post(uh.ResendVerification, `{"username":"nobody@example.com"}`)
+		known := post(uh.ResendVerification, `{"username":"frank@example.com"}`)
+		assert.Equal(t, http.StatusAccepted, unknown.Code)
+		assert.Equal(t, known.Body.String(), unknown.Body.String())
+		_, ok := outbox.Last("nobody@example.com")
+		assert.False(t, ok)
+		// the new link replaces the first one
+		assert.Equal(t, http.StatusBadRequest, verify(first))
+	})
+
+	t.Run("verify the email address", func(t *testing.T) {
+		token := mailedToken(t, outbox, "frank@example.com")
+		assert.Equal(t, http.StatusBadRequest, verify("forged"))
+		assert.Equal(t, http.StatusNoContent, verify(token))
+		assert.Equal(t, http.StatusBadRequest, verify(token))
+		assert.Equal(t, http.StatusOK, login("frank@example.com").Code)
+
+		// verified users are not sent another link
+		count := len(outbox.Messages())
+		post(uh.ResendVerification, `{"username":"frank@example.com"}`)
+		assert.Len(t, outbox.Messages(), count)
+	})
+
+	t.Run("mail failures are only logged", func(t *testing.T) {
+		down := &UsersHandler{Users: uh.Users, Sessions: &mongostore.Sessions{Col: sessions}, Tokens: &mongostore.UserTokens{Col: tokens}, Attempts: &mongostore.LoginAttempts{Col: attempts}, Keys: keys, Mailer: failingMailer{}, Events: &events.Memory{}}
+		res := post(down.CreateUser, `{"username":"heidi@example.com","password":"qwertyuiop"}`)
+		assert.Equal(t, http.StatusCreated, res.Code)
+		res = post(down.ResendVerification, `{"username":"heidi@example.com"}`)
+		assert.Equal(t, http.StatusAccepted, res.Code)
+	})
+
+	t.Run("unverified users may log in without permissions", func(t *testing.T) {
+		prop.AllowUnverifiedLogin = true
+		res := signUp("grace@example.com")
+		assert.Equal(t, http.StatusCreated, res.Code)
+		assert.NotEmpty(t, res.Header().Get(headerAuthToken))
+
+		res = login("grace@example.com")
+		assert.Equal(t, http.StatusOK, res.Code)
+		token, err := jwt.Parse(res.Header().Get(headerAuthToken), keys.Keyfunc)
+		assert.Nil(t, err)
+		assert.Empty(t, token.Claims.(jwt.MapClaims)["permissions"])
+	})
+}
@@ -3,6 +3,7 @@ package handlers
 import (
 	"context"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -10,140 +11,181 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/gommon/log"
 	"github.com/nitin06890/go-rest-api/config"
-	"github.com/nitin06890/go-rest-api/dbiface"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
+	"github.com/nitin06890/go-rest-api/events"
+	"github.com/nitin06890/go-rest-api/keyring"
+	"github.com/nitin06890/go-rest-api/mailer"
+	"github.com/nitin06890/go-rest-api/problem"
+	"github.com/nitin06890/go-rest-api/store"
 	"golang.org/x/crypto/bcrypt"
 )
 
-// User represents a user
-type User struct {
-	Email    string `json:"username" bson:"username" validate:"required,email"`
-	Password string `json:"password,omitempty" bson:"password" validate:"required,min=8,max=300"`
-	IsAdmin  bool   `json:"isadmin,omitempty" bson:"isadmin"`
+// userPermissions returns the permissions granted to the user. Unverified users
+// that are allowed to log in and users that have yet to enroll a second
+// factor their roles require are granted none.
+func userPermissions(u store.User) []Permission {
+	if u.Unverified() || (twoFactorRequired(u) && !u.TwoFactor()) {
+		return []Permission{}
+	}
+	return permissionsOf(u.AllRoles())
 }
 
 // UsersHandler handles user related requests
 type UsersHandler struct {
-	Col dbiface.CollectionAPI
-}
+	Users    UserRepository
+	Sessions SessionRepository
+	Tokens   UserTokenRepository
+	Attempts LoginAttemptRepository
+	APIKeys  APIKeyRepository
+	Keys     *keyring.Ring
+	Mailer   mailer.Mailer
+	Events   events.Emitter
 
-type errorMessage struct {
-	Message string `json:"message"`
+	// background tracks the emails being sent after their request was answered
+	background sync.WaitGroup
 }
 
 var (
 	prop config.Properties
 )
 
-// CreateUser creates a user
+func init() {
+	if err := cleanenv.ReadEnv(&prop); err != nil {
+		log.Fatalf("Unable to read configuration: %v", err)
+	}
+}
+
+// CreateUser creates an unverified user and mails them a verification link.
+// Tokens are only issued right away when unverified users may log in.
 func (h *UsersHandler) CreateUser(c echo.Context) error {
-	var user User
+	var user store.User
 	c.Echo().Validator = &userValidator{validator: v}
 	if err := c.Bind(&user); err != nil {
 		log.Errorf("Unable to bind user: %v", err)
-		return c.JSON(http.StatusBadRequest, errorMessage{Message: "Unable to bind user"})
+		return problem.New(http.StatusBadRequest, "Unable to bind user")
 	}
+	// roles and status are set by administrators, never chosen at sign up
+	user.Roles = []string{RoleCustomer}
+	user.Status = store.StatusUnverified
 	if err := c.Validate(user); err != nil {
 		log.Errorf("Unable to validate user: %v", err)
-		return c.JSON(http.StatusBadRequest, errorMessage{Message: "Unable to validate user"})
+		return validationError("Unable to validate user", err)
 	}
-	insertedUserID, err := insertUser(context.Background(), user, h.Col)
+	ctx := c.Request().Context()
+	insertedUser, err := insertUser(ctx, user, h.Users)
 	if err != nil {
-		return c.JSON(err.Code, err.Message)
+		return err
 	}
-	token, er := user.generateToken()
-	if er != nil {
-		log.Errorf("Unable to generate token: %v", er)
-		return c.JSON(http.StatusInternalServerError, errorMessage{Message: "Unable to generate token"})
+	if err := h.sendVerification(ctx, insertedUser.Email); err != nil {
+		return err
 	}
-	c.Response().Header().Set("x-auth-token", token)
-	return c.JSON(http.StatusCreated, insertedUserID)
-}
-
-func insertUser(ctx context.Context, user User, col dbiface.CollectionAPI) (interface{}, *echo.HTTPError) {
-	var newUser User
-	// Check if user already exists
-	res := col.FindOne(ctx, bson.M{"username": user.Email})
-	err := res.Decode(&newUser)
-	if err == nil && err != mongo.ErrNoDocuments {
-		log.Errorf("Unable to decode retrieved user: %v", err)
-		return nil, echo.NewHTTPError(http.StatusUnprocessableEntity, errorMessage{Message: "Unable to decode retrieved user"})
-	}
-	// If user already exists, return error
-	if newUser.Email != "" {
-		log.Errorf("User by %s already exists", user.Email)
-		return nil, echo.NewHTTPError(http.StatusBadRequest, errorMessage{Message: "User already exists"})
+	if prop.AllowUnverifiedLogin {
+		if _, err := h.issueTokens(ctx, c, insertedUser); err != nil {
+			return err
+		}
 	}
+	return c.JSON(http.StatusCreated, store.User{Email: insertedUser.Email})
+}
 
+func insertUser(ctx context.Context, user store.User, users UserRepository) (store.User, *problem.Problem) {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 	if err != nil {
 		log.Errorf("Unable to hash password: %+v", err)
-		return nil, echo.NewHTTPError(http.StatusInternalServerError, errorMessage{Message: "Unable to hash password"})
+		return store.User{}, problem.New(http.StatusInternalServerError, "Unable to hash password")
 	}
 	user.Password = string(hashedPassword)
 
-	// If user doesn't exist, insert user
-	_, err = col.InsertOne(ctx, user)
+	created, err := users.Create(ctx, user)
+	if err == store.ErrDuplicate {
+		log.Errorf("User by %s already exists", user.Email)
+		return store.User{}, problem.New(http.StatusBadRequest, "User already exists")
+	}
 	if err != nil {
 		log.Errorf("Unable to insert user: %+v", err)
-		return nil, echo.NewHTTPError(http.StatusInternalServerError, errorMessage{Message: "Unable to insert user"})
+		return store.User{}, problem.New(http.StatusInternalServerError, "Unable to insert user")
 	}
-	return User{Email: user.Email}, nil
+	return store.User{ID: created.ID, Email: created.Email, Roles: created.Roles, Status: created.Status}, nil
 }
 
 func (h *UsersHandler) AuthnUser(ctx echo.Context) error {
-	var user User
+	var user store.User
 	ctx.Echo().Validator = &userValidator{validator: v}
 	if err := ctx.Bind(&user); err != nil {
 		log.Errorf("Unable to bind user: %v", err)
-		return ctx.JSON(http.StatusUnprocessableEntity, errorMessage{Message: "Unable to bind user"})
+		return problem.New(http.StatusUnprocessableEntity, "Unable to bind user")
 	}
 	if err := ctx.Validate(user); err != nil {
 		log.Errorf("Unable to validate user: %v", err)
-		return ctx.JSON(http.StatusBadRequest, errorMessage{Message: "Unable to validate user"})
+		return validationError("Unable to validate user", err)
+	}
+	throttles := loginThrottles(user.Email, ctx.RealIP())
+	if wait, err := lockedOut(ctx.Request().Context(), throttles, h.Attempts); err != nil {
+		return err
+	} else if wait > 0 {
+		return tooManyAttempts(ctx, wait)
 	}
-	authenticatedUser, httpError := authenticateUser(context.Background(), user, h.Col)
+	authenticatedUser, httpError := authenticateUser(ctx.Request().Context(), user, h.Users)
 	if httpError != nil {
 		log.Errorf("Unable to authenticate user: %v", httpError)
-		return ctx.JSON(httpError.Code, httpError.Message)
-	}
-	token, err := user.generateToken()
-	if err != nil {
-		log.Errorf("Unable to generate token: %v", err)
-		return ctx.JSON(http.StatusInternalServerError, errorMessage{Message: "Unable to generate token"})
-	}
-	ctx.Response().Header().Set("x-auth-token", token)
-	return ctx.JSON(http.StatusOK, User{Email: authenticatedUser.Email})
+		// unknown users count too, so lockouts don't tell which users exist
+		if httpError.Status == http.StatusUnauthorized || httpError.Status == http.StatusBadRequest {
+			if wait, err := h.recordLoginFailure(ctx.Request().Context(), throttles, ctx.RealIP()); err != nil {
+				return err
+			} else if wait > 0 {
+				return tooManyAttempts(ctx, wait)
+			}
+		}
+		return httpError
+	}
+	// the failures of users with a second factor are cleared once it is
+	// checked too, or guessing codes would never lock them out
+	if authenticatedUser.TwoFactor() {
+		return h.challengeTwoFactor(ctx.Request().Context(), ctx, authenticatedUser)
+	}
+	if err := clearLoginFailures(ctx.Request().Context(), throttles[0], h.Attempts); err != nil {
+		return err
+	}
+	if _, err := h.issueTokens(ctx.Request().Context(), ctx, authenticatedUser); err != nil {
+		return err
+	}
+	return ctx.JSON(http.StatusOK, store.User{Email: authenticatedUser.Email})
 }
 
-func authenticateUser(ctx context.Context, reqUser User, col dbiface.CollectionAPI) (User, *echo.HTTPError) {
-	var storedUser User
-	res := col.FindOne(ctx, bson.M{"username": reqUser.Email})
-	err := res.Decode(&storedUser)
-	if err == nil && err != mongo.ErrNoDocuments {
+func authenticateUser(ctx context.Context, reqUser store.User, users UserRepository) (store.User, *problem.Problem) {
+	storedUser, err := users.FindByUsername(ctx, reqUser.Email)
+	if err == store.ErrNotFound {
 		log.Errorf("User by %s doesn't exist", reqUser.Email)
-		return User{}, echo.NewHTTPError(http.StatusBadRequest, errorMessage{Message: "User doesn't exist"})
+		return store.User{}, problem.New(http.StatusBadRequest, "User doesn't exist")
+	}
+	if err != nil {
+		log.Errorf("Unable to decode retrieved user: %v", err)
+		return store.User{}, problem.New(http.StatusUnprocessableEntity, "Unable to decode retrieved user")
 	}
 	// Validate the password
 	err = bcrypt.CompareHashAndPassword([]byte(storedUser.Password), []byte(reqUser.Password))
 	if err != nil {
 		log.Errorf("Invalid password: %v", err)
-		return User{}, echo.NewHTTPError(http.StatusUnauthorized, errorMessage{Message: "Invalid password"})
+		return store.User{}, problem.New(http.StatusUnauthorized, "Invalid password")
+	}
+	if storedUser.Disabled() {
+		log.Errorf("User %s is disabled", reqUser.Email)
+		return store.User{}, problem.New(http.StatusForbidden, "User is disabled")
+	}
+	if storedUser.Unverified() && !prop.AllowUnverifiedLogin {
+		log.Errorf("User %s is not verified", reqUser.Email)
+		return store.User{}, problem.New(http.StatusForbidden, "Email address is not verified")
 	}
-	return User{Email: storedUser.Email}, nil
+	return store.User{ID: storedUser.ID, Email: storedUser.Email, Roles: storedUser.AllRoles(), Status: storedUser.Status, TOTP: storedUser.TOTP}, nil
 }
 
-func (u User) generateToken() (string, error) {
-	if err := cleanenv.ReadEnv(&prop); err != nil {
-		log.Fatalf("Unable to read configuration: %v", err)
-	}
+// generateToken returns an access token of the session for the user
+func generateToken(u store.User, keys *keyring.Ring, sid string) (string, error) {
 	claims := jwt.MapClaims{}
-	claims["authorized"] = u.IsAdmin
 	claims["user_id"] = u.Email
-	claims["exp"] = time.Now().Add(time.Minute * 15).Unix()
-	at := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	token, err := at.SignedString([]byte(prop.JwtTokenSecret))
+	claims["roles"] = u.AllRoles()
+	claims["permissions"] = userPermissions(u)
+	claims["sid"] = sid
+	claims["exp"] = time.Now().Add(prop.AccessTokenTTL).Unix()
+	token, err := keys.Sign(claims)
 	if err != nil {
 		log.Errorf("Unable to generate the token: %v", err)
 		return "", err
@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/nitin06890/go-rest-api/problem"
+	"github.com/nitin06890/go-rest-api/store"
+)
+
+// userResource is a user as returned by the API. It never carries the
+// password hash.
+type userResource struct {
+	ID        string   `json:"_id"`
+	Username  string   `json:"username"`
+	Name      string   `json:"name,omitempty"`
+	Roles     []string `json:"roles"`
+	Status    string   `json:"status"`
+	TwoFactor bool     `json:"two_factor"`
+}
+
+func newUserResource(u store.User) userResource {
+	r := userResource{ID: string(u.ID), Username: u.Email, Name: u.Name, Roles: u.AllRoles(), Status: u.Status, TwoFactor: u.TwoFactor()}
+	if r.Roles == nil {
+		r.Roles = []string{}
+	}
+	if r.Status == "" {
+		r.Status = store.StatusActive
+	}
+	return r
+}
+
+type usersPage struct {
+	Data  []userResource `json:"data"`
+	Total int64          `json:"total"`
+	Next  string         `json:"next,omitempty"`
+
+	nextCursor string
+}
+
+// userUpdate is the body of PATCH /users/:id, absent members are left unchanged
+type userUpdate struct {
+	Roles  *[]string `json:"roles"`
+	Status *string   `json:"status"`
+}
+
+// idCursor is the cursor of lists ordered by _id
+type idCursor struct {
+	After store.ID `json:"a"`
+}
+
+func encodeIDCursor(after store.ID) string {
+	b, _ := json.Marshal(idCursor{After: after})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeIDCursor(token string) (store.ID, error) {
+	var ic idCursor
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || json.Unmarshal(b, &ic) != nil {
+		return "", errors.New("invalid cursor")
+	}
+	if _, err := store.ParseID(string(ic.After)); err != nil {
+		return "", errors.New("invalid cursor")
+	}
+	return ic.After, nil
+}
+
+// userFilter compiles the role and status query parameters to a filter
+func userFilter(q url.Values) (store.UserFilter, *problem.Problem) {
+	var filter store.UserFilter
+	for key := range q {
+		switch key {
+		case "limit", "cursor", "role", "status":
+		default:
+			return filter, problem.InvalidQuery(key, "unknown filter field")
+		}
+	}
+	if role := q.Get("role"); role != "" {
+		if _, ok := rolePermissions[role]; !ok {
+			return filter, problem.InvalidQuery("role", "unknown role")
+		}
+		filter.Role = role
+	}
+	switch status := q.Get("status"); status {
+	case "", store.StatusActive, store.StatusDisabled, store.StatusUnverified:
+		filter.Status = status
+	default:
+		return filter, problem.InvalidQuery("status", "unknown status")
+	}
+	return filter, nil
+}
+
+func findUsers(ctx context.Context, q url.Values, users UserRepository) (usersPage, *problem.Problem) {
+	page := usersPage{Data: []userResource{}}
+	filter, httpErr := userFilter(q)
+	if httpErr != nil {
+		log.Errorf("Invalid user filter: %v", httpErr)
+		return page, httpErr
+	}
+	limit, err := parseLimit(q)
+	if err != nil {
+		log.Errorf("Invalid limit: %v", err)
+		return page, problem.InvalidQuery("limit", err.Error())
+	}
+	page.Total, err = users.Count(ctx, filter)
+	if err != nil {
+		log.Errorf("Unable to count the users: %v", err)
+		return page, problem.New(http.StatusInternalServerError, "Unable to count the users")
+	}
+
+	req := store.UserPageRequest{Limit: limit + 1}
+	if token := q.Get("cursor"); token != "" {
+		if req.After, err = decodeIDCursor(token); err != nil {
+			log.Errorf("Unable to decode the cursor: %v", err)
+			return page, problem.InvalidQuery("cursor", err.Error())
+		}
+	}
+	found, err := users.List(ctx, filter, req)
+	if err != nil {
+		log.Errorf("Unable to find the users: %v", err)
+		return page, problem.New(http.StatusInternalServerError, "Unable to find the users")
+	}
+	if int64(len(found)) > limit {
+		found = found[:limit]
+		page.nextCursor = encodeIDCursor(found[len(found)-1].ID)
+	}
+	for _, u := range found {
+		page.Data = append(page.Data, newUserResource(u))
+	}
+	return page, nil
+}
+
+// GetUsers returns a page of users, optionally filtered by role and status
+func (h *UsersHandler) GetUsers(c echo.Context) error {
+	page, err := findUsers(c.Request().Context(), c.QueryParams(), h.Users)
+	if err != nil {
+		return err
+	}
+	if page.nextCursor != "" {
+		page.Next = pageLink(c.Request().URL, page.nextCursor)
+	}
+	return c.JSON(http.StatusOK, page)
+}
+
+func findUser(ctx context.Context, id string, users UserRepository) (store.User, *problem.Problem) {
+	user, err := users.FindByID(ctx, id)
+	if err != nil {
+		if err == store.ErrInvalidID {
+			log.Errorf("cannot convert to ObjectID :%v", err)
+			return user, problem.New(http.StatusNotFound, "User doesn't exist")
+		}
+		if err == store.ErrNotFound {
+			log.Errorf("User %s doesn't exist", id)
+			return user, problem.New(http.StatusNotFound, "User doesn't exist")
+		}
+		log.Errorf("Unable to decode the user: %v", err)
+		return user, problem.New(http.StatusUnprocessableEntity, "Unable to decode the user")
+	}
+	return user, nil
+}
+
+// GetUser returns a user
+func (h *UsersHandler) GetUser(c echo.Context) error {
+	user, err := findUser(c.Request().Context(), c.Param("id"), h.Users)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, newUserResource(user))
+}
+
+// currentUsername returns the user the access token validated by echojwt
+// was issued to, or the owner of the API key checked by Authenticate
+func currentUsername(c echo.Context) string {
+	if key, ok := c.Get(apiKeyContextKey).(*apiKey); ok {
+		return key.Owner
+	}
+	token, ok := c.Get(jwtContextKey).(*jwt.Token)
+	if !ok {
+		return ""
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return ""
+	}
+	username, _ := claims["user_id"].(string)
+	return username
+}
+
+func modifyUser(ctx context.Context, id, actor string, reqBody io.Reader, h *UsersHandler) (store.User, *problem.Problem) {
+	var update userUpdate
+	user, httpErr := findUser(ctx, id, h.Users)
+	if httpErr != nil {
+		return user, httpErr
+	}
+	dec := json.NewDecoder(reqBody)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&update); err != nil {
+		log.Errorf("Unable to decode the user update: %v", err)
+		return user, problem.New(http.StatusUnprocessableEntity, "Unable to decode the request body")
+	}
+
+	var changes store.UserUpdate
+	if update.Roles != nil {
+		roles := []string{}
+		seen := make(map[string]bool)
+		for _, r := range *update.Roles {
+			if _, ok := rolePermissions[r]; !ok {
+				log.Errorf("Unknown role %s", r)
+				return user, problem.Newf(http.StatusBadRequest, "Unknown role %s", r).With("field", "roles")
+			}
+			if !seen[r] {
+				seen[r] = true
+				roles = append(roles, r)
+			}
+		}
+		user.Roles, user.IsAdmin = roles, false
+		changes.Roles = &roles
+	}
+	if update.Status != nil {
+		if *update.Status != store.StatusActive && *update.Status != store.StatusDisabled {
+			log.Errorf("Unknown status %s", *update.Status)
+			return user, problem.Newf(http.StatusBadRequest, "Unknown status %s", *update.Status).With("field", "status")
+		}
+		user.Status = *update.Status
+		changes.Status = &user.Status
+	}
+	// administrators cannot lock themselves out
+	if user.Email == actor {
+		if user.Disabled() {
+			return user, problem.New(http.StatusConflict, "You cannot disable your own account")
+		}
+		if !permissionsGranted(user.AllRoles(), PermUsersAdmin) {
+			return user, problem.New(http.StatusConflict, "You cannot remove your own administration permission")
+		}
+	}
+	if changes.Roles == nil && changes.Status == nil {
+		return user, nil
+	}
+	if err := h.Users.Update(ctx, string(user.ID), changes); err != nil {
+		log.Errorf("Unable to update the user: %v", err)
+		return user, problem.New(http.StatusInternalServerError, "Unable to update the user")
+	}
+	// tokens carry the roles, so they must be issued again for changes to apply
+	if httpErr := revokeUserSessions(ctx, user.Email, h.Sessions); httpErr != nil {
+		return user, httpErr
+	}
+	return user, nil
+}
+
+// UpdateUser changes the roles or the status of a user. Disabling a user or
+// changing their roles revokes their sessions; activating an unverified user
+// stands for verifying their email address.
+func (h *UsersHandler) UpdateUser(c echo.Context) error {
+	user, err := modifyUser(c.Request().Context(), c.Param("id"), currentUsername(c), c.Request().Body, h)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, newUserResource(user))
+}
+
+// DeleteUser revokes the sessions and API keys of a user, then deletes them.
+// Revoking first means a failed deletion never leaves credentials of a
+// deleted user behind, which a new account of the same username would
+// otherwise inherit.
+func (h *UsersHandler) DeleteUser(c echo.Context) error {
+	ctx := c.Request().Context()
+	user, err := findUser(ctx, c.Param("id"), h.Users)
+	if err != nil {
+		return err
+	}
+	if user.Email == currentUsername(c) {
+		return problem.New(http.StatusConflict, "You cannot delete your own account")
+	}
+	if err := revokeUserSessions(ctx, user.Email, h.Sessions); err != nil {
+		return err
+	}
+	if err := revokeUserAPIKeys(ctx, user.Email, h.APIKeys); err != nil {
+		return err
+	}
+	if err := h.Users.Delete(ctx, string(user.ID)); err != nil {
+		log.Errorf("Unable to delete the user: %v", err)
+		return problem.New(http.StatusInternalServerError, "Unable to delete the user")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
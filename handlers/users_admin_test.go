@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/nitin06890/go-rest-api/store"
+	mongostore "github.com/nitin06890/go-rest-api/store/mongo"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestUsersAdministration(t *testing.T) {
+	ctx := context.Background()
+	e := echo.New()
+	// the users of this test live apart so other tests don't change the counts
+	users, sessions, apiKeys := db.Collection("admin_users"), db.Collection("admin_sessions"), db.Collection("admin_api_keys")
+	uh := UsersHandler{Users: &mongostore.Users{Col: users}, Sessions: &mongostore.Sessions{Col: sessions}, APIKeys: &mongostore.APIKeys{Col: apiKeys}, Keys: keys}
+	t.Cleanup(func() {
+		users.Drop(ctx)
+		sessions.Drop(ctx)
+		apiKeys.Drop(ctx)
+	})
+
+	create := func(email string, roles []string, status string) store.User {
+		user, err := insertUser(ctx, store.User{Email: email, Password: "qwertyuiop", Roles: roles, Status: status}, uh.Users)
+		assert.Nil(t, err)
+		return user
+	}
+	admin := create("admin@example.com", []string{RoleAdmin}, store.StatusActive)
+	alice := create("alice@example.com", []string{RoleCustomer}, store.StatusActive)
+	create("bob@example.com", []string{RoleEditor}, store.StatusDisabled)
+
+	adminToken, err := generateToken(admin, keys, string(store.NewID()))
+	assert.Nil(t, err)
+	do := func(method, target, body string, handler echo.HandlerFunc, id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(headerAuthToken, adminToken)
+		res := httptest.NewRecorder()
+		c := e.NewContext(req, res)
+		c.SetParamNames("id")
+		c.SetParamValues(id)
+		serve(jwtMiddleware()(handler), c)
+		return res
+	}
+	list := func(query string) usersPage {
+		var page usersPage
+		res := do(http.MethodGet, "/users"+query, "", uh.GetUsers, "")
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.NotContains(t, res.Body.String(), "password")
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &page))
+		return page
+	}
+	usernames := func(page usersPage) []string {
+		var names []string
+		for _, u := range page.Data {
+			names = append(names, u.Username)
+		}
+		return names
+	}
+
+	t.Run("list users", func(t *testing.T) {
+		page := list("?limit=2")
+		assert.Equal(t, int64(3), page.Total)
+		assert.Equal(t, []string{"admin@example.com", "alice@example.com"}, usernames(page))
+		assert.NotEmpty(t, page.Next)
+		page = list(strings.TrimPrefix(page.Next, "/users"))
+		assert.Equal(t, []string{"bob@example.com"}, usernames(page))
+		assert.Empty(t, page.Next)
+	})
+
+	t.Run("filter users", func(t *testing.T) {
+		assert.Equal(t, []string{"bob@example.com"}, usernames(list("?role=editor")))
+		assert.Equal(t, []string{"bob@example.com"}, usernames(list("?status=disabled")))
+		assert.Equal(t, []string{"admin@example.com", "alice@example.com"}, usernames(list("?status=active")))
+		for _, query := range []string{"?role=root", "?status=gone", "?password=x"} {
+			res := do(http.MethodGet, "/users"+query, "", uh.GetUsers, "")
+			assert.Equal(t, http.StatusBadRequest, res.Code, query)
+		}
+	})
+
+	t.Run("get a user", func(t *testing.T) {
+		var user userResource
+		res := do(http.MethodGet, "/users/"+string(alice.ID), "", uh.GetUser, string(alice.ID))
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.NotContains(t, res.Body.String(), "password")
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &user))
+		assert.Equal(t, userResource{ID: string(alice.ID), Username: "alice@example.com", Roles: []string{RoleCustomer}, Status: store.StatusActive}, user)
+
+		missing := primitive.NewObjectID().Hex()
+		assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/users/"+missing, "", uh.GetUser, missing).Code)
+	})
+
+	t.Run("promote a user", func(t *testing.T) {
+		var user userResource
+		sid, _, httpErr := startSession(ctx, alice.Email, uh.Sessions)
+		assert.Nil(t, httpErr)
+		res := do(http.MethodPatch, "/users/"+string(alice.ID), `{"roles":["editor","editor"]}`, uh.UpdateUser, string(alice.ID))
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &user))
+		assert.Equal(t, []string{RoleEditor}, user.Roles)
+
+		// the session carries the old roles, so it is revoked
+		sess, err := uh.Sessions.FindByID(ctx, sid)
+		assert.Nil(t, err)
+		assert.True(t, sess.Revoked)
+	})
+
+	t.Run("invalid updates", func(t *testing.T) {
+		id := string(alice.ID)
+		assert.Equal(t, http.StatusBadRequest, do(http.MethodPatch, "/users/"+id, `{"roles":["root"]}`, uh.UpdateUser, id).Code)
+		assert.Equal(t, http.StatusBadRequest, do(http.MethodPatch, "/users/"+id, `{"status":"gone"}`, uh.UpdateUser, id).Code)
+		assert.Equal(t, http.StatusUnprocessableEntity, do(http.MethodPatch, "/users/"+id, `{"password":"hunter22"}`, uh.UpdateUser, id).Code)
+	})
+
+	t.Run("disable a user", func(t *testing.T) {
+		id := string(alice.ID)
+		res := do(http.MethodPatch, "/users/"+id, `{"status":"disabled"}`, uh.UpdateUser, id)
+		assert.Equal(t, http.StatusOK, res.Code)
+		_, httpErr := authenticateUser(ctx, store.User{Email: alice.Email, Password: "qwertyuiop"}, uh.Users)
+		assert.Equal(t, http.StatusForbidden, httpErr.Status)
+	})
+
+	t.Run("admins cannot lock themselves out", func(t *testing.T) {
+		id := string(admin.ID)
+		assert.Equal(t, http.StatusConflict, do(http.MethodPatch, "/users/"+id, `{"status":"disabled"}`, uh.UpdateUser, id).Code)
+		assert.Equal(t, http.StatusConflict, do(http.MethodPatch, "/users/"+id, `{"roles":["editor"]}`, uh.UpdateUser, id).Code)
+		assert.Equal(t, http.StatusConflict, do(http.MethodDelete, "/users/"+id, "", uh.DeleteUser, id).Code)
+	})
+
+	t.Run("delete a user", func(t *testing.T) {
+		id := string(alice.ID)
+		assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/users/"+id, "", uh.DeleteUser, id).Code)
+		assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/users/"+id, "", uh.GetUser, id).Code)
+	})
+
+	t.Run("deleting a user revokes their credentials", func(t *testing.T) {
+		carol := create("carol@example.com", []string{RoleEditor}, store.StatusActive)
+		sid, _, httpErr := startSession(ctx, carol.Email, uh.Sessions)
+		assert.Nil(t, httpErr)
+		key, httpErr := insertAPIKey(ctx, carol, apiKeyRequest{Name: "import", Scopes: []Permission{PermCatalogWrite}}, &uh)
+		assert.Nil(t, httpErr)
+		id := string(carol.ID)
+		assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/users/"+id, "", uh.DeleteUser, id).Code)
+
+		// a new account of the same username doesn't inherit them
+		create("carol@example.com", []string{RoleEditor}, store.StatusActive)
+		sess, err := uh.Sessions.FindByID(ctx, sid)
+		assert.Nil(t, err)
+		assert.True(t, sess.Revoked)
+		req := httptest.NewRequest(http.MethodPost, "/products", nil)
+		req.Header.Set(echo.HeaderAuthorization, authSchemeAPIKey+" "+key.Key)
+		res := httptest.NewRecorder()
+		ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+		serve(uh.Authenticate(jwtMiddleware())(RequirePermission(PermCatalogWrite)(ok)), e.NewContext(req, res))
+		assert.Equal(t, http.StatusUnauthorized, res.Code)
+	})
+}
@@ -8,6 +8,8 @@ import (
 	"testing"
 
 	"github.com/labstack/echo/v4"
+	"github.com/nitin06890/go-rest-api/store"
+	mongostore "github.com/nitin06890/go-rest-api/store/mongo"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -25,15 +27,19 @@ func TestUsers(t *testing.T) {
 		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 		e := echo.New()
 		c := e.NewContext(req, res)
-		uh.Col = usersCol
-		err := uh.CreateUser(c)
+		uh.Users = &mongostore.Users{Col: usersCol}
+		uh.Sessions = &mongostore.Sessions{Col: sessCol}
+		serve(uh.CreateUser, c)
 		t.Logf("res: %#+v\n", string(res.Body.String()))
-		assert.Nil(t, err)
 		assert.Equal(t, http.StatusBadRequest, res.Code)
+		var msg problemBody
+		err := json.Unmarshal(res.Body.Bytes(), &msg)
+		assert.Nil(t, err)
+		assert.Equal(t, []fieldError{{Field: "password", Rule: "min", Param: "8"}}, msg.Errors)
 	})
 
 	t.Run("test create user", func(t *testing.T) {
-		var user User
+		var user store.User
 		body := `
 		{
 			"username":"shelby.dummy@gmail.com",
@@ -45,12 +51,15 @@ func TestUsers(t *testing.T) {
 		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 		e := echo.New()
 		c := e.NewContext(req, res)
-		uh.Col = usersCol
+		uh.Users = &mongostore.Users{Col: usersCol}
+		uh.Sessions = &mongostore.Sessions{Col: sessCol}
 		err := uh.CreateUser(c)
 		assert.Nil(t, err)
 		assert.Equal(t, http.StatusCreated, res.Code)
-		token := res.Header().Get("X-Auth-Token")
-		assert.NotEmpty(t, token)
+		// no token until the email address is verified
+		assert.Empty(t, res.Header().Get("X-Auth-Token"))
+		_, sent := outbox.Last("shelby.dummy@gmail.com")
+		assert.True(t, sent)
 		err = json.Unmarshal(res.Body.Bytes(), &user)
 		assert.Nil(t, err)
 		assert.Equal(t, "shelby.dummy@gmail.com", user.Email)
@@ -1,11 +1,31 @@
 package handlers
 
-import "gopkg.in/go-playground/validator.v9"
+import (
+	"errors"
+	"reflect"
+	"strings"
+
+	"github.com/nitin06890/go-rest-api/problem"
+	"gopkg.in/go-playground/validator.v9"
+)
 
 var (
-	v = validator.New()
+	v = newValidator()
 )
 
+// newValidator returns a validator reporting fields by their JSON name
+func newValidator() *validator.Validate {
+	validate := validator.New()
+	validate.RegisterTagNameFunc(func(fld reflect.StructField) string {
+		name := strings.SplitN(fld.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	return validate
+}
+
 // ProductValidator a product validator
 type ProductValidator struct {
 	validator *validator.Validate
@@ -23,3 +43,35 @@ type userValidator struct {
 func (u *userValidator) Validate(i interface{}) error {
 	return u.validator.Struct(i)
 }
+
+// fieldError describes a field failing a validation rule
+type fieldError struct {
+	Field string `json:"field"`
+	Rule  string `json:"rule"`
+	Param string `json:"param,omitempty"`
+	Index *int   `json:"index,omitempty"`
+}
+
+// fieldErrors lists the failing fields of a validation error. index is the
+// position of the validated item in a batch, or nil.
+func fieldErrors(err error, index *int) []fieldError {
+	var verrs validator.ValidationErrors
+	if !errors.As(err, &verrs) {
+		return nil
+	}
+	fields := make([]fieldError, 0, len(verrs))
+	for _, fe := range verrs {
+		fields = append(fields, fieldError{
+			Field: fe.Field(),
+			Rule:  fe.Tag(),
+			Param: fe.Param(),
+			Index: index,
+		})
+	}
+	return fields
+}
+
+// validationError returns a validation problem listing the failing fields
+func validationError(msg string, err error) *problem.Problem {
+	return problem.Validation(msg, fieldErrors(err, nil))
+}
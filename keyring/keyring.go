@@ -0,0 +1,507 @@
+// Package keyring keeps the asymmetric keys access tokens are signed with.
+// A new key is published as a JWK set before it signs, and a key that no
+// longer signs is kept until the tokens it signed have expired.
+package keyring
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Signing algorithms
+const (
+	RS256 = "RS256"
+	EdDSA = "EdDSA"
+)
+
+const rsaBits = 2048
+
+// JWKSCacheTTL is how long clients may cache the published JWK set. A new
+// key is published at least this long before it signs, so that clients
+// with a cached set fetch the set again only for tokens of unknown keys.
+const JWKSCacheTTL = 5 * time.Minute
+
+// keyFileLayout names the key files by their creation time
+const keyFileLayout = "20060102T150405.000000000Z"
+
+// reloadBackoff is how long a reload for a token of an unknown key waits
+// for the previous one, so that forged kids do not read the directory on
+// every request
+const reloadBackoff = 5 * time.Second
+
+var (
+	// ErrUnknownKey is returned for tokens signed by a key not in the ring
+	ErrUnknownKey = errors.New("unknown signing key")
+	// ErrUnsupportedKey is returned for keys of an unsupported type
+	ErrUnsupportedKey = errors.New("unsupported key type")
+)
+
+// Key is a signing key
+type Key struct {
+	ID        string
+	Algorithm string
+	Private   crypto.Signer
+	Created   time.Time
+
+	path string
+}
+
+// Lifetimes are how long the keys of a ring are published before they sign
+// and kept after they stop signing
+type Lifetimes struct {
+	// Publish is how long a new key is published before it signs, at least
+	// as long as clients cache the JWK set
+	Publish time.Duration
+	// Verify is how long a key is kept once a newer key signs, at least as
+	// long as the tokens it signed are valid
+	Verify time.Duration
+}
+
+// Ring holds the signing keys ordered by creation time
+type Ring struct {
+	mu        sync.RWMutex
+	keys      []*Key
+	dir       string
+	alg       string
+	lifetimes Lifetimes
+	now       func() time.Time
+
+	// dirMu keeps a reload from missing a key rotated while it reads
+	dirMu    sync.Mutex
+	reloadMu sync.Mutex
+	reloaded time.Time
+}
+
+// New returns a ring with a single generated key of the algorithm, which
+// signs right away as no client can know another key yet. When dir is set,
+// generated keys are written to it as PEM files.
+func New(alg, dir string, lifetimes Lifetimes) (*Ring, error) {
+	r := &Ring{dir: dir, alg: alg, lifetimes: lifetimes, now: time.Now}
+	if _, err := r.Rotate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Load returns a ring of the PEM encoded PKCS #8 private keys in dir. Keys
+// are created at the time their file is named after, or else when it was
+// last modified. If dir holds no key, a key of the algorithm is generated
+// and written to it. The directory may be shared by several servers, which
+// see each other's keys when they reload it.
+func Load(alg, dir string, lifetimes Lifetimes) (*Ring, error) {
+	return load(alg, dir, lifetimes, time.Now)
+}
+
+func load(alg, dir string, lifetimes Lifetimes, now func() time.Time) (*Ring, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	r := &Ring{dir: dir, alg: alg, lifetimes: lifetimes, now: now}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	if len(r.keys) == 0 {
+		if _, err := r.Rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func readKey(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("no PKCS #8 private key found")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	created, err := time.Parse(keyFileLayout, strings.TrimSuffix(filepath.Base(path), ".pem"))
+	if err != nil {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		created = info.ModTime()
+	}
+	key, err := newKey(parsed, created)
+	if err != nil {
+		return nil, err
+	}
+	key.path = path
+	return key, nil
+}
+
+func newKey(private interface{}, created time.Time) (*Key, error) {
+	key := &Key{Created: created}
+	switch k := private.(type) {
+	case *rsa.PrivateKey:
+		key.Algorithm, key.Private = RS256, k
+	case ed25519.PrivateKey:
+		key.Algorithm, key.Private = EdDSA, k
+	default:
+		return nil, ErrUnsupportedKey
+	}
+	jwk, err := key.JWK()
+	if err != nil {
+		return nil, err
+	}
+	key.ID = jwk.thumbprint()
+	return key, nil
+}
+
+func generate(alg string) (interface{}, error) {
+	switch alg {
+	case RS256:
+		return rsa.GenerateKey(rand.Reader, rsaBits)
+	case EdDSA:
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		return private, err
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedKey, alg)
+}
+
+// Rotate generates a new key, which is published right away and signs once
+// it has been published for the Publish lifetime
+func (r *Ring) Rotate() (*Key, error) {
+	private, err := generate(r.alg)
+	if err != nil {
+		return nil, err
+	}
+	r.dirMu.Lock()
+	defer r.dirMu.Unlock()
+	now := r.now().UTC()
+	key, err := newKey(private, now)
+	if err != nil {
+		return nil, err
+	}
+	if r.dir != "" {
+		der, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			return nil, err
+		}
+		// the key is renamed into place so that the other servers never
+		// read a partly written file
+		key.path = filepath.Join(r.dir, now.Format(keyFileLayout)+".pem")
+		tmp := key.path + ".tmp"
+		if err := os.WriteFile(tmp, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(tmp, key.path); err != nil {
+			return nil, err
+		}
+	}
+	r.mu.Lock()
+	dropped := r.set(append(append([]*Key(nil), r.keys...), key))
+	r.mu.Unlock()
+	return key, remove(dropped)
+}
+
+// Reload reads the keys written to the directory since it was last read,
+// such as those of the other servers sharing it, and forgets the keys whose
+// files were removed. Keys that are no longer needed are dropped either way.
+func (r *Ring) Reload() error {
+	r.dirMu.Lock()
+	defer r.dirMu.Unlock()
+	if r.dir == "" {
+		r.mu.Lock()
+		dropped := r.set(r.keys)
+		r.mu.Unlock()
+		return remove(dropped)
+	}
+	paths, err := filepath.Glob(filepath.Join(r.dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+	r.mu.RLock()
+	known := make(map[string]*Key, len(r.keys))
+	for _, key := range r.keys {
+		known[key.path] = key
+	}
+	r.mu.RUnlock()
+	keys := make([]*Key, 0, len(paths))
+	for _, p := range paths {
+		if key, ok := known[p]; ok {
+			keys = append(keys, key)
+			continue
+		}
+		key, err := readKey(p)
+		if errors.Is(err, os.ErrNotExist) {
+			// dropped by another server since the directory was listed
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 && len(known) > 0 {
+		return fmt.Errorf("no key found in %s", r.dir)
+	}
+	r.mu.Lock()
+	dropped := r.set(keys)
+	r.mu.Unlock()
+	return remove(dropped)
+}
+
+// set orders the keys of the ring by creation time and drops those no
+// longer needed, which it returns. The caller holds the write lock.
+func (r *Ring) set(keys []*Key) []*Key {
+	sort.SliceStable(keys, func(i, j int) bool {
+		if !keys[i].Created.Equal(keys[j].Created) {
+			return keys[i].Created.Before(keys[j].Created)
+		}
+		return keys[i].path < keys[j].path
+	})
+	// a key stops signing when the next one has been published long
+	// enough, and is needed until the tokens it signed then have expired
+	now := r.now()
+	n := 0
+	for n+1 < len(keys) && !now.Before(keys[n+1].Created.Add(r.lifetimes.Publish+r.lifetimes.Verify)) {
+		n++
+	}
+	r.keys = keys[n:]
+	return keys[:n]
+}
+
+// remove deletes the files of the dropped keys. The other servers sharing
+// the directory may have deleted them already.
+func remove(dropped []*Key) error {
+	for _, key := range dropped {
+		if key.path == "" {
+			continue
+		}
+		if err := os.Remove(key.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// RotateEvery reloads the keys at every interval until ctx is done, and
+// rotates the signing key unless a server sharing the directory has just
+// done so. A key created less than half an interval ago is taken to be the
+// one of the current interval.
+func (r *Ring) RotateEvery(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Reload(); err != nil && onError != nil {
+				onError(err)
+			}
+			if r.now().Sub(r.newest().Created) < interval/2 {
+				continue
+			}
+			if _, err := r.Rotate(); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+func (r *Ring) newest() *Key {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.keys[len(r.keys)-1]
+}
+
+// SigningKey returns the key tokens are currently signed with, the newest
+// key published for the Publish lifetime. Until one is, the oldest key
+// signs.
+func (r *Ring) SigningKey() *Key {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	now := r.now()
+	for i := len(r.keys) - 1; i > 0; i-- {
+		if !now.Before(r.keys[i].Created.Add(r.lifetimes.Publish)) {
+			return r.keys[i]
+		}
+	}
+	return r.keys[0]
+}
+
+// Sign returns the token of the claims signed by the signing key, naming
+// the key in the kid header
+func (r *Ring) Sign(claims jwt.Claims) (string, error) {
+	key := r.SigningKey()
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+// Keyfunc returns the public key verifying the token, to be used with
+// jwt.Parse. Tokens must name a key of the ring and its algorithm. A token
+// of an unknown key reloads the directory first, as another server may have
+// signed it with a key this one has not read yet.
+func (r *Ring) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key := r.key(kid)
+	if key == nil && r.reloadUnknown() {
+		key = r.key(kid)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, kid)
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("unexpected signing method %s for key %s", token.Method.Alg(), kid)
+	}
+	return key.Private.Public(), nil
+}
+
+func (r *Ring) key(kid string) *Key {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, key := range r.keys {
+		if key.ID == kid {
+			return key
+		}
+	}
+	return nil
+}
+
+// reloadUnknown reloads the directory for a token of an unknown key, unless
+// it was reloaded for one less than reloadBackoff ago. It reports whether
+// the keys were reloaded.
+func (r *Ring) reloadUnknown() bool {
+	if r.dir == "" {
+		return false
+	}
+	r.reloadMu.Lock()
+	now := r.now()
+	if now.Sub(r.reloaded) < reloadBackoff {
+		r.reloadMu.Unlock()
+		return false
+	}
+	r.reloaded = now
+	r.reloadMu.Unlock()
+	return r.Reload() == nil
+}
+
+// JWK is a public key as a JSON Web Key (RFC 7517)
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+// JWKSet is a JSON Web Key set
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK returns the public key of k
+func (k *Key) JWK() (JWK, error) {
+	jwk := JWK{KeyID: k.ID, Use: "sig", Algorithm: k.Algorithm}
+	switch public := k.Private.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = encode(public.N.Bytes())
+		jwk.E = encode(big.NewInt(int64(public.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = encode(public)
+	default:
+		return jwk, ErrUnsupportedKey
+	}
+	return jwk, nil
+}
+
+// thumbprint returns the RFC 7638 thumbprint of the key
+func (j JWK) thumbprint() string {
+	var members string
+	switch j.KeyType {
+	case "RSA":
+		members = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, j.E, j.N)
+	case "OKP":
+		members = fmt.Sprintf(`{"crv":%q,"kty":"OKP","x":%q}`, j.Curve, j.X)
+	}
+	sum := sha256.Sum256([]byte(members))
+	return encode(sum[:])
+}
+
+// JWKS returns the public keys of the ring
+func (r *Ring) JWKS() JWKSet {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	set := JWKSet{Keys: make([]JWK, 0, len(r.keys))}
+	for _, key := range r.keys {
+		if jwk, err := key.JWK(); err == nil {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
+}
+
+// ParseJWKS decodes a JWK set, e.g. to verify tokens in another service
+func ParseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set JWKSet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, j := range set.Keys {
+		switch {
+		case j.KeyType == "RSA":
+			n, err := decode(j.N)
+			if err != nil {
+				return nil, err
+			}
+			e, err := decode(j.E)
+			if err != nil {
+				return nil, err
+			}
+			keys[j.KeyID] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case j.KeyType == "OKP" && strings.EqualFold(j.Curve, "Ed25519"):
+			x, err := decode(j.X)
+			if err != nil {
+				return nil, err
+			}
+			keys[j.KeyID] = ed25519.PublicKey(x)
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedKey, j.KeyType)
+		}
+	}
+	return keys, nil
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
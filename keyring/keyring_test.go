@@ -0,0 +1,162 @@
+package keyring
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	for _, alg := range []string{RS256, EdDSA} {
+		t.Run(alg, func(t *testing.T) {
+			r, err := New(alg, "", Lifetimes{})
+			assert.Nil(t, err)
+			signed, err := r.Sign(jwt.MapClaims{"user_id": "shelby"})
+			assert.Nil(t, err)
+
+			token, err := jwt.Parse(signed, r.Keyfunc)
+			assert.Nil(t, err)
+			assert.Equal(t, alg, token.Method.Alg())
+			assert.Equal(t, r.SigningKey().ID, token.Header["kid"])
+
+			// the published keys verify the token too
+			data, err := json.Marshal(r.JWKS())
+			assert.Nil(t, err)
+			public, err := ParseJWKS(data)
+			assert.Nil(t, err)
+			_, err = jwt.Parse(signed, func(token *jwt.Token) (interface{}, error) {
+				return public[token.Header["kid"].(string)], nil
+			})
+			assert.Nil(t, err)
+		})
+	}
+}
+
+func TestKeyfuncRejects(t *testing.T) {
+	r, err := New(EdDSA, "", Lifetimes{})
+	assert.Nil(t, err)
+
+	hmac := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{})
+	hmac.Header["kid"] = r.SigningKey().ID
+	signed, err := hmac.SignedString([]byte("secret"))
+	assert.Nil(t, err)
+	_, err = jwt.Parse(signed, r.Keyfunc)
+	assert.NotNil(t, err)
+
+	other, err := New(EdDSA, "", Lifetimes{})
+	assert.Nil(t, err)
+	signed, err = other.Sign(jwt.MapClaims{})
+	assert.Nil(t, err)
+	_, err = jwt.Parse(signed, r.Keyfunc)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
+
+var lifetimes = Lifetimes{Publish: JWKSCacheTTL, Verify: 15 * time.Minute}
+
+// clock is a time set by the tests, starting an hour ago so that the keys
+// are not created in the future of a ring loaded with the real clock
+type clock struct{ t time.Time }
+
+func newClock() *clock               { return &clock{t: time.Now().Add(-time.Hour)} }
+func (c *clock) now() time.Time      { return c.t }
+func (c *clock) add(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestRotate(t *testing.T) {
+	dir := t.TempDir()
+	c := newClock()
+	r, err := load(RS256, dir, lifetimes, c.now)
+	assert.Nil(t, err)
+	first := r.SigningKey()
+	firstToken, err := r.Sign(jwt.MapClaims{})
+	assert.Nil(t, err)
+
+	// a new key is published before it signs
+	c.add(time.Minute)
+	second, err := r.Rotate()
+	assert.Nil(t, err)
+	assert.Len(t, r.JWKS().Keys, 2)
+	assert.Equal(t, first.ID, r.SigningKey().ID)
+	c.add(lifetimes.Publish - time.Second)
+	assert.Equal(t, first.ID, r.SigningKey().ID)
+	c.add(time.Second)
+	assert.Equal(t, second.ID, r.SigningKey().ID)
+
+	// the old key verifies the tokens it signed until they expire, and is
+	// then dropped and deleted
+	c.add(lifetimes.Verify - time.Second)
+	assert.Nil(t, r.Reload())
+	_, err = jwt.Parse(firstToken, r.Keyfunc)
+	assert.Nil(t, err)
+	c.add(time.Second)
+	assert.Nil(t, r.Reload())
+	_, err = jwt.Parse(firstToken, r.Keyfunc)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+
+	// the keys survive a restart
+	secondToken, err := r.Sign(jwt.MapClaims{})
+	assert.Nil(t, err)
+	loaded, err := Load(RS256, dir, lifetimes)
+	assert.Nil(t, err)
+	assert.Equal(t, second.ID, loaded.SigningKey().ID)
+	_, err = jwt.Parse(secondToken, loaded.Keyfunc)
+	assert.Nil(t, err)
+}
+
+func TestSharedDirectory(t *testing.T) {
+	dir := t.TempDir()
+	c := newClock()
+	a, err := load(EdDSA, dir, lifetimes, c.now)
+	assert.Nil(t, err)
+	b, err := load(EdDSA, dir, lifetimes, c.now)
+	assert.Nil(t, err)
+	assert.Equal(t, a.SigningKey().ID, b.SigningKey().ID)
+
+	// a reload publishes the keys of the other server
+	c.add(time.Minute)
+	rotated, err := a.Rotate()
+	assert.Nil(t, err)
+	assert.Len(t, b.JWKS().Keys, 1)
+	assert.Nil(t, b.Reload())
+	assert.Len(t, b.JWKS().Keys, 2)
+	c.add(lifetimes.Publish)
+	assert.Equal(t, rotated.ID, b.SigningKey().ID)
+
+	// a token of a key not read yet reloads the directory, though not
+	// more than once per reloadBackoff
+	rotated, err = a.Rotate()
+	assert.Nil(t, err)
+	c.add(lifetimes.Publish)
+	signed, err := a.Sign(jwt.MapClaims{})
+	assert.Nil(t, err)
+	_, err = jwt.Parse(signed, b.Keyfunc)
+	assert.Nil(t, err)
+	assert.Equal(t, rotated.ID, b.SigningKey().ID)
+
+	rotated, err = a.Rotate()
+	assert.Nil(t, err)
+	c.add(time.Second)
+	forged := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{})
+	forged.Header["kid"] = rotated.ID
+	signed, err = forged.SignedString(rotated.Private)
+	assert.Nil(t, err)
+	_, err = jwt.Parse(signed, b.Keyfunc)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+	c.add(reloadBackoff)
+	_, err = jwt.Parse(signed, b.Keyfunc)
+	assert.Nil(t, err)
+}
+
+func TestLoadRejectsInvalidKeys(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "key.pem"), []byte("not a key"), 0o600))
+	_, err := Load(EdDSA, dir, Lifetimes{})
+	assert.NotNil(t, err)
+}
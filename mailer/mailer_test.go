@@ -0,0 +1,51 @@
+package mailer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFile(t *testing.T) {
+	dir := t.TempDir()
+	m := &File{Dir: dir, From: "shop@example.com"}
+	err := m.Send(context.Background(), Message{To: "shelby@example.com", Subject: "Hello", Body: "line one\nline two"})
+	assert.Nil(t, err)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+	data, err := os.ReadFile(files[0])
+	assert.Nil(t, err)
+	headers, body, _ := strings.Cut(string(data), "\r\n\r\n")
+	assert.Contains(t, headers, "From: shop@example.com\r\n")
+	assert.Contains(t, headers, "To: shelby@example.com\r\n")
+	assert.Contains(t, headers, "Subject: Hello\r\n")
+	assert.Equal(t, "line one\r\nline two", body)
+}
+
+func TestMemory(t *testing.T) {
+	m := &Memory{}
+	ctx := context.Background()
+	assert.Nil(t, m.Send(ctx, Message{To: "a@example.com", Subject: "first"}))
+	assert.Nil(t, m.Send(ctx, Message{To: "b@example.com", Subject: "second"}))
+	assert.Nil(t, m.Send(ctx, Message{To: "a@example.com", Subject: "third"}))
+	assert.Len(t, m.Messages(), 3)
+
+	msg, ok := m.Last("a@example.com")
+	assert.True(t, ok)
+	assert.Equal(t, "third", msg.Subject)
+	_, ok = m.Last("c@example.com")
+	assert.False(t, ok)
+}
+
+func TestHeaderInjection(t *testing.T) {
+	m := &Memory{}
+	err := m.Send(context.Background(), Message{To: "a@example.com\r\nBcc: b@example.com", Subject: "hi"})
+	assert.NotNil(t, err)
+	assert.Empty(t, m.Messages())
+}
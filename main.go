@@ -2,33 +2,54 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/ilyakaznacheev/cleanenv"
 	echojwt "github.com/labstack/echo-jwt/v4"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/labstack/gommon/log"
 	"github.com/labstack/gommon/random"
+	"github.com/nitin06890/go-rest-api/cache"
 	"github.com/nitin06890/go-rest-api/config"
+	"github.com/nitin06890/go-rest-api/dbiface"
+	"github.com/nitin06890/go-rest-api/events"
 	"github.com/nitin06890/go-rest-api/handlers"
-	"go.mongodb.org/mongo-driver/bson"
+	"github.com/nitin06890/go-rest-api/keyring"
+	"github.com/nitin06890/go-rest-api/mailer"
+	"github.com/nitin06890/go-rest-api/problem"
+	"github.com/nitin06890/go-rest-api/sqlstore"
+	mongostore "github.com/nitin06890/go-rest-api/store/mongo"
+	"github.com/nitin06890/go-rest-api/store/sqlite"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 const (
 	// CorrelationID is the header key for correlation ID
-	CorrelationID = "X-Correlation-ID"
+	CorrelationID = problem.CorrelationIDHeader
 )
 
 var (
-	c        *mongo.Client
-	db       *mongo.Database
-	prodCol  *mongo.Collection
-	usersCol *mongo.Collection
+	products handlers.ProductRepository
+	users    handlers.UserRepository
+	sessions handlers.SessionRepository
+	tokens   handlers.UserTokenRepository
+	attempts handlers.LoginAttemptRepository
+	apiKeys  handlers.APIKeyRepository
+	inst     *dbiface.Instruments
+	keys     *keyring.Ring
 	cfg      config.Properties
 	err      error
 )
@@ -39,53 +60,255 @@ func init() {
 	}
 	ctx := context.Background()
 
+	// only access tokens are signed, so a key is kept for as long as they
+	// are valid once it stops signing
+	lifetimes := keyring.Lifetimes{Publish: keyring.JWKSCacheTTL, Verify: cfg.AccessTokenTTL}
+	if cfg.JwtKeysDir != "" {
+		keys, err = keyring.Load(cfg.JwtAlgorithm, cfg.JwtKeysDir, lifetimes)
+	} else {
+		log.Warnf("JWT_KEYS_DIR is not set, tokens are signed with a key that lasts until the server stops")
+		keys, err = keyring.New(cfg.JwtAlgorithm, "", lifetimes)
+	}
+	if err != nil {
+		log.Fatalf("Unable to load the signing keys: %v", err)
+	}
+
+	setUpTracing(ctx)
+	inst, err = dbiface.NewInstruments(prometheus.DefaultRegisterer, cfg.SlowQueryThreshold)
+	if err != nil {
+		log.Fatalf("Unable to register the database metrics: %v", err)
+	}
+	switch cfg.StorageDriver {
+	case "mongo":
+		openMongo(ctx)
+	case "sqlite":
+		openSQLite(ctx)
+	default:
+		log.Fatalf("Unknown storage driver %q", cfg.StorageDriver)
+	}
+
+	if cfg.ProductCacheTTL > 0 {
+		counters, err := cache.NewCounters(prometheus.DefaultRegisterer, "products")
+		if err != nil {
+			log.Fatalf("Unable to register the cache metrics: %v", err)
+		}
+		products = &handlers.CachedProducts{
+			Products: products,
+			Cache:    cache.NewLRU(cfg.ProductCacheSize, cfg.ProductCacheTTL),
+			Counters: counters,
+		}
+	}
+}
+
+// setUpTracing exports the spans of the database operations over OTLP/HTTP
+// to OTEL_EXPORTER_OTLP_ENDPOINT, such as http://localhost:4318. The
+// exporter reads the other OTEL_ variables too, like OTEL_SERVICE_NAME.
+// Without an endpoint tracing is disabled and the spans are dropped.
+func setUpTracing(ctx context.Context) {
+	if cfg.OTLPEndpoint == "" {
+		log.Infof("OTEL_EXPORTER_OTLP_ENDPOINT is not set, tracing is disabled")
+		return
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		log.Fatalf("Unable to create the trace exporter: %v", err)
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter)))
+}
+
+// instrument times, traces and counts the errors of the operations of the
+// collection, and logs the slow ones
+func instrument(col dbiface.CollectionAPI, name string) dbiface.CollectionAPI {
+	return &dbiface.InstrumentedCollection{Col: col, Name: name, Instruments: inst}
+}
+
+// openMongo connects to mongo and creates the indexes of the collections
+func openMongo(ctx context.Context) {
 	connectURI := fmt.Sprintf("mongodb://%s:%s", cfg.DBHost, cfg.DBPort)
-	c, err = mongo.Connect(ctx, options.Client().ApplyURI(connectURI))
+	c, err := mongo.Connect(ctx, options.Client().ApplyURI(connectURI))
 	if err != nil {
 		log.Fatalf("Unable to connect to database: %v", err)
 	}
-	db = c.Database(cfg.DBName)
-	prodCol = db.Collection(cfg.ProductCollection)
-	usersCol = db.Collection(cfg.UsersCollection)
 
-	isUserIndexUnique := true
-	indexmodel := mongo.IndexModel{
-		Keys: bson.D{{Key: "username", Value: 1}},
-		Options: &options.IndexOptions{
-			Unique: &isUserIndexUnique,
-		},
+	db := c.Database(cfg.DBName)
+	prodCol := db.Collection(cfg.ProductCollection)
+	usersCol := db.Collection(cfg.UsersCollection)
+	sessCol := db.Collection(cfg.SessionsCollection)
+	tokCol := db.Collection(cfg.UserTokensCollection)
+	attCol := db.Collection(cfg.AttemptsCollection)
+	keysCol := db.Collection(cfg.APIKeysCollection)
+
+	if err := mongostore.CreateUserIndexes(ctx, usersCol); err != nil {
+		log.Fatalf("Unable to create index: %v", err)
 	}
 
-	if _, err := usersCol.Indexes().CreateOne(ctx, indexmodel); err != nil {
+	if err := mongostore.CreateSessionIndexes(ctx, sessCol); err != nil {
+		log.Fatalf("Unable to create index: %v", err)
+	}
+	if err := mongostore.CreateUserTokenIndexes(ctx, tokCol); err != nil {
+		log.Fatalf("Unable to create index: %v", err)
+	}
+	if err := mongostore.CreateLoginAttemptIndexes(ctx, attCol); err != nil {
+		log.Fatalf("Unable to create index: %v", err)
+	}
+	if err := mongostore.CreateAPIKeyIndexes(ctx, keysCol); err != nil {
+		log.Fatalf("Unable to create index: %v", err)
+	}
+	if err := mongostore.CreateProductIndexes(ctx, prodCol); err != nil {
 		log.Fatalf("Unable to create index: %v", err)
 	}
+
+	products = &mongostore.Products{
+		Col: instrument(prodCol, cfg.ProductCollection),
+		Txn: &dbiface.MongoTransactions{Client: c},
+	}
+	users = &mongostore.Users{Col: instrument(usersCol, cfg.UsersCollection)}
+	sessions = &mongostore.Sessions{Col: instrument(sessCol, cfg.SessionsCollection)}
+	tokens = &mongostore.UserTokens{Col: instrument(tokCol, cfg.UserTokensCollection)}
+	attempts = &mongostore.LoginAttempts{Col: instrument(attCol, cfg.AttemptsCollection)}
+	apiKeys = &mongostore.APIKeys{Col: instrument(keysCol, cfg.APIKeysCollection)}
+}
+
+// openSQLite opens the SQLite database, and deletes the expired sessions,
+// tokens and login attempts like the TTL indexes of mongo do
+func openSQLite(ctx context.Context) {
+	sqlDB, err := sqlstore.Open(ctx, cfg.SQLitePath)
+	if err != nil {
+		log.Fatalf("Unable to open the database: %v", err)
+	}
+	products = &sqlite.Products{DB: sqlDB}
+	users = &sqlite.Users{DB: sqlDB}
+	sessions = &sqlite.Sessions{DB: sqlDB}
+	tokens = &sqlite.UserTokens{DB: sqlDB}
+	attempts = &sqlite.LoginAttempts{DB: sqlDB}
+	apiKeys = &sqlite.APIKeys{DB: sqlDB}
+	go deleteExpired(context.Background(), time.Minute, sqlDB)
+}
+
+// deleteExpired deletes the rows whose expires_at has passed, every period
+func deleteExpired(ctx context.Context, period time.Duration, db *sql.DB) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := sqlite.DeleteExpired(ctx, db, now); err != nil {
+				log.Errorf("Unable to delete the expired rows: %v", err)
+			}
+		}
+	}
 }
 
 func main() {
 	e := echo.New()
 	e.Logger.SetLevel(log.ERROR)
+	e.HTTPErrorHandler = problem.HTTPErrorHandler
+	if e.IPExtractor, err = handlers.IPExtractor(cfg.TrustedProxies); err != nil {
+		log.Fatalf("Unable to configure the trusted proxies: %v", err)
+	}
 	e.Pre(middleware.RemoveTrailingSlash())
 	e.Pre(addCorrelationID)
 	jwtMiddleware := echojwt.WithConfig(echojwt.Config{
-		SigningKey:  []byte(cfg.JwtTokenSecret),
+		KeyFunc:     keys.Keyfunc,
 		TokenLookup: "header:x-auth-token",
 	})
+	if cfg.JwtKeyRotation > 0 {
+		go keys.RotateEvery(context.Background(), cfg.JwtKeyRotation, func(err error) {
+			log.Errorf("Unable to rotate the signing key: %v", err)
+		})
+	}
 	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
 		Format: `${time_rfc3339} ${remote_ip} ${header:X-Correlation-ID} ${host} ${method} ${uri} ${user_agent} ` +
 			`${status} ${error} ${latency_human}` + "\n",
 	}))
-	h := &handlers.ProductHandler{Col: prodCol}
-	uh := &handlers.UsersHandler{Col: usersCol}
+	h := &handlers.ProductHandler{
+		Products: products,
+		CacheTTL: cfg.ProductCacheTTL,
+	}
+	uh := &handlers.UsersHandler{
+		Users:    users,
+		Sessions: sessions,
+		Tokens:   tokens,
+		Attempts: attempts,
+		APIKeys:  apiKeys,
+		Keys:     keys,
+		Mailer:   newMailer(),
+		Events:   &events.Log{Out: os.Stdout},
+	}
+	kh := &handlers.KeysHandler{Keys: keys}
+	sessionMiddleware := uh.RequireSession
+	// services may call these routes with an API key instead of an access token
+	authMiddleware := uh.Authenticate(jwtMiddleware)
 	e.GET("/products", h.GetProducts)
+	e.GET("/products/search", h.SearchProducts)
+	e.GET("/products/facets", h.GetProductFacets)
 	e.GET("/products/:id", h.GetProduct)
-	e.DELETE("/products/:id", h.DeleteProduct, jwtMiddleware, adminMiddleware)
-	e.POST("/products", h.CreateProducts, middleware.BodyLimit("1M"), jwtMiddleware)
-	e.PUT("/products/:id", h.UpdateProduct, middleware.BodyLimit("1M"), jwtMiddleware)
+	e.DELETE("/products/:id", h.DeleteProduct, authMiddleware,
+		handlers.RequirePermission(handlers.PermCatalogDelete))
+	e.POST("/products", h.CreateProducts, middleware.BodyLimit("1M"), authMiddleware,
+		handlers.RequirePermission(handlers.PermCatalogWrite))
+	e.PUT("/products/:id", h.UpdateProduct, middleware.BodyLimit("1M"), authMiddleware,
+		handlers.RequirePermission(handlers.PermCatalogWrite))
+	e.PATCH("/products/:id", h.PatchProduct, middleware.BodyLimit("1M"), authMiddleware,
+		handlers.RequirePermission(handlers.PermCatalogWrite))
 
 	e.POST("/users", uh.CreateUser, middleware.BodyLimit("1M"))
+	usersAdmin := handlers.RequirePermission(handlers.PermUsersAdmin)
+	e.GET("/users", uh.GetUsers, jwtMiddleware, sessionMiddleware, usersAdmin)
+	e.GET("/users/:id", uh.GetUser, jwtMiddleware, sessionMiddleware, usersAdmin)
+	e.PATCH("/users/:id", uh.UpdateUser, middleware.BodyLimit("1M"), jwtMiddleware, sessionMiddleware, usersAdmin)
+	e.DELETE("/users/:id", uh.DeleteUser, jwtMiddleware, sessionMiddleware, usersAdmin)
+	e.GET("/me", uh.GetMe, jwtMiddleware, sessionMiddleware)
+	e.PATCH("/me", uh.UpdateMe, middleware.BodyLimit("1M"), jwtMiddleware, sessionMiddleware)
+	e.POST("/me/password", uh.ChangePassword, middleware.BodyLimit("1M"), jwtMiddleware, sessionMiddleware)
+	e.GET("/me/api-keys", uh.GetAPIKeys, jwtMiddleware, sessionMiddleware)
+	e.POST("/me/api-keys", uh.CreateAPIKey, middleware.BodyLimit("1M"), jwtMiddleware, sessionMiddleware)
+	e.DELETE("/me/api-keys/:id", uh.RevokeAPIKey, jwtMiddleware, sessionMiddleware)
+	e.POST("/me/2fa/enroll", uh.EnrollTOTP, jwtMiddleware, sessionMiddleware)
+	e.POST("/me/2fa/confirm", uh.ConfirmTOTP, middleware.BodyLimit("1M"), jwtMiddleware, sessionMiddleware)
 	e.POST("/auth", uh.AuthnUser)
+	e.POST("/auth/2fa", uh.VerifyTwoFactor, middleware.BodyLimit("1M"))
+	e.POST("/auth/refresh", uh.RefreshToken, middleware.BodyLimit("1M"))
+	e.POST("/auth/logout", uh.Logout, jwtMiddleware, sessionMiddleware)
+	e.POST("/auth/forgot", uh.ForgotPassword, middleware.BodyLimit("1M"))
+	e.POST("/auth/reset", uh.ResetPassword, middleware.BodyLimit("1M"))
+	e.POST("/auth/verify", uh.VerifyEmail, middleware.BodyLimit("1M"))
+	e.POST("/auth/verify/resend", uh.ResendVerification, middleware.BodyLimit("1M"))
+	e.GET("/.well-known/jwks.json", kh.GetJWKS)
+	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
 	e.Logger.Info("Listening on %s:%s ", cfg.Host, cfg.Port)
-	e.Logger.Fatal(e.Start(fmt.Sprintf("%s:%s", cfg.Host, cfg.Port)))
+	go func() {
+		if err := e.Start(fmt.Sprintf("%s:%s", cfg.Host, cfg.Port)); err != nil && err != http.ErrServerClosed {
+			e.Logger.Fatal(err)
+		}
+	}()
+
+	// on SIGINT or SIGTERM, finish the requests in flight and then the
+	// emails they left sending in the background
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	<-quit
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		log.Errorf("Unable to shut the server down: %v", err)
+	}
+	uh.Wait()
+}
+
+func newMailer() mailer.Mailer {
+	switch cfg.MailDriver {
+	case "smtp":
+		return &mailer.SMTP{Addr: cfg.SMTPAddr, From: cfg.MailFrom, Username: cfg.SMTPUsername, Password: cfg.SMTPPassword}
+	case "file":
+		return &mailer.File{Dir: cfg.MailDir, From: cfg.MailFrom}
+	case "memory":
+		return &mailer.Memory{}
+	}
+	log.Fatalf("Unknown mail driver %q", cfg.MailDriver)
+	return nil
 }
 
 func addCorrelationID(next echo.HandlerFunc) echo.HandlerFunc {
@@ -98,24 +321,8 @@ func addCorrelationID(next echo.HandlerFunc) echo.HandlerFunc {
 			newID = id
 		}
 		c.Request().Header.Set(CorrelationID, newID)
+		c.SetRequest(c.Request().WithContext(dbiface.WithCorrelationID(c.Request().Context(), newID)))
 		c.Response().Header().Set(CorrelationID, newID)
 		return next(c)
 	}
 }
-
-func adminMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		token := c.Request().Header.Get("x-auth-token")
-		claims := jwt.MapClaims{}
-		_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
-			return []byte(cfg.JwtTokenSecret), nil
-		})
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "Unable to parse token")
-		}
-		if !claims["authorized"].(bool) {
-			return echo.NewHTTPError(http.StatusForbidden, "Not authorized")
-		}
-		return next(c)
-	}
-}
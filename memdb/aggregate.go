@@ -0,0 +1,379 @@
+package memdb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// aggregate runs the stages of a pipeline over the documents
+func aggregate(docs []bson.D, stages []bson.D) ([]bson.D, error) {
+	var err error
+	for _, stage := range stages {
+		if docs, err = runStage(docs, stage[0]); err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+func runStage(docs []bson.D, stage bson.E) ([]bson.D, error) {
+	switch stage.Key {
+	case "$match":
+		f, ok := stage.Value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("memdb: $match needs a document")
+		}
+		var out []bson.D
+		for _, doc := range docs {
+			ok, err := matches(doc, f)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				out = append(out, doc)
+			}
+		}
+		return out, nil
+	case "$sort":
+		keys, err := toSort(stage.Value)
+		if err != nil {
+			return nil, err
+		}
+		out := append([]bson.D(nil), docs...)
+		sort.SliceStable(out, func(a, b int) bool { return compareBy(out[a], out[b], keys) < 0 })
+		return out, nil
+	case "$skip", "$limit":
+		n, ok := toInt(stage.Value)
+		if !ok || n < 0 || (stage.Key == "$limit" && n == 0) {
+			return nil, fmt.Errorf("memdb: %s needs a positive integer", stage.Key)
+		}
+		if n > int64(len(docs)) {
+			n = int64(len(docs))
+		}
+		if stage.Key == "$skip" {
+			return docs[n:], nil
+		}
+		return docs[:n], nil
+	case "$project":
+		out := make([]bson.D, len(docs))
+		for i, doc := range docs {
+			var err error
+			if out[i], err = project(doc, stage.Value); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case "$count":
+		field, ok := stage.Value.(string)
+		if !ok || field == "" || strings.HasPrefix(field, "$") {
+			return nil, fmt.Errorf("memdb: $count needs a field name")
+		}
+		if len(docs) == 0 {
+			return nil, nil
+		}
+		return []bson.D{{{Key: field, Value: int32(len(docs))}}}, nil
+	case "$group":
+		spec, ok := stage.Value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("memdb: $group needs a document")
+		}
+		return group(docs, spec)
+	case "$bucket":
+		spec, ok := stage.Value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("memdb: $bucket needs a document")
+		}
+		return bucket(docs, spec)
+	case "$facet":
+		spec, ok := stage.Value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("memdb: $facet needs a document")
+		}
+		return facet(docs, spec)
+	}
+	return nil, fmt.Errorf("memdb: unsupported aggregation stage %s", stage.Key)
+}
+
+// evaluate evaluates the expression on the document. Only field paths, as
+// "$field", and literals are supported.
+func evaluate(doc bson.D, expr interface{}) (interface{}, error) {
+	switch e := expr.(type) {
+	case string:
+		if !strings.HasPrefix(e, "$") {
+			return e, nil
+		}
+		if strings.HasPrefix(e, "$$") {
+			return nil, fmt.Errorf("memdb: unsupported variable %s", e)
+		}
+		v, _ := getPath(doc, strings.Split(e[1:], "."))
+		return v, nil
+	case bson.D:
+		if isOperatorDocument(e) {
+			return nil, fmt.Errorf("memdb: unsupported expression %s", e[0].Key)
+		}
+		out := bson.D{}
+		for _, f := range e {
+			v, err := evaluate(doc, f.Value)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, bson.E{Key: f.Key, Value: v})
+		}
+		return out, nil
+	}
+	return expr, nil
+}
+
+// accumulator folds the values of a group into a single one
+type accumulator struct {
+	op     string
+	expr   interface{}
+	value  interface{}
+	count  int
+	values bson.A
+}
+
+func newAccumulator(field string, spec interface{}) (*accumulator, error) {
+	d, ok := spec.(bson.D)
+	if !ok || len(d) != 1 {
+		return nil, fmt.Errorf("memdb: the accumulator of %s must be a document with a single operator", field)
+	}
+	switch d[0].Key {
+	case "$sum", "$avg", "$min", "$max", "$first", "$last", "$push", "$addToSet":
+		return &accumulator{op: d[0].Key, expr: d[0].Value, values: bson.A{}}, nil
+	}
+	return nil, fmt.Errorf("memdb: unsupported accumulator %s", d[0].Key)
+}
+
+func (a *accumulator) add(doc bson.D) error {
+	v, err := evaluate(doc, a.expr)
+	if err != nil {
+		return err
+	}
+	a.count++
+	switch a.op {
+	case "$sum", "$avg":
+		if a.value == nil {
+			a.value = int32(0)
+		}
+		// non numeric values are ignored
+		if sum, ok := add(a.value, v); ok {
+			a.value = sum
+		} else if a.op == "$avg" {
+			a.count--
+		}
+	case "$min", "$max":
+		if v == nil {
+			return nil
+		}
+		c := compare(v, a.value)
+		if a.value == nil || (a.op == "$min" && c < 0) || (a.op == "$max" && c > 0) {
+			a.value = v
+		}
+	case "$first":
+		if a.count == 1 {
+			a.value = v
+		}
+	case "$last":
+		a.value = v
+	case "$push":
+		a.values = append(a.values, v)
+	case "$addToSet":
+		if !contains(a.values, v) {
+			a.values = append(a.values, v)
+		}
+	}
+	return nil
+}
+
+func (a *accumulator) result() interface{} {
+	switch a.op {
+	case "$avg":
+		if a.count == 0 {
+			return nil
+		}
+		sum, _ := toFloat(a.value)
+		return sum / float64(a.count)
+	case "$sum":
+		if a.value == nil {
+			return int32(0)
+		}
+	case "$push", "$addToSet":
+		return a.values
+	}
+	return a.value
+}
+
+// groupOf is a group of documents being accumulated
+type groupOf struct {
+	id           interface{}
+	accumulators []*accumulator
+}
+
+func newGroup(id interface{}, spec bson.D) (*groupOf, error) {
+	g := &groupOf{id: id}
+	for _, f := range spec {
+		if f.Key == "_id" {
+			continue
+		}
+		a, err := newAccumulator(f.Key, f.Value)
+		if err != nil {
+			return nil, err
+		}
+		g.accumulators = append(g.accumulators, a)
+	}
+	return g, nil
+}
+
+func (g *groupOf) add(doc bson.D) error {
+	for _, a := range g.accumulators {
+		if err := a.add(doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *groupOf) document(spec bson.D) bson.D {
+	doc := bson.D{{Key: "_id", Value: g.id}}
+	i := 0
+	for _, f := range spec {
+		if f.Key == "_id" {
+			continue
+		}
+		doc = append(doc, bson.E{Key: f.Key, Value: g.accumulators[i].result()})
+		i++
+	}
+	return doc
+}
+
+// group groups the documents by the _id expression, in the order the
+// groups first appear
+func group(docs []bson.D, spec bson.D) ([]bson.D, error) {
+	idExpr, ok := lookupKey(spec, "_id")
+	if !ok {
+		return nil, fmt.Errorf("memdb: $group needs an _id")
+	}
+	var groups []*groupOf
+	for _, doc := range docs {
+		id, err := evaluate(doc, idExpr)
+		if err != nil {
+			return nil, err
+		}
+		var g *groupOf
+		for _, candidate := range groups {
+			if typeOrder(candidate.id) == typeOrder(id) && compare(candidate.id, id) == 0 {
+				g = candidate
+				break
+			}
+		}
+		if g == nil {
+			if g, err = newGroup(id, spec); err != nil {
+				return nil, err
+			}
+			groups = append(groups, g)
+		}
+		if err := g.add(doc); err != nil {
+			return nil, err
+		}
+	}
+	out := make([]bson.D, len(groups))
+	for i, g := range groups {
+		out[i] = g.document(spec)
+	}
+	return out, nil
+}
+
+// bucket groups the documents by the boundaries their groupBy value falls
+// between, the _id of a bucket being its lower boundary. Values outside of
+// the boundaries go to the default bucket.
+func bucket(docs []bson.D, spec bson.D) ([]bson.D, error) {
+	groupBy, _ := lookupKey(spec, "groupBy")
+	boundaries, ok := get(spec, "boundaries").(bson.A)
+	if groupBy == nil || !ok || len(boundaries) < 2 {
+		return nil, fmt.Errorf("memdb: $bucket needs groupBy and at least two boundaries")
+	}
+	for i := 1; i < len(boundaries); i++ {
+		if compare(boundaries[i-1], boundaries[i]) >= 0 {
+			return nil, fmt.Errorf("memdb: the boundaries of $bucket must be ascending")
+		}
+	}
+	def, hasDefault := lookupKey(spec, "default")
+	output, ok := get(spec, "output").(bson.D)
+	if !ok {
+		output = bson.D{{Key: "count", Value: bson.D{{Key: "$sum", Value: int32(1)}}}}
+	}
+
+	groups := make([]*groupOf, len(boundaries))
+	for _, doc := range docs {
+		v, err := evaluate(doc, groupBy)
+		if err != nil {
+			return nil, err
+		}
+		i := len(boundaries) - 1
+		for j := 0; j < len(boundaries)-1; j++ {
+			if typeOrder(v) == typeOrder(boundaries[j]) && compare(v, boundaries[j]) >= 0 && compare(v, boundaries[j+1]) < 0 {
+				i = j
+				break
+			}
+		}
+		if i == len(boundaries)-1 && !hasDefault {
+			return nil, fmt.Errorf("memdb: $bucket has no default for the value %v", v)
+		}
+		if groups[i] == nil {
+			id := def
+			if i < len(boundaries)-1 {
+				id = boundaries[i]
+			}
+			if groups[i], err = newGroup(id, output); err != nil {
+				return nil, err
+			}
+		}
+		if err := groups[i].add(doc); err != nil {
+			return nil, err
+		}
+	}
+	var out []bson.D
+	for _, g := range groups {
+		if g != nil {
+			out = append(out, g.document(output))
+		}
+	}
+	return out, nil
+}
+
+// facet runs every sub pipeline over the documents, returning a single
+// document with the results of each
+func facet(docs []bson.D, spec bson.D) ([]bson.D, error) {
+	out := bson.D{}
+	for _, f := range spec {
+		pipeline, ok := f.Value.(bson.A)
+		if !ok {
+			return nil, fmt.Errorf("memdb: the $facet %s needs a pipeline", f.Key)
+		}
+		stages := make([]bson.D, len(pipeline))
+		for i, s := range pipeline {
+			stage, ok := s.(bson.D)
+			if !ok || len(stage) != 1 {
+				return nil, fmt.Errorf("memdb: stage %d of the $facet %s must be a document with a single field", i, f.Key)
+			}
+			if stage[0].Key == "$facet" {
+				return nil, fmt.Errorf("memdb: $facet cannot be nested")
+			}
+			stages[i] = stage
+		}
+		results, err := aggregate(append([]bson.D(nil), docs...), stages)
+		if err != nil {
+			return nil, err
+		}
+		values := bson.A{}
+		for _, r := range results {
+			values = append(values, r)
+		}
+		out = append(out, bson.E{Key: f.Key, Value: values})
+	}
+	return []bson.D{out}, nil
+}
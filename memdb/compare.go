@@ -0,0 +1,192 @@
+package memdb
+
+import (
+	"bytes"
+	"math"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// typeOrder ranks the BSON types in the order mongo compares them
+func typeOrder(v interface{}) int {
+	switch v.(type) {
+	case primitive.MinKey:
+		return 0
+	case nil, primitive.Null, primitive.Undefined:
+		return 1
+	case int32, int64, float64, primitive.Decimal128:
+		return 2
+	case string, primitive.Symbol:
+		return 3
+	case bson.D:
+		return 4
+	case bson.A:
+		return 5
+	case primitive.Binary:
+		return 6
+	case primitive.ObjectID:
+		return 7
+	case bool:
+		return 8
+	case primitive.DateTime:
+		return 9
+	case primitive.Timestamp:
+		return 10
+	case primitive.Regex:
+		return 11
+	case primitive.MaxKey:
+		return 100
+	}
+	return 50
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// compare orders two normalized values as mongo does, values of different
+// types by their type
+func compare(a, b interface{}) int {
+	ta, tb := typeOrder(a), typeOrder(b)
+	if ta != tb {
+		return sign(ta - tb)
+	}
+	switch a := a.(type) {
+	case int32, int64, float64:
+		return compareNumbers(a, b)
+	case string:
+		return strings.Compare(a, b.(string))
+	case bson.D:
+		bd := b.(bson.D)
+		for i := 0; i < len(a) && i < len(bd); i++ {
+			if c := strings.Compare(a[i].Key, bd[i].Key); c != 0 {
+				return c
+			}
+			if c := compare(a[i].Value, bd[i].Value); c != 0 {
+				return c
+			}
+		}
+		return sign(len(a) - len(bd))
+	case bson.A:
+		ba := b.(bson.A)
+		for i := 0; i < len(a) && i < len(ba); i++ {
+			if c := compare(a[i], ba[i]); c != 0 {
+				return c
+			}
+		}
+		return sign(len(a) - len(ba))
+	case primitive.Binary:
+		return bytes.Compare(a.Data, b.(primitive.Binary).Data)
+	case primitive.ObjectID:
+		bo := b.(primitive.ObjectID)
+		return bytes.Compare(a[:], bo[:])
+	case bool:
+		switch bb := b.(bool); {
+		case a == bb:
+			return 0
+		case !a:
+			return -1
+		}
+		return 1
+	case primitive.DateTime:
+		return compareInts(int64(a), int64(b.(primitive.DateTime)))
+	case primitive.Timestamp:
+		bt := b.(primitive.Timestamp)
+		if a.T != bt.T {
+			return compareInts(int64(a.T), int64(bt.T))
+		}
+		return compareInts(int64(a.I), int64(bt.I))
+	case primitive.Regex:
+		br := b.(primitive.Regex)
+		if a.Pattern != br.Pattern {
+			return strings.Compare(a.Pattern, br.Pattern)
+		}
+		return strings.Compare(a.Options, br.Options)
+	}
+	return 0
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareNumbers compares integers exactly and other numbers as floats
+func compareNumbers(a, b interface{}) int {
+	ai, aInt := toInt(a)
+	bi, bInt := toInt(b)
+	if aInt && bInt {
+		return compareInts(ai, bi)
+	}
+	af, _ := toFloat(a)
+	bf, _ := toFloat(b)
+	switch {
+	case af < bf:
+		return -1
+	case af > bf:
+		return 1
+	case math.IsNaN(af) && !math.IsNaN(bf):
+		return -1
+	case !math.IsNaN(af) && math.IsNaN(bf):
+		return 1
+	}
+	return 0
+}
+
+func toInt(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	}
+	return 0, false
+}
+
+// add adds two numbers keeping the narrowest type that holds the result
+func add(a, b interface{}) (interface{}, bool) {
+	ai, aInt := toInt(a)
+	bi, bInt := toInt(b)
+	if aInt && bInt {
+		sum := ai + bi
+		_, a32 := a.(int32)
+		_, b32 := b.(int32)
+		if a32 && b32 && sum >= math.MinInt32 && sum <= math.MaxInt32 {
+			return int32(sum), true
+		}
+		return sum, true
+	}
+	af, aok := toFloat(a)
+	bf, bok := toFloat(b)
+	if !aok || !bok {
+		return nil, false
+	}
+	return af + bf, true
+}
@@ -0,0 +1,325 @@
+package memdb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// normalize round trips the value through BSON so that documents, filters
+// and updates only hold the types the driver decodes to: bson.D for
+// documents, bson.A for arrays, int32, int64, float64, primitive.DateTime...
+func normalize(v interface{}) (interface{}, error) {
+	raw, err := bson.Marshal(bson.D{{Key: "v", Value: v}})
+	if err != nil {
+		return nil, fmt.Errorf("memdb: %w", err)
+	}
+	var wrapped bson.D
+	if err := bson.Unmarshal(raw, &wrapped); err != nil {
+		return nil, fmt.Errorf("memdb: %w", err)
+	}
+	return wrapped[0].Value, nil
+}
+
+func toDocument(v interface{}) (bson.D, error) {
+	n, err := normalize(v)
+	if err != nil {
+		return nil, err
+	}
+	doc, ok := n.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("memdb: %T is not a document", v)
+	}
+	return doc, nil
+}
+
+// toFilter returns the filter as a document, nil meaning every document
+func toFilter(v interface{}) (bson.D, error) {
+	if v == nil {
+		return bson.D{}, nil
+	}
+	return toDocument(v)
+}
+
+// toUpdate returns the update, which may only hold update operators
+func toUpdate(v interface{}) (bson.D, error) {
+	u, err := toDocument(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(u) == 0 || !isOperatorDocument(u) {
+		return nil, fmt.Errorf("memdb: update documents may only contain update operators")
+	}
+	return u, nil
+}
+
+func toPipeline(v interface{}) ([]bson.D, error) {
+	n, err := normalize(v)
+	if err != nil {
+		return nil, err
+	}
+	a, ok := n.(bson.A)
+	if !ok {
+		return nil, fmt.Errorf("memdb: a pipeline is an array of stages, not %T", v)
+	}
+	stages := make([]bson.D, len(a))
+	for i, s := range a {
+		stage, ok := s.(bson.D)
+		if !ok || len(stage) != 1 {
+			return nil, fmt.Errorf("memdb: stage %d must be a document with a single field", i)
+		}
+		stages[i] = stage
+	}
+	return stages, nil
+}
+
+// sortKey is a field to sort by, in ascending order unless desc
+type sortKey struct {
+	path string
+	desc bool
+}
+
+func toSort(v interface{}) ([]sortKey, error) {
+	spec, err := toDocument(v)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]sortKey, len(spec))
+	for i, e := range spec {
+		dir, ok := toFloat(e.Value)
+		if !ok || (dir != 1 && dir != -1) {
+			return nil, fmt.Errorf("memdb: unsupported sort order %v of %s", e.Value, e.Key)
+		}
+		keys[i] = sortKey{path: e.Key, desc: dir < 0}
+	}
+	return keys, nil
+}
+
+// compareBy compares documents by the sort keys
+func compareBy(a, b bson.D, keys []sortKey) int {
+	for _, k := range keys {
+		c := compare(sortValue(a, k), sortValue(b, k))
+		if k.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// sortValue is the value a document is sorted by: missing fields sort as
+// null and arrays by their smallest element, or largest when descending
+func sortValue(doc bson.D, k sortKey) interface{} {
+	values := lookup(doc, k.path)
+	var best interface{}
+	found := false
+	for _, v := range values {
+		candidates := []interface{}{v}
+		if a, ok := v.(bson.A); ok && len(a) > 0 {
+			candidates = a
+		}
+		for _, c := range candidates {
+			if !found || (k.desc && compare(c, best) > 0) || (!k.desc && compare(c, best) < 0) {
+				best, found = c, true
+			}
+		}
+	}
+	return best
+}
+
+func isOperatorDocument(d bson.D) bool {
+	return len(d) > 0 && strings.HasPrefix(d[0].Key, "$")
+}
+
+func lookupKey(d bson.D, key string) (interface{}, bool) {
+	for _, e := range d {
+		if e.Key == key {
+			return e.Value, true
+		}
+	}
+	return nil, false
+}
+
+// get returns the value of a top level field
+func get(d bson.D, key string) interface{} {
+	v, _ := lookupKey(d, key)
+	return v
+}
+
+// lookup returns the values at the dotted path. Arrays on the way are
+// traversed, so a path may reach several values; none means missing.
+func lookup(v interface{}, path string) []interface{} {
+	return lookupParts(v, strings.Split(path, "."))
+}
+
+func lookupParts(v interface{}, parts []string) []interface{} {
+	if len(parts) == 0 {
+		return []interface{}{v}
+	}
+	switch v := v.(type) {
+	case bson.D:
+		child, ok := lookupKey(v, parts[0])
+		if !ok {
+			return nil
+		}
+		return lookupParts(child, parts[1:])
+	case bson.A:
+		if i, err := strconv.Atoi(parts[0]); err == nil {
+			if i < 0 || i >= len(v) {
+				return nil
+			}
+			return lookupParts(v[i], parts[1:])
+		}
+		var values []interface{}
+		for _, elem := range v {
+			if _, ok := elem.(bson.D); ok {
+				values = append(values, lookupParts(elem, parts)...)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// getPath returns the single value at the dotted path, without traversing arrays
+func getPath(d bson.D, parts []string) (interface{}, bool) {
+	var v interface{} = d
+	for _, p := range parts {
+		switch cur := v.(type) {
+		case bson.D:
+			child, ok := lookupKey(cur, p)
+			if !ok {
+				return nil, false
+			}
+			v = child
+		case bson.A:
+			i, err := strconv.Atoi(p)
+			if err != nil || i < 0 || i >= len(cur) {
+				return nil, false
+			}
+			v = cur[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// setPath returns a copy of the document with the value at the dotted path,
+// creating the documents on the way
+func setPath(d bson.D, parts []string, value interface{}) bson.D {
+	out := make(bson.D, 0, len(d)+1)
+	found := false
+	for _, e := range d {
+		if e.Key != parts[0] {
+			out = append(out, e)
+			continue
+		}
+		found = true
+		out = append(out, bson.E{Key: e.Key, Value: setValue(e.Value, parts[1:], value)})
+	}
+	if !found {
+		out = append(out, bson.E{Key: parts[0], Value: setValue(nil, parts[1:], value)})
+	}
+	return out
+}
+
+func setValue(current interface{}, parts []string, value interface{}) interface{} {
+	if len(parts) == 0 {
+		return value
+	}
+	if a, ok := current.(bson.A); ok {
+		if i, err := strconv.Atoi(parts[0]); err == nil && i >= 0 {
+			out := append(bson.A(nil), a...)
+			for len(out) <= i {
+				out = append(out, nil)
+			}
+			out[i] = setValue(out[i], parts[1:], value)
+			return out
+		}
+	}
+	d, ok := current.(bson.D)
+	if !ok {
+		d = bson.D{}
+	}
+	return setPath(d, parts, value)
+}
+
+// unsetPath returns a copy of the document without the value at the dotted path
+func unsetPath(d bson.D, parts []string) bson.D {
+	out := make(bson.D, 0, len(d))
+	for _, e := range d {
+		if e.Key != parts[0] {
+			out = append(out, e)
+			continue
+		}
+		if len(parts) == 1 {
+			continue
+		}
+		if child, ok := e.Value.(bson.D); ok {
+			e.Value = unsetPath(child, parts[1:])
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// project applies an inclusion or exclusion projection to the document
+func project(doc bson.D, projection interface{}) (bson.D, error) {
+	spec, err := toDocument(projection)
+	if err != nil {
+		return nil, err
+	}
+	include := false
+	keepID := true
+	for _, e := range spec {
+		if _, ok := e.Value.(bson.D); ok {
+			return nil, fmt.Errorf("memdb: unsupported projection of %s", e.Key)
+		}
+		if e.Key == "_id" {
+			keepID = truthy(e.Value)
+			continue
+		}
+		include = include || truthy(e.Value)
+	}
+	if !include {
+		out := doc
+		for _, e := range spec {
+			if !truthy(e.Value) {
+				out = unsetPath(out, strings.Split(e.Key, "."))
+			}
+		}
+		return out, nil
+	}
+	out := bson.D{}
+	if id, ok := lookupKey(doc, "_id"); ok && keepID {
+		out = append(out, bson.E{Key: "_id", Value: id})
+	}
+	for _, e := range spec {
+		if e.Key == "_id" || !truthy(e.Value) {
+			continue
+		}
+		parts := strings.Split(e.Key, ".")
+		if v, ok := getPath(doc, parts); ok {
+			out = setPath(out, parts, v)
+		}
+	}
+	return out, nil
+}
+
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case nil:
+		return false
+	}
+	if f, ok := toFloat(v); ok {
+		return f != 0
+	}
+	return true
+}
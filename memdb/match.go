@@ -0,0 +1,262 @@
+package memdb
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// matches reports whether the document matches the filter
+func matches(doc bson.D, f bson.D) (bool, error) {
+	for _, e := range f {
+		ok, err := matchElement(doc, e)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchElement(doc bson.D, e bson.E) (bool, error) {
+	switch e.Key {
+	case "$and", "$or", "$nor":
+		clauses, ok := e.Value.(bson.A)
+		if !ok || len(clauses) == 0 {
+			return false, fmt.Errorf("memdb: %s needs a non empty array", e.Key)
+		}
+		for _, clause := range clauses {
+			f, ok := clause.(bson.D)
+			if !ok {
+				return false, fmt.Errorf("memdb: %s needs an array of documents", e.Key)
+			}
+			ok, err := matches(doc, f)
+			if err != nil {
+				return false, err
+			}
+			switch {
+			case e.Key == "$and" && !ok:
+				return false, nil
+			case e.Key == "$or" && ok:
+				return true, nil
+			case e.Key == "$nor" && ok:
+				return false, nil
+			}
+		}
+		return e.Key != "$or", nil
+	}
+	if strings.HasPrefix(e.Key, "$") {
+		return false, fmt.Errorf("memdb: unsupported query operator %s", e.Key)
+	}
+	return matchCondition(lookup(doc, e.Key), e.Value)
+}
+
+// matchCondition matches the values at a path against either a document of
+// operators or a value to be equal to
+func matchCondition(values []interface{}, cond interface{}) (bool, error) {
+	ops, ok := cond.(bson.D)
+	if !ok || !isOperatorDocument(ops) {
+		if re, ok := cond.(primitive.Regex); ok {
+			return matchRegex(values, re)
+		}
+		return matchEqual(values, cond), nil
+	}
+	options := ""
+	if o, ok := lookupKey(ops, "$options"); ok {
+		options, _ = o.(string)
+	}
+	for _, op := range ops {
+		ok, err := matchOperator(values, op, options)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// candidates returns the values at a path and the elements of the arrays
+// among them, which conditions match individually. A missing path is null.
+func candidates(values []interface{}) []interface{} {
+	if len(values) == 0 {
+		return []interface{}{nil}
+	}
+	var out []interface{}
+	for _, v := range values {
+		out = append(out, v)
+		if a, ok := v.(bson.A); ok {
+			out = append(out, a...)
+		}
+	}
+	return out
+}
+
+func matchEqual(values []interface{}, want interface{}) bool {
+	for _, v := range candidates(values) {
+		if typeOrder(v) == typeOrder(want) && compare(v, want) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func matchCompare(values []interface{}, bound interface{}, ok func(int) bool) bool {
+	for _, v := range candidates(values) {
+		// values only compare with values of the same type
+		if typeOrder(v) == typeOrder(bound) && ok(compare(v, bound)) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchIn(values []interface{}, list interface{}) (bool, error) {
+	a, ok := list.(bson.A)
+	if !ok {
+		return false, fmt.Errorf("memdb: $in and $nin need an array")
+	}
+	for _, want := range a {
+		if re, ok := want.(primitive.Regex); ok {
+			if ok, err := matchRegex(values, re); err != nil || ok {
+				return ok, err
+			}
+			continue
+		}
+		if matchEqual(values, want) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func matchRegex(values []interface{}, re primitive.Regex) (bool, error) {
+	pattern, err := compileRegex(re.Pattern, re.Options)
+	if err != nil {
+		return false, err
+	}
+	for _, v := range candidates(values) {
+		if s, ok := v.(string); ok && pattern.MatchString(s) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func compileRegex(pattern, options string) (*regexp.Regexp, error) {
+	flags := ""
+	for _, o := range options {
+		switch o {
+		case 'i', 'm', 's':
+			flags += string(o)
+		case 'x':
+			return nil, fmt.Errorf("memdb: unsupported regular expression option x")
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("memdb: %w", err)
+	}
+	return re, nil
+}
+
+func matchOperator(values []interface{}, op bson.E, options string) (bool, error) {
+	switch op.Key {
+	case "$eq":
+		return matchEqual(values, op.Value), nil
+	case "$ne":
+		return !matchEqual(values, op.Value), nil
+	case "$gt":
+		return matchCompare(values, op.Value, func(c int) bool { return c > 0 }), nil
+	case "$gte":
+		return matchCompare(values, op.Value, func(c int) bool { return c >= 0 }), nil
+	case "$lt":
+		return matchCompare(values, op.Value, func(c int) bool { return c < 0 }), nil
+	case "$lte":
+		return matchCompare(values, op.Value, func(c int) bool { return c <= 0 }), nil
+	case "$in":
+		return matchIn(values, op.Value)
+	case "$nin":
+		ok, err := matchIn(values, op.Value)
+		return !ok, err
+	case "$exists":
+		return (len(values) > 0) == truthy(op.Value), nil
+	case "$regex":
+		switch re := op.Value.(type) {
+		case string:
+			return matchRegex(values, primitive.Regex{Pattern: re, Options: options})
+		case primitive.Regex:
+			if options == "" {
+				options = re.Options
+			}
+			return matchRegex(values, primitive.Regex{Pattern: re.Pattern, Options: options})
+		}
+		return false, fmt.Errorf("memdb: $regex needs a string or a regular expression")
+	case "$options":
+		// applied with $regex
+		return true, nil
+	case "$not":
+		ok, err := matchCondition(values, op.Value)
+		return !ok, err
+	case "$size":
+		n, ok := toFloat(op.Value)
+		if !ok {
+			return false, fmt.Errorf("memdb: $size needs a number")
+		}
+		for _, v := range values {
+			if a, ok := v.(bson.A); ok && float64(len(a)) == n {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$all":
+		all, ok := op.Value.(bson.A)
+		if !ok {
+			return false, fmt.Errorf("memdb: $all needs an array")
+		}
+		for _, want := range all {
+			if !matchEqual(values, want) {
+				return false, nil
+			}
+		}
+		return len(all) > 0, nil
+	case "$elemMatch":
+		cond, ok := op.Value.(bson.D)
+		if !ok {
+			return false, fmt.Errorf("memdb: $elemMatch needs a document")
+		}
+		for _, v := range values {
+			a, ok := v.(bson.A)
+			if !ok {
+				continue
+			}
+			for _, elem := range a {
+				ok, err := matchElem(elem, cond)
+				if err != nil {
+					return false, err
+				}
+				if ok {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("memdb: unsupported query operator %s", op.Key)
+}
+
+// matchElem matches an array element against the condition of $elemMatch,
+// either operators on the element or a filter on its fields
+func matchElem(elem interface{}, cond bson.D) (bool, error) {
+	if isOperatorDocument(cond) {
+		return matchCondition([]interface{}{elem}, cond)
+	}
+	doc, ok := elem.(bson.D)
+	if !ok {
+		return false, nil
+	}
+	return matches(doc, cond)
+}
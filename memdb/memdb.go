@@ -0,0 +1,572 @@
+// Package memdb keeps collections in memory behind dbiface.CollectionAPI so
+// handlers can be tested without a database. Filters, updates and
+// aggregations follow the mongo semantics for the operators and stages the
+// API uses; anything else is reported as unsupported rather than guessed.
+package memdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nitin06890/go-rest-api/dbiface"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// duplicateKeyCode is the server error code of unique index violations
+const duplicateKeyCode = 11000
+
+var _ dbiface.CollectionAPI = (*Collection)(nil)
+
+// Database is a set of collections created on first use
+type Database struct {
+	mu          sync.Mutex
+	collections map[string]*Collection
+}
+
+// NewDatabase returns an empty database
+func NewDatabase() *Database {
+	return &Database{collections: make(map[string]*Collection)}
+}
+
+// Collection returns the collection of the name, creating it if needed
+func (d *Database) Collection(name string) *Collection {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.collections[name]
+	if !ok {
+		c = NewCollection(name)
+		d.collections[name] = c
+	}
+	return c
+}
+
+// Drop drops every collection of the database
+func (d *Database) Drop(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, c := range d.collections {
+		if err := c.Drop(ctx); err != nil {
+			return err
+		}
+	}
+	d.collections = make(map[string]*Collection)
+	return nil
+}
+
+// Collection is an in-memory collection. Documents are kept in insertion
+// order, which is the order of unsorted queries.
+type Collection struct {
+	name string
+
+	mu      sync.RWMutex
+	docs    []bson.D
+	uniques [][]string
+}
+
+// NewCollection returns an empty collection
+func NewCollection(name string) *Collection {
+	return &Collection{name: name}
+}
+
+// CreateUniqueIndex makes the combination of the fields unique among the
+// documents, as a unique index would. Missing fields count as null.
+func (c *Collection) CreateUniqueIndex(fields ...string) error {
+	if len(fields) == 0 {
+		return fmt.Errorf("memdb: an index needs at least one field")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.docs {
+		if dup := c.duplicateOf(c.docs[i], [][]string{fields}, i); dup != nil {
+			return fmt.Errorf("memdb: cannot create the index of %s, %s", c.name, dup)
+		}
+	}
+	c.uniques = append(c.uniques, fields)
+	return nil
+}
+
+// Drop removes every document and index of the collection
+func (c *Collection) Drop(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.docs, c.uniques = nil, nil
+	return nil
+}
+
+// InsertOne inserts the document, giving it an ObjectID if it has no _id
+func (c *Collection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	doc, err := toDocument(document)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	doc = withID(doc)
+	if dup := c.duplicateOf(doc, c.indexes(), -1); dup != nil {
+		return nil, mongo.WriteException{WriteErrors: mongo.WriteErrors{dup.writeError(0)}}
+	}
+	c.docs = append(c.docs, doc)
+	return &mongo.InsertOneResult{InsertedID: get(doc, "_id")}, nil
+}
+
+// InsertMany inserts the documents. Ordered inserts, the default, stop at
+// the first failure while unordered ones go on with the next document.
+func (c *Collection) InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	o := options.MergeInsertManyOptions(opts...)
+	ordered := o.Ordered == nil || *o.Ordered
+	docs := make([]bson.D, len(documents))
+	for i, document := range documents {
+		doc, err := toDocument(document)
+		if err != nil {
+			return nil, err
+		}
+		docs[i] = withID(doc)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res := &mongo.InsertManyResult{}
+	var failures []mongo.BulkWriteError
+	for i, doc := range docs {
+		if dup := c.duplicateOf(doc, c.indexes(), -1); dup != nil {
+			failures = append(failures, mongo.BulkWriteError{WriteError: dup.writeError(i)})
+			if ordered {
+				break
+			}
+			continue
+		}
+		c.docs = append(c.docs, doc)
+		res.InsertedIDs = append(res.InsertedIDs, get(doc, "_id"))
+	}
+	if len(failures) > 0 {
+		return res, mongo.BulkWriteException{WriteErrors: failures}
+	}
+	return res, nil
+}
+
+// Find returns a cursor over the documents matching the filter
+func (c *Collection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	o := options.MergeFindOptions(opts...)
+	var skip, limit int64
+	if o.Skip != nil {
+		skip = *o.Skip
+	}
+	if o.Limit != nil {
+		limit = *o.Limit
+	}
+	docs, err := c.query(filter, o.Sort, skip, limit, o.Projection)
+	if err != nil {
+		return nil, err
+	}
+	return cursor(docs)
+}
+
+// CountDocuments counts the documents matching the filter
+func (c *Collection) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	o := options.MergeCountOptions(opts...)
+	var skip, limit int64
+	if o.Skip != nil {
+		skip = *o.Skip
+	}
+	if o.Limit != nil {
+		limit = *o.Limit
+	}
+	docs, err := c.query(filter, nil, skip, limit, nil)
+	return int64(len(docs)), err
+}
+
+// FindOne returns the first document matching the filter
+func (c *Collection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	if err := ctx.Err(); err != nil {
+		return singleResult(nil, err)
+	}
+	o := options.MergeFindOneOptions(opts...)
+	var skip int64
+	if o.Skip != nil {
+		skip = *o.Skip
+	}
+	docs, err := c.query(filter, o.Sort, skip, 1, o.Projection)
+	if err != nil {
+		return singleResult(nil, err)
+	}
+	if len(docs) == 0 {
+		return singleResult(nil, mongo.ErrNoDocuments)
+	}
+	return singleResult(docs[0], nil)
+}
+
+// UpdateOne updates the first document matching the filter
+func (c *Collection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return c.updateMany(ctx, filter, update, false, opts...)
+}
+
+// UpdateMany updates every document matching the filter
+func (c *Collection) UpdateMany(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return c.updateMany(ctx, filter, update, true, opts...)
+}
+
+func (c *Collection) updateMany(ctx context.Context, filter interface{}, update interface{}, many bool, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	o := options.MergeUpdateOptions(opts...)
+	f, err := toFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	u, err := toUpdate(update)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res := &mongo.UpdateResult{}
+	for i := range c.docs {
+		ok, err := matches(c.docs[i], f)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		res.MatchedCount++
+		modified, err := c.replace(i, u)
+		if err != nil {
+			return nil, err
+		}
+		if modified {
+			res.ModifiedCount++
+		}
+		if !many {
+			break
+		}
+	}
+	if res.MatchedCount == 0 && o.Upsert != nil && *o.Upsert {
+		doc, err := c.upsert(f, u)
+		if err != nil {
+			return nil, err
+		}
+		res.UpsertedCount, res.UpsertedID = 1, get(doc, "_id")
+	}
+	return res, nil
+}
+
+// FindOneAndUpdate updates the first document matching the filter and
+// returns it as it was before the update, or after with options.After
+func (c *Collection) FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+	if err := ctx.Err(); err != nil {
+		return singleResult(nil, err)
+	}
+	o := options.MergeFindOneAndUpdateOptions(opts...)
+	after := o.ReturnDocument != nil && *o.ReturnDocument == options.After
+	f, err := toFilter(filter)
+	if err != nil {
+		return singleResult(nil, err)
+	}
+	u, err := toUpdate(update)
+	if err != nil {
+		return singleResult(nil, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	found, err := c.matching(f, o.Sort)
+	if err != nil {
+		return singleResult(nil, err)
+	}
+	var result bson.D
+	switch {
+	case len(found) > 0:
+		i := found[0]
+		result = c.docs[i]
+		if _, err := c.replace(i, u); err != nil {
+			return singleResult(nil, err)
+		}
+		if after {
+			result = c.docs[i]
+		}
+	case o.Upsert != nil && *o.Upsert:
+		doc, err := c.upsert(f, u)
+		if err != nil {
+			return singleResult(nil, err)
+		}
+		// there was nothing before the upsert
+		if !after {
+			return singleResult(nil, mongo.ErrNoDocuments)
+		}
+		result = doc
+	default:
+		return singleResult(nil, mongo.ErrNoDocuments)
+	}
+	if o.Projection != nil {
+		if result, err = project(result, o.Projection); err != nil {
+			return singleResult(nil, err)
+		}
+	}
+	return singleResult(result, nil)
+}
+
+// DeleteOne deletes the first document matching the filter
+func (c *Collection) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	return c.delete(ctx, filter, false)
+}
+
+// DeleteMany deletes every document matching the filter
+func (c *Collection) DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	return c.delete(ctx, filter, true)
+}
+
+func (c *Collection) delete(ctx context.Context, filter interface{}, many bool) (*mongo.DeleteResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f, err := toFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res := &mongo.DeleteResult{}
+	kept := c.docs[:0]
+	for _, doc := range c.docs {
+		ok, err := matches(doc, f)
+		if err != nil {
+			return nil, err
+		}
+		if ok && (many || res.DeletedCount == 0) {
+			res.DeletedCount++
+			continue
+		}
+		kept = append(kept, doc)
+	}
+	c.docs = kept
+	return res, nil
+}
+
+// Aggregate runs the pipeline over the documents of the collection
+func (c *Collection) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	stages, err := toPipeline(pipeline)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.RLock()
+	docs := append([]bson.D(nil), c.docs...)
+	c.mu.RUnlock()
+	if docs, err = aggregate(docs, stages); err != nil {
+		return nil, err
+	}
+	return cursor(docs)
+}
+
+// query returns the documents matching the filter, sorted, skipped,
+// limited and projected
+func (c *Collection) query(filter interface{}, sortSpec interface{}, skip, limit int64, projection interface{}) ([]bson.D, error) {
+	f, err := toFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	found, err := c.matching(f, sortSpec)
+	if err != nil {
+		return nil, err
+	}
+	if skip > int64(len(found)) {
+		skip = int64(len(found))
+	}
+	found = found[skip:]
+	// a negative limit is a limit too, returned in a single batch
+	if limit < 0 {
+		limit = -limit
+	}
+	if limit > 0 && limit < int64(len(found)) {
+		found = found[:limit]
+	}
+	docs := make([]bson.D, 0, len(found))
+	for _, i := range found {
+		doc := c.docs[i]
+		if projection != nil {
+			if doc, err = project(doc, projection); err != nil {
+				return nil, err
+			}
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// matching returns the positions of the documents matching the filter, in
+// the order of the sort specification
+func (c *Collection) matching(f bson.D, sortSpec interface{}) ([]int, error) {
+	var found []int
+	for i, doc := range c.docs {
+		ok, err := matches(doc, f)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			found = append(found, i)
+		}
+	}
+	if sortSpec == nil {
+		return found, nil
+	}
+	keys, err := toSort(sortSpec)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(found, func(a, b int) bool {
+		return compareBy(c.docs[found[a]], c.docs[found[b]], keys) < 0
+	})
+	return found, nil
+}
+
+// replace applies the update to the document at position i, checking the
+// unique indexes, and reports whether the document changed
+func (c *Collection) replace(i int, u bson.D) (bool, error) {
+	doc, err := applyUpdate(c.docs[i], u, false)
+	if err != nil {
+		return false, err
+	}
+	if compare(get(doc, "_id"), get(c.docs[i], "_id")) != 0 {
+		return false, fmt.Errorf("memdb: the _id field cannot be changed")
+	}
+	if dup := c.duplicateOf(doc, c.indexes(), i); dup != nil {
+		return false, mongo.WriteException{WriteErrors: mongo.WriteErrors{dup.writeError(0)}}
+	}
+	modified := !equalDocuments(doc, c.docs[i])
+	c.docs[i] = doc
+	return modified, nil
+}
+
+// upsert inserts the document made of the equality conditions of the filter
+// and the update
+func (c *Collection) upsert(f bson.D, u bson.D) (bson.D, error) {
+	seed := bson.D{}
+	for _, e := range f {
+		if strings.HasPrefix(e.Key, "$") {
+			continue
+		}
+		value := e.Value
+		if ops, ok := value.(bson.D); ok && isOperatorDocument(ops) {
+			eq, found := lookupKey(ops, "$eq")
+			if !found {
+				continue
+			}
+			value = eq
+		}
+		seed = setPath(seed, strings.Split(e.Key, "."), value)
+	}
+	doc, err := applyUpdate(seed, u, true)
+	if err != nil {
+		return nil, err
+	}
+	doc = withID(doc)
+	if dup := c.duplicateOf(doc, c.indexes(), -1); dup != nil {
+		return nil, mongo.WriteException{WriteErrors: mongo.WriteErrors{dup.writeError(0)}}
+	}
+	c.docs = append(c.docs, doc)
+	return doc, nil
+}
+
+// indexes returns the unique indexes, including the one on _id
+func (c *Collection) indexes() [][]string {
+	return append([][]string{{"_id"}}, c.uniques...)
+}
+
+// duplicate is a violation of a unique index
+type duplicate struct {
+	collection string
+	fields     []string
+	key        bson.D
+}
+
+func (d *duplicate) String() string {
+	return fmt.Sprintf("E11000 duplicate key error collection: %s index: %s dup key: %v",
+		d.collection, strings.Join(d.fields, "_1_")+"_1", d.key)
+}
+
+func (d *duplicate) writeError(index int) mongo.WriteError {
+	return mongo.WriteError{Index: index, Code: duplicateKeyCode, Message: d.String()}
+}
+
+// duplicateOf returns the first unique index the document would violate,
+// ignoring the document at position self
+func (c *Collection) duplicateOf(doc bson.D, indexes [][]string, self int) *duplicate {
+	for _, fields := range indexes {
+		key := indexKey(doc, fields)
+		for i, other := range c.docs {
+			if i != self && equalDocuments(key, indexKey(other, fields)) {
+				return &duplicate{collection: c.name, fields: fields, key: key}
+			}
+		}
+	}
+	return nil
+}
+
+func indexKey(doc bson.D, fields []string) bson.D {
+	key := make(bson.D, len(fields))
+	for i, f := range fields {
+		var value interface{}
+		if values := lookup(doc, f); len(values) > 0 {
+			value = values[0]
+		}
+		key[i] = bson.E{Key: f, Value: value}
+	}
+	return key
+}
+
+// withID returns the document with an _id first, generating one if needed
+func withID(doc bson.D) bson.D {
+	for _, e := range doc {
+		if e.Key == "_id" {
+			return doc
+		}
+	}
+	return append(bson.D{{Key: "_id", Value: primitive.NewObjectID()}}, doc...)
+}
+
+// equalDocuments reports whether the documents have the same BSON encoding
+func equalDocuments(a, b bson.D) bool {
+	ra, errA := bson.Marshal(a)
+	rb, errB := bson.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(ra, rb)
+}
+
+func cursor(docs []bson.D) (*mongo.Cursor, error) {
+	values := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		values[i] = doc
+	}
+	return mongo.NewCursorFromDocuments(values, nil, nil)
+}
+
+func singleResult(doc bson.D, err error) *mongo.SingleResult {
+	if doc == nil {
+		doc = bson.D{}
+	}
+	return mongo.NewSingleResultFromDocument(doc, err, nil)
+}
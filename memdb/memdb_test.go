@@ -0,0 +1,220 @@
+package memdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type product struct {
+	Name   string   `bson:"name"`
+	Price  int      `bson:"price"`
+	Vendor string   `bson:"vendor,omitempty"`
+	Tags   []string `bson:"tags,omitempty"`
+}
+
+func seed(t *testing.T) *Collection {
+	c := NewCollection("products")
+	_, err := c.InsertMany(context.Background(), []interface{}{
+		product{Name: "lamp", Price: 40, Vendor: "acme", Tags: []string{"home", "light"}},
+		product{Name: "desk", Price: 300, Vendor: "acme", Tags: []string{"home"}},
+		product{Name: "phone", Price: 800, Vendor: "globex"},
+		product{Name: "cable", Price: 10},
+	})
+	assert.Nil(t, err)
+	return c
+}
+
+func names(t *testing.T, cursor *mongo.Cursor, err error) []string {
+	var found []product
+	assert.Nil(t, err)
+	assert.Nil(t, cursor.All(context.Background(), &found))
+	out := []string{}
+	for _, p := range found {
+		out = append(out, p.Name)
+	}
+	return out
+}
+
+func TestFind(t *testing.T) {
+	c := seed(t)
+	ctx := context.Background()
+	tests := []struct {
+		name   string
+		filter interface{}
+		want   []string
+	}{
+		{"everything", nil, []string{"lamp", "desk", "phone", "cable"}},
+		{"equality", bson.M{"vendor": "acme"}, []string{"lamp", "desk"}},
+		{"range", bson.M{"price": bson.M{"$gte": 40, "$lt": 800}}, []string{"lamp", "desk"}},
+		{"array element", bson.M{"tags": "light"}, []string{"lamp"}},
+		{"missing as null", bson.M{"vendor": nil}, []string{"cable"}},
+		{"not equal", bson.M{"vendor": bson.M{"$ne": "acme"}}, []string{"phone", "cable"}},
+		{"in", bson.M{"name": bson.M{"$in": bson.A{"desk", "cable"}}}, []string{"desk", "cable"}},
+		{"not in", bson.M{"tags": bson.M{"$nin": bson.A{"home"}}}, []string{"phone", "cable"}},
+		{"exists", bson.M{"tags": bson.M{"$exists": false}}, []string{"phone", "cable"}},
+		{"regex", bson.M{"name": bson.M{"$regex": "^P", "$options": "i"}}, []string{"phone"}},
+		{"or", bson.M{"$or": bson.A{bson.M{"price": bson.M{"$gt": 500}}, bson.M{"name": "lamp"}}}, []string{"lamp", "phone"}},
+		{"and", bson.M{"$and": bson.A{bson.M{"vendor": "acme"}, bson.M{"price": bson.M{"$lte": 40}}}}, []string{"lamp"}},
+		{"types don't compare", bson.M{"price": bson.M{"$gt": "0"}}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cursor, err := c.Find(ctx, tt.filter)
+			assert.Equal(t, tt.want, names(t, cursor, err))
+		})
+	}
+
+	t.Run("sort skip limit", func(t *testing.T) {
+		opts := options.Find().SetSort(bson.D{{Key: "price", Value: -1}}).SetSkip(1).SetLimit(2)
+		cursor, err := c.Find(ctx, bson.M{}, opts)
+		assert.Equal(t, []string{"desk", "lamp"}, names(t, cursor, err))
+	})
+	t.Run("projection", func(t *testing.T) {
+		var got bson.M
+		opts := options.FindOne().SetProjection(bson.M{"name": 1, "_id": 0})
+		assert.Nil(t, c.FindOne(ctx, bson.M{"name": "desk"}, opts).Decode(&got))
+		assert.Equal(t, bson.M{"name": "desk"}, got)
+	})
+	t.Run("no document", func(t *testing.T) {
+		assert.Equal(t, mongo.ErrNoDocuments, c.FindOne(ctx, bson.M{"name": "chair"}).Err())
+	})
+	t.Run("count", func(t *testing.T) {
+		n, err := c.CountDocuments(ctx, bson.M{"price": bson.M{"$lt": 500}})
+		assert.Nil(t, err)
+		assert.Equal(t, int64(3), n)
+	})
+	t.Run("unsupported operator", func(t *testing.T) {
+		_, err := c.Find(ctx, bson.M{"$text": bson.M{"$search": "lamp"}})
+		assert.NotNil(t, err)
+	})
+}
+
+func TestUpdate(t *testing.T) {
+	c := seed(t)
+	ctx := context.Background()
+	var got product
+
+	res, err := c.UpdateOne(ctx, bson.M{"name": "lamp"}, bson.M{
+		"$set":  bson.M{"vendor": "initech"},
+		"$inc":  bson.M{"price": 5},
+		"$push": bson.M{"tags": "desk"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), res.ModifiedCount)
+	assert.Nil(t, c.FindOne(ctx, bson.M{"name": "lamp"}).Decode(&got))
+	assert.Equal(t, product{Name: "lamp", Price: 45, Vendor: "initech", Tags: []string{"home", "light", "desk"}}, got)
+
+	res, err = c.UpdateOne(ctx, bson.M{"name": "lamp"}, bson.M{"$set": bson.M{"vendor": "initech"}})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), res.MatchedCount)
+	assert.Equal(t, int64(0), res.ModifiedCount, "setting the same value doesn't modify")
+
+	res, err = c.UpdateMany(ctx, bson.M{"tags": "home"}, bson.M{"$pull": bson.M{"tags": "home"}, "$unset": bson.M{"vendor": ""}})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), res.ModifiedCount)
+	n, _ := c.CountDocuments(ctx, bson.M{"vendor": bson.M{"$exists": true}})
+	assert.Equal(t, int64(1), n)
+
+	_, err = c.UpdateOne(ctx, bson.M{"name": "lamp"}, bson.M{"name": "bulb"})
+	assert.NotNil(t, err, "replacements aren't updates")
+
+	t.Run("upsert", func(t *testing.T) {
+		var got product
+		upsert := options.Update().SetUpsert(true)
+		update := bson.M{"$set": bson.M{"price": 5}, "$setOnInsert": bson.M{"vendor": "acme"}}
+		res, err := c.UpdateOne(ctx, bson.M{"name": "fuse"}, update, upsert)
+		assert.Nil(t, err)
+		assert.NotNil(t, res.UpsertedID)
+		assert.Nil(t, c.FindOne(ctx, bson.M{"name": "fuse"}).Decode(&got))
+		assert.Equal(t, product{Name: "fuse", Price: 5, Vendor: "acme"}, got)
+
+		res, err = c.UpdateOne(ctx, bson.M{"name": "fuse"}, bson.M{"$set": bson.M{"vendor": "globex"}, "$setOnInsert": bson.M{"price": 1}}, upsert)
+		assert.Nil(t, err)
+		assert.Nil(t, res.UpsertedID)
+		assert.Nil(t, c.FindOne(ctx, bson.M{"name": "fuse"}).Decode(&got))
+		assert.Equal(t, 5, got.Price, "$setOnInsert only applies to inserts")
+	})
+
+	t.Run("find one and update", func(t *testing.T) {
+		var before, after product
+		assert.Nil(t, c.FindOneAndUpdate(ctx, bson.M{"name": "desk"}, bson.M{"$inc": bson.M{"price": 1}}).Decode(&before))
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		assert.Nil(t, c.FindOneAndUpdate(ctx, bson.M{"name": "desk"}, bson.M{"$inc": bson.M{"price": 1}}, opts).Decode(&after))
+		assert.Equal(t, 300, before.Price)
+		assert.Equal(t, 302, after.Price)
+
+		err := c.FindOneAndUpdate(ctx, bson.M{"name": "chair"}, bson.M{"$inc": bson.M{"price": 1}}).Err()
+		assert.Equal(t, mongo.ErrNoDocuments, err)
+	})
+}
+
+func TestUniqueIndex(t *testing.T) {
+	c := seed(t)
+	ctx := context.Background()
+	assert.Nil(t, c.CreateUniqueIndex("name"))
+	assert.NotNil(t, c.CreateUniqueIndex("vendor"), "the existing documents share vendors")
+
+	_, err := c.InsertOne(ctx, product{Name: "lamp"})
+	assert.True(t, mongo.IsDuplicateKeyError(err))
+	_, err = c.UpdateOne(ctx, bson.M{"name": "desk"}, bson.M{"$set": bson.M{"name": "lamp"}})
+	assert.True(t, mongo.IsDuplicateKeyError(err))
+
+	res, err := c.InsertMany(ctx, []interface{}{product{Name: "fuse"}, product{Name: "lamp"}, product{Name: "bulb"}},
+		options.InsertMany().SetOrdered(false))
+	assert.True(t, mongo.IsDuplicateKeyError(err))
+	assert.Len(t, res.InsertedIDs, 2, "unordered inserts go on after a failure")
+
+	id := res.InsertedIDs[0]
+	_, err = c.InsertOne(ctx, bson.M{"_id": id, "name": "plug"})
+	assert.True(t, mongo.IsDuplicateKeyError(err), "_id is always unique")
+
+	deleted, err := c.DeleteOne(ctx, bson.M{"name": "lamp"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), deleted.DeletedCount)
+	_, err = c.InsertOne(ctx, product{Name: "lamp"})
+	assert.Nil(t, err)
+}
+
+func TestAggregate(t *testing.T) {
+	c := seed(t)
+	ctx := context.Background()
+	pipeline := bson.A{
+		bson.M{"$match": bson.M{"price": bson.M{"$gte": 10}}},
+		bson.M{"$facet": bson.M{
+			"total": bson.A{bson.M{"$count": "count"}},
+			"vendor": bson.A{
+				bson.M{"$group": bson.M{"_id": "$vendor", "count": bson.M{"$sum": 1}, "max": bson.M{"$max": "$price"}}},
+				bson.M{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}},
+			},
+			"price": bson.A{bson.M{"$bucket": bson.M{
+				"groupBy":    "$price",
+				"boundaries": bson.A{0, 100, 500},
+				"default":    "other",
+			}}},
+		}},
+	}
+	cursor, err := c.Aggregate(ctx, pipeline)
+	assert.Nil(t, err)
+	var results []bson.M
+	assert.Nil(t, cursor.All(ctx, &results))
+	assert.Len(t, results, 1)
+	assert.Equal(t, bson.A{bson.M{"count": int32(4)}}, results[0]["total"])
+	assert.Equal(t, bson.A{
+		bson.M{"_id": "acme", "count": int32(2), "max": int32(300)},
+		bson.M{"_id": nil, "count": int32(1), "max": int32(10)},
+		bson.M{"_id": "globex", "count": int32(1), "max": int32(800)},
+	}, results[0]["vendor"])
+	assert.Equal(t, bson.A{
+		bson.M{"_id": int32(0), "count": int32(2)},
+		bson.M{"_id": int32(100), "count": int32(1)},
+		bson.M{"_id": "other", "count": int32(1)},
+	}, results[0]["price"])
+
+	_, err = c.Aggregate(ctx, bson.A{bson.M{"$lookup": bson.M{}}})
+	assert.NotNil(t, err)
+}
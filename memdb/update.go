@@ -0,0 +1,113 @@
+package memdb
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// applyUpdate returns a copy of the document with the update operators
+// applied. $setOnInsert only applies when the update inserts the document.
+func applyUpdate(doc bson.D, u bson.D, insert bool) (bson.D, error) {
+	out := append(bson.D(nil), doc...)
+	for _, op := range u {
+		fields, ok := op.Value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("memdb: %s needs a document", op.Key)
+		}
+		for _, f := range fields {
+			var err error
+			if out, err = applyOperator(out, op.Key, f, insert); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return out, nil
+}
+
+func applyOperator(doc bson.D, op string, f bson.E, insert bool) (bson.D, error) {
+	path := strings.Split(f.Key, ".")
+	current, exists := getPath(doc, path)
+	switch op {
+	case "$set":
+		return setPath(doc, path, f.Value), nil
+	case "$setOnInsert":
+		if !insert {
+			return doc, nil
+		}
+		return setPath(doc, path, f.Value), nil
+	case "$unset":
+		return unsetPath(doc, path), nil
+	case "$inc":
+		if !exists {
+			current = int32(0)
+		}
+		sum, ok := add(current, f.Value)
+		if !ok {
+			return nil, fmt.Errorf("memdb: cannot $inc %s by %v", f.Key, f.Value)
+		}
+		return setPath(doc, path, sum), nil
+	case "$push", "$addToSet":
+		array, ok := current.(bson.A)
+		if exists && !ok {
+			return nil, fmt.Errorf("memdb: cannot %s to the non array field %s", op, f.Key)
+		}
+		array = append(bson.A{}, array...)
+		for _, value := range eachValue(f.Value) {
+			if op == "$addToSet" && contains(array, value) {
+				continue
+			}
+			array = append(array, value)
+		}
+		return setPath(doc, path, array), nil
+	case "$pull":
+		array, ok := current.(bson.A)
+		if !exists {
+			return doc, nil
+		}
+		if !ok {
+			return nil, fmt.Errorf("memdb: cannot $pull from the non array field %s", f.Key)
+		}
+		kept := bson.A{}
+		for _, elem := range array {
+			pulled, err := pulls(elem, f.Value)
+			if err != nil {
+				return nil, err
+			}
+			if !pulled {
+				kept = append(kept, elem)
+			}
+		}
+		return setPath(doc, path, kept), nil
+	}
+	return nil, fmt.Errorf("memdb: unsupported update operator %s", op)
+}
+
+// eachValue returns the values to add, several with the $each modifier
+func eachValue(v interface{}) []interface{} {
+	if d, ok := v.(bson.D); ok && len(d) == 1 && d[0].Key == "$each" {
+		if each, ok := d[0].Value.(bson.A); ok {
+			return each
+		}
+	}
+	return []interface{}{v}
+}
+
+func contains(array bson.A, value interface{}) bool {
+	for _, elem := range array {
+		if typeOrder(elem) == typeOrder(value) && compare(elem, value) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// pulls reports whether $pull removes the element, either equal to the
+// value or matching the condition
+func pulls(elem interface{}, cond interface{}) (bool, error) {
+	if d, ok := cond.(bson.D); ok {
+		return matchElem(elem, d)
+	}
+	return contains(bson.A{elem}, cond), nil
+}
@@ -0,0 +1,154 @@
+// Package problem implements RFC 7807 problem details for HTTP APIs.
+package problem
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	// MIMEProblemJSON is the media type of a problem details document
+	MIMEProblemJSON = "application/problem+json"
+
+	// CorrelationIDHeader is the request header carrying the correlation ID
+	CorrelationIDHeader = "X-Correlation-ID"
+
+	// TypeBlank is the problem type of problems described by their status alone
+	TypeBlank = "about:blank"
+	// TypeValidation is the problem type of requests failing validation
+	TypeValidation = "/problems/validation"
+	// TypeInvalidQuery is the problem type of unusable query parameters
+	TypeInvalidQuery = "/problems/invalid-query"
+)
+
+// Problem describes an error as an RFC 7807 problem details object.
+// Extension members are serialised next to the standard members.
+type Problem struct {
+	Type          string
+	Title         string
+	Status        int
+	Detail        string
+	Instance      string
+	CorrelationID string
+	Extensions    map[string]interface{}
+}
+
+// New returns a problem of the blank type for the status
+func New(status int, detail string) *Problem {
+	return &Problem{
+		Type:   TypeBlank,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
+
+// Newf returns a problem of the blank type with a formatted detail
+func Newf(status int, format string, args ...interface{}) *Problem {
+	return New(status, fmt.Sprintf(format, args...))
+}
+
+// Validation returns a 400 problem listing the failing fields
+func Validation(detail string, errs interface{}) *Problem {
+	p := New(http.StatusBadRequest, detail)
+	p.Type = TypeValidation
+	p.Title = "Validation failed"
+	return p.With("errors", errs)
+}
+
+// InvalidQuery returns a 400 problem naming the offending query parameter
+func InvalidQuery(field, detail string) *Problem {
+	p := New(http.StatusBadRequest, detail)
+	p.Type = TypeInvalidQuery
+	p.Title = "Invalid query parameter"
+	return p.With("field", field)
+}
+
+// With sets an extension member and returns the problem
+func (p *Problem) With(key string, value interface{}) *Problem {
+	if p.Extensions == nil {
+		p.Extensions = make(map[string]interface{})
+	}
+	p.Extensions[key] = value
+	return p
+}
+
+func (p *Problem) Error() string {
+	if p.Detail == "" {
+		return p.Title
+	}
+	return fmt.Sprintf("%s: %s", p.Title, p.Detail)
+}
+
+// MarshalJSON encodes the standard members and the extensions in one object
+func (p *Problem) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{}, len(p.Extensions)+6)
+	for k, v := range p.Extensions {
+		m[k] = v
+	}
+	m["type"] = p.Type
+	m["title"] = p.Title
+	m["status"] = p.Status
+	if p.Detail != "" {
+		m["detail"] = p.Detail
+	}
+	if p.Instance != "" {
+		m["instance"] = p.Instance
+	}
+	if p.CorrelationID != "" {
+		m["correlation_id"] = p.CorrelationID
+	}
+	return json.Marshal(m)
+}
+
+// From converts any error to a problem. Echo's HTTP errors keep their
+// status and message, other errors become 500 Internal Server Error.
+func From(err error) *Problem {
+	var p *Problem
+	if errors.As(err, &p) {
+		return p
+	}
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		if internal, ok := he.Internal.(*echo.HTTPError); ok {
+			he = internal
+		}
+		if msg, ok := he.Message.(string); ok {
+			return New(he.Code, msg)
+		}
+		return New(he.Code, "")
+	}
+	return New(http.StatusInternalServerError, "")
+}
+
+// HTTPErrorHandler writes every error returned by handlers and middleware
+// as application/problem+json
+func HTTPErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+	p := *From(err)
+	req := c.Request()
+	p.Instance = req.URL.RequestURI()
+	p.CorrelationID = req.Header.Get(CorrelationIDHeader)
+	if p.Status >= http.StatusInternalServerError {
+		log.Errorf("%s %s failed: %v", req.Method, p.Instance, err)
+	}
+
+	if req.Method == http.MethodHead {
+		err = c.NoContent(p.Status)
+	} else {
+		var body []byte
+		if body, err = json.Marshal(&p); err == nil {
+			err = c.Blob(p.Status, MIMEProblemJSON, body)
+		}
+	}
+	if err != nil {
+		log.Errorf("Unable to write the problem: %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package problem
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPErrorHandler(t *testing.T) {
+	e := echo.New()
+	handle := func(err error) (*httptest.ResponseRecorder, map[string]interface{}) {
+		var body map[string]interface{}
+		req := httptest.NewRequest(http.MethodGet, "/products?limit=0", nil)
+		req.Header.Set(CorrelationIDHeader, "abc123")
+		res := httptest.NewRecorder()
+		HTTPErrorHandler(err, e.NewContext(req, res))
+		assert.Equal(t, MIMEProblemJSON, res.Header().Get(echo.HeaderContentType))
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &body))
+		return res, body
+	}
+
+	t.Run("problem", func(t *testing.T) {
+		res, body := handle(InvalidQuery("limit", "limit must be between 1 and 100"))
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+		assert.Equal(t, map[string]interface{}{
+			"type":           TypeInvalidQuery,
+			"title":          "Invalid query parameter",
+			"status":         float64(http.StatusBadRequest),
+			"detail":         "limit must be between 1 and 100",
+			"instance":       "/products?limit=0",
+			"correlation_id": "abc123",
+			"field":          "limit",
+		}, body)
+	})
+
+	t.Run("echo error", func(t *testing.T) {
+		res, body := handle(echo.ErrUnauthorized)
+		assert.Equal(t, http.StatusUnauthorized, res.Code)
+		assert.Equal(t, TypeBlank, body["type"])
+		assert.Equal(t, "Unauthorized", body["title"])
+	})
+
+	t.Run("other error", func(t *testing.T) {
+		res, body := handle(errors.New("connection refused"))
+		assert.Equal(t, http.StatusInternalServerError, res.Code)
+		assert.Nil(t, body["detail"])
+	})
+}
@@ -0,0 +1,183 @@
+// Package sqlstore opens the SQLite database used when the API runs without
+// mongo and keeps its schema up to date. The tables are read and written by
+// the repositories of the store/sqlite package.
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+
+	// registers the "sqlite" driver
+	_ "modernc.org/sqlite"
+)
+
+// migrations are applied in order, each in a transaction, and the number of
+// the ones applied is kept as the user_version of the database. Released
+// migrations must never change; append new ones instead.
+var migrations = []string{
+	// products, with a full-text index weighted like the mongo text index
+	`CREATE TABLE products (
+		id           TEXT PRIMARY KEY,
+		product_name TEXT,
+		price        INTEGER,
+		currency     TEXT,
+		discount     INTEGER,
+		vendor       TEXT,
+		accessories  TEXT,
+		is_essential INTEGER,
+		version      INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE VIRTUAL TABLE products_fts USING fts5(
+		product_name, vendor, accessories,
+		content='products', content_rowid='rowid', tokenize='porter unicode61'
+	);
+	CREATE TRIGGER products_fts_insert AFTER INSERT ON products BEGIN
+		INSERT INTO products_fts(rowid, product_name, vendor, accessories)
+		VALUES (new.rowid, new.product_name, new.vendor, new.accessories);
+	END;
+	CREATE TRIGGER products_fts_delete AFTER DELETE ON products BEGIN
+		INSERT INTO products_fts(products_fts, rowid, product_name, vendor, accessories)
+		VALUES ('delete', old.rowid, old.product_name, old.vendor, old.accessories);
+	END;
+	CREATE TRIGGER products_fts_update AFTER UPDATE ON products BEGIN
+		INSERT INTO products_fts(products_fts, rowid, product_name, vendor, accessories)
+		VALUES ('delete', old.rowid, old.product_name, old.vendor, old.accessories);
+		INSERT INTO products_fts(rowid, product_name, vendor, accessories)
+		VALUES (new.rowid, new.product_name, new.vendor, new.accessories);
+	END;`,
+
+	// users and the hashes of their recovery codes
+	`CREATE TABLE users (
+		id             TEXT PRIMARY KEY,
+		username       TEXT NOT NULL UNIQUE,
+		password       TEXT NOT NULL,
+		name           TEXT NOT NULL DEFAULT '',
+		roles          TEXT NOT NULL DEFAULT '[]',
+		status         TEXT NOT NULL DEFAULT '',
+		totp_secret    TEXT,
+		totp_confirmed INTEGER NOT NULL DEFAULT 0,
+		totp_last_step INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE user_recovery_codes (
+		user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		hash    TEXT NOT NULL,
+		PRIMARY KEY (user_id, hash)
+	);`,
+
+	// the collections without a table of their own
+	`CREATE TABLE documents (
+		collection TEXT NOT NULL,
+		id         BLOB NOT NULL,
+		doc        BLOB NOT NULL,
+		PRIMARY KEY (collection, id)
+	);`,
+
+	// sessions, tokens, login attempts and API keys, which replace the
+	// documents table. Times are unix milliseconds, the precision of mongo.
+	`DROP TABLE documents;
+	CREATE TABLE sessions (
+		id         TEXT PRIMARY KEY,
+		username   TEXT NOT NULL,
+		token_hash TEXT NOT NULL,
+		revoked    INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE INDEX sessions_username ON sessions(username);
+	CREATE INDEX sessions_expires_at ON sessions(expires_at);
+	CREATE TABLE session_previous_hashes (
+		session_id TEXT NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+		hash       TEXT NOT NULL,
+		PRIMARY KEY (session_id, hash)
+	);
+	CREATE TABLE user_tokens (
+		id         TEXT PRIMARY KEY,
+		username   TEXT NOT NULL,
+		purpose    TEXT NOT NULL,
+		token_hash TEXT NOT NULL,
+		used       INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE INDEX user_tokens_token_hash ON user_tokens(token_hash);
+	CREATE INDEX user_tokens_username ON user_tokens(username, purpose);
+	CREATE INDEX user_tokens_expires_at ON user_tokens(expires_at);
+	CREATE TABLE login_attempts (
+		key          TEXT PRIMARY KEY,
+		failures     INTEGER NOT NULL DEFAULT 0,
+		lockouts     INTEGER NOT NULL DEFAULT 0,
+		locked_until INTEGER,
+		expires_at   INTEGER NOT NULL
+	);
+	CREATE INDEX login_attempts_expires_at ON login_attempts(expires_at);
+	CREATE TABLE api_keys (
+		id           TEXT PRIMARY KEY,
+		name         TEXT NOT NULL,
+		prefix       TEXT NOT NULL UNIQUE,
+		hash         TEXT NOT NULL,
+		owner        TEXT NOT NULL,
+		scopes       TEXT NOT NULL DEFAULT '[]',
+		revoked      INTEGER NOT NULL DEFAULT 0,
+		created_at   INTEGER NOT NULL,
+		expires_at   INTEGER NOT NULL,
+		last_used_at INTEGER
+	);
+	CREATE INDEX api_keys_owner ON api_keys(owner);`,
+}
+
+// Open opens the SQLite database at the path, creating it if needed, and
+// applies the migrations it lacks. The database is used through a single
+// connection, which serializes the writes instead of failing them with
+// SQLITE_BUSY.
+func Open(ctx context.Context, path string) (*sql.DB, error) {
+	dsn := "file:" + path + "?" + url.Values{"_pragma": {
+		"foreign_keys(1)",
+		"busy_timeout(5000)",
+		"journal_mode(WAL)",
+	}}.Encode()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if err := Migrate(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Migrate applies the migrations the database lacks
+func Migrate(ctx context.Context, db *sql.DB) error {
+	var version int
+	if err := db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("sqlstore: the database is at version %d, newer than this build", version)
+	}
+	for i := version; i < len(migrations); i++ {
+		if err := migrate(ctx, db, i+1, migrations[i]); err != nil {
+			return fmt.Errorf("sqlstore: migration %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+func migrate(ctx context.Context, db *sql.DB, version int, stmts string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, stmts); err != nil {
+		return err
+	}
+	// PRAGMA doesn't take parameters
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", version)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
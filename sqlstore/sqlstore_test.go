@@ -0,0 +1,27 @@
+package sqlstore
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	db, err := Open(ctx, filepath.Join(t.TempDir(), "test.db"))
+	require.Nil(t, err)
+	defer db.Close()
+
+	// migrating again has nothing to apply
+	assert.Nil(t, Migrate(ctx, db))
+	var version int
+	assert.Nil(t, db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version))
+	assert.Equal(t, len(migrations), version)
+
+	_, err = db.ExecContext(ctx, "PRAGMA user_version = 1000")
+	assert.Nil(t, err)
+	assert.NotNil(t, Migrate(ctx, db), "a database of a newer build is refused")
+}
@@ -0,0 +1,53 @@
+package store
+
+import "time"
+
+// Session is a login. Every refresh rotates its refresh token, so the
+// session holds the hash of the only token that may still be used and the
+// hashes of the ones already spent.
+type Session struct {
+	ID             ID        `bson:"_id,omitempty"`
+	Username       string    `bson:"username"`
+	TokenHash      string    `bson:"token_hash"`
+	PreviousHashes []string  `bson:"previous_hashes"`
+	Revoked        bool      `bson:"revoked"`
+	CreatedAt      time.Time `bson:"created_at"`
+	ExpiresAt      time.Time `bson:"expires_at"`
+}
+
+// UserToken is a single use token mailed to a user, or handed out for the
+// second step of a login. Only its hash is stored.
+type UserToken struct {
+	ID        ID        `bson:"_id,omitempty"`
+	Username  string    `bson:"username"`
+	Purpose   string    `bson:"purpose"`
+	TokenHash string    `bson:"token_hash"`
+	Used      bool      `bson:"used"`
+	CreatedAt time.Time `bson:"created_at"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// LoginAttempts counts the failed logins of a key, such as an account or
+// an address. It is stored so that every replica sees the same counts.
+type LoginAttempts struct {
+	Key         string    `bson:"_id"`
+	Failures    int       `bson:"failures"`
+	Lockouts    int       `bson:"lockouts"`
+	LockedUntil time.Time `bson:"locked_until"`
+	ExpiresAt   time.Time `bson:"expires_at"`
+}
+
+// APIKey is a long lived credential of a user for services. Only the hash
+// of its secret is stored, the prefix identifies it.
+type APIKey struct {
+	ID         ID         `bson:"_id,omitempty"`
+	Name       string     `bson:"name"`
+	Prefix     string     `bson:"prefix"`
+	Hash       string     `bson:"hash"`
+	Owner      string     `bson:"owner"`
+	Scopes     []string   `bson:"scopes"`
+	Revoked    bool       `bson:"revoked"`
+	CreatedAt  time.Time  `bson:"created_at"`
+	ExpiresAt  time.Time  `bson:"expires_at"`
+	LastUsedAt *time.Time `bson:"last_used_at,omitempty"`
+}
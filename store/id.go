@@ -0,0 +1,56 @@
+package store
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ID identifies a stored product, user, session, token or API key. It is
+// the hex form of a mongo ObjectID, and is stored as an ObjectID in mongo
+// so that the documents written before keep their ids.
+type ID string
+
+// NewID returns a new unique ID
+func NewID() ID {
+	return ID(primitive.NewObjectID().Hex())
+}
+
+// ParseID returns the ID of s, or ErrInvalidID if s cannot identify anything
+func ParseID(s string) (ID, error) {
+	if _, err := primitive.ObjectIDFromHex(s); err != nil {
+		return "", ErrInvalidID
+	}
+	return ID(s), nil
+}
+
+// MarshalBSONValue stores the ID as an ObjectID. IDs that are not valid,
+// such as those of a tampered cursor, are stored as strings and so match
+// nothing.
+func (id ID) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	oid, err := primitive.ObjectIDFromHex(string(id))
+	if err != nil {
+		return bson.MarshalValue(string(id))
+	}
+	return bson.MarshalValue(oid)
+}
+
+// UnmarshalBSONValue reads an ID stored as an ObjectID or as a string
+func (id *ID) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	raw := bson.RawValue{Type: t, Value: data}
+	if oid, ok := raw.ObjectIDOK(); ok {
+		*id = ID(oid.Hex())
+		return nil
+	}
+	if s, ok := raw.StringValueOK(); ok {
+		*id = ID(s)
+		return nil
+	}
+	if t == bsontype.Null {
+		*id = ""
+		return nil
+	}
+	return fmt.Errorf("cannot decode %s into an ID", t)
+}
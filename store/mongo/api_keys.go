@@ -0,0 +1,92 @@
+package mongo
+
+import (
+	"context"
+	"time"
+
+	"github.com/nitin06890/go-rest-api/dbiface"
+	"github.com/nitin06890/go-rest-api/store"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// APIKeys stores the API keys in a mongo collection
+type APIKeys struct {
+	Col dbiface.CollectionAPI
+}
+
+// CreateAPIKeyIndexes creates the unique index of the prefixes the keys
+// are looked up by
+func CreateAPIKeyIndexes(ctx context.Context, col *mongo.Collection) error {
+	_, err := col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "prefix", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// Create inserts the key with a new id
+func (r *APIKeys) Create(ctx context.Context, key store.APIKey) (store.APIKey, error) {
+	key.ID = store.NewID()
+	if _, err := r.Col.InsertOne(ctx, key); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return store.APIKey{}, store.ErrDuplicate
+		}
+		return store.APIKey{}, err
+	}
+	return key, nil
+}
+
+// FindByPrefix returns the key of the prefix
+func (r *APIKeys) FindByPrefix(ctx context.Context, prefix string) (store.APIKey, error) {
+	var key store.APIKey
+	err := r.Col.FindOne(ctx, bson.M{"prefix": prefix}).Decode(&key)
+	if err == mongo.ErrNoDocuments {
+		return key, store.ErrNotFound
+	}
+	return key, err
+}
+
+// ListByOwner returns the keys of the user, in the order of ids
+func (r *APIKeys) ListByOwner(ctx context.Context, owner string) ([]store.APIKey, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	cursor, err := r.Col.Find(ctx, bson.M{"owner": owner}, opts)
+	if err != nil {
+		return nil, err
+	}
+	keys := []store.APIKey{}
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Revoke revokes the key of the id if the user owns it
+func (r *APIKeys) Revoke(ctx context.Context, id, owner string) (bool, error) {
+	docID, err := objectID(id)
+	if err != nil {
+		return false, nil
+	}
+	res, err := r.Col.UpdateOne(ctx, bson.M{"_id": docID, "owner": owner}, bson.M{"$set": bson.M{"revoked": true}})
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// RevokeOwner revokes every key of the user
+func (r *APIKeys) RevokeOwner(ctx context.Context, owner string) error {
+	_, err := r.Col.UpdateMany(ctx, bson.M{"owner": owner}, bson.M{"$set": bson.M{"revoked": true}})
+	return err
+}
+
+// Touch records the last use of the key of the id
+func (r *APIKeys) Touch(ctx context.Context, id string, at time.Time) error {
+	docID, err := objectID(id)
+	if err != nil {
+		return err
+	}
+	_, err = r.Col.UpdateOne(ctx, bson.M{"_id": docID}, bson.M{"$set": bson.M{"last_used_at": at}})
+	return err
+}
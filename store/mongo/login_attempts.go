@@ -0,0 +1,75 @@
+package mongo
+
+import (
+	"context"
+	"time"
+
+	"github.com/nitin06890/go-rest-api/dbiface"
+	"github.com/nitin06890/go-rest-api/store"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LoginAttempts stores the failed logins in a mongo collection, keyed by
+// their throttle key
+type LoginAttempts struct {
+	Col dbiface.CollectionAPI
+}
+
+// CreateLoginAttemptIndexes creates the TTL index that forgets the failed
+// logins once they are old enough
+func CreateLoginAttemptIndexes(ctx context.Context, col *mongo.Collection) error {
+	_, err := col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// Locked returns the attempts of the keys that are locked out after now
+func (r *LoginAttempts) Locked(ctx context.Context, keys []string, now time.Time) ([]store.LoginAttempts, error) {
+	cursor, err := r.Col.Find(ctx, bson.M{"_id": bson.M{"$in": keys}, "locked_until": bson.M{"$gt": now}})
+	if err != nil {
+		return nil, err
+	}
+	var locked []store.LoginAttempts
+	if err := cursor.All(ctx, &locked); err != nil {
+		return nil, err
+	}
+	return locked, nil
+}
+
+// AddFailure counts the failure with an upsert, so concurrent failures are
+// all counted
+func (r *LoginAttempts) AddFailure(ctx context.Context, key string, expiresAt time.Time) (store.LoginAttempts, error) {
+	var attempts store.LoginAttempts
+	update := bson.M{
+		"$inc": bson.M{"failures": 1},
+		"$set": bson.M{"expires_at": expiresAt},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := r.Col.FindOneAndUpdate(ctx, bson.M{"_id": key}, update, opts).Decode(&attempts)
+	return attempts, err
+}
+
+// LockOut resets the failures with a single update whose filter holds the
+// threshold, so only one of the concurrent failures reaching it locks out
+func (r *LoginAttempts) LockOut(ctx context.Context, key string, threshold int, lockedUntil, expiresAt time.Time) (bool, error) {
+	res, err := r.Col.UpdateOne(ctx,
+		bson.M{"_id": key, "failures": bson.M{"$gte": threshold}},
+		bson.M{
+			"$set": bson.M{"failures": 0, "locked_until": lockedUntil, "expires_at": expiresAt},
+			"$inc": bson.M{"lockouts": 1},
+		})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+// Clear forgets the failed logins of the key
+func (r *LoginAttempts) Clear(ctx context.Context, key string) error {
+	_, err := r.Col.DeleteOne(ctx, bson.M{"_id": key})
+	return err
+}
@@ -0,0 +1,352 @@
+// Package mongo stores the products and users in mongo collections, or in
+// anything else behind dbiface.CollectionAPI such as memdb.
+package mongo
+
+import (
+	"context"
+	"errors"
+
+	"github.com/nitin06890/go-rest-api/dbiface"
+	"github.com/nitin06890/go-rest-api/store"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// duplicateKeyCode is the server error code of unique index violations
+	duplicateKeyCode = 11000
+	// illegalOperationCode is the server error code of transactions on a
+	// standalone server
+	illegalOperationCode = 20
+)
+
+// Products stores the products in a mongo collection. Atomic batches
+// need Txn.
+type Products struct {
+	Col dbiface.CollectionAPI
+	Txn dbiface.TransactionAPI
+}
+
+// objectID returns the ObjectID of an id, or store.ErrInvalidID
+func objectID(id string) (primitive.ObjectID, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return oid, store.ErrInvalidID
+	}
+	return oid, nil
+}
+
+// CreateProductIndexes creates the text index the searches of Products need
+func CreateProductIndexes(ctx context.Context, col *mongo.Collection) error {
+	textIndexName := "products_text"
+	textIndexModel := mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "product_name", Value: "text"},
+			{Key: "vendor", Value: "text"},
+			{Key: "accessories", Value: "text"},
+		},
+		Options: &options.IndexOptions{
+			Name:    &textIndexName,
+			Weights: bson.D{{Key: "product_name", Value: 10}, {Key: "vendor", Value: 5}, {Key: "accessories", Value: 1}},
+		},
+	}
+	_, err := col.Indexes().CreateOne(ctx, textIndexModel)
+	return err
+}
+
+// productQuery compiles a filter to a mongo filter. Fields and operators
+// are whitelisted when the filter is built, so only plain values reach mongo.
+func productQuery(filter store.ProductFilter) bson.M {
+	query := bson.M{}
+	for name, conditions := range filter {
+		ops := bson.M{}
+		for op, value := range conditions {
+			if list, ok := value.([]interface{}); ok {
+				value = bson.A(list)
+			}
+			ops["$"+op] = value
+		}
+		query[name] = ops
+	}
+	return query
+}
+
+// sortDocument returns the mongo sort document, reversed when paging backwards
+func sortDocument(keys []store.SortKey, reverse bool) bson.D {
+	sort := make(bson.D, len(keys))
+	for i, k := range keys {
+		dir := 1
+		if k.Desc != reverse {
+			dir = -1
+		}
+		sort[i] = bson.E{Key: k.Field.Name, Value: dir}
+	}
+	return sort
+}
+
+// keysetFilter matches the documents strictly after (or before) the given
+// sort values, e.g. {$or: [{a: {$gt: va}}, {a: va, _id: {$gt: vid}}]}
+func keysetFilter(keys []store.SortKey, values []interface{}, backwards bool) bson.M {
+	var or bson.A
+	for i, k := range keys {
+		clause := bson.M{}
+		for j := 0; j < i; j++ {
+			clause[keys[j].Field.Name] = values[j]
+		}
+		op := "$gt"
+		if k.Desc != backwards {
+			op = "$lt"
+		}
+		clause[k.Field.Name] = bson.M{op: values[i]}
+		or = append(or, clause)
+	}
+	return bson.M{"$or": or}
+}
+
+// versionFilter matches a product only while it still has the given
+// version. Products stored before versioning have no version field.
+func versionFilter(id primitive.ObjectID, version int64) bson.M {
+	if version == 0 {
+		return bson.M{"_id": id, "version": bson.M{"$in": bson.A{0, nil}}}
+	}
+	return bson.M{"_id": id, "version": version}
+}
+
+// FindByID returns the product of the id
+func (r *Products) FindByID(ctx context.Context, id string) (store.Product, error) {
+	var product store.Product
+	docID, err := objectID(id)
+	if err != nil {
+		return product, err
+	}
+	err = r.Col.FindOne(ctx, bson.M{"_id": docID}).Decode(&product)
+	if err == mongo.ErrNoDocuments {
+		return product, store.ErrNotFound
+	}
+	return product, err
+}
+
+// List returns a page of the products matching the filter
+func (r *Products) List(ctx context.Context, filter store.ProductFilter, page store.ProductPageRequest) ([]store.Product, error) {
+	products := []store.Product{}
+	query := productQuery(filter)
+	if len(page.After) > 0 {
+		query = bson.M{"$and": bson.A{query, keysetFilter(page.Sort, page.After, page.Backwards)}}
+	}
+	opts := options.Find().SetSort(sortDocument(page.Sort, page.Backwards)).SetLimit(page.Limit)
+	cursor, err := r.Col.Find(ctx, query, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &products); err != nil {
+		return nil, err
+	}
+	return products, nil
+}
+
+// Count counts the products matching the filter
+func (r *Products) Count(ctx context.Context, filter store.ProductFilter) (int64, error) {
+	return r.Col.CountDocuments(ctx, productQuery(filter))
+}
+
+// Create inserts the products with InsertMany, in a transaction for atomic batches
+func (r *Products) Create(ctx context.Context, products []store.Product, mode store.BulkMode) ([]error, error) {
+	docs := make([]interface{}, len(products))
+	for i := range products {
+		products[i].ID = store.NewID()
+		products[i].Version = 1
+		docs[i] = products[i]
+	}
+	insert := func(ctx context.Context) error {
+		_, err := r.Col.InsertMany(ctx, docs, options.InsertMany().SetOrdered(mode.Ordered))
+		return err
+	}
+	var err error
+	if mode.Atomic {
+		if r.Txn == nil {
+			return nil, store.ErrNoTransactions
+		}
+		err = r.Txn.WithTransaction(ctx, insert)
+		var se mongo.ServerError
+		if errors.As(err, &se) && se.HasErrorCode(illegalOperationCode) {
+			return nil, store.ErrNoTransactions
+		}
+	} else {
+		err = insert(ctx)
+	}
+
+	var bwe mongo.BulkWriteException
+	if err != nil && (!errors.As(err, &bwe) || len(bwe.WriteErrors) == 0) {
+		return nil, err
+	}
+	errs := make([]error, len(products))
+	for _, we := range bwe.WriteErrors {
+		if we.Code == duplicateKeyCode {
+			errs[we.Index] = store.ErrDuplicate
+		} else {
+			errs[we.Index] = we.WriteError
+		}
+	}
+	for i := range errs {
+		// an ordered insert stops at the first error, a transaction is rolled back
+		if errs[i] == nil && err != nil && (mode.Atomic || (mode.Ordered && i > bwe.WriteErrors[0].Index)) {
+			errs[i] = store.ErrNotInserted
+		}
+	}
+	return errs, nil
+}
+
+// Update stores the product with $set while it still has the version
+func (r *Products) Update(ctx context.Context, product store.Product, version int64) error {
+	docID, err := objectID(string(product.ID))
+	if err != nil {
+		return err
+	}
+	res, err := r.Col.UpdateOne(ctx, versionFilter(docID, version), bson.M{"$set": product})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return store.ErrConflict
+	}
+	return nil
+}
+
+// Patch sets and unsets the fields while the product still has the version
+func (r *Products) Patch(ctx context.Context, id string, version int64, set map[string]interface{}, unset []string) error {
+	docID, err := objectID(id)
+	if err != nil {
+		return err
+	}
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = bson.M(set)
+	}
+	if len(unset) > 0 {
+		fields := bson.M{}
+		for _, name := range unset {
+			fields[name] = ""
+		}
+		update["$unset"] = fields
+	}
+	res, err := r.Col.UpdateOne(ctx, versionFilter(docID, version), update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return store.ErrConflict
+	}
+	return nil
+}
+
+// Delete deletes the product of the id, if it still has the version when one is given
+func (r *Products) Delete(ctx context.Context, id string, version *int64) (bool, error) {
+	docID, err := objectID(id)
+	if err != nil {
+		return false, err
+	}
+	filter := bson.M{"_id": docID}
+	if version != nil {
+		filter = versionFilter(docID, *version)
+	}
+	res, err := r.Col.DeleteOne(ctx, filter)
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
+
+// Search runs a $text query, which needs the text index of the products
+func (r *Products) Search(ctx context.Context, text string, offset, limit int64) ([]store.ScoredProduct, int64, error) {
+	filter := bson.M{"$text": bson.M{"$search": text}}
+	total, err := r.Col.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	score := bson.M{"$meta": "textScore"}
+	opts := options.Find().
+		SetProjection(bson.M{"score": score}).
+		SetSort(bson.D{{Key: "score", Value: score}, {Key: "_id", Value: 1}}).
+		SetSkip(offset).
+		SetLimit(limit)
+	cursor, err := r.Col.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	var results []store.ScoredProduct
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, 0, err
+	}
+	return results, total, nil
+}
+
+// facetGroup is a single group as returned by $group, $bucket and $count
+type facetGroup struct {
+	ID    interface{} `bson:"_id"`
+	Count int64       `bson:"count"`
+}
+
+// facetsPipeline counts the products matching filter by every facet in one $facet stage
+func facetsPipeline(filter bson.M) bson.A {
+	facets := bson.M{
+		"total": bson.A{bson.M{"$count": "count"}},
+		"price": bson.A{bson.M{"$bucket": bson.M{
+			"groupBy":    "$price",
+			"boundaries": store.PriceBoundaries,
+			"default":    "other",
+			"output":     bson.M{"count": bson.M{"$sum": 1}},
+		}}},
+	}
+	for _, f := range store.ValueFacets {
+		facets[f] = bson.A{
+			bson.M{"$group": bson.M{"_id": "$" + f, "count": bson.M{"$sum": 1}}},
+			bson.M{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}},
+		}
+	}
+	return bson.A{
+		bson.M{"$match": filter},
+		bson.M{"$facet": facets},
+	}
+}
+
+// Facets counts the products by facet with a single aggregation
+func (r *Products) Facets(ctx context.Context, filter store.ProductFilter) (store.FacetCounts, error) {
+	counts := store.FacetCounts{Values: make(map[string][]store.ValueCount), Prices: make(map[int]int64)}
+	cursor, err := r.Col.Aggregate(ctx, facetsPipeline(productQuery(filter)))
+	if err != nil {
+		return counts, err
+	}
+	var results []map[string][]facetGroup
+	if err := cursor.All(ctx, &results); err != nil {
+		return counts, err
+	}
+	var groups map[string][]facetGroup
+	if len(results) > 0 {
+		groups = results[0]
+	}
+
+	if total := groups["total"]; len(total) > 0 {
+		counts.Total = total[0].Count
+	}
+	for _, f := range store.ValueFacets {
+		values := []store.ValueCount{}
+		for _, g := range groups[f] {
+			values = append(values, store.ValueCount{Value: g.ID, Count: g.Count})
+		}
+		counts.Values[f] = values
+	}
+	for _, g := range groups["price"] {
+		switch min := g.ID.(type) {
+		case int32:
+			counts.Prices[int(min)] = g.Count
+		case int64:
+			counts.Prices[int(min)] = g.Count
+		case string:
+			// the default bucket
+			counts.OtherPrices = g.Count
+		}
+	}
+	return counts, nil
+}
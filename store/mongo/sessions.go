@@ -0,0 +1,88 @@
+package mongo
+
+import (
+	"context"
+
+	"github.com/nitin06890/go-rest-api/dbiface"
+	"github.com/nitin06890/go-rest-api/store"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Sessions stores the sessions in a mongo collection
+type Sessions struct {
+	Col dbiface.CollectionAPI
+}
+
+// CreateSessionIndexes creates the TTL index that drops the sessions once
+// their refresh tokens have expired
+func CreateSessionIndexes(ctx context.Context, col *mongo.Collection) error {
+	_, err := col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// Create inserts the session with a new id
+func (r *Sessions) Create(ctx context.Context, session store.Session) (store.Session, error) {
+	session.ID = store.NewID()
+	if session.PreviousHashes == nil {
+		session.PreviousHashes = []string{}
+	}
+	if _, err := r.Col.InsertOne(ctx, session); err != nil {
+		return store.Session{}, err
+	}
+	return session, nil
+}
+
+// FindByID returns the session of the id
+func (r *Sessions) FindByID(ctx context.Context, id string) (store.Session, error) {
+	var session store.Session
+	docID, err := objectID(id)
+	if err != nil {
+		return session, err
+	}
+	err = r.Col.FindOne(ctx, bson.M{"_id": docID}).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		return session, store.ErrNotFound
+	}
+	return session, err
+}
+
+// Rotate swaps the token hash with a single update, whose filter holds the
+// current hash so that a token presented twice concurrently rotates once
+func (r *Sessions) Rotate(ctx context.Context, id, hash, newHash string) (store.Session, error) {
+	var session store.Session
+	docID, err := objectID(id)
+	if err != nil {
+		return session, err
+	}
+	filter := bson.M{"_id": docID, "token_hash": hash, "revoked": false}
+	update := bson.M{
+		"$set":  bson.M{"token_hash": newHash},
+		"$push": bson.M{"previous_hashes": hash},
+	}
+	err = r.Col.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		return session, store.ErrConflict
+	}
+	return session, err
+}
+
+// Revoke revokes the session of the id
+func (r *Sessions) Revoke(ctx context.Context, id string) error {
+	docID, err := objectID(id)
+	if err != nil {
+		return err
+	}
+	_, err = r.Col.UpdateOne(ctx, bson.M{"_id": docID}, bson.M{"$set": bson.M{"revoked": true}})
+	return err
+}
+
+// RevokeUser revokes every session of the user
+func (r *Sessions) RevokeUser(ctx context.Context, username string) error {
+	_, err := r.Col.UpdateMany(ctx, bson.M{"username": username}, bson.M{"$set": bson.M{"revoked": true}})
+	return err
+}
@@ -0,0 +1,57 @@
+package mongo
+
+import (
+	"context"
+	"time"
+
+	"github.com/nitin06890/go-rest-api/dbiface"
+	"github.com/nitin06890/go-rest-api/store"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// UserTokens stores the tokens mailed to the users in a mongo collection
+type UserTokens struct {
+	Col dbiface.CollectionAPI
+}
+
+// CreateUserTokenIndexes creates the index the tokens are looked up by, and
+// the TTL index that drops them once they have expired
+func CreateUserTokenIndexes(ctx context.Context, col *mongo.Collection) error {
+	_, err := col.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	return err
+}
+
+// Issue marks the unused tokens of the user and purpose as used, then
+// inserts the token with a new id
+func (r *UserTokens) Issue(ctx context.Context, token store.UserToken) error {
+	previous := bson.M{"username": token.Username, "purpose": token.Purpose, "used": false}
+	if _, err := r.Col.UpdateMany(ctx, previous, bson.M{"$set": bson.M{"used": true}}); err != nil {
+		return err
+	}
+	token.ID = store.NewID()
+	_, err := r.Col.InsertOne(ctx, token)
+	return err
+}
+
+// Consume marks the token as used with a single update, so it can only be
+// consumed once
+func (r *UserTokens) Consume(ctx context.Context, hash, purpose string, now time.Time) (store.UserToken, error) {
+	var token store.UserToken
+	filter := bson.M{
+		"token_hash": hash,
+		"purpose":    purpose,
+		"used":       false,
+		"expires_at": bson.M{"$gt": now},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := r.Col.FindOneAndUpdate(ctx, filter, bson.M{"$set": bson.M{"used": true}}, opts).Decode(&token)
+	if err == mongo.ErrNoDocuments {
+		return token, store.ErrNotFound
+	}
+	return token, err
+}
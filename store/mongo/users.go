@@ -0,0 +1,214 @@
+package mongo
+
+import (
+	"context"
+
+	"github.com/nitin06890/go-rest-api/dbiface"
+	"github.com/nitin06890/go-rest-api/store"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Users stores the users in a mongo collection
+type Users struct {
+	Col dbiface.CollectionAPI
+}
+
+// CreateUserIndexes creates the unique index of the usernames
+func CreateUserIndexes(ctx context.Context, col *mongo.Collection) error {
+	isUserIndexUnique := true
+	indexmodel := mongo.IndexModel{
+		Keys: bson.D{{Key: "username", Value: 1}},
+		Options: &options.IndexOptions{
+			Unique: &isUserIndexUnique,
+		},
+	}
+	_, err := col.Indexes().CreateOne(ctx, indexmodel)
+	return err
+}
+
+// userQuery compiles a filter to a mongo filter
+func userQuery(filter store.UserFilter) bson.M {
+	var and bson.A
+	switch filter.Role {
+	case "":
+	case store.RoleAdmin:
+		and = append(and, bson.M{"$or": bson.A{bson.M{"roles": store.RoleAdmin}, bson.M{"isadmin": true}}})
+	default:
+		and = append(and, bson.M{"roles": filter.Role})
+	}
+	switch filter.Status {
+	case "":
+	case store.StatusActive:
+		// users stored before statuses were introduced are active
+		and = append(and, bson.M{"status": bson.M{"$nin": bson.A{store.StatusDisabled, store.StatusUnverified}}})
+	default:
+		and = append(and, bson.M{"status": filter.Status})
+	}
+	if len(and) == 0 {
+		return bson.M{}
+	}
+	return bson.M{"$and": and}
+}
+
+func (r *Users) findOne(ctx context.Context, filter bson.M) (store.User, error) {
+	var user store.User
+	err := r.Col.FindOne(ctx, filter).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return user, store.ErrNotFound
+	}
+	return user, err
+}
+
+// FindByID returns the user of the id
+func (r *Users) FindByID(ctx context.Context, id string) (store.User, error) {
+	docID, err := objectID(id)
+	if err != nil {
+		return store.User{}, err
+	}
+	return r.findOne(ctx, bson.M{"_id": docID})
+}
+
+// FindByUsername returns the user of the username
+func (r *Users) FindByUsername(ctx context.Context, username string) (store.User, error) {
+	return r.findOne(ctx, bson.M{"username": username})
+}
+
+// List returns a page of the users matching the filter, in the order of ids
+func (r *Users) List(ctx context.Context, filter store.UserFilter, page store.UserPageRequest) ([]store.User, error) {
+	query := userQuery(filter)
+	if page.After != "" {
+		query = bson.M{"$and": bson.A{query, bson.M{"_id": bson.M{"$gt": page.After}}}}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(page.Limit)
+	cursor, err := r.Col.Find(ctx, query, opts)
+	if err != nil {
+		return nil, err
+	}
+	var users []store.User
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// Count counts the users matching the filter
+func (r *Users) Count(ctx context.Context, filter store.UserFilter) (int64, error) {
+	return r.Col.CountDocuments(ctx, userQuery(filter))
+}
+
+// Create inserts the user with a new id. Collections without a unique
+// index on the username are checked beforehand.
+func (r *Users) Create(ctx context.Context, user store.User) (store.User, error) {
+	if _, err := r.FindByUsername(ctx, user.Email); err == nil {
+		return store.User{}, store.ErrDuplicate
+	} else if err != store.ErrNotFound {
+		return store.User{}, err
+	}
+	user.ID = store.NewID()
+	if _, err := r.Col.InsertOne(ctx, user); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return store.User{}, store.ErrDuplicate
+		}
+		return store.User{}, err
+	}
+	return user, nil
+}
+
+// Update applies the changes to the user of the id with $set
+func (r *Users) Update(ctx context.Context, id string, update store.UserUpdate) error {
+	docID, err := objectID(id)
+	if err != nil {
+		return err
+	}
+	set := bson.M{}
+	unset := bson.M{}
+	if update.Name != nil {
+		set["name"] = *update.Name
+	}
+	if update.Password != nil {
+		set["password"] = *update.Password
+	}
+	if update.Roles != nil {
+		set["roles"] = *update.Roles
+		unset["isadmin"] = ""
+	}
+	if update.Status != nil {
+		set["status"] = *update.Status
+	}
+	if update.TOTP != nil {
+		set["totp"] = update.TOTP
+	}
+	if len(set) == 0 {
+		return nil
+	}
+	doc := bson.M{"$set": set}
+	if len(unset) > 0 {
+		doc["$unset"] = unset
+	}
+	_, err = r.Col.UpdateOne(ctx, bson.M{"_id": docID}, doc)
+	return err
+}
+
+// Delete deletes the user of the id
+func (r *Users) Delete(ctx context.Context, id string) error {
+	docID, err := objectID(id)
+	if err != nil {
+		return err
+	}
+	_, err = r.Col.DeleteOne(ctx, bson.M{"_id": docID})
+	return err
+}
+
+// Activate activates the user of the username if they are unverified
+func (r *Users) Activate(ctx context.Context, username string) error {
+	filter := bson.M{"username": username, "status": store.StatusUnverified}
+	_, err := r.Col.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"status": store.StatusActive}})
+	return err
+}
+
+// ConfirmTOTP stores the factor while the user is still enrolling the one
+// of the same secret, so a concurrent enrollment cannot be confirmed twice
+func (r *Users) ConfirmTOTP(ctx context.Context, id string, factor store.TOTPFactor) (bool, error) {
+	docID, err := objectID(id)
+	if err != nil {
+		return false, err
+	}
+	filter := bson.M{"_id": docID, "totp.secret": factor.Secret, "totp.confirmed": false}
+	res, err := r.Col.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"totp": factor}})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+// UseTOTPStep records the step in a single update, so a code cannot be
+// replayed by concurrent requests
+func (r *Users) UseTOTPStep(ctx context.Context, id string, step int64) (bool, error) {
+	docID, err := objectID(id)
+	if err != nil {
+		return false, err
+	}
+	filter := bson.M{"_id": docID, "totp.last_step": bson.M{"$lt": step}}
+	res, err := r.Col.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"totp.last_step": step}})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
+
+// UseRecoveryCode pulls the recovery code in a single update, so it can
+// only be used once
+func (r *Users) UseRecoveryCode(ctx context.Context, id string, hash string) (bool, error) {
+	docID, err := objectID(id)
+	if err != nil {
+		return false, err
+	}
+	filter := bson.M{"_id": docID, "totp.recovery_codes": hash}
+	res, err := r.Col.UpdateOne(ctx, filter, bson.M{"$pull": bson.M{"totp.recovery_codes": hash}})
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount == 1, nil
+}
@@ -0,0 +1,49 @@
+package mongo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nitin06890/go-rest-api/memdb"
+	"github.com/nitin06890/go-rest-api/store"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestUsersLegacyDocuments(t *testing.T) {
+	ctx := context.Background()
+	users := memdb.NewDatabase().Collection("users")
+	repo := &Users{Col: users}
+
+	// users stored before roles and statuses were introduced
+	_, err := users.InsertMany(ctx, []interface{}{
+		bson.M{"username": "root@example.com", "password": "x", "isadmin": true},
+		bson.M{"username": "old@example.com", "password": "x"},
+	})
+	assert.Nil(t, err)
+	_, err = repo.Create(ctx, store.User{Email: "new@example.com", Password: "x", Roles: []string{"customer"}, Status: store.StatusUnverified})
+	assert.Nil(t, err)
+
+	list := func(filter store.UserFilter) []string {
+		found, err := repo.List(ctx, filter, store.UserPageRequest{Limit: 10})
+		assert.Nil(t, err)
+		var names []string
+		for _, u := range found {
+			names = append(names, u.Email)
+		}
+		return names
+	}
+	assert.Equal(t, []string{"root@example.com"}, list(store.UserFilter{Role: store.RoleAdmin}))
+	assert.Equal(t, []string{"root@example.com", "old@example.com"}, list(store.UserFilter{Status: store.StatusActive}))
+
+	root, err := repo.FindByUsername(ctx, "root@example.com")
+	assert.Nil(t, err)
+	roles := []string{"editor"}
+	assert.Nil(t, repo.Update(ctx, string(root.ID), store.UserUpdate{Roles: &roles}))
+	assert.Empty(t, list(store.UserFilter{Role: store.RoleAdmin}), "setting the roles drops the legacy admin flag")
+
+	_, err = repo.Create(ctx, store.User{Email: "old@example.com", Password: "x"})
+	assert.Equal(t, store.ErrDuplicate, err)
+	_, err = repo.FindByID(ctx, "nope")
+	assert.Equal(t, store.ErrInvalidID, err)
+}
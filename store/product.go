@@ -0,0 +1,121 @@
+package store
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Product describes an electronic product
+type Product struct {
+	ID          ID       `json:"_id,omitempty" bson:"_id,omitempty"`
+	Name        string   `json:"product_name" bson:"product_name" validate:"required,max=10"`
+	Price       int      `json:"price" bson:"price" validate:"required,max=1000"`
+	Currency    string   `json:"currency" bson:"currency" validate:"required,len=3"`
+	Discount    int      `json:"discount" bson:"discount"`
+	Vendor      string   `json:"vendor" bson:"vendor" validate:"required"`
+	Accessories []string `json:"accessories,omitempty" bson:"accessories,omitempty"`
+	IsEssential bool     `json:"is_essential" bson:"is_essential"`
+	Version     int64    `json:"version" bson:"version"`
+}
+
+// Field describes a Product field as it is stored in the database
+type Field struct {
+	Name     string
+	JSONName string
+	Index    int
+	Type     reflect.Type
+	Sortable bool
+}
+
+// ProductFields holds the Product fields keyed by their bson name
+var ProductFields = fieldsByBSONName(reflect.TypeOf(Product{}))
+
+func fieldsByBSONName(t reflect.Type) map[string]Field {
+	fields := make(map[string]Field)
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name := strings.Split(sf.Tag.Get("bson"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = Field{
+			Name:     name,
+			JSONName: strings.Split(sf.Tag.Get("json"), ",")[0],
+			Index:    i,
+			Type:     sf.Type,
+			Sortable: sf.Type.Kind() != reflect.Slice,
+		}
+	}
+	return fields
+}
+
+// SortKey is a single field of a sort specification
+type SortKey struct {
+	Field Field
+	Desc  bool
+}
+
+// FilterOperators are the operators of the conditions of a ProductFilter,
+// named after the mongo operators they stand for
+var FilterOperators = map[string]bool{
+	"eq": true, "ne": true, "gt": true, "gte": true, "lt": true, "lte": true, "in": true, "nin": true,
+}
+
+// ProductFilter maps product fields, by their stored name, to the
+// conditions they must all meet, keyed by FilterOperators. The in and nin
+// operators take a []interface{}.
+type ProductFilter map[string]map[string]interface{}
+
+// ProductPageRequest asks for the products following a position in a sort
+// order
+type ProductPageRequest struct {
+	// Sort ends with _id so the order is total
+	Sort []SortKey
+	// After holds the sort values of the product the page starts after,
+	// none for the first page
+	After []interface{}
+	// Backwards asks for the products before the position instead, the
+	// nearest first
+	Backwards bool
+	Limit     int64
+}
+
+// BulkMode controls how a batch of products is written
+type BulkMode struct {
+	// Atomic writes all the products in one transaction or none of them
+	Atomic bool
+	// Ordered stops at the first failing product, unordered writes every valid one
+	Ordered bool
+}
+
+// ScoredProduct is a product decoded together with its text score
+type ScoredProduct struct {
+	Product `bson:",inline"`
+	Score   float64 `bson:"score"`
+}
+
+// ValueFacets are the fields counted by distinct value
+var ValueFacets = []string{"vendor", "currency", "is_essential"}
+
+// PriceBoundaries are the lower bounds of the price buckets, the last one
+// being one past the highest price a product may have
+var PriceBoundaries = []int{0, 100, 250, 500, 750, 1001}
+
+// ValueCount is the number of products with a value of a field
+type ValueCount struct {
+	Value interface{} `json:"value"`
+	Count int64       `json:"count"`
+}
+
+// FacetCounts are the counts of the products matching a filter by facet
+type FacetCounts struct {
+	Total int64
+	// Values are the counts by value of the ValueFacets fields, the most
+	// frequent first
+	Values map[string][]ValueCount
+	// Prices are the counts by price bucket, keyed by its lower boundary
+	Prices map[int]int64
+	// OtherPrices counts the products priced outside of the buckets, or
+	// without a price
+	OtherPrices int64
+}
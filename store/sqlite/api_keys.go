@@ -0,0 +1,106 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/nitin06890/go-rest-api/store"
+)
+
+// APIKeys stores the API keys in the api_keys table of a database opened by
+// sqlstore.Open
+type APIKeys struct {
+	DB *sql.DB
+}
+
+// apiKeyColumns are the columns an API key is read from
+const apiKeyColumns = "id, name, prefix, hash, owner, scopes, revoked, created_at, expires_at, last_used_at"
+
+func scanAPIKey(row rowScanner) (store.APIKey, error) {
+	var k store.APIKey
+	var id, scopes string
+	var createdAt, expiresAt int64
+	var lastUsedAt sql.NullInt64
+	if err := row.Scan(&id, &k.Name, &k.Prefix, &k.Hash, &k.Owner, &scopes, &k.Revoked, &createdAt, &expiresAt, &lastUsedAt); err != nil {
+		return k, err
+	}
+	k.ID = store.ID(id)
+	k.CreatedAt, k.ExpiresAt = fromMillis(createdAt), fromMillis(expiresAt)
+	if lastUsedAt.Valid {
+		t := fromMillis(lastUsedAt.Int64)
+		k.LastUsedAt = &t
+	}
+	err := json.Unmarshal([]byte(scopes), &k.Scopes)
+	return k, err
+}
+
+// Create inserts the key with a new id, the unique prefix is checked by the
+// table
+func (r *APIKeys) Create(ctx context.Context, key store.APIKey) (store.APIKey, error) {
+	key.ID = store.NewID()
+	var lastUsedAt interface{}
+	if key.LastUsedAt != nil {
+		lastUsedAt = millis(*key.LastUsedAt)
+	}
+	_, err := r.DB.ExecContext(ctx, "INSERT INTO api_keys ("+apiKeyColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		string(key.ID), key.Name, key.Prefix, key.Hash, key.Owner, stringsJSON(key.Scopes), key.Revoked,
+		millis(key.CreatedAt), millis(key.ExpiresAt), lastUsedAt)
+	if isUniqueViolation(err) {
+		return store.APIKey{}, store.ErrDuplicate
+	}
+	if err != nil {
+		return store.APIKey{}, err
+	}
+	return key, nil
+}
+
+// FindByPrefix returns the key of the prefix
+func (r *APIKeys) FindByPrefix(ctx context.Context, prefix string) (store.APIKey, error) {
+	key, err := scanAPIKey(r.DB.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE prefix = ?", prefix))
+	if err == sql.ErrNoRows {
+		return key, store.ErrNotFound
+	}
+	return key, err
+}
+
+// ListByOwner returns the keys of the user, in the order of ids
+func (r *APIKeys) ListByOwner(ctx context.Context, owner string) ([]store.APIKey, error) {
+	rows, err := r.DB.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE owner = ? ORDER BY id", owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []store.APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// Revoke revokes the key of the id if the user owns it
+func (r *APIKeys) Revoke(ctx context.Context, id, owner string) (bool, error) {
+	res, err := r.DB.ExecContext(ctx, "UPDATE api_keys SET revoked = 1 WHERE id = ? AND owner = ?", id, owner)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// RevokeOwner revokes every key of the user
+func (r *APIKeys) RevokeOwner(ctx context.Context, owner string) error {
+	_, err := r.DB.ExecContext(ctx, "UPDATE api_keys SET revoked = 1 WHERE owner = ?", owner)
+	return err
+}
+
+// Touch records the last use of the key of the id
+func (r *APIKeys) Touch(ctx context.Context, id string, at time.Time) error {
+	_, err := r.DB.ExecContext(ctx, "UPDATE api_keys SET last_used_at = ? WHERE id = ?", millis(at), id)
+	return err
+}
@@ -0,0 +1,32 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// millis returns the time as stored in the columns of times
+func millis(t time.Time) int64 {
+	return t.UnixMilli()
+}
+
+// fromMillis returns the time of a column of times
+func fromMillis(ms int64) time.Time {
+	return time.UnixMilli(ms).UTC()
+}
+
+// expiringTables are the tables whose rows are deleted once they expire,
+// like the documents of the mongo collections with TTL indexes
+var expiringTables = []string{"sessions", "user_tokens", "login_attempts"}
+
+// DeleteExpired deletes the sessions, tokens and login attempts that expired
+// before now
+func DeleteExpired(ctx context.Context, db *sql.DB, now time.Time) error {
+	for _, table := range expiringTables {
+		if _, err := db.ExecContext(ctx, "DELETE FROM "+table+" WHERE expires_at < ?", millis(now)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/nitin06890/go-rest-api/store"
+)
+
+// LoginAttempts stores the failed logins in the login_attempts table of a
+// database opened by sqlstore.Open, keyed by their throttle key
+type LoginAttempts struct {
+	DB *sql.DB
+}
+
+// loginAttemptColumns are the columns login attempts are read from
+const loginAttemptColumns = "key, failures, lockouts, locked_until, expires_at"
+
+func scanLoginAttempts(row rowScanner) (store.LoginAttempts, error) {
+	var a store.LoginAttempts
+	var lockedUntil sql.NullInt64
+	var expiresAt int64
+	if err := row.Scan(&a.Key, &a.Failures, &a.Lockouts, &lockedUntil, &expiresAt); err != nil {
+		return a, err
+	}
+	if lockedUntil.Valid {
+		a.LockedUntil = fromMillis(lockedUntil.Int64)
+	}
+	a.ExpiresAt = fromMillis(expiresAt)
+	return a, nil
+}
+
+// Locked returns the attempts of the keys that are locked out after now
+func (r *LoginAttempts) Locked(ctx context.Context, keys []string, now time.Time) ([]store.LoginAttempts, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	args := make([]interface{}, 0, len(keys)+1)
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	args = append(args, millis(now))
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(keys)), ", ")
+	rows, err := r.DB.QueryContext(ctx, "SELECT "+loginAttemptColumns+" FROM login_attempts WHERE key IN ("+placeholders+") AND locked_until > ?", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var locked []store.LoginAttempts
+	for rows.Next() {
+		a, err := scanLoginAttempts(rows)
+		if err != nil {
+			return nil, err
+		}
+		locked = append(locked, a)
+	}
+	return locked, rows.Err()
+}
+
+// AddFailure counts the failure with an upsert, so concurrent failures are
+// all counted
+func (r *LoginAttempts) AddFailure(ctx context.Context, key string, expiresAt time.Time) (store.LoginAttempts, error) {
+	return scanLoginAttempts(r.DB.QueryRowContext(ctx, `INSERT INTO login_attempts (key, failures, expires_at) VALUES (?, 1, ?)
+		ON CONFLICT (key) DO UPDATE SET failures = failures + 1, expires_at = excluded.expires_at
+		RETURNING `+loginAttemptColumns, key, millis(expiresAt)))
+}
+
+// LockOut resets the failures with a single update whose condition holds
+// the threshold, so only one of the concurrent failures reaching it locks out
+func (r *LoginAttempts) LockOut(ctx context.Context, key string, threshold int, lockedUntil, expiresAt time.Time) (bool, error) {
+	res, err := r.DB.ExecContext(ctx, `UPDATE login_attempts SET failures = 0, lockouts = lockouts + 1, locked_until = ?, expires_at = ?
+		WHERE key = ? AND failures >= ?`, millis(lockedUntil), millis(expiresAt), key, threshold)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Clear forgets the failed logins of the key
+func (r *LoginAttempts) Clear(ctx context.Context, key string) error {
+	_, err := r.DB.ExecContext(ctx, "DELETE FROM login_attempts WHERE key = ?", key)
+	return err
+}
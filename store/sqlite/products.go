@@ -0,0 +1,510 @@
+// Package sqlite stores the products and users in the tables of a database
+// opened by sqlstore.Open.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/nitin06890/go-rest-api/store"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Products stores the products in the products table of a database
+// opened by sqlstore.Open. Fields a patch removed are stored as NULL and
+// filtered like missing fields are in mongo.
+type Products struct {
+	DB *sql.DB
+}
+
+// productColumns are the columns of the products table, in the order of
+// the fields of Product
+const productColumns = "id, product_name, price, currency, discount, vendor, accessories, is_essential, version"
+
+// sqlExecutor is either a database or a transaction
+type sqlExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// rowScanner is either a row or rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// isUniqueViolation reports whether the error is a violated unique or
+// primary key constraint
+func isUniqueViolation(err error) bool {
+	var e *sqlite.Error
+	if !errors.As(err, &e) {
+		return false
+	}
+	return e.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || e.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+}
+
+// productColumn returns the column of a field of store.ProductFields
+func productColumn(name string) string {
+	if name == "_id" {
+		return "id"
+	}
+	return name
+}
+
+// sqlValue converts a field value to the value stored in its column
+func sqlValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case store.ID:
+		return string(v)
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case []string:
+		if len(v) == 0 {
+			return nil
+		}
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+	return v
+}
+
+func scanProduct(row rowScanner, extra ...interface{}) (store.Product, error) {
+	var p store.Product
+	var id string
+	var name, currency, vendor, accessories sql.NullString
+	var price, discount sql.NullInt64
+	var essential sql.NullBool
+	dest := append([]interface{}{&id, &name, &price, &currency, &discount, &vendor, &accessories, &essential, &p.Version}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return p, err
+	}
+	p.ID = store.ID(id)
+	p.Name, p.Price, p.Currency = name.String, int(price.Int64), currency.String
+	p.Discount, p.Vendor, p.IsEssential = int(discount.Int64), vendor.String, essential.Bool
+	if accessories.Valid {
+		if err := json.Unmarshal([]byte(accessories.String), &p.Accessories); err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+func productArgs(p store.Product) []interface{} {
+	return []interface{}{string(p.ID), p.Name, p.Price, p.Currency, p.Discount, p.Vendor, sqlValue(p.Accessories), sqlValue(p.IsEssential), p.Version}
+}
+
+// sqlOperators are the SQL operators of the comparisons of the query grammar
+var sqlOperators = map[string]string{"eq": "=", "gt": ">", "gte": ">=", "lt": "<", "lte": "<="}
+
+// placeholders returns the placeholders of a list and its values
+func placeholders(list []interface{}) (string, []interface{}) {
+	marks := make([]string, len(list))
+	args := make([]interface{}, len(list))
+	for i, v := range list {
+		marks[i], args[i] = "?", sqlValue(v)
+	}
+	return strings.Join(marks, ", "), args
+}
+
+// productCondition compiles a single condition. Like mongo, ne and nin match
+// NULL, the other operators don't, and conditions on the accessories match
+// if any of them does.
+func productCondition(field store.Field, op string, value interface{}) (string, []interface{}) {
+	col := productColumn(field.Name)
+	if field.Type.Kind() == reflect.Slice {
+		elems := "SELECT 1 FROM json_each(" + col + ") WHERE value "
+		switch op {
+		case "ne":
+			return "NOT EXISTS (" + elems + "= ?)", []interface{}{sqlValue(value)}
+		case "in", "nin":
+			marks, args := placeholders(value.([]interface{}))
+			cond := "EXISTS (" + elems + "IN (" + marks + "))"
+			if op == "nin" {
+				cond = "NOT " + cond
+			}
+			return cond, args
+		}
+		return "EXISTS (" + elems + sqlOperators[op] + " ?)", []interface{}{sqlValue(value)}
+	}
+	switch op {
+	case "ne":
+		return "(" + col + " IS NULL OR " + col + " <> ?)", []interface{}{sqlValue(value)}
+	case "in":
+		marks, args := placeholders(value.([]interface{}))
+		return col + " IN (" + marks + ")", args
+	case "nin":
+		marks, args := placeholders(value.([]interface{}))
+		return "(" + col + " IS NULL OR " + col + " NOT IN (" + marks + "))", args
+	}
+	return col + " " + sqlOperators[op] + " ?", []interface{}{sqlValue(value)}
+}
+
+// productWhere compiles a filter to a condition and its arguments. Fields
+// and operators were whitelisted when the filter was built.
+func productWhere(filter store.ProductFilter) (string, []interface{}) {
+	conds := []string{"1 = 1"}
+	var args []interface{}
+	names := make([]string, 0, len(filter))
+	for name := range filter {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ops := make([]string, 0, len(filter[name]))
+		for op := range filter[name] {
+			ops = append(ops, op)
+		}
+		sort.Strings(ops)
+		for _, op := range ops {
+			cond, condArgs := productCondition(store.ProductFields[name], op, filter[name][op])
+			conds = append(conds, cond)
+			args = append(args, condArgs...)
+		}
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// orderBy returns the ORDER BY clause of the sort keys, reversed when
+// paging backwards
+func orderBy(keys []store.SortKey, reverse bool) string {
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		dir := "ASC"
+		if k.Desc != reverse {
+			dir = "DESC"
+		}
+		parts[i] = productColumn(k.Field.Name) + " " + dir
+	}
+	return strings.Join(parts, ", ")
+}
+
+// keysetWhere matches the products strictly after (or before) the given
+// sort values, as the mongo repository does
+func keysetWhere(keys []store.SortKey, values []interface{}, backwards bool) (string, []interface{}) {
+	var or []string
+	var args []interface{}
+	for i, k := range keys {
+		var and []string
+		for j := 0; j < i; j++ {
+			and = append(and, productColumn(keys[j].Field.Name)+" = ?")
+			args = append(args, sqlValue(values[j]))
+		}
+		op := ">"
+		if k.Desc != backwards {
+			op = "<"
+		}
+		and = append(and, productColumn(k.Field.Name)+" "+op+" ?")
+		args = append(args, sqlValue(values[i]))
+		or = append(or, "("+strings.Join(and, " AND ")+")")
+	}
+	return "(" + strings.Join(or, " OR ") + ")", args
+}
+
+// FindByID returns the product of the id
+func (r *Products) FindByID(ctx context.Context, id string) (store.Product, error) {
+	docID, err := store.ParseID(id)
+	if err != nil {
+		return store.Product{}, err
+	}
+	row := r.DB.QueryRowContext(ctx, "SELECT "+productColumns+" FROM products WHERE id = ?", string(docID))
+	product, err := scanProduct(row)
+	if err == sql.ErrNoRows {
+		return product, store.ErrNotFound
+	}
+	return product, err
+}
+
+// List returns a page of the products matching the filter
+func (r *Products) List(ctx context.Context, filter store.ProductFilter, page store.ProductPageRequest) ([]store.Product, error) {
+	where, args := productWhere(filter)
+	if len(page.After) > 0 {
+		keyset, keysetArgs := keysetWhere(page.Sort, page.After, page.Backwards)
+		where += " AND " + keyset
+		args = append(args, keysetArgs...)
+	}
+	query := "SELECT " + productColumns + " FROM products WHERE " + where + " ORDER BY " + orderBy(page.Sort, page.Backwards)
+	if page.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, page.Limit)
+	}
+	rows, err := r.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	products := []store.Product{}
+	for rows.Next() {
+		product, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, product)
+	}
+	return products, rows.Err()
+}
+
+// Count counts the products matching the filter
+func (r *Products) Count(ctx context.Context, filter store.ProductFilter) (int64, error) {
+	var n int64
+	where, args := productWhere(filter)
+	err := r.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM products WHERE "+where, args...).Scan(&n)
+	return n, err
+}
+
+func insertProduct(ctx context.Context, db sqlExecutor, p store.Product) error {
+	_, err := db.ExecContext(ctx, "INSERT INTO products ("+productColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", productArgs(p)...)
+	if isUniqueViolation(err) {
+		return store.ErrDuplicate
+	}
+	return err
+}
+
+// Create inserts the products one by one, in a transaction for atomic batches
+func (r *Products) Create(ctx context.Context, products []store.Product, mode store.BulkMode) ([]error, error) {
+	for i := range products {
+		products[i].ID = store.NewID()
+		products[i].Version = 1
+	}
+	errs := make([]error, len(products))
+	if !mode.Atomic {
+		for i := range products {
+			if errs[i] = insertProduct(ctx, r.DB, products[i]); errs[i] != nil && mode.Ordered {
+				for j := i + 1; j < len(products); j++ {
+					errs[j] = store.ErrNotInserted
+				}
+				break
+			}
+		}
+		return errs, nil
+	}
+
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	for i := range products {
+		if err := insertProduct(ctx, tx, products[i]); err != nil {
+			// the transaction is rolled back
+			for j := range errs {
+				errs[j] = store.ErrNotInserted
+			}
+			errs[i] = err
+			return errs, nil
+		}
+	}
+	return errs, tx.Commit()
+}
+
+// Update stores the product while it still has the version
+func (r *Products) Update(ctx context.Context, product store.Product, version int64) error {
+	args := append(productArgs(product)[1:], string(product.ID), version)
+	res, err := r.DB.ExecContext(ctx, `UPDATE products SET product_name = ?, price = ?, currency = ?, discount = ?,
+		vendor = ?, accessories = ?, is_essential = ?, version = ? WHERE id = ? AND version = ?`, args...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return store.ErrConflict
+	}
+	return nil
+}
+
+// Patch sets the columns of the fields, and sets those of the unset
+// fields to NULL, while the product still has the version
+func (r *Products) Patch(ctx context.Context, id string, version int64, set map[string]interface{}, unset []string) error {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	assignments := []string{"id = id"}
+	var args []interface{}
+	for _, name := range names {
+		assignments = append(assignments, productColumn(name)+" = ?")
+		args = append(args, sqlValue(set[name]))
+	}
+	for _, name := range unset {
+		if name == "version" {
+			// products stored before versioning have version 0
+			assignments = append(assignments, "version = 0")
+			continue
+		}
+		assignments = append(assignments, productColumn(name)+" = NULL")
+	}
+	args = append(args, id, version)
+	res, err := r.DB.ExecContext(ctx, "UPDATE products SET "+strings.Join(assignments, ", ")+" WHERE id = ? AND version = ?", args...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return store.ErrConflict
+	}
+	return nil
+}
+
+// Delete deletes the product of the id, if it still has the version when one is given
+func (r *Products) Delete(ctx context.Context, id string, version *int64) (bool, error) {
+	docID, err := store.ParseID(id)
+	if err != nil {
+		return false, err
+	}
+	query, args := "DELETE FROM products WHERE id = ?", []interface{}{string(docID)}
+	if version != nil {
+		query += " AND version = ?"
+		args = append(args, *version)
+	}
+	res, err := r.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ftsQuery translates a mongo $text search to an FTS5 query: the words
+// match any of them, quoted phrases must all match, and words prefixed
+// with a hyphen must not. Every word and phrase is quoted, so the search
+// cannot use the FTS5 syntax. The query is empty when nothing can match.
+func ftsQuery(text string) string {
+	var words, phrases, negated []string
+	quote := func(s string) string { return `"` + strings.ReplaceAll(s, `"`, `""`) + `"` }
+	for i, part := range strings.Split(text, `"`) {
+		if i%2 == 1 {
+			if part = strings.TrimSpace(part); part != "" {
+				phrases = append(phrases, quote(part))
+			}
+			continue
+		}
+		for _, word := range strings.Fields(part) {
+			if strings.HasPrefix(word, "-") {
+				if word = strings.TrimLeft(word, "-"); word != "" {
+					negated = append(negated, quote(word))
+				}
+				continue
+			}
+			words = append(words, quote(word))
+		}
+	}
+	var query string
+	switch {
+	case len(phrases) > 0:
+		query = strings.Join(phrases, " AND ")
+	case len(words) > 0:
+		query = strings.Join(words, " OR ")
+	default:
+		return ""
+	}
+	if len(negated) > 0 {
+		query = "(" + query + ") NOT (" + strings.Join(negated, " OR ") + ")"
+	}
+	return query
+}
+
+// Search runs a full-text search on the FTS5 index of the products. The
+// score is the bm25 rank, negated so the most relevant have the highest.
+func (r *Products) Search(ctx context.Context, text string, offset, limit int64) ([]store.ScoredProduct, int64, error) {
+	query := ftsQuery(text)
+	if query == "" {
+		return nil, 0, nil
+	}
+	var total int64
+	if err := r.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM products_fts WHERE products_fts MATCH ?", query).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := r.DB.QueryContext(ctx, `SELECT `+productColumns+`, score FROM products JOIN (
+			SELECT rowid AS matched, -bm25(products_fts, 10.0, 5.0, 1.0) AS score FROM products_fts WHERE products_fts MATCH ?
+		) ON products.rowid = matched ORDER BY score DESC, id ASC LIMIT ? OFFSET ?`, query, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var results []store.ScoredProduct
+	for rows.Next() {
+		var score float64
+		product, err := scanProduct(rows, &score)
+		if err != nil {
+			return nil, 0, err
+		}
+		results = append(results, store.ScoredProduct{Product: product, Score: score})
+	}
+	return results, total, rows.Err()
+}
+
+// priceBucketExpr returns the expression of the lower boundary of the price
+// bucket of a product, NULL outside of the boundaries or without a price
+func priceBucketExpr() string {
+	var b strings.Builder
+	b.WriteString("CASE")
+	for i := 0; i < len(store.PriceBoundaries)-1; i++ {
+		fmt.Fprintf(&b, " WHEN price >= %d AND price < %d THEN %d", store.PriceBoundaries[i], store.PriceBoundaries[i+1], store.PriceBoundaries[i])
+	}
+	b.WriteString(" END")
+	return b.String()
+}
+
+// Facets counts the products by facet with a query per facet
+func (r *Products) Facets(ctx context.Context, filter store.ProductFilter) (store.FacetCounts, error) {
+	counts := store.FacetCounts{Values: make(map[string][]store.ValueCount), Prices: make(map[int]int64)}
+	where, args := productWhere(filter)
+	if err := r.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM products WHERE "+where, args...).Scan(&counts.Total); err != nil {
+		return counts, err
+	}
+	for _, f := range store.ValueFacets {
+		col := productColumn(f)
+		rows, err := r.DB.QueryContext(ctx, "SELECT "+col+", COUNT(*) AS n FROM products WHERE "+where+
+			" GROUP BY "+col+" ORDER BY n DESC, "+col+" ASC", args...)
+		if err != nil {
+			return counts, err
+		}
+		values := []store.ValueCount{}
+		for rows.Next() {
+			var vc store.ValueCount
+			if err := rows.Scan(&vc.Value, &vc.Count); err != nil {
+				rows.Close()
+				return counts, err
+			}
+			if n, ok := vc.Value.(int64); ok && store.ProductFields[f].Type.Kind() == reflect.Bool {
+				vc.Value = n != 0
+			}
+			values = append(values, vc)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return counts, err
+		}
+		counts.Values[f] = values
+	}
+
+	rows, err := r.DB.QueryContext(ctx, "SELECT "+priceBucketExpr()+" AS bucket, COUNT(*) FROM products WHERE "+where+
+		" GROUP BY bucket", args...)
+	if err != nil {
+		return counts, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var min sql.NullInt64
+		var n int64
+		if err := rows.Scan(&min, &n); err != nil {
+			return counts, err
+		}
+		if !min.Valid {
+			counts.OtherPrices = n
+			continue
+		}
+		counts.Prices[int(min.Int64)] = n
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,109 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/nitin06890/go-rest-api/store"
+)
+
+// Sessions stores the sessions in the sessions table of a database opened
+// by sqlstore.Open, and the hashes of their spent refresh tokens in
+// session_previous_hashes
+type Sessions struct {
+	DB *sql.DB
+}
+
+// sessionColumns are the columns a session is read from
+const sessionColumns = `id, username, token_hash, revoked, created_at, expires_at,
+	(SELECT json_group_array(hash) FROM session_previous_hashes WHERE session_id = sessions.id)`
+
+func scanSession(row rowScanner) (store.Session, error) {
+	var s store.Session
+	var id, hashes string
+	var createdAt, expiresAt int64
+	if err := row.Scan(&id, &s.Username, &s.TokenHash, &s.Revoked, &createdAt, &expiresAt, &hashes); err != nil {
+		return s, err
+	}
+	s.ID = store.ID(id)
+	s.CreatedAt, s.ExpiresAt = fromMillis(createdAt), fromMillis(expiresAt)
+	err := json.Unmarshal([]byte(hashes), &s.PreviousHashes)
+	return s, err
+}
+
+// Create inserts the session with a new id
+func (r *Sessions) Create(ctx context.Context, session store.Session) (store.Session, error) {
+	session.ID = store.NewID()
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return store.Session{}, err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, "INSERT INTO sessions (id, username, token_hash, revoked, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		string(session.ID), session.Username, session.TokenHash, session.Revoked, millis(session.CreatedAt), millis(session.ExpiresAt))
+	if err != nil {
+		return store.Session{}, err
+	}
+	for _, hash := range session.PreviousHashes {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO session_previous_hashes (session_id, hash) VALUES (?, ?)", string(session.ID), hash); err != nil {
+			return store.Session{}, err
+		}
+	}
+	if session.PreviousHashes == nil {
+		session.PreviousHashes = []string{}
+	}
+	return session, tx.Commit()
+}
+
+// FindByID returns the session of the id
+func (r *Sessions) FindByID(ctx context.Context, id string) (store.Session, error) {
+	if _, err := store.ParseID(id); err != nil {
+		return store.Session{}, err
+	}
+	session, err := scanSession(r.DB.QueryRowContext(ctx, "SELECT "+sessionColumns+" FROM sessions WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return session, store.ErrNotFound
+	}
+	return session, err
+}
+
+// Rotate swaps the token hash with a single update, whose condition holds
+// the current hash so that a token presented twice concurrently rotates once
+func (r *Sessions) Rotate(ctx context.Context, id, hash, newHash string) (store.Session, error) {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return store.Session{}, err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, "UPDATE sessions SET token_hash = ? WHERE id = ? AND token_hash = ? AND revoked = 0", newHash, id, hash)
+	if err != nil {
+		return store.Session{}, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = store.ErrConflict
+		}
+		return store.Session{}, err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO session_previous_hashes (session_id, hash) VALUES (?, ?)", id, hash); err != nil {
+		return store.Session{}, err
+	}
+	session, err := scanSession(tx.QueryRowContext(ctx, "SELECT "+sessionColumns+" FROM sessions WHERE id = ?", id))
+	if err != nil {
+		return session, err
+	}
+	return session, tx.Commit()
+}
+
+// Revoke revokes the session of the id
+func (r *Sessions) Revoke(ctx context.Context, id string) error {
+	_, err := r.DB.ExecContext(ctx, "UPDATE sessions SET revoked = 1 WHERE id = ?", id)
+	return err
+}
+
+// RevokeUser revokes every session of the user
+func (r *Sessions) RevokeUser(ctx context.Context, username string) error {
+	_, err := r.DB.ExecContext(ctx, "UPDATE sessions SET revoked = 1 WHERE username = ?", username)
+	return err
+}
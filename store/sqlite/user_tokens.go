@@ -0,0 +1,58 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/nitin06890/go-rest-api/store"
+)
+
+// UserTokens stores the tokens mailed to the users in the user_tokens table
+// of a database opened by sqlstore.Open
+type UserTokens struct {
+	DB *sql.DB
+}
+
+// Issue marks the unused tokens of the user and purpose as used and inserts
+// the token with a new id, in a single transaction
+func (r *UserTokens) Issue(ctx context.Context, token store.UserToken) error {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, "UPDATE user_tokens SET used = 1 WHERE username = ? AND purpose = ? AND used = 0",
+		token.Username, token.Purpose)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO user_tokens (id, username, purpose, token_hash, used, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, string(store.NewID()), token.Username, token.Purpose, token.TokenHash, token.Used,
+		millis(token.CreatedAt), millis(token.ExpiresAt))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Consume marks the token as used with a single update, so it can only be
+// consumed once
+func (r *UserTokens) Consume(ctx context.Context, hash, purpose string, now time.Time) (store.UserToken, error) {
+	var t store.UserToken
+	var id string
+	var createdAt, expiresAt int64
+	err := r.DB.QueryRowContext(ctx, `UPDATE user_tokens SET used = 1
+		WHERE token_hash = ? AND purpose = ? AND used = 0 AND expires_at > ?
+		RETURNING id, username, purpose, token_hash, used, created_at, expires_at`, hash, purpose, millis(now)).
+		Scan(&id, &t.Username, &t.Purpose, &t.TokenHash, &t.Used, &createdAt, &expiresAt)
+	if err == sql.ErrNoRows {
+		return t, store.ErrNotFound
+	}
+	if err != nil {
+		return t, err
+	}
+	t.ID = store.ID(id)
+	t.CreatedAt, t.ExpiresAt = fromMillis(createdAt), fromMillis(expiresAt)
+	return t, nil
+}
@@ -0,0 +1,275 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+
+	"github.com/nitin06890/go-rest-api/store"
+)
+
+// Users stores the users in the users table of a database opened by
+// sqlstore.Open, and the hashes of their recovery codes in
+// user_recovery_codes
+type Users struct {
+	DB *sql.DB
+}
+
+// userColumns are the columns a user is read from
+const userColumns = `id, username, password, name, roles, status, totp_secret, totp_confirmed, totp_last_step,
+	(SELECT json_group_array(hash) FROM user_recovery_codes WHERE user_id = users.id)`
+
+func scanUser(row rowScanner) (store.User, error) {
+	var u store.User
+	var id, roles, codes string
+	var secret sql.NullString
+	var confirmed bool
+	var lastStep int64
+	if err := row.Scan(&id, &u.Email, &u.Password, &u.Name, &roles, &u.Status, &secret, &confirmed, &lastStep, &codes); err != nil {
+		return u, err
+	}
+	u.ID = store.ID(id)
+	if err := json.Unmarshal([]byte(roles), &u.Roles); err != nil {
+		return u, err
+	}
+	if len(u.Roles) == 0 {
+		u.Roles = nil
+	}
+	if secret.Valid {
+		u.TOTP = &store.TOTPFactor{Secret: secret.String, Confirmed: confirmed, LastStep: lastStep}
+		if err := json.Unmarshal([]byte(codes), &u.TOTP.RecoveryCodes); err != nil {
+			return u, err
+		}
+	}
+	return u, nil
+}
+
+// stringsJSON encodes the strings as stored in the columns of JSON arrays,
+// such as roles
+func stringsJSON(values []string) string {
+	if values == nil {
+		values = []string{}
+	}
+	b, _ := json.Marshal(values)
+	return string(b)
+}
+
+// userWhere compiles a filter to a condition and its arguments
+func userWhere(filter store.UserFilter) (string, []interface{}) {
+	conds := []string{"1 = 1"}
+	var args []interface{}
+	if filter.Role != "" {
+		conds = append(conds, "EXISTS (SELECT 1 FROM json_each(roles) WHERE value = ?)")
+		args = append(args, filter.Role)
+	}
+	switch filter.Status {
+	case "":
+	case store.StatusActive:
+		// users stored without a status are active
+		conds = append(conds, "status NOT IN (?, ?)")
+		args = append(args, store.StatusDisabled, store.StatusUnverified)
+	default:
+		conds = append(conds, "status = ?")
+		args = append(args, filter.Status)
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+func (r *Users) findOne(ctx context.Context, where string, args ...interface{}) (store.User, error) {
+	user, err := scanUser(r.DB.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE "+where, args...))
+	if err == sql.ErrNoRows {
+		return user, store.ErrNotFound
+	}
+	return user, err
+}
+
+// FindByID returns the user of the id
+func (r *Users) FindByID(ctx context.Context, id string) (store.User, error) {
+	docID, err := store.ParseID(id)
+	if err != nil {
+		return store.User{}, err
+	}
+	return r.findOne(ctx, "id = ?", string(docID))
+}
+
+// FindByUsername returns the user of the username
+func (r *Users) FindByUsername(ctx context.Context, username string) (store.User, error) {
+	return r.findOne(ctx, "username = ?", username)
+}
+
+// List returns a page of the users matching the filter, in the order of ids
+func (r *Users) List(ctx context.Context, filter store.UserFilter, page store.UserPageRequest) ([]store.User, error) {
+	where, args := userWhere(filter)
+	if page.After != "" {
+		where += " AND id > ?"
+		args = append(args, string(page.After))
+	}
+	query := "SELECT " + userColumns + " FROM users WHERE " + where + " ORDER BY id"
+	if page.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, page.Limit)
+	}
+	rows, err := r.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []store.User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// Count counts the users matching the filter
+func (r *Users) Count(ctx context.Context, filter store.UserFilter) (int64, error) {
+	var n int64
+	where, args := userWhere(filter)
+	err := r.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE "+where, args...).Scan(&n)
+	return n, err
+}
+
+// Create inserts the user with a new id, the unique username is checked by
+// the table
+func (r *Users) Create(ctx context.Context, user store.User) (store.User, error) {
+	user.ID = store.NewID()
+	_, err := r.DB.ExecContext(ctx, "INSERT INTO users (id, username, password, name, roles, status) VALUES (?, ?, ?, ?, ?, ?)",
+		string(user.ID), user.Email, user.Password, user.Name, stringsJSON(user.AllRoles()), user.Status)
+	if isUniqueViolation(err) {
+		return store.User{}, store.ErrDuplicate
+	}
+	if err != nil {
+		return store.User{}, err
+	}
+	if user.TOTP != nil {
+		if err := r.Update(ctx, string(user.ID), store.UserUpdate{TOTP: user.TOTP}); err != nil {
+			return store.User{}, err
+		}
+	}
+	return user, nil
+}
+
+// setRecoveryCodes replaces the recovery codes of the user
+func setRecoveryCodes(ctx context.Context, tx *sql.Tx, id string, hashes []string) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_recovery_codes WHERE user_id = ?", id); err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO user_recovery_codes (user_id, hash) VALUES (?, ?)", id, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Update applies the changes to the user of the id, along with the
+// recovery codes of a new second factor in the same transaction
+func (r *Users) Update(ctx context.Context, id string, update store.UserUpdate) error {
+	var assignments []string
+	var args []interface{}
+	if update.Name != nil {
+		assignments = append(assignments, "name = ?")
+		args = append(args, *update.Name)
+	}
+	if update.Password != nil {
+		assignments = append(assignments, "password = ?")
+		args = append(args, *update.Password)
+	}
+	if update.Roles != nil {
+		assignments = append(assignments, "roles = ?")
+		args = append(args, stringsJSON(*update.Roles))
+	}
+	if update.Status != nil {
+		assignments = append(assignments, "status = ?")
+		args = append(args, *update.Status)
+	}
+	if update.TOTP != nil {
+		assignments = append(assignments, "totp_secret = ?", "totp_confirmed = ?", "totp_last_step = ?")
+		args = append(args, update.TOTP.Secret, update.TOTP.Confirmed, update.TOTP.LastStep)
+	}
+	if len(assignments) == 0 {
+		return nil
+	}
+
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	args = append(args, id)
+	res, err := tx.ExecContext(ctx, "UPDATE users SET "+strings.Join(assignments, ", ")+" WHERE id = ?", args...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	if update.TOTP != nil {
+		if err := setRecoveryCodes(ctx, tx, id, update.TOTP.RecoveryCodes); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Delete deletes the user of the id, and their recovery codes with them
+func (r *Users) Delete(ctx context.Context, id string) error {
+	_, err := r.DB.ExecContext(ctx, "DELETE FROM users WHERE id = ?", id)
+	return err
+}
+
+// Activate activates the user of the username if they are unverified
+func (r *Users) Activate(ctx context.Context, username string) error {
+	_, err := r.DB.ExecContext(ctx, "UPDATE users SET status = ? WHERE username = ? AND status = ?",
+		store.StatusActive, username, store.StatusUnverified)
+	return err
+}
+
+// ConfirmTOTP stores the factor while the user is still enrolling the one
+// of the same secret, so a concurrent enrollment cannot be confirmed twice
+func (r *Users) ConfirmTOTP(ctx context.Context, id string, factor store.TOTPFactor) (bool, error) {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, `UPDATE users SET totp_confirmed = ?, totp_last_step = ?
+		WHERE id = ? AND totp_secret = ? AND totp_confirmed = 0`, factor.Confirmed, factor.LastStep, id, factor.Secret)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if err := setRecoveryCodes(ctx, tx, id, factor.RecoveryCodes); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// UseTOTPStep records the step in a single update, so a code cannot be
+// replayed by concurrent requests
+func (r *Users) UseTOTPStep(ctx context.Context, id string, step int64) (bool, error) {
+	res, err := r.DB.ExecContext(ctx, "UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_secret IS NOT NULL AND totp_last_step < ?",
+		step, id, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// UseRecoveryCode deletes the recovery code, so it can only be used once
+func (r *Users) UseRecoveryCode(ctx context.Context, id string, hash string) (bool, error) {
+	res, err := r.DB.ExecContext(ctx, "DELETE FROM user_recovery_codes WHERE user_id = ? AND hash = ?", id, hash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
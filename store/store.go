@@ -0,0 +1,24 @@
+// Package store holds the products and users as they are stored, and what
+// the repositories of the handlers package are asked for and answer with.
+// The adapters of the databases live in its subpackages.
+package store
+
+import "errors"
+
+// Errors of the repositories
+var (
+	// ErrNotFound is returned when there is nothing with the id or key
+	ErrNotFound = errors.New("not found")
+	// ErrInvalidID is returned for ids that cannot identify anything
+	ErrInvalidID = errors.New("invalid id")
+	// ErrDuplicate is returned when a unique key is already taken
+	ErrDuplicate = errors.New("duplicate key")
+	// ErrConflict is returned when a product changed since it was read
+	ErrConflict = errors.New("modified concurrently")
+	// ErrNotInserted reports the products of a batch that were not written
+	// because an earlier product failed or the transaction was rolled back
+	ErrNotInserted = errors.New("not inserted")
+	// ErrNoTransactions is returned for atomic writes to a repository
+	// without transaction support
+	ErrNoTransactions = errors.New("transactions are not available")
+)
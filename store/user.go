@@ -0,0 +1,81 @@
+package store
+
+// User statuses
+const (
+	StatusUnverified = "unverified"
+	StatusActive     = "active"
+	StatusDisabled   = "disabled"
+)
+
+// RoleAdmin is the role of the users stored with the legacy admin flag
+const RoleAdmin = "admin"
+
+// User represents a user
+type User struct {
+	ID       ID       `json:"_id,omitempty" bson:"_id,omitempty"`
+	Email    string   `json:"username" bson:"username" validate:"required,email"`
+	Password string   `json:"password,omitempty" bson:"password" validate:"required,min=8,max=300"`
+	Name     string   `json:"name,omitempty" bson:"name,omitempty" validate:"max=100"`
+	Roles    []string `json:"roles,omitempty" bson:"roles"`
+	Status   string   `json:"status,omitempty" bson:"status,omitempty"`
+	// IsAdmin is only read from users stored before roles were introduced
+	IsAdmin bool `json:"-" bson:"isadmin,omitempty"`
+	// TOTP is the second factor of the user, once they started enrolling one
+	TOTP *TOTPFactor `json:"-" bson:"totp,omitempty"`
+}
+
+// AllRoles returns the roles of the user, mapping the legacy admin flag to
+// the admin role
+func (u User) AllRoles() []string {
+	if u.IsAdmin {
+		return append([]string{RoleAdmin}, u.Roles...)
+	}
+	return u.Roles
+}
+
+// Disabled reports whether the user was disabled by an administrator
+func (u User) Disabled() bool {
+	return u.Status == StatusDisabled
+}
+
+// Unverified reports whether the user has yet to confirm their email address
+func (u User) Unverified() bool {
+	return u.Status == StatusUnverified
+}
+
+// TwoFactor reports whether the user logs in with a second factor
+func (u User) TwoFactor() bool {
+	return u.TOTP != nil && u.TOTP.Confirmed
+}
+
+// TOTPFactor is the TOTP second factor of a user. Only the hashes of the
+// recovery codes are stored.
+type TOTPFactor struct {
+	Secret        string   `bson:"secret"`
+	Confirmed     bool     `bson:"confirmed"`
+	LastStep      int64    `bson:"last_step"`
+	RecoveryCodes []string `bson:"recovery_codes"`
+}
+
+// UserFilter restricts a list of users, empty members match everyone
+type UserFilter struct {
+	Role   string
+	Status string
+}
+
+// UserPageRequest asks for the users following an id, in the order of ids
+type UserPageRequest struct {
+	// After is the id of the user the page starts after, empty for the first page
+	After ID
+	Limit int64
+}
+
+// UserUpdate holds the changes to a user, nil members are left unchanged
+type UserUpdate struct {
+	Name     *string
+	Password *string
+	// Roles replaces the roles, and the legacy admin flag with them
+	Roles  *[]string
+	Status *string
+	TOTP   *TOTPFactor
+}